@@ -0,0 +1,93 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state, such as READY=1, to the systemd service manager on the socket it names in NOTIFY_SOCKET.
+// It does nothing when NOTIFY_SOCKET isn't set, as when the reflector isn't run by systemd with Type=notify.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // in the abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often to tell systemd the reflector is alive: half the WatchdogSec it passes in
+// WATCHDOG_USEC, as sd_watchdog_enabled(3) advises, or 0 if the watchdog isn't enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyReady tells systemd the reflector is listening, and if the watchdog is enabled, sends it WATCHDOG=1 on
+// time until ctx is done. Errors are logged, as the reflector works without systemd knowing.
+func notifyReady(ctx context.Context) {
+	err := sdNotify("READY=1")
+	if err != nil {
+		slog.Warn("error notifying systemd", "err", err)
+		return
+	}
+	interval := sdWatchdogInterval()
+	if interval == 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	slog.Info("pinging the systemd watchdog", "interval", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := sdNotify("WATCHDOG=1")
+				if err != nil {
+					slog.Warn("error pinging the systemd watchdog", "err", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify binds a socket for systemd's notifications in a temporary directory and points NOTIFY_SOCKET at it
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// nextNotification returns the next state sent to conn
+func nextNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifyReadyPingsWatchdogAndStopping(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifyReady(ctx)
+	if state := nextNotification(t, conn); state != "READY=1" {
+		t.Errorf("got %q, want READY=1", state)
+	}
+	if state := nextNotification(t, conn); state != "WATCHDOG=1" {
+		t.Errorf("got %q, want WATCHDOG=1", state)
+	}
+	cancel()
+	err := sdNotify("STOPPING=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		state := nextNotification(t, conn)
+		if state == "STOPPING=1" {
+			break
+		}
+		if state != "WATCHDOG=1" {
+			t.Fatalf("got %q, want STOPPING=1", state)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := sdWatchdogInterval(); interval != 15*time.Second {
+		t.Errorf("interval %v, want half of WATCHDOG_USEC, 15s", interval)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Errorf("interval %v with the watchdog meant for another process, want 0", interval)
+	}
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Errorf("interval %v without the watchdog, want 0", interval)
+	}
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	conn := listenNotify(t)
+	os.Unsetenv("NOTIFY_SOCKET") // restored by the Setenv in listenNotify
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		err := sdNotify(state)
+		if err != nil {
+			t.Errorf("%s without NOTIFY_SOCKET returned %v", state, err)
+		}
+	}
+	err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 256)
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("got %q without NOTIFY_SOCKET, want nothing sent", buf[:n])
+	}
+}
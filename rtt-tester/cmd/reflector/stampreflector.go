@@ -22,140 +22,121 @@ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 SOFTWARE.
 */
 import (
-	"encoding/binary"
+	"context"
 	"flag"
-	"log"
-	"net"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"golang.org/x/net/ipv4"
-	_ "golang.org/x/net/ipv4"
+	"stamp/reflector"
+	"stamp/wire"
 )
 
-type StampReflector struct {
-	conn      *ipv4.PacketConn
-	gotSender bool
-}
-
-func (c *StampReflector) now() time.Time {
-	return time.Now()
-}
-
-/*  7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                        sequence number                        | <- idx = 0
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                           timestamp                           | <- idx = 4
-* |                                                               |
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                      receive  timestamp                       | <- idx = 12
-* |                                                               |
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                     sender sequence number                    | <- idx = 20
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                       sender timestamp                        | <- idx = 24
-* |                                                               |
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                      sender window size                       | <- idx = 32
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                      sender packet size                       | <- idx = 36
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |     TTL       |                (padding zeros)                | <- idx = 40
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
- */
-
-func (c *StampReflector) receiver() {
-	log.Printf("receiving on %+v", c.conn.LocalAddr())
-	packet := make([]byte, 10000)
-	err := c.conn.SetControlMessage(ipv4.FlagTTL, true)
-	if err != nil {
-		log.Printf("error setting control message: %+v", err)
-	}
-	srcMap := make(map[string]uint32)
-	for {
-		ttl := uint8(0)
-		//c.conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-		n, cm, src, err := c.conn.ReadFrom(packet)
-		if err != nil {
-			log.Print(err)
-		} else {
-			if cm != nil {
-				ttl = uint8(cm.TTL)
-			}
-			//log.Print(string(packet[:n]))
-			if !c.gotSender {
-				c.gotSender = true
-				log.Printf("got first packet from %s", src)
-			}
-			count := srcMap[src.String()]
-			srcMap[src.String()] = count + 1
-			if n < 16 {
-				log.Printf("unexpected received packet size %d: expected larger than 16", n)
-				continue
-			}
-			//log.Printf("from %+v, ttl %d, count %d", src, ttl, count)
-			senderSequenceNumber := binary.BigEndian.Uint32(packet[0:])
-			senderTimestamp := binary.BigEndian.Uint64(packet[4:])
-			senderWindowSize := binary.BigEndian.Uint32(packet[12:])
-
-			myTimestamp := uint64(time.Now().UnixNano())
-			//timeDiff := myTimestamp - senderTimestamp
-
-			//log.Printf("their time delta from now is %+v", timeDiff)
-
-			idx := 0
-			binary.BigEndian.PutUint32(packet[idx:], count) // Sequence Number
-			idx += 4
-			binary.BigEndian.PutUint64(packet[idx:], myTimestamp) // Timestamp
-			idx += 8
-			binary.BigEndian.PutUint64(packet[idx:], myTimestamp) // Receive Timestamp
-			idx += 8
-			binary.BigEndian.PutUint32(packet[idx:], senderSequenceNumber)
-			idx += 4
-			binary.BigEndian.PutUint64(packet[idx:], senderTimestamp)
-			idx += 8
-			binary.BigEndian.PutUint32(packet[idx:], senderWindowSize)
-			idx += 4
-			binary.BigEndian.PutUint32(packet[idx:], uint32(n)) // sender packet size
-			idx += 4
-			binary.BigEndian.PutUint32(packet[idx:], 0)
-			packet[idx] = ttl
-			idx += 4
-			_, err = c.conn.WriteTo(packet[:idx], nil, src) // reflector packet is not necessarily the same size as sender packet.
-			if err != nil {
-				log.Print("write error: ", err)
-			} else {
-				//log.Print("wrote ", sent, " bytes")
-			}
-		}
-	}
-}
-
-func newClient(listenAddr string) (StampReflector, error) {
-	uconn, err := net.ListenPacket("udp4", listenAddr)
-	if err != nil {
-		log.Fatal("error in listenpacket:", err)
-	}
-	conn := ipv4.NewPacketConn(uconn)
-	return StampReflector{
-		conn: conn,
-	}, nil
-}
-
 func main() {
-	log.Print(VersionString())
 	fs := flag.NewFlagSet("stampreflector", flag.ExitOnError)
 	defaultListenAddr := "0.0.0.0:9996"
 	e, ok := os.LookupEnv("STAMP_REFLECTOR_ADDR")
 	if ok {
 		defaultListenAddr = e
 	}
-	listenAddrArg := fs.String("l", defaultListenAddr, "listen address:port")
+	defaultLogLevel := "info"
+	e, ok = os.LookupEnv("LOG_LEVEL")
+	if ok {
+		defaultLogLevel = e
+	}
+	defaultSecret := os.Getenv("STAMP_SECRET")
+	defaultTimestampFormat := "unix"
+	e, ok = os.LookupEnv("TIMESTAMP_FORMAT")
+	if ok {
+		defaultTimestampFormat = e
+	}
+	defaultMode := "legacy"
+	e, ok = os.LookupEnv("STAMP_MODE")
+	if ok {
+		defaultMode = e
+	}
+	listenAddrArg := fs.String("l", defaultListenAddr, "listen address:port, or a comma-separated list of them to serve several ports")
+	srcAddrArg := fs.String("src", "", "local IP address to send replies from, default lets the OS choose")
+	groupArg := fs.String("group", "", "IPv4 multicast group to join on each -l port, on -iface if given, to answer senders probing the group, default none")
+	ifaceArg := fs.String("iface", "", "name of the interface to send replies out of e.g. eth1, default lets the OS choose")
+	tcpArg := fs.Bool("tcp", false, "also accept TCP connections on each -l port from senders run with -transport tcp, legacy mode only")
+	payloadCRCArg := fs.Bool("payload-crc", false, "end each reply with the CRC-32 of the packet's payload, for senders run with -verify-payload, legacy mode only")
+	replyPortArg := fs.Int("reply-port", 0, "send each reply to this port of the sender's address instead of the port the packet came from, for a sender run with -recv-port of the same; 0 for the port it came from")
+	rcvbufArg := fs.Int("rcvbuf", 0, "bytes to set the receive buffer (SO_RCVBUF) of each -l socket to, 0 for the OS default; the OS may grant less, which is logged")
+	sndbufArg := fs.Int("sndbuf", 0, "bytes to set the send buffer (SO_SNDBUF) of each -l socket to, 0 for the OS default; the OS may grant less, which is logged")
+	replyTTLArg := fs.Int("reply-ttl", 0, "send each reply with this IP TTL, 1-255, so that legacy mode senders can record the hops the reply took; 0 for the OS default")
+	replySizeArg := fs.Int("reply-size", 0, "pad each reply with zeros to this many bytes, but no longer than the packet it answers, to load the return path as much as the way there; legacy mode only")
+	statusAddrArg := fs.String("status-addr", "", "address:port to serve JSON status on at /status, default none")
+	idleTimeoutArg := fs.Duration("idle-timeout", 5*time.Minute, "forget senders not heard from for this long, 0 to never forget")
+	quietAfterArg := fs.Duration("quiet-after", 0, "log a sender that hasn't sent for this long, once until it sends again, 0 for never")
+	maxSourcesArg := fs.Int("max-sources", 10000, "most senders to remember, forgetting the least recently seen, 0 for no limit")
+	workersArg := fs.Int("workers", 0, "goroutines reflecting the packets of each -l address, 0 for one per CPU")
+	monotonicArg := fs.Bool("monotonic", false, "take receive and transmit timestamps from a monotonic clock anchored to the wall clock at startup, so a wall clock step doesn't skew the turnaround; logs and status stay on the wall clock")
+	dropRateArg := fs.Float64("drop-rate", 0, "fraction of packets, 0-1, to count but not reply to, so senders see loss on the way back; for testing only")
+	seedArg := fs.Int64("seed", 0, "seed for the -drop-rate draws, 0 picks a seed from the clock")
+	delayArg := fs.String("delay", "0", "hold each reply this long before sending it, or a random time in a range such as 5ms-20ms")
+	sendRetriesArg := fs.Int("send-retries", 3, "times to retry a reply the socket has no buffer space for, backing off, before dropping it")
+	secretArg := fs.String("secret", defaultSecret, "shared secret senders must authenticate packets with, default accepts any packet (env: STAMP_SECRET)")
+	modeArg := fs.String("mode", defaultMode, "packet format: legacy, stamp for RFC 8762 senders or twamp-light for RFC 5357 TWAMP-Light senders (env: STAMP_MODE)")
+	timestampFormatArg := fs.String("timestamp-format", defaultTimestampFormat, "legacy mode timestamps: unix nanoseconds or ntp, must match the senders (env: TIMESTAMP_FORMAT)")
+	logLevelArg := fs.String("log-level", defaultLogLevel, "log level: debug, info, warn or error (env: LOG_LEVEL)")
 	_ = fs.Parse(os.Args[1:])
-	client, err := newClient(*listenAddrArg)
+	err := setupLogging(*logLevelArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	slog.Info(VersionString())
+	mode, err := wire.ParseMode(*modeArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	timestampFormat, err := wire.ParseTimestampFormat(*timestampFormatArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	delay, err := reflector.ParseDelay(*delayArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	cfg := reflector.Config{
+		ListenAddr:          *listenAddrArg,
+		SrcAddr:             *srcAddrArg,
+		Interface:           *ifaceArg,
+		Group:               *groupArg,
+		StatusAddr:          *statusAddrArg,
+		IdleTimeout:         *idleTimeoutArg,
+		QuietAfter:          *quietAfterArg,
+		MaxSources:          *maxSourcesArg,
+		SendRetries:         *sendRetriesArg,
+		Workers:             *workersArg,
+		Delay:               delay,
+		Mode:                mode,
+		TimestampFormat:     timestampFormat,
+		TCP:                 *tcpArg,
+		PayloadCRC:          *payloadCRCArg,
+		ReplySize:           *replySizeArg,
+		ReplyPort:           *replyPortArg,
+		ReplyTTL:            *replyTTLArg,
+		SocketBuffers:       wire.Buffers{Recv: *rcvbufArg, Send: *sndbufArg},
+		MonotonicTimestamps: *monotonicArg,
+		DropRate:            *dropRateArg,
+		Seed:                *seedArg,
+	}
+	if *secretArg != "" {
+		cfg.Secret = []byte(*secretArg)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	r, err := reflector.Listen(ctx, cfg)
+	if err != nil {
+		fatalf("could not run reflector: %s", err)
+	}
+	notifyReady(ctx)
+	err = r.Serve(ctx)
+	_ = sdNotify("STOPPING=1")
 	if err != nil {
-		log.Fatal("could not create client: ", err)
+		fatalf("could not run reflector: %s", err)
 	}
-	client.receiver()
 }
@@ -0,0 +1,158 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// fileConfig is the JSON form of the sender's flags, e.g.
+//
+//	{
+//	  "reflector": "10.0.1.1:9996",
+//	  "window_size": "50-100",
+//	  "packet_length": "100-200",
+//	  "duration": 60,
+//	  "interval": "500ms",
+//	  "output": "/tmp/rtt-50-100.db"
+//	}
+//
+// Fields that are left out keep the flag's default.
+type fileConfig struct {
+	ReflectorAddr *string `json:"reflector"`
+	ListenAddr    *string `json:"listen"`
+	WindowSize    *string `json:"window_size"`
+	PacketLength  *string `json:"packet_length"`
+	Duration      *int    `json:"duration"` // seconds, as for -d
+	Count         *int    `json:"count"`
+	Interval      *string `json:"interval"`
+	Schedule      *string `json:"schedule"`
+	PPS           *int    `json:"pps"`
+	Burst         *int    `json:"burst"`
+	BurstGap      *string `json:"burst_gap"`
+	Ramp          *string `json:"ramp"`
+	RampSteps     *int    `json:"steps"`
+	RampShape     *string `json:"ramp_shape"`
+	Fill          *string `json:"fill"`
+	Output        *string `json:"output"`
+	TTL           *int    `json:"ttl"`
+	TTLThreshold  *int    `json:"ttl_threshold"`
+	SrcPorts      *string `json:"src_ports"`
+	Warmup        *string `json:"warmup"`
+	Mode          *string `json:"mode"`
+	Transport     *string `json:"transport"`
+	Timestamps    *string `json:"timestamp_format"`
+	RxTimestamps  *string `json:"timestamp"`
+	MaxPacketLen  *int    `json:"max_packet_length"`
+	DF            *bool   `json:"df"`
+	VerifyPayload *bool   `json:"verify_payload"`
+	SendRetries   *int    `json:"send_retries"`
+}
+
+// applyConfigFile sets the flags in fs from the JSON file at path, skipping any flag that was given explicitly on
+// the command line so that those take precedence over the file.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %w", err)
+	}
+	defer f.Close()
+	var fc fileConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&fc)
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	// -o and -output share a value, so either one being set overrides the file
+	if explicit["output"] {
+		explicit["o"] = true
+	}
+	values := []struct {
+		flag  string
+		value *string
+	}{
+		{"r", fc.ReflectorAddr},
+		{"l", fc.ListenAddr},
+		{"w", fc.WindowSize},
+		{"p", fc.PacketLength},
+		{"d", itoa(fc.Duration)},
+		{"count", itoa(fc.Count)},
+		{"interval", fc.Interval},
+		{"schedule", fc.Schedule},
+		{"pps", itoa(fc.PPS)},
+		{"burst", itoa(fc.Burst)},
+		{"burst-gap", fc.BurstGap},
+		{"ramp", fc.Ramp},
+		{"steps", itoa(fc.RampSteps)},
+		{"ramp-shape", fc.RampShape},
+		{"fill", fc.Fill},
+		{"o", fc.Output},
+		{"ttl", itoa(fc.TTL)},
+		{"ttl-threshold", itoa(fc.TTLThreshold)},
+		{"src-ports", fc.SrcPorts},
+		{"warmup", fc.Warmup},
+		{"mode", fc.Mode},
+		{"transport", fc.Transport},
+		{"timestamp-format", fc.Timestamps},
+		{"timestamp", fc.RxTimestamps},
+		{"max-packet-len", itoa(fc.MaxPacketLen)},
+		{"df", formatBool(fc.DF)},
+		{"verify-payload", formatBool(fc.VerifyPayload)},
+		{"send-retries", itoa(fc.SendRetries)},
+	}
+	for _, v := range values {
+		if v.value == nil || explicit[v.flag] {
+			continue
+		}
+		err = fs.Set(v.flag, *v.value)
+		if err != nil {
+			return fmt.Errorf("error in config file %s: -%s: %w", path, v.flag, err)
+		}
+	}
+	return nil
+}
+
+func formatBool(b *bool) *string {
+	if b == nil {
+		return nil
+	}
+	s := strconv.FormatBool(*b)
+	return &s
+}
+
+func itoa(n *int) *string {
+	if n == nil {
+		return nil
+	}
+	s := strconv.Itoa(*n)
+	return &s
+}
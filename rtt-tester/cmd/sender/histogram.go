@@ -0,0 +1,46 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"stamp/rtt"
+)
+
+// histogramBarWidth is the length of the bar of the fullest bin
+const histogramBarWidth = 50
+
+// printHistogram writes the RTT histogram bins of a run to w, a line each with a bar scaled to the fullest bin
+func printHistogram(w io.Writer, bins []rtt.HistogramBin) {
+	most := 0
+	for _, b := range bins {
+		most = max(most, b.Count)
+	}
+	fmt.Fprintf(w, "%12s   %-12s %8s\n", "rtt from", "to", "packets")
+	for _, b := range bins {
+		bar := strings.Repeat("#", (b.Count*histogramBarWidth+most-1)/most)
+		fmt.Fprintf(w, "%12s - %-12s %8d %s\n", b.Low, b.High, b.Count, bar)
+	}
+}
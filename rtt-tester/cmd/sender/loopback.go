@@ -0,0 +1,65 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"stamp/reflector"
+	"stamp/rtt"
+)
+
+// loopbackAddr is the address the sender and the loopback reflector listen on, each on a port the OS picks
+const loopbackAddr = "127.0.0.1:0"
+
+// startLoopback starts a reflector in this process on loopbackAddr, with cfg's packet format, and points cfg at it,
+// sending from loopbackAddr too. stop closes the reflector's sockets, once the run is over.
+func startLoopback(ctx context.Context, cfg *rtt.Config) (stop func(), err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	r, err := reflector.Listen(ctx, reflector.Config{
+		ListenAddr:      loopbackAddr,
+		Secret:          cfg.Secret,
+		SendRetries:     cfg.SendRetries,
+		Mode:            cfg.Mode,
+		TimestampFormat: cfg.TimestampFormat,
+		TCP:             cfg.Transport == rtt.TransportTCP,
+		ReplyPort:       cfg.RecvPort,
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error starting loopback reflector: %w", err)
+	}
+	cfg.ReflectorAddr = r.Addrs()[0]
+	cfg.ListenAddr = loopbackAddr
+	slog.Info("reflecting in process", "addr", cfg.ReflectorAddr)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.Serve(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"stamp/rtt"
+)
+
+// printPlan writes the windows of a dry run to w, with runs of identical windows on one line, and the totals
+func printPlan(w io.Writer, windows []rtt.PlannedWindow) {
+	fmt.Fprintf(w, "%-12s %8s %8s %8s\n", "start", "windows", "packets", "length")
+	packets, bytes := 0, 0
+	for i := 0; i < len(windows); {
+		first := windows[i]
+		j := i + 1
+		for j < len(windows) && windows[j].Packets == first.Packets && windows[j].PacketLen == first.PacketLen &&
+			windows[j].Warmup == first.Warmup {
+			j++
+		}
+		note := ""
+		if first.Warmup {
+			note = " warmup"
+		}
+		fmt.Fprintf(w, "%-12s %8d %8d %8d%s\n", first.Start, j-i, first.Packets, first.PacketLen, note)
+		for _, win := range windows[i:j] {
+			packets += win.Packets
+			bytes += win.Packets * win.PacketLen
+		}
+		i = j
+	}
+	last := time.Duration(0)
+	if len(windows) > 0 {
+		last = windows[len(windows)-1].Start
+	}
+	fmt.Fprintf(w, "%d windows, %d packets, %d bytes, last window at %s\n", len(windows), packets, bytes, last)
+}
@@ -0,0 +1,70 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"stamp/rtt"
+)
+
+// playout plays out a finished run's results database through jitter buffers of each depth given, and prints how
+// many packets would have been late and how often the picture would have frozen with each
+func playout(args []string) {
+	fs := flag.NewFlagSet("stampsender playout", flag.ExitOnError)
+	defaultDBPath := "/tmp/rtt.db"
+	e, ok := os.LookupEnv("RTT_DB_PATH")
+	if ok {
+		defaultDBPath = e
+	}
+	dbPathArg := fs.String("o", defaultDBPath, "path of the results database to play out (env: RTT_DB_PATH)")
+	depthArg := fs.String("depth", "50ms", "jitter buffer depth, or a comma-separated list of them to compare e.g. 20ms,50ms,100ms")
+	_ = fs.Parse(args)
+	var depths []time.Duration
+	for _, s := range strings.Split(*depthArg, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d < 0 {
+			fatalf("bad jitter buffer depth %q", s)
+		}
+		depths = append(depths, d)
+	}
+	fmt.Fprintf(os.Stdout, "%10s %10s %10s %8s %10s %8s %12s %12s\n", "depth", "packets", "late", "late%", "lost",
+		"freezes", "frozen", "longest")
+	for _, d := range depths {
+		stats, err := rtt.PlayoutOf(*dbPathArg, d)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		printPlayout(os.Stdout, stats)
+	}
+}
+
+// printPlayout writes one line of stats to w
+func printPlayout(w io.Writer, s rtt.PlayoutStats) {
+	fmt.Fprintf(w, "%10s %10d %10d %7.2f%% %10d %8d %12s %12s\n", s.Depth, s.Packets, s.Late, s.LatePercent(), s.Lost,
+		s.Freezes, s.FrozenTime, s.LongestFreeze)
+}
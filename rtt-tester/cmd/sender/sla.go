@@ -0,0 +1,62 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"log/slog"
+	"time"
+
+	"stamp/rtt"
+)
+
+// Exit codes of a run that broke an SLA, ORed together when it broke more than one, or was stopped partway by a
+// fatal error. Other errors exit with 1.
+const (
+	exitLossSLA = 1 << 1
+	exitRTTSLA  = 1 << 2
+	exitFatal   = 1 << 3
+)
+
+// sla is the most loss and latency a run can measure and still pass
+type sla struct {
+	loss   float64       // percentage of the packets sent, negative for no limit
+	rttP95 time.Duration // 95th percentile RTT, 0 for no limit
+}
+
+// check logs each part of s that summary breaks, with what was measured, and returns the exit code for the run: 0
+// if it passed
+func (s sla) check(summary rtt.Summary) int {
+	code := 0
+	if loss := summary.LossPercent(); s.loss >= 0 && loss > s.loss {
+		slog.Error("SLA failed: loss", "measured_percent", loss, "limit_percent", s.loss)
+		code |= exitLossSLA
+	}
+	if s.rttP95 > 0 && (summary.Received == 0 || summary.RTT.P95 > s.rttP95) {
+		slog.Error("SLA failed: 95th percentile RTT", "measured", summary.RTT.P95, "limit", s.rttP95,
+			"received", summary.Received)
+		code |= exitRTTSLA
+	}
+	if code == 0 && (s.loss >= 0 || s.rttP95 > 0) {
+		slog.Info("SLA passed", "loss_percent", summary.LossPercent(), "rtt_p95", summary.RTT.P95)
+	}
+	return code
+}
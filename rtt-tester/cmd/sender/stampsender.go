@@ -21,266 +21,32 @@ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 SOFTWARE.
 */
 import (
-	"database/sql"
-	"encoding/binary"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/net/ipv4"
-	"log"
-	"net"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-)
 
-const (
-	MaxPacketLen = 10000
-	SenderTTL    = 123
+	"stamp/rtt"
+	"stamp/wire"
 )
 
-type VarParam struct {
-	start   int
-	end     int
-	current int
-}
-
-func (vp VarParam) String() string {
-	if vp.end != vp.start {
-		return fmt.Sprintf("%d-%d", vp.start, vp.end)
-	}
-	return fmt.Sprintf("%d", vp.start)
-}
-
-type Report struct {
-	SequenceNumber int
-	Dropped        bool
-	WindowSize     int
-	PacketLength   int
-	MeasuredRTT    int64
-	TTL            int64
-}
-
-type StampClient struct {
-	conn          *ipv4.PacketConn
-	reflectorAddr *net.UDPAddr
-	nextSendSeqNo uint32
-	packet        []byte
-	windowSize    VarParam
-	packetLen     VarParam
-	lastRecvSeqNo uint32
-	dbChan        chan Report
-	duration      int64
-	received      bool
-}
-
-func newClient(listenAddr, reflectorAddrStr string, windowSize, pktLen VarParam, duration int) (StampClient, error) {
-	reflectorAddr, err := net.ResolveUDPAddr("udp4", reflectorAddrStr)
-	if err != nil {
-		log.Fatal("error resolving reflector address: ", err)
-	}
-	uconn, err := net.ListenPacket("udp4", listenAddr)
-	if err != nil {
-		log.Fatal("error in listenpacket:", err)
-	}
-	//defer uconn.Close()
-	conn := ipv4.NewPacketConn(uconn)
-	err = conn.SetTTL(SenderTTL)
-	if err != nil {
-		log.Fatal("error in SetTTL:", err)
-	}
-	return StampClient{
-		conn:          conn,
-		reflectorAddr: reflectorAddr,
-		nextSendSeqNo: uint32(0),
-		dbChan:        make(chan Report, 100),
-		packet:        make([]byte, MaxPacketLen),
-		windowSize:    windowSize,
-		packetLen:     pktLen,
-		duration:      (time.Duration(duration) * time.Second).Nanoseconds(),
-		received:      false,
-	}, nil
-}
-
-/*  7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                        sequence number                        | <- idx = 0
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                           timestamp                           | <- idx = 4
-* |                                                               |
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-* |                          window size                          | <- idx = 12
-* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
- */
-
-// send runs a loop that sends current window size of packets and then sleeps for 1 second before sending again
-func (c *StampClient) send(durationElapsed chan bool) {
-	start := time.Now().UnixNano()
-	for {
-		now := time.Now().UnixNano()
-		if c.duration != 0 {
-			percent := float64(now-start) / float64(c.duration)
-			if percent >= 1 {
-				// finish when the duration has elapsed
-				if c.windowSize.current == c.windowSize.end && c.packetLen.current == c.packetLen.end {
-					durationElapsed <- true
-					return
-				} else {
-					c.windowSize.current = c.windowSize.end
-					c.packetLen.current = c.packetLen.end
-				}
-			} else {
-				if c.windowSize.current != c.windowSize.end {
-					c.windowSize.current = c.windowSize.start + int(float64(c.windowSize.end-c.windowSize.start)*percent)
-				}
-				if c.packetLen.current != c.packetLen.end {
-					c.packetLen.current = c.packetLen.start + int(float64(c.packetLen.end-c.packetLen.start)*percent)
-				}
-			}
-		}
-		c.sendPacketWindow(c.windowSize.current, c.packetLen.current)
-		time.Sleep(1 * time.Second)
-	}
-}
-
-// sendPacketWindow sends n packets of size m (n = numPackets, m = packetLen) to the reflector.
-// Each packet has the current time as the timestamp
-// and an incremented sequence number from the previous packet sequence number.
-func (c *StampClient) sendPacketWindow(numPackets int, packetLen int) {
-	for i := 0; i < numPackets; i++ {
-		// timestamp
-		timestamp := time.Now().UnixNano()
-		// send packet
-		idx := 0
-		binary.BigEndian.PutUint32(c.packet[idx:], c.nextSendSeqNo)
-		c.nextSendSeqNo += 1
-		idx += 4
-		binary.BigEndian.PutUint64(c.packet[idx:], uint64(timestamp))
-		idx += 8
-		binary.BigEndian.PutUint32(c.packet[idx:], uint32(c.windowSize.current))
-
-		_, err := c.conn.WriteTo(c.packet[:packetLen], nil, c.reflectorAddr)
-		if err != nil {
-			log.Print("write error: ", err)
-		} else {
-			//log.Print("wrote ", len, " bytes")
-		}
-	}
-}
-
-func (c *StampClient) reporter(dbPath string, done chan bool) {
-	os.Remove(dbPath)
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
-	sqlStmt := `
-	create table rtt (id integer primary key asc, sequence_number integer not null, window_size integer, packet_length integer, rtt numeric, delta_ttl numeric);
-	delete from rtt;
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		tail(os.Args[2:])
 		return
 	}
-	stmt, err := db.Prepare("insert into rtt(sequence_number, window_size, packet_length, rtt, delta_ttl) values(?, ?, ?, ?, ?)")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer stmt.Close()
-	for {
-		select {
-		case <-done:
-			log.Printf("reporter received done signal\n")
-			return
-		case r := <-c.dbChan:
-			if r.Dropped {
-				log.Printf("seq %d was dropped", r.SequenceNumber)
-				_, err = stmt.Exec(r.SequenceNumber, sql.NullInt32{}, sql.NullInt32{}, sql.NullInt64{}, sql.NullInt64{})
-				if err != nil {
-					log.Fatal(err)
-				}
-			} else {
-				_, err = stmt.Exec(r.SequenceNumber, r.WindowSize, r.PacketLength, r.MeasuredRTT, r.TTL)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-		}
-	}
-
-}
-
-func (c *StampClient) receiver() {
-	//log.Printf("receiving on %+v", c.conn.LocalAddr())
-	packet := make([]byte, 10000)
-	err := c.conn.SetControlMessage(ipv4.FlagTTL, true)
-	if err != nil {
-		log.Printf("error setting control message: %+v", err)
-	}
-	c.sendPacketWindow(c.windowSize.current, c.packetLen.current)
-	for {
-		//ttl := uint8(0)
-		//c.conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-		n, _, src, err := c.conn.ReadFrom(packet)
-		if err != nil {
-			log.Print("read error: ", err)
-		} else {
-			receiveTime := time.Now().UnixNano()
-			if n != 44 { // reflector packet size = 44
-				log.Printf("bad packet length %d: expected 44 bytes", n)
-			}
-			if !c.received {
-				c.received = true
-				log.Printf("received first packet from %s", src)
-			}
-			//if cm != nil {
-			//	ttl = uint8(cm.TTL)
-			//}
-			idx := 0
-			//reflectorSequenceNumber := binary.BigEndian.Uint32(packet[idx:])
-			idx += 4
-			idx += 8 // skip timestamp
-			//reflectorTimestamp := binary.BigEndian.Uint64(packet[idx:])
-			idx += 8
-			myPacketSequenceNumber := binary.BigEndian.Uint32(packet[idx:])
-			idx += 4
-			myPacketTimestamp := binary.BigEndian.Uint64(packet[idx:])
-			idx += 8
-			myWindowSize := binary.BigEndian.Uint32(packet[idx:])
-			idx += 4
-			myPacketLen := binary.BigEndian.Uint32(packet[idx:])
-			idx += 4
-			myPacketTTL := packet[idx]
-			rtt := uint64(receiveTime) - myPacketTimestamp
-
-			for i := 0; i < int(myPacketSequenceNumber-c.lastRecvSeqNo)-1; i++ {
-				report := Report{
-					SequenceNumber: int(c.lastRecvSeqNo + 1),
-					Dropped:        true,
-				}
-				c.dbChan <- report
-			}
-			// received packet
-			report := Report{
-				SequenceNumber: int(myPacketSequenceNumber),
-				Dropped:        false,
-				WindowSize:     int(myWindowSize),
-				PacketLength:   int(myPacketLen),
-				MeasuredRTT:    int64(rtt),
-				TTL:            int64(myPacketTTL - SenderTTL),
-			}
-			c.dbChan <- report
-			c.lastRecvSeqNo = myPacketSequenceNumber
-		}
+	if len(os.Args) > 1 && os.Args[1] == "playout" {
+		playout(os.Args[2:])
+		return
 	}
-}
-
-func main() {
-	log.Print(VersionString())
 	fs := flag.NewFlagSet("stampsender", flag.ExitOnError)
 	defaultReflectorAddr := "127.0.0.1:9996"
 	e, ok := os.LookupEnv("STAMP_REFLECTOR_ADDR")
@@ -307,82 +73,479 @@ func main() {
 	if ok {
 		defaultDuration = e
 	}
+	defaultCount := 0
+	e, ok = os.LookupEnv("PACKET_COUNT")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing PACKET_COUNT: %s", e)
+		}
+		defaultCount = n
+	}
+	defaultLogLevel := "info"
+	e, ok = os.LookupEnv("LOG_LEVEL")
+	if ok {
+		defaultLogLevel = e
+	}
+	defaultPPS := 0
+	e, ok = os.LookupEnv("PACKETS_PER_SECOND")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing PACKETS_PER_SECOND: %s", e)
+		}
+		defaultPPS = n
+	}
+	defaultBurst := 0
+	e, ok = os.LookupEnv("BURST_SIZE")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing BURST_SIZE: %s", e)
+		}
+		defaultBurst = n
+	}
+	defaultBurstGap := time.Duration(0)
+	e, ok = os.LookupEnv("BURST_GAP")
+	if ok {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			fatalf("error parsing BURST_GAP: %s", e)
+		}
+		defaultBurstGap = d
+	}
+	defaultRamp := "linear"
+	e, ok = os.LookupEnv("RAMP")
+	if ok {
+		defaultRamp = e
+	}
+	defaultRampShape := "up"
+	e, ok = os.LookupEnv("RAMP_SHAPE")
+	if ok {
+		defaultRampShape = e
+	}
+	defaultRampSteps := 10
+	e, ok = os.LookupEnv("RAMP_STEPS")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing RAMP_STEPS: %s", e)
+		}
+		defaultRampSteps = n
+	}
+	defaultFill := "zero"
+	e, ok = os.LookupEnv("FILL_PATTERN")
+	if ok {
+		defaultFill = e
+	}
+	defaultDBPath := "/tmp/rtt.db"
+	e, ok = os.LookupEnv("RTT_DB_PATH")
+	if ok {
+		defaultDBPath = e
+	}
+	defaultInterval := 1 * time.Second
+	e, ok = os.LookupEnv("WINDOW_INTERVAL")
+	if ok {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			fatalf("error parsing WINDOW_INTERVAL: %s", e)
+		}
+		defaultInterval = d
+	}
+	defaultSchedule := "periodic"
+	e, ok = os.LookupEnv("SCHEDULE")
+	if ok {
+		defaultSchedule = e
+	}
+	defaultTransport := "udp"
+	e, ok = os.LookupEnv("TRANSPORT")
+	if ok {
+		defaultTransport = e
+	}
+	defaultSecret := os.Getenv("STAMP_SECRET")
+	defaultInfluxToken := os.Getenv("INFLUX_TOKEN")
+	defaultWarmup := time.Duration(0)
+	e, ok = os.LookupEnv("WARMUP")
+	if ok {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			fatalf("error parsing WARMUP: %s", e)
+		}
+		defaultWarmup = d
+	}
+	defaultMode := "legacy"
+	e, ok = os.LookupEnv("STAMP_MODE")
+	if ok {
+		defaultMode = e
+	}
+	defaultTimestampFormat := "unix"
+	e, ok = os.LookupEnv("TIMESTAMP_FORMAT")
+	if ok {
+		defaultTimestampFormat = e
+	}
+	defaultRxTimestamps := "software"
+	e, ok = os.LookupEnv("TIMESTAMP_SOURCE")
+	if ok {
+		defaultRxTimestamps = e
+	}
+	defaultMaxPktLen := rtt.MaxPacketLen
+	e, ok = os.LookupEnv("MAX_PACKET_LENGTH")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing MAX_PACKET_LENGTH: %s", e)
+		}
+		defaultMaxPktLen = n
+	}
+	defaultDF := false
+	e, ok = os.LookupEnv("DONT_FRAGMENT")
+	if ok {
+		b, err := strconv.ParseBool(e)
+		if err != nil {
+			fatalf("error parsing DONT_FRAGMENT: %s", e)
+		}
+		defaultDF = b
+	}
+	defaultVerifyPayload := false
+	e, ok = os.LookupEnv("VERIFY_PAYLOAD")
+	if ok {
+		b, err := strconv.ParseBool(e)
+		if err != nil {
+			fatalf("error parsing VERIFY_PAYLOAD: %s", e)
+		}
+		defaultVerifyPayload = b
+	}
+	defaultSendRetries := 3
+	e, ok = os.LookupEnv("SEND_RETRIES")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing SEND_RETRIES: %s", e)
+		}
+		defaultSendRetries = n
+	}
+	defaultMaxWriteErrors := 0
+	e, ok = os.LookupEnv("MAX_WRITE_ERRORS")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing MAX_WRITE_ERRORS: %s", e)
+		}
+		defaultMaxWriteErrors = n
+	}
+	defaultSrcPorts := ""
+	e, ok = os.LookupEnv("SRC_PORTS")
+	if ok {
+		defaultSrcPorts = e
+	}
+	defaultTTL := rtt.SenderTTL
+	e, ok = os.LookupEnv("TTL")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing TTL: %s", e)
+		}
+		defaultTTL = n
+	}
+	defaultTTLThreshold := 0
+	e, ok = os.LookupEnv("TTL_THRESHOLD")
+	if ok {
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			fatalf("error parsing TTL_THRESHOLD: %s", e)
+		}
+		defaultTTLThreshold = n
+	}
 
-	reflectorAddrArg := fs.String("r", defaultReflectorAddr, "address:port of reflector (env: STAMP_REFLECTOR_ADDR)")
+	reflectorAddrArg := fs.String("r", defaultReflectorAddr, "address:port of reflector, or an SRV record name such as _stamp._udp.example.com (env: STAMP_REFLECTOR_ADDR)")
 	listenAddrArg := fs.String("l", defaultListenAddr, "listen address:port (env: STAMP_CLIENT_ADDR)")
-	windowSizeArg := fs.String("w", defaultWindowSize, "window size (can be a range) e.g. 100, 100-200 (env: WINDOW_SIZE)")
-	pktLenArg := fs.String("p", defaultPktLen, "packet length (can be a range) e.g. 100, 100-200 (env: PACKET_LENGTH)")
+	ifaceArg := fs.String("iface", "", "name of the interface to send out of e.g. eth1, default lets the OS choose")
+	windowSizeArg := fs.String("w", defaultWindowSize, "window size (can be a range, ramping over part of the run) e.g. 100, 100-200, 100-200@0-50% (env: WINDOW_SIZE)")
+	pktLenArg := fs.String("p", defaultPktLen, "packet length (can be a range, ramping over part of the run) e.g. 100, 100-200, 100-200@50-100% (env: PACKET_LENGTH)")
+	labelArg := fs.String("label", "", "key=value tags for the run e.g. site=nyc,isp=comcast, recorded in run_meta and on every report sent to a socket or InfluxDB")
+	sizeDistArg := fs.String("size-dist", "", "draw each packet's length from a weighted distribution instead of -p, given as length:weight pairs e.g. 1200:30,200:70 or a file of a length and weight per line")
 	durationArg := fs.String("d", defaultDuration, "time duration in seconds (env: DURATION_IN_SECONDS)")
+	countArg := fs.Int("count", defaultCount, "number of packets to send instead of a duration, 0 for no limit (env: PACKET_COUNT)")
+	ppsArg := fs.Int("pps", defaultPPS, "packets per second within a window, 0 sends each window as a burst (env: PACKETS_PER_SECOND)")
+	burstArg := fs.Int("burst", defaultBurst, "send each window in bursts of this many packets back-to-back, 0 sends it as one burst (env: BURST_SIZE)")
+	burstGapArg := fs.Duration("burst-gap", defaultBurstGap, "idle time between the bursts of a window e.g. 1ms (env: BURST_GAP)")
+	rampArg := fs.String("ramp", defaultRamp, "ramp mode for window size and packet length: linear, exponential or step (env: RAMP)")
+	rampShapeArg := fs.String("ramp-shape", defaultRampShape, "course of the ramp: up, or triangle to ramp up over the first half of the run and back down over the second (env: RAMP_SHAPE)")
+	rampStepsArg := fs.Int("steps", defaultRampSteps, "number of increments when -ramp is step (env: RAMP_STEPS)")
+	var dbPath string
+	fs.StringVar(&dbPath, "o", defaultDBPath, "path of the results database, or unix:///path/to.sock, influx:///path/to/file or an InfluxDB http:// write URL to send them to (env: RTT_DB_PATH)")
+	fs.StringVar(&dbPath, "output", defaultDBPath, "same as -o")
+	fillArg := fs.String("fill", defaultFill, "payload fill pattern: zero, random or incrementing (env: FILL_PATTERN)")
+	seedArg := fs.Int64("seed", 0, "seed for the random fill pattern, poisson schedule and -size-dist draws, 0 picks a seed from the clock")
+	intervalArg := fs.Duration("interval", defaultInterval, "sleep between windows e.g. 1s, 100ms, 0 for back-to-back (env: WINDOW_INTERVAL)")
+	scheduleArg := fs.String("schedule", defaultSchedule, "periodic sends every -interval, poisson waits a random time with a mean of -interval (env: SCHEDULE)")
+	influxTokenArg := fs.String("influx-token", defaultInfluxToken, "API token for an InfluxDB -o, default none (env: INFLUX_TOKEN)")
+	secretArg := fs.String("secret", defaultSecret, "shared secret to authenticate packets to the reflector with, default none (env: STAMP_SECRET)")
+	sendRetriesArg := fs.Int("send-retries", defaultSendRetries, "times to retry a packet the socket has no buffer space for, backing off, before counting a send error (env: SEND_RETRIES)")
+	estimateOffsetArg := fs.Bool("estimate-offset", false, "estimate the reflector's clock offset from the lowest-RTT reflection, assuming it took as long each way, and record the one-way delays corrected by it")
+	verifyPayloadArg := fs.Bool("verify-payload", defaultVerifyPayload, "flag packets whose payload was changed on the way to the reflector, against a reflector run with -payload-crc, legacy mode only (env: VERIFY_PAYLOAD)")
+	dfArg := fs.Bool("df", defaultDF, "set the don't-fragment bit so that packets too long for the path are dropped, Linux only (env: DONT_FRAGMENT)")
+	maxPktLenArg := fs.Int("max-packet-len", defaultMaxPktLen, "largest packet length allowed, up to 65507 for jumbo frames (env: MAX_PACKET_LENGTH)")
+	reportQueueArg := fs.Int("report-queue", rtt.DefaultReportQueueLen, "results that can wait to be written to -o, beyond which they are dropped and counted in reports_dropped")
+	maxWriteErrorsArg := fs.Int("max-write-errors", defaultMaxWriteErrors, "stop the run after this many results in a row fail to be written to -o, 0 to carry on regardless (env: MAX_WRITE_ERRORS)")
+	modeArg := fs.String("mode", defaultMode, "packet format: legacy, or stamp for RFC 8762 reflectors (env: STAMP_MODE)")
+	transportArg := fs.String("transport", defaultTransport, "udp, or tcp to probe over one TCP connection where UDP is blocked, against a reflector run with -tcp (env: TRANSPORT)")
+	timestampFormatArg := fs.String("timestamp-format", defaultTimestampFormat, "legacy mode timestamps: unix nanoseconds or ntp, must match the reflector (env: TIMESTAMP_FORMAT)")
+	rxTimestampsArg := fs.String("timestamp", defaultRxTimestamps, "where receive times come from: software (the kernel's, where it gives them), hardware (the NIC's, on Linux, needs -iface) or userspace (env: TIMESTAMP_SOURCE)")
+	warmupArg := fs.Duration("warmup", defaultWarmup, "time to send at the start values before the ramp, recorded but left out of the summary (env: WARMUP)")
+	srcPortsArg := fs.String("src-ports", defaultSrcPorts, "range of source ports to rotate through per packet on the -l address e.g. 40000-40015, default sends from -l (env: SRC_PORTS)")
+	ttlArg := fs.Int("ttl", defaultTTL, "TTL of the packets sent, 1-255, low to make them expire at that hop; delta TTL is measured from it (env: TTL)")
+	dscpArg := fs.Int("dscp", 0, "DSCP to mark the packets sent with, 0-63 e.g. 46 for EF, 0 leaves them unmarked; with -trace, shows the hop it was changed before")
+	ttlThresholdArg := fs.Int("ttl-threshold", defaultTTLThreshold, "warn of a route change when delta TTL moves more than this from the first packet's (env: TTL_THRESHOLD)")
+
+	logLevelArg := fs.String("log-level", defaultLogLevel, "log level: debug, info, warn or error (env: LOG_LEVEL)")
+	quietArg := fs.Bool("quiet", false, "don't log single packets, such as each one dropped, even at -log-level debug")
+	pmtuArg := fs.Bool("pmtu", false, "find the path MTU with don't-fragment probes between the -p lengths, or from -p up to -max-packet-len, and exit")
+	traceArg := fs.Bool("trace", false, "map the path to the reflector by sending probes with the TTL rising from 1 and listening for the routers' ICMP time exceeded errors, and exit; needs root or CAP_NET_RAW")
+	conformanceArg := fs.Bool("conformance", false, "send a fixed sequence of probes, check the reflections field by field against what this sender expects, print a JSON report of each check, and exit, with 1 if any failed")
+	encodingArg := fs.String("encoding", "json", "encoding of the results streamed to a unix:// -o: json lines or cbor")
+	loopbackArg := fs.Bool("loopback", false, "start a reflector in this process on a loopback port and send to it instead of -r, from a loopback port instead of -l")
+	failoverArg := fs.Duration("failover", 0, "when -r resolves to several addresses, probe one at a time and move on to the next when it has reflected nothing for this long, 0 to probe the first only")
+	resolveArg := fs.Duration("resolve", 0, "resolve -r again this often to pick up DNS changes, 0 to resolve it once")
+	rcvbufArg := fs.Int("rcvbuf", 0, "bytes to set the receive buffer (SO_RCVBUF) of each socket to, 0 for the OS default; the OS may grant less, which is logged")
+	sndbufArg := fs.Int("sndbuf", 0, "bytes to set the send buffer (SO_SNDBUF) of each socket to, 0 for the OS default; the OS may grant less, which is logged")
+	recvPortArg := fs.Int("recv-port", 0, "port on the -l host to receive the reflections on, for a reflector run with -reply-port of the same; 0 for the port each packet was sent from")
+	proxyArg := fs.String("proxy", "", "host:port of a SOCKS5 proxy to send the probes through with UDP ASSOCIATE, for a host with no other way out; the RTT includes the proxy's")
+	anySourceArg := fs.Bool("any-source", false, "accept reflections from any address, not just -r, for a reflector behind NAT")
+	summarizeDropsArg := fs.Bool("summarize-drops", false, "record each run of dropped packets as one row of a drops table, first and last sequence number and count, instead of a row each, to keep the database small through heavy loss")
+	noDBArg := fs.Bool("no-db", false, "don't write the results anywhere, only the summary, for a quick check; -o is ignored")
+	walArg := fs.Bool("wal", false, "write the results database in WAL mode, so it can be queried during the run, at the risk of the last results if the host loses power")
+	rotateArg := fs.Duration("rotate", 0, "start a new results database this often e.g. 1h, renaming the last with the time it was started, 0 for one database")
+	jitterBufferArg := fs.Duration("jitter-buffer", 0, "play the run out through a video jitter buffer this deep e.g. 50ms, adding the late packets and freezes to the summary, 0 for none")
+	histBinArg := fs.Duration("hist-bin", 0, "width of the linear bins of the RTT histogram e.g. 500us, 0 for logarithmic bins")
+	summaryArg := fs.String("summary", "", "path to write a JSON summary of the run to, default the -o path with .summary.json added")
+	replayArg := fs.String("replay", "", "results database of an earlier run to send the same windows as, instead of the ramp")
+	replayPcapArg := fs.String("replay-pcap", "", "pcap capture whose UDP packets to send again instead of the ramp, with the same lengths and timing, up to -d if it is given")
+	tuiArg := fs.Bool("tui", false, "show the window size, packets sent and received, and the loss and RTT percentiles of the last 1000 packets on stdout as the run goes, redrawn in place on a terminal and a line a second otherwise")
+	dryRunArg := fs.Bool("dry-run", false, "print the windows that would be sent and exit, without sending or writing the database")
+	abortLossArg := fs.Float64("abort-on-loss", 0, "stop the run with an error if more than this percentage of the packets sent over the last -abort-window are lost, after any warmup, so a dead reflector is found in seconds; 0 to never stop")
+	drainArg := fs.Duration("drain", rtt.DefaultDrain, "longest to wait after the last window for the reflections still in flight, ending as soon as they are all in")
+	dropRateArg := fs.Float64("drop-rate", 0, "fraction of packets, 0-1, not to send at all though they are counted as sent, to check that the loss is detected; for testing only")
+	abortWindowArg := fs.Duration("abort-window", rtt.DefaultAbortWindow, "how long the loss must stay over -abort-on-loss before the run is stopped")
+	slaLossArg := fs.Float64("sla-loss", -1, "exit with code 2 if more than this percentage of the packets sent are lost, negative for no limit")
+	slaRTTP95Arg := fs.Duration("sla-rtt-p95", 0, "exit with code 4 if the 95th percentile RTT is over this e.g. 50ms, 0 for no limit")
+	configArg := fs.String("config", "", "JSON file of settings, flags given on the command line override it")
 
 	_ = fs.Parse(os.Args[1:])
+	err := setupLogging(*logLevelArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	slog.Info(VersionString())
+	if *configArg != "" {
+		err := applyConfigFile(fs, *configArg)
+		if err != nil {
+			fatalf("%s", err)
+		}
+	}
 	duration, err := strconv.Atoi(*durationArg)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("error parsing packet length: %s\n", *pktLenArg))
-	}
-	// window size
-	windowSize := VarParam{}
-	if strings.Contains(*windowSizeArg, "-") == true {
-		sizes := strings.Split(*windowSizeArg, "-")
-		if len(sizes) > 2 {
-			log.Fatal("error parsing window size")
+		fatalf("error parsing duration: %s", *durationArg)
+	}
+	windowSize, err := rtt.ParseVarParam(*windowSizeArg)
+	if err != nil {
+		fatalf("error parsing window size: %s", err)
+	}
+	pktLen, err := rtt.ParseVarParam(*pktLenArg)
+	if err != nil {
+		fatalf("error parsing packet length: %s", err)
+	}
+	ramp, err := rtt.ParseRampMode(*rampArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	rampShape, err := rtt.ParseRampShape(*rampShapeArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	fill, err := rtt.ParseFillPattern(*fillArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	schedule, err := rtt.ParseSchedule(*scheduleArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	encoding, err := rtt.ParseEncoding(*encodingArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	mode, err := wire.ParseMode(*modeArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	timestampFormat, err := wire.ParseTimestampFormat(*timestampFormatArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	transport, err := rtt.ParseTransport(*transportArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	rxTimestamps, err := rtt.ParseTimestampSource(*rxTimestampsArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	var srcPorts rtt.PortRange
+	if *srcPortsArg != "" {
+		srcPorts, err = rtt.ParsePortRange(*srcPortsArg)
+		if err != nil {
+			fatalf("error parsing source ports: %s", err)
 		}
-		windowSize.start, err = strconv.Atoi(sizes[0])
+	}
+	var sizeDist rtt.SizeDist
+	if *sizeDistArg != "" {
+		sizeDist, err = rtt.ParseSizeDist(*sizeDistArg)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("error parsing window size: %s\n", *windowSizeArg))
+			fatalf("%s", err)
 		}
-		windowSize.end, err = strconv.Atoi(sizes[1])
+	}
+	var labels rtt.Labels
+	if *labelArg != "" {
+		labels, err = rtt.ParseLabels(*labelArg)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("error parsing window size: %s\n", *windowSizeArg))
+			fatalf("%s", err)
 		}
-	} else {
-		windowSize.start, err = strconv.Atoi(*windowSizeArg)
+	}
+	cfg := rtt.Config{
+		ReflectorAddr:   *reflectorAddrArg,
+		ListenAddr:      *listenAddrArg,
+		Interface:       *ifaceArg,
+		WindowSize:      windowSize,
+		PacketLen:       pktLen,
+		SizeDist:        sizeDist,
+		Duration:        time.Duration(duration) * time.Second,
+		Count:           *countArg,
+		Interval:        *intervalArg,
+		Schedule:        schedule,
+		PPS:             *ppsArg,
+		Burst:           *burstArg,
+		BurstGap:        *burstGapArg,
+		Ramp:            ramp,
+		RampSteps:       *rampStepsArg,
+		RampShape:       rampShape,
+		Fill:            fill,
+		Seed:            *seedArg,
+		DBPath:          dbPath,
+		TTL:             *ttlArg,
+		TTLThreshold:    *ttlThresholdArg,
+		DSCP:            *dscpArg,
+		SrcPorts:        srcPorts,
+		Warmup:          *warmupArg,
+		Mode:            mode,
+		Transport:       transport,
+		TimestampFormat: timestampFormat,
+		MaxPacketLen:    *maxPktLenArg,
+		DF:              *dfArg,
+		VerifyPayload:   *verifyPayloadArg,
+		EstimateOffset:  *estimateOffsetArg,
+		RxTimestamps:    rxTimestamps,
+		Replay:          *replayArg,
+		ReplayPcap:      *replayPcapArg,
+		SendRetries:     *sendRetriesArg,
+		SummaryPath:     *summaryArg,
+		InfluxToken:     *influxTokenArg,
+		Labels:          labels,
+		HistogramBin:    *histBinArg,
+		JitterBuffer:    *jitterBufferArg,
+		Rotate:          *rotateArg,
+		Quiet:           *quietArg,
+		WAL:             *walArg,
+		NoDB:            *noDBArg,
+		SummarizeDrops:  *summarizeDropsArg,
+		AnySource:       *anySourceArg,
+		Proxy:           *proxyArg,
+		RecvPort:        *recvPortArg,
+		SocketBuffers:   wire.Buffers{Recv: *rcvbufArg, Send: *sndbufArg},
+		Failover:        *failoverArg,
+		AbortLoss:       *abortLossArg,
+		AbortWindow:     *abortWindowArg,
+		Resolve:         *resolveArg,
+		Encoding:        encoding,
+		MaxWriteErrors:  *maxWriteErrorsArg,
+		ReportQueueLen:  *reportQueueArg,
+		Drain:           *drainArg,
+		DropRate:        *dropRateArg,
+		Version:         VersionString(),
+		GitRev:          GitRev,
+	}
+	if *secretArg != "" {
+		cfg.Secret = []byte(*secretArg)
+	}
+	if cfg.SummaryPath == "" && !strings.Contains(dbPath, "://") && !cfg.NoDB {
+		cfg.SummaryPath = dbPath + ".summary.json"
+	}
+
+	if *dryRunArg {
+		windows, err := rtt.Plan(cfg)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("error parsing window size: %s\n", *windowSizeArg))
+			fatalf("%s", err)
 		}
-		windowSize.end = windowSize.start
-	}
-	windowSize.current = windowSize.start
-	// packet length
-	pktLen := VarParam{}
-	if strings.Contains(*pktLenArg, "-") == true {
-		sizes := strings.Split(*pktLenArg, "-")
-		if len(sizes) > 2 {
-			log.Fatal("error parsing packet length")
+		printPlan(os.Stdout, windows)
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *pmtuArg {
+		pktLen, err := rtt.DiscoverPMTU(ctx, cfg)
+		if err != nil {
+			fatalf("%s", err)
 		}
-		pktLen.start, err = strconv.Atoi(sizes[0])
+		fmt.Printf("largest reflected packet length: %d bytes, path MTU: %d bytes\n", pktLen, pktLen+rtt.IPUDPHeaderLen)
+		return
+	}
+	if *traceArg {
+		hops, err := rtt.Trace(ctx, cfg)
+		printTrace(os.Stdout, hops, cfg.DSCP)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("error parsing packet length: %s\n", *pktLenArg))
+			fatalf("%s", err)
 		}
-		pktLen.end, err = strconv.Atoi(sizes[1])
+		return
+	}
+	stop := func() {}
+	if *loopbackArg {
+		stop, err = startLoopback(ctx, &cfg)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("error parsing packet length: %s\n", *pktLenArg))
+			fatalf("%s", err)
 		}
-	} else {
-		pktLen.start, err = strconv.Atoi(*pktLenArg)
+	}
+	if *conformanceArg {
+		report, err := rtt.Conformance(ctx, cfg)
+		stop()
 		if err != nil {
-			log.Fatal(fmt.Sprintf("error parsing packet length: %s\n", *pktLenArg))
+			fatalf("%s", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+		if !report.Pass {
+			fatalf("the reflector failed conformance")
 		}
-		pktLen.end = pktLen.start
+		return
+	}
+	if *tuiArg {
+		cfg.Progress = newTUI(os.Stdout, cfg.ReflectorAddr).update
 	}
-	pktLen.current = pktLen.start
-	if (pktLen.start > MaxPacketLen) || (pktLen.end > MaxPacketLen) {
-		log.Fatalf("requested packet length is larger than the maximum permitted size of %d", MaxPacketLen)
+	summary, err := rtt.Run(ctx, cfg)
+	stop()
+	if errors.Is(err, rtt.ErrFatal) {
+		slog.Error(err.Error())
+		os.Exit(exitFatal)
 	}
-	client, err := newClient(*listenAddrArg, *reflectorAddrArg, windowSize, pktLen, duration)
 	if err != nil {
-		log.Fatal("could not create client: ", err)
+		fatalf("%s", err)
+	}
+	if len(summary.RTTHistogram) > 0 {
+		printHistogram(os.Stderr, summary.RTTHistogram)
+	}
+	code := sla{loss: *slaLossArg, rttP95: *slaRTTP95Arg}.check(summary)
+	if code != 0 {
+		os.Exit(code)
 	}
-
-	done := make(chan bool)
-	durationElapsed := make(chan bool)
-	const dbPath = "/tmp/rtt.db"
-	log.Printf("sending to %s, window %s packets, packet size %s bytes, duration %d sec, results to %s",
-		*reflectorAddrArg, windowSize, pktLen, duration, dbPath)
-	go client.reporter(dbPath, done)
-	go client.receiver()
-	go client.send(durationElapsed)
-	<-durationElapsed
-	// keep receiving the final window, then exit / timeout a second after duration elapses
-	time.Sleep(1 * time.Second)
-	done <- true // terminate reporter goroutine
 }
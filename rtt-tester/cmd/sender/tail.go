@@ -0,0 +1,90 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"stamp/rtt"
+)
+
+// tail follows a results database as the sender writes it, printing each packet with the loss and mean RTT of the
+// last ones, until interrupted
+func tail(args []string) {
+	fs := flag.NewFlagSet("stampsender tail", flag.ExitOnError)
+	defaultDBPath := "/tmp/rtt.db"
+	e, ok := os.LookupEnv("RTT_DB_PATH")
+	if ok {
+		defaultDBPath = e
+	}
+	dbPathArg := fs.String("o", defaultDBPath, "path of the results database to follow (env: RTT_DB_PATH)")
+	lastArg := fs.Int("last", 100, "number of packets the loss and mean RTT are of")
+	pollArg := fs.Duration("poll", 250*time.Millisecond, "how often to check for new results")
+	logLevelArg := fs.String("log-level", "info", "log level: debug, info, warn or error")
+	_ = fs.Parse(args)
+	err := setupLogging(*logLevelArg)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if *lastArg < 1 || *pollArg <= 0 {
+		fatalf("-last and -poll must be positive")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	stats := rtt.NewRollingStats(*lastArg)
+	fmt.Fprintf(os.Stdout, "%10s %12s %10s %8s %12s\n", "seq", "rtt", "delta_ttl", "loss", "mean_rtt")
+	err = rtt.Tail(ctx, *dbPathArg, *pollArg, func(r rtt.Report) {
+		stats.Add(r)
+		printTailLine(os.Stdout, r, stats)
+	})
+	if err != nil {
+		fatalf("%s", err)
+	}
+}
+
+// printTailLine writes r to w, with the loss and mean RTT of the last packets in stats
+func printTailLine(w io.Writer, r rtt.Report, stats *rtt.RollingStats) {
+	note := ""
+	switch {
+	case r.Duplicate:
+		note = " duplicate"
+	case r.Warmup:
+		note = " warmup"
+	case r.RouteChanged:
+		note = " route changed"
+	}
+	if r.Dropped {
+		fmt.Fprintf(w, "%10d %12s %10s %7.2f%% %12s%s\n", r.SequenceNumber, "dropped", r.Direction,
+			stats.LossPercent(), stats.MeanRTT(), note)
+		return
+	}
+	fmt.Fprintf(w, "%10d %12s %10d %7.2f%% %12s%s\n", r.SequenceNumber, time.Duration(r.MeasuredRTT), r.TTL,
+		stats.LossPercent(), stats.MeanRTT(), note)
+}
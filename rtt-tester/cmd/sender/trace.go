@@ -0,0 +1,62 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"stamp/rtt"
+)
+
+// printTrace writes the hops of a trace to w, traceroute style, with * for each probe that wasn't answered. If the
+// probes were marked with dscp, each hop's is added, with the first that differs flagged as changed.
+func printTrace(w io.Writer, hops []rtt.Hop, dscp int) {
+	remarked := false
+	for _, hop := range hops {
+		addr := "*"
+		if hop.Addr != nil {
+			addr = hop.Addr.String()
+		}
+		rtts := make([]string, len(hop.RTTs))
+		for i, d := range hop.RTTs {
+			rtts[i] = "*"
+			if d != 0 {
+				rtts[i] = d.Round(time.Microsecond).String()
+			}
+		}
+		note := ""
+		if dscp != 0 && hop.DSCP >= 0 {
+			note = fmt.Sprintf("  dscp %d", hop.DSCP)
+			if hop.DSCP != dscp && !remarked {
+				note += " (changed)"
+				remarked = true
+			}
+		}
+		fmt.Fprintf(w, "%3d  %-15s  %s%s\n", hop.TTL, addr, strings.Join(rtts, "  "), note)
+	}
+	if len(hops) > 0 && !hops[len(hops)-1].Reached {
+		fmt.Fprintf(w, "reflector not reached in %d hops\n", len(hops))
+	}
+}
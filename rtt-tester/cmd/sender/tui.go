@@ -0,0 +1,87 @@
+package main
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"stamp/rtt"
+)
+
+// tui shows the progress of a run, see rtt.Config.Progress: redrawn in place on a terminal, and otherwise as a line
+// per update, so that it can be piped or logged
+type tui struct {
+	w        io.Writer
+	terminal bool
+	target   string
+	lines    int // drawn last time, to move back up over
+}
+
+// newTUI returns a tui writing to f, showing the run's reflector as target
+func newTUI(f *os.File, target string) *tui {
+	info, err := f.Stat()
+	return &tui{w: f, terminal: err == nil && info.Mode()&os.ModeCharDevice != 0, target: target}
+}
+
+// update shows p
+func (t *tui) update(p rtt.Progress) {
+	elapsed := p.Elapsed.Round(time.Second)
+	rtts := p.RTT
+	if !t.terminal {
+		fmt.Fprintf(t.w, "elapsed=%s window=%d packet_length=%d sent=%d received=%d dropped=%d loss=%.2f%% rtt_p50=%s rtt_p90=%s rtt_p99=%s\n",
+			elapsed, p.WindowSize, p.PacketLength, p.Sent, p.Received, p.Dropped, p.LossPercent, roundRTT(rtts.P50),
+			roundRTT(rtts.P90), roundRTT(rtts.P99))
+		return
+	}
+	warmup := ""
+	if p.Warmup {
+		warmup = " (warmup)"
+	}
+	lines := []string{
+		fmt.Sprintf("reflector  %s, %s elapsed", t.target, elapsed),
+		fmt.Sprintf("window     %d packets of %d bytes%s", p.WindowSize, p.PacketLength, warmup),
+		fmt.Sprintf("packets    %d sent, %d received, %d dropped", p.Sent, p.Received, p.Dropped),
+		fmt.Sprintf("loss       %.2f%% of the last %d", p.LossPercent, rtt.ProgressLast),
+		fmt.Sprintf("rtt        p50 %s  p90 %s  p99 %s  mean %s  max %s", roundRTT(rtts.P50), roundRTT(rtts.P90),
+			roundRTT(rtts.P99), roundRTT(rtts.Mean), roundRTT(rtts.Max)),
+	}
+	var b strings.Builder
+	if t.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", t.lines) // back up to the first line drawn last time
+	}
+	for _, line := range lines {
+		b.WriteString("\x1b[2K") // clear what was there
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	t.lines = len(lines)
+	_, _ = io.WriteString(t.w, b.String())
+}
+
+// roundRTT rounds d to the microsecond, which is as fine as is worth reading off a live display
+func roundRTT(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
@@ -1,6 +1,6 @@
 module stamp
 
-go 1.16
+go 1.21
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.14
@@ -0,0 +1,149 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// delayQueueLen is how many delayed replies a listener's workers can hand to its delayer before they have to wait for it
+const delayQueueLen = 4096
+
+// Delay is how long the reflector holds each reply before sending it, to emulate a slow reflector. A delay with
+// Max above Min is drawn uniformly from [Min, Max] for each packet. The zero Delay sends replies straight away.
+type Delay struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// ParseDelay parses a fixed delay such as "10ms", or a range such as "5ms-20ms" to draw from uniformly
+func ParseDelay(s string) (Delay, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := time.ParseDuration(lo)
+	if err != nil {
+		return Delay{}, fmt.Errorf("bad delay %q: %w", s, err)
+	}
+	max := min
+	if isRange {
+		max, err = time.ParseDuration(hi)
+		if err != nil {
+			return Delay{}, fmt.Errorf("bad delay %q: %w", s, err)
+		}
+	}
+	d := Delay{Min: min, Max: max}
+	return d, d.validate()
+}
+
+func (d Delay) validate() error {
+	if d.Min < 0 {
+		return fmt.Errorf("delay must not be negative: %s", d.Min)
+	}
+	if d.Max < d.Min {
+		return fmt.Errorf("delay range %s-%s is backwards", d.Min, d.Max)
+	}
+	return nil
+}
+
+func (d Delay) String() string {
+	if d.Max > d.Min {
+		return fmt.Sprintf("%s-%s", d.Min, d.Max)
+	}
+	return d.Min.String()
+}
+
+// sample returns the delay for one reply
+func (d Delay) sample() time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + time.Duration(rand.Int63n(int64(d.Max-d.Min)+1))
+}
+
+// delayedReply is a reply held until it is due
+type delayedReply struct {
+	due   time.Time
+	seq   uint64 // the order it was received in, so that replies due at the same time are sent in that order
+	reply []byte
+	dst   net.Addr
+}
+
+// replyHeap orders delayed replies by when they are due, see container/heap
+type replyHeap []delayedReply
+
+func (h replyHeap) Len() int { return len(h) }
+func (h replyHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h replyHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *replyHeap) Push(x any)   { *h = append(*h, x.(delayedReply)) }
+func (h *replyHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// delayer sends each reply from in on l once it is due. A fixed delay keeps replies in the order they were
+// received, while a range reorders them as their delays overlap. When in is closed the replies still held are
+// sent when due before it returns.
+func (c *StampReflector) delayer(l *listener, in <-chan delayedReply) {
+	var held replyHeap
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		var wake <-chan time.Time
+		if len(held) > 0 {
+			timer.Reset(time.Until(held[0].due))
+			wake = timer.C
+		}
+		select {
+		case r, ok := <-in:
+			if !ok {
+				timer.Stop()
+				for held.Len() > 0 {
+					r := heap.Pop(&held).(delayedReply)
+					time.Sleep(time.Until(r.due))
+					c.send(l, r.reply, r.dst)
+				}
+				return
+			}
+			heap.Push(&held, r)
+			if wake != nil && !timer.Stop() {
+				<-timer.C
+			}
+		case <-wake:
+			now := time.Now()
+			for held.Len() > 0 && !held[0].due.After(now) {
+				r := heap.Pop(&held).(delayedReply)
+				c.send(l, r.reply, r.dst)
+			}
+		}
+	}
+}
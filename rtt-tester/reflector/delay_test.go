@@ -0,0 +1,120 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"stamp/wire"
+)
+
+func TestParseDelay(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Delay
+		ok   bool
+	}{
+		{"0", Delay{}, true},
+		{"10ms", Delay{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond}, true},
+		{"5ms-20ms", Delay{Min: 5 * time.Millisecond, Max: 20 * time.Millisecond}, true},
+		{"20ms-5ms", Delay{}, false},
+		{"5ms-", Delay{}, false},
+		{"fast", Delay{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseDelay(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseDelay(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("ParseDelay(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDelaySample(t *testing.T) {
+	fixed := Delay{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond}
+	if got := fixed.sample(); got != fixed.Min {
+		t.Errorf("fixed delay sampled %s, want %s", got, fixed.Min)
+	}
+	if got := (Delay{}).sample(); got != 0 {
+		t.Errorf("zero delay sampled %s, want 0", got)
+	}
+	d := Delay{Min: 5 * time.Millisecond, Max: 20 * time.Millisecond}
+	for i := 0; i < 1000; i++ {
+		got := d.sample()
+		if got < d.Min || got > d.Max {
+			t.Fatalf("sampled %s outside %s", got, d)
+		}
+	}
+}
+
+func TestDelayerKeepsOrder(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	c := &StampReflector{delay: Delay{Min: 5 * time.Millisecond, Max: 5 * time.Millisecond}, clock: wire.SystemClock{},
+		stamps: wire.SystemClock{}}
+	l := &listener{conn: ipv4.NewPacketConn(conn), addr: conn.LocalAddr().String()}
+	in := make(chan delayedReply, delayQueueLen)
+	done := make(chan struct{})
+	go func() {
+		c.delayer(l, in)
+		close(done)
+	}()
+	const n = 100
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		reply := make([]byte, 48)
+		binary.BigEndian.PutUint32(reply[20:], uint32(i))
+		in <- delayedReply{due: time.Now().Add(c.delay.sample()), seq: uint64(i), reply: reply, dst: sink.LocalAddr()}
+	}
+	close(in)
+	<-done
+	if elapsed := time.Since(start); elapsed < c.delay.Min {
+		t.Errorf("replies sent after %s, before the %s delay", elapsed, c.delay.Min)
+	}
+	_ = sink.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	for i := 0; i < n; i++ {
+		_, _, err := sink.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reply %d: %s", i, err)
+		}
+		if got := binary.BigEndian.Uint32(buf[20:]); got != uint32(i) {
+			t.Fatalf("reply %d arrived as number %d", i, got)
+		}
+	}
+}
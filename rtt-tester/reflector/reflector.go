@@ -0,0 +1,850 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"stamp/wire"
+)
+
+// Config holds everything needed to run a reflector
+type Config struct {
+	// ListenAddr is the address:port to receive on and reply from, or a comma-separated list of them to serve
+	// several ports from one reflector
+	ListenAddr string
+	SrcAddr    string // local IP address to send replies from, empty to let the OS choose
+	Interface  string // name of the interface to send replies out of e.g. eth1, empty to let the OS choose
+	// Group is the IPv4 multicast group to join on each listener, on Interface if it is set, so that the reflector
+	// answers packets sent to the group on its ports as well as to it. Empty for none. The listeners must be bound
+	// to the unspecified address, such as 0.0.0.0:9996, to receive the group's packets.
+	Group string
+	// StatusAddr is the address:port to serve the JSON status endpoint on, empty for none
+	StatusAddr string
+	// IdleTimeout is how long a source can go without sending before it is forgotten, 0 to never forget
+	IdleTimeout time.Duration
+	// QuietAfter is how long a source can go without sending before it is reported as quiet, once, 0 to never
+	// report it. It must be shorter than IdleTimeout, after which the source is forgotten.
+	QuietAfter time.Duration
+	// MaxSources is how many sources to remember before forgetting the least recently seen, 0 for no limit
+	MaxSources int
+	// Secret is the shared secret sender packets must be authenticated with, nil to accept any packet
+	Secret []byte
+	// SendRetries is how many times to retry a reply that fails to send because the socket or interface is
+	// momentarily out of buffers, see wire.WriteTo
+	SendRetries int
+	// Workers is how many goroutines reflect the packets received on each listener, 0 for one per CPU. Each source's
+	// packets are reflected in order by the same worker.
+	Workers int
+	// Delay is how long to hold each reply before sending it, the zero Delay for none. The reply's timestamp is
+	// written as it is sent, so the sender sees the delay as time spent in the reflector.
+	Delay Delay
+	// Mode is the packet format to expect and reply with
+	Mode wire.Mode
+	// TimestampFormat is how the reflector's timestamps are written in ModeLegacy replies, and must match the
+	// sender's. ModeSTAMP always uses NTP.
+	TimestampFormat wire.TimestampFormat
+	// TCP also accepts TCP connections on the port of each listener, from senders run with rtt.TransportTCP, and
+	// reflects the frames sent on them back down them. ModeLegacy only. Delay applies to UDP replies only.
+	TCP bool
+	// Clock is what receive and transmit timestamps are taken from, nil for the system clock. Delay is always timed
+	// by the system clock.
+	Clock wire.Clock
+	// MonotonicTimestamps takes the receive and transmit timestamps from a wire.MonotonicClock anchored to Clock at
+	// startup, so that the turnaround between them isn't thrown out by Clock being stepped, while the times sources
+	// are logged and reported with stay on Clock. The timestamps drift from Clock over a long run.
+	MonotonicTimestamps bool
+	// PayloadCRC appends the CRC-32 of everything each ModeLegacy packet carried after its header to the reply, so
+	// that a sender run with rtt.Config.VerifyPayload can tell a payload corrupted on the way. Senders from before
+	// it was added skip the longer replies.
+	PayloadCRC bool
+	// ReplySize pads each ModeLegacy reply with zeros to this many bytes, but no longer than the packet it answers,
+	// so that the return path carries as much as the way there. 0 leaves replies unpadded.
+	ReplySize int
+	// ReplyPort sends each UDP reply to this port of the address the packet came from, rather than to the port it
+	// came from, for a firewall or NAT that only lets replies in to a fixed port. The sender must be run with
+	// rtt.Config.RecvPort set to the same port to hear them. 0 replies to the port each packet came from.
+	ReplyPort int
+	// ReplyTTL sends each UDP reply with this IP TTL, from 1 to 255, rather than the OS default, and ModeLegacy
+	// replies carry it so that a sender can work out how many hops the reply took. 0 leaves the OS default.
+	ReplyTTL int
+	// SocketBuffers sets the receive and send buffers of each UDP listener, so that bursts from busy senders aren't
+	// dropped by the kernel for want of room, which senders would count as loss. The OS can grant less, which is
+	// logged, see wire.SetBuffers. The zero Buffers leaves the OS defaults.
+	SocketBuffers wire.Buffers
+	// DropRate is the fraction of the packets received, from 0 to 1, that are counted and then not replied to, so
+	// that loss can be put on the way back from the reflector to check that a sender tells it from loss on the way
+	// there. The packets are drawn at random, repeatably with Seed. For testing only.
+	DropRate float64
+	// Seed seeds the draws of DropRate, each worker's from a stream of its own, so that the same packets have the same
+	// replies dropped. 0 picks a seed from the clock.
+	Seed int64
+}
+
+type StampReflector struct {
+	listeners []*listener
+	replyCM   *ipv4.ControlMessage // nil unless replies are sent from a chosen address or interface
+	sources   *sourceTable
+	secret    []byte // packets that aren't authenticated with this are dropped, nil to accept any packet
+	mode      wire.Mode
+	tsFormat  wire.TimestampFormat
+	minLen    int // shortest sender packet that can be reflected
+	retries   int
+	delay     Delay
+	workers   int
+	clock     wire.Clock
+	crc       bool // Config.PayloadCRC
+	padTo     int  // Config.ReplySize
+	toPort    int  // Config.ReplyPort
+	replyTTL  byte // Config.ReplyTTL
+	// stamps is what timestamps are taken from: clock, or a MonotonicClock for Config.MonotonicTimestamps
+	stamps wire.Clock
+	// idleTimeout and quietAfter are Config.IdleTimeout and Config.QuietAfter, for Serve
+	idleTimeout time.Duration
+	quietAfter  time.Duration
+	// pending counts the delayer goroutines that haven't yet sent all of their replies
+	pending sync.WaitGroup
+	// sendErrors counts the replies that failed to send even after retrying
+	sendErrors atomic.Int64
+	// dropRate is Config.DropRate, drawn with a rand.Rand per worker seeded from seed, and injected counts the
+	// replies it kept from being sent
+	dropRate float64
+	seed     int64
+	injected atomic.Int64
+	// group, iface and bufs are what each listener's socket is opened with, see openListener
+	group net.IP
+	iface *net.Interface
+	bufs  wire.Buffers
+	// maxReopens is how many times in a row a listener whose reads keep failing is reopened before the reflector
+	// gives up, wire.MaxReopens
+	maxReopens int
+}
+
+// listener is one of the sockets the reflector receives on and replies from. Each is read by a receiver goroutine
+// of its own, and the source table is shared between them.
+type listener struct {
+	conn      *ipv4.PacketConn
+	addr      string // the local address:port, which tags the sources heard on it
+	gotSender bool
+	tcp       *net.TCPListener // nil unless Config.TCP
+	// mu guards conn while the receiver replaces it, see reopen, so that replies are sent on the socket from before
+	// or after
+	mu sync.RWMutex
+}
+
+// socket returns the listener's UDP socket, which the receiver may have replaced
+func (l *listener) socket() *ipv4.PacketConn {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.conn
+}
+
+// workerQueueLen is how many packets a receiver can hand to each worker before it has to wait for it
+const workerQueueLen = 1024
+
+// legacyReplyLen is the length of a ModeLegacy reply, laid out below
+const legacyReplyLen = 48
+
+const (
+	FlagPrevSeqValid = 1 << 0 // the previous sender sequence number field is valid
+	FlagPayloadCRC   = 1 << 1 // the reply ends with the payload CRC, see Config.PayloadCRC
+	// FormatVersion is the version of the layout below, sent in the byte after the flags so that a sender can tell
+	// a reply it doesn't know how to read. Reflectors from before it was added send 0.
+	FormatVersion = 1
+)
+
+// now is the wall time, that sources are logged and reported with
+func (c *StampReflector) now() time.Time {
+	return c.clock.Now()
+}
+
+// stampNow is the time to write in receive and transmit timestamps
+func (c *StampReflector) stampNow() time.Time {
+	return c.stamps.Now()
+}
+
+/*  7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                        sequence number                        | <- idx = 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                           timestamp                           | <- idx = 4
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                      receive  timestamp                       | <- idx = 12
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                     sender sequence number                    | <- idx = 20
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                       sender timestamp                        | <- idx = 24
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                      sender window size                       | <- idx = 32
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                      sender packet size                       | <- idx = 36
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |     TTL       |     flags     |    version    |   reply TTL   | <- idx = 40
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                previous sender sequence number                | <- idx = 44
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                   payload CRC (optional)                      | <- idx = 48
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*
+* The previous sender sequence number is the one reflected before this packet for the same source, so the sender
+* can tell which of the packets it didn't get back never reached the reflector. It is only valid if the
+* FlagPrevSeqValid bit of flags is set.
+*
+* The reply TTL is the IP TTL the reply is sent with, set by Config.ReplyTTL, or 0 if it is left to the OS. Older
+* reflectors always send 0 there.
+*
+* The payload CRC, the CRC-32 (IEEE) of the sender packet from idx = 16 on, is only sent with Config.PayloadCRC, which
+* sets the FlagPayloadCRC bit of flags.
+*
+* With Config.ReplySize the reply is padded with zeros after the last field, so a sender must allow for a reply
+* longer than it knows the fields of.
+*
+* With a secret, a sender packet must carry the MAC of its sequence number and timestamp (see wire.MAC) straight
+* after its 16 byte header, or it is dropped without a reply.
+*
+* In STAMP mode the RFC 8762 packets laid out in package wire are used instead.
+ */
+
+// receiver reads packets on l until ctx is done, and hands each to one of c.workers workers to reflect back to its
+// source. It returns an error if l's reads still fail after it has been reopened c.maxReopens times in a row.
+func (c *StampReflector) receiver(ctx context.Context, l *listener) error {
+	slog.Info("receiving", "addr", l.addr, "mode", c.mode)
+	packet := make([]byte, wire.MaxUDPPayload) // big enough that no packet is ever truncated
+	err := l.conn.SetControlMessage(ipv4.FlagTTL, true)
+	if err != nil {
+		slog.Warn("error setting control message", "listener", l.addr, "err", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = l.socket().SetReadDeadline(time.Now())
+	}()
+	var delayed chan delayedReply
+	if c.delay.Max > 0 {
+		// delayed replies are sent by a goroutine of their own, so that packets keep being read meanwhile
+		delayed = make(chan delayedReply, delayQueueLen)
+		defer close(delayed)
+		c.pending.Add(1)
+		go func() {
+			defer c.pending.Done()
+			c.delayer(l, delayed)
+		}()
+	}
+	jobs := make([]chan job, c.workers)
+	var workers sync.WaitGroup
+	for i := range jobs {
+		jobs[i] = make(chan job, workerQueueLen)
+		workers.Add(1)
+		go func(jobs <-chan job, rng *rand.Rand) {
+			defer workers.Done()
+			reply := make([]byte, wire.MaxUDPPayload) // each worker writes its replies in a buffer of its own
+			for j := range jobs {
+				c.reflect(l, j, reply, rng, delayed)
+			}
+		}(jobs[i], rand.New(rand.NewSource(c.seed+int64(i))))
+	}
+	defer func() {
+		for _, q := range jobs {
+			close(q)
+		}
+		workers.Wait()
+	}()
+	var seq uint64
+	conn := l.socket()
+	var backoff wire.Backoff
+	failed := 0 // reads in a row that failed
+	for {
+		n, cm, src, err := conn.ReadFrom(packet)
+		received, rx := c.now(), c.stampNow()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			failed++
+			if failed < wire.MaxReadErrors && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("read error", "listener", l.addr, "err", err)
+				continue
+			}
+			if backoff.Attempts() == c.maxReopens {
+				return fmt.Errorf("reads kept failing on %s after reopening it %d times, the last: %v", l.addr,
+					c.maxReopens, err)
+			}
+			reopened, rerr := c.reopen(ctx, l, &backoff, err)
+			if rerr != nil {
+				// the old socket is closed, so the next read fails straight away and it is tried again
+				slog.Warn("error reopening listener", "listener", l.addr, "attempt", backoff.Attempts(), "err", rerr)
+				continue
+			}
+			if reopened == nil {
+				return nil
+			}
+			conn = reopened
+			failed = 0
+			continue
+		}
+		failed = 0
+		backoff.Reset()
+		if !l.gotSender {
+			l.gotSender = true
+			slog.Info("got first packet", "from", src, "listener", l.addr)
+		}
+		seq++
+		j := job{
+			packet:   append([]byte(nil), packet[:n]...), // packet is read into again straight away
+			key:      sourceKey{listener: l.addr, addr: src.String()},
+			src:      src,
+			received: received,
+			rx:       rx.UnixNano(),
+			seq:      seq,
+		}
+		if cm != nil {
+			j.ttl = uint8(cm.TTL)
+		}
+		// a source's packets always go to the same worker, so that they are counted and reflected in order
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(j.key.addr))
+		jobs[h.Sum32()%uint32(len(jobs))] <- j
+	}
+}
+
+// reopen replaces the socket of l, whose reads keep failing with cause, with a new one on the same address once
+// backoff has been waited out, so that the reflector keeps answering after the interface it listens on goes down and
+// comes back. It returns nil if ctx is done first.
+func (c *StampReflector) reopen(ctx context.Context, l *listener, backoff *wire.Backoff, cause error) (*ipv4.PacketConn, error) {
+	if !backoff.Wait(ctx) {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+	slog.Warn("reopening listener after its reads kept failing", "listener", l.addr, "attempt", backoff.Attempts(), "err", cause)
+	l.conn.Close() // frees the port for the new socket
+	conn, err := c.openListener(ctx, l.addr)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetControlMessage(ipv4.FlagTTL, true)
+	if err != nil {
+		slog.Warn("error setting control message", "listener", l.addr, "err", err)
+	}
+	l.conn = conn
+	slog.Info("reopened listener", "listener", l.addr)
+	return conn, nil
+}
+
+// job is a packet read by a receiver, for a worker to reflect
+type job struct {
+	packet   []byte // a copy of the packet, that the worker owns
+	key      sourceKey
+	src      net.Addr
+	ttl      uint8
+	received time.Time
+	rx       int64  // the receive timestamp, see StampReflector.stampNow
+	seq      uint64 // the order it was received in on its listener
+}
+
+// reflect writes the reply to the packet of j, which was received on l, in buf and sends it straight away, or hands
+// a copy of it to delayed. rng is the worker's, for dropReply.
+func (c *StampReflector) reflect(l *listener, j job, buf []byte, rng *rand.Rand, delayed chan<- delayedReply) {
+	packet, src := j.packet, j.src
+	count, ok := c.admit(packet, j.key, src, j.ttl)
+	if !ok {
+		return
+	}
+	slog.Debug("received", "from", src, "listener", l.addr, "ttl", j.ttl, "count", count, "at", j.received)
+	var reply []byte
+	if c.mode != wire.ModeLegacy {
+		reply = c.stampReply(buf, packet, j.key, count, j.ttl, j.rx)
+	} else {
+		reply = c.legacyReply(buf, packet, j.key, count, j.ttl, j.rx)
+	}
+	if c.dropReply(rng) {
+		slog.Debug("dropped reply on purpose", "to", src, "listener", l.addr, "count", count)
+		return
+	}
+	dst := c.replyTo(src)
+	if delayed == nil {
+		c.send(l, reply, dst)
+		return
+	}
+	delayed <- delayedReply{
+		due:   j.received.Add(c.delay.sample()),
+		seq:   j.seq,
+		reply: append([]byte(nil), reply...), // buf is written over by the next packet
+		dst:   dst,
+	}
+}
+
+// dropReply returns whether to drop a reply on purpose, drawing from rng, see Config.DropRate, and counts it if so.
+// The reply is still made first, so that the source counts it as reflected and the sender can tell it was lost on
+// the way back.
+func (c *StampReflector) dropReply(rng *rand.Rand) bool {
+	if c.dropRate == 0 || rng.Float64() >= c.dropRate {
+		return false
+	}
+	c.injected.Add(1)
+	return true
+}
+
+// replyTo returns where to send the reply to a packet from src: src, or its address at Config.ReplyPort
+func (c *StampReflector) replyTo(src net.Addr) net.Addr {
+	addr, ok := src.(*net.UDPAddr)
+	if c.toPort == 0 || !ok {
+		return src
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: c.toPort}
+}
+
+// admit checks packet, received from src, against the secret and counts it against its source, then returns the
+// count and whether the packet is long enough to reflect
+func (c *StampReflector) admit(packet []byte, key sourceKey, src net.Addr, ttl uint8) (uint32, bool) {
+	n := len(packet)
+	if c.secret != nil && (n < 16+wire.MACLen || !wire.Verify(c.secret, packet, packet[16:16+wire.MACLen])) {
+		slog.Debug("dropped unauthenticated packet", "from", src, "bytes", n)
+		return 0, false
+	}
+	count := c.sources.received(key, c.now(), ttl)
+	if n < c.minLen {
+		slog.Warn("unexpected received packet size", "bytes", n, "min", c.minLen, "from", src)
+		return count, false
+	}
+	return count, true
+}
+
+// stamp writes the time it is sent into reply
+func (c *StampReflector) stamp(reply []byte) {
+	now := c.stampNow().UnixNano()
+	if c.mode != wire.ModeLegacy {
+		wire.PutNTP(reply[wire.STAMPTimestampIdx:], now)
+	} else {
+		binary.BigEndian.PutUint64(reply[4:], c.tsFormat.Encode(now))
+	}
+}
+
+// send stamps reply with the time it is sent and sends it to dst on l
+func (c *StampReflector) send(l *listener, reply []byte, dst net.Addr) {
+	c.stamp(reply)
+	err := wire.WriteTo(l.socket(), reply, c.replyCM, dst, c.retries)
+	if err != nil {
+		c.sendErrors.Add(1)
+		slog.Warn("write error", "to", dst, "listener", l.addr, "err", err)
+	}
+}
+
+// legacyReply writes the reply to packet, received from src at rx, in buf in this project's own format, and returns
+// it. The timestamp is left for send to stamp.
+func (c *StampReflector) legacyReply(buf, packet []byte, src sourceKey, count uint32, ttl uint8, rx int64) []byte {
+	senderSequenceNumber := binary.BigEndian.Uint32(packet[0:])
+	senderTimestamp := binary.BigEndian.Uint64(packet[4:])
+	senderWindowSize := binary.BigEndian.Uint32(packet[12:])
+
+	rxTimestamp := c.tsFormat.Encode(rx)
+
+	replyLen := legacyReplyLen
+	if c.crc {
+		replyLen += crc32.Size
+	}
+	reply := buf[:replyLen] // reflector packet is not necessarily the same size as sender packet.
+	idx := 0
+	binary.BigEndian.PutUint32(reply[idx:], count) // Sequence Number
+	idx += 4
+	// Timestamp, stamped by send
+	idx += 8
+	binary.BigEndian.PutUint64(reply[idx:], rxTimestamp) // Receive Timestamp
+	idx += 8
+	binary.BigEndian.PutUint32(reply[idx:], senderSequenceNumber)
+	idx += 4
+	binary.BigEndian.PutUint64(reply[idx:], senderTimestamp)
+	idx += 8
+	binary.BigEndian.PutUint32(reply[idx:], senderWindowSize)
+	idx += 4
+	binary.BigEndian.PutUint32(reply[idx:], uint32(len(packet))) // sender packet size
+	idx += 4
+	binary.BigEndian.PutUint32(reply[idx:], 0)
+	reply[idx] = ttl
+	reply[idx+2] = FormatVersion
+	reply[idx+3] = c.replyTTL
+	prevSeq, prevSeen := c.sources.reflected(src, senderSequenceNumber)
+	if prevSeen {
+		reply[idx+1] = FlagPrevSeqValid
+	}
+	if c.crc {
+		reply[idx+1] |= FlagPayloadCRC
+	}
+	idx += 4
+	binary.BigEndian.PutUint32(reply[idx:], prevSeq)
+	if c.crc {
+		idx += 4
+		binary.BigEndian.PutUint32(reply[idx:], crc32.ChecksumIEEE(packet[16:]))
+	}
+	if padded := min(c.padTo, len(packet)); padded > len(reply) {
+		reply = buf[:padded]
+		clear(reply[replyLen:])
+	}
+	return reply
+}
+
+// stampReply writes the RFC 8762 reply, or in TWAMP-Light mode the RFC 5357 one, to packet, received from src at
+// rx, in buf and returns it. The reply is padded to the length of the sender packet so that both directions carry
+// the same load. The timestamp is left for send to stamp.
+func (c *StampReflector) stampReply(buf, packet []byte, src sourceKey, count uint32, ttl uint8, rx int64) []byte {
+	senderSequenceNumber := binary.BigEndian.Uint32(packet[wire.STAMPSeqIdx:])
+	senderTimestamp := binary.BigEndian.Uint64(packet[wire.STAMPTimestampIdx:])
+	senderErrorEstimate := binary.BigEndian.Uint16(packet[wire.STAMPErrorEstimateIdx:])
+	c.sources.reflected(src, senderSequenceNumber)
+
+	replyLen := len(packet)
+	if c.mode == wire.ModeTWAMPLight {
+		replyLen = max(replyLen, wire.TWAMPReflectorLen)
+	}
+	// the sender packet's padding, and its SSID in STAMP mode, are returned as they were sent
+	reply := buf[:max(replyLen, wire.STAMPPacketLen)]
+	clear(reply[copy(reply, packet):])
+	if c.mode == wire.ModeTWAMPLight {
+		// the SSID field of STAMP is MBZ in TWAMP-Light, and padding in the sender packet
+		clear(reply[wire.STAMPSSIDIdx:wire.STAMPReceiveTimestampIdx])
+	}
+	clear(reply[wire.STAMPReceiveTimestampIdx:wire.STAMPPacketLen])
+	reply = reply[:replyLen]
+	binary.BigEndian.PutUint32(reply[wire.STAMPSeqIdx:], count)
+	binary.BigEndian.PutUint16(reply[wire.STAMPErrorEstimateIdx:], wire.ErrorEstimate)
+	wire.PutNTP(reply[wire.STAMPReceiveTimestampIdx:], rx)
+	binary.BigEndian.PutUint32(reply[wire.STAMPSenderSeqIdx:], senderSequenceNumber)
+	binary.BigEndian.PutUint64(reply[wire.STAMPSenderTimestampIdx:], senderTimestamp)
+	binary.BigEndian.PutUint16(reply[wire.STAMPSenderErrorIdx:], senderErrorEstimate)
+	reply[wire.STAMPSenderTTLIdx] = ttl
+	return reply
+}
+
+func newReflector(ctx context.Context, cfg Config) (*StampReflector, error) {
+	minLen := 16
+	switch cfg.Mode {
+	case wire.ModeSTAMP:
+		minLen = wire.STAMPPacketLen
+	case wire.ModeTWAMPLight:
+		minLen = wire.TWAMPSenderMinLen
+	}
+	if cfg.QuietAfter < 0 {
+		return nil, fmt.Errorf("quiet window must not be negative: %s", cfg.QuietAfter)
+	}
+	if cfg.QuietAfter > 0 && cfg.IdleTimeout > 0 && cfg.QuietAfter >= cfg.IdleTimeout {
+		return nil, fmt.Errorf("quiet window %s must be shorter than the idle timeout %s", cfg.QuietAfter, cfg.IdleTimeout)
+	}
+	if cfg.Workers < 0 {
+		return nil, fmt.Errorf("workers must not be negative: %d", cfg.Workers)
+	}
+	if cfg.SendRetries < 0 {
+		return nil, fmt.Errorf("send retries must not be negative: %d", cfg.SendRetries)
+	}
+	err := cfg.Delay.validate()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mode != wire.ModeLegacy && cfg.Secret != nil {
+		return nil, fmt.Errorf("a secret can't be used in %s mode", cfg.Mode)
+	}
+	if cfg.Mode != wire.ModeLegacy && cfg.TCP {
+		return nil, fmt.Errorf("TCP can't be used in %s mode", cfg.Mode)
+	}
+	if cfg.Mode != wire.ModeLegacy && cfg.PayloadCRC {
+		return nil, fmt.Errorf("payload CRCs can't be sent in %s mode", cfg.Mode)
+	}
+	if cfg.ReplySize < 0 {
+		return nil, fmt.Errorf("reply size must not be negative: %d", cfg.ReplySize)
+	}
+	if cfg.ReplyPort < 0 || cfg.ReplyPort > 65535 {
+		return nil, fmt.Errorf("reply port %d is not between 0 and 65535", cfg.ReplyPort)
+	}
+	if cfg.SocketBuffers.Recv < 0 || cfg.SocketBuffers.Send < 0 {
+		return nil, fmt.Errorf("socket buffer sizes must not be negative: %d and %d", cfg.SocketBuffers.Recv, cfg.SocketBuffers.Send)
+	}
+	if cfg.ReplyTTL < 0 || cfg.ReplyTTL > 255 {
+		return nil, fmt.Errorf("reply TTL %d is not between 0 and 255", cfg.ReplyTTL)
+	}
+	if !(cfg.DropRate >= 0 && cfg.DropRate <= 1) {
+		return nil, fmt.Errorf("drop rate must be from 0 to 1: %g", cfg.DropRate)
+	}
+	if cfg.Mode != wire.ModeLegacy && cfg.ReplySize != 0 {
+		return nil, fmt.Errorf("the reply size can't be set in %s mode, whose replies are as long as the packets sent", cfg.Mode)
+	}
+	var iface *net.Interface
+	if cfg.Interface != "" {
+		iface, err = wire.InterfaceByName(cfg.Interface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var group net.IP
+	if cfg.Group != "" {
+		group = net.ParseIP(cfg.Group).To4()
+		if group == nil || !group.IsMulticast() {
+			return nil, fmt.Errorf("%q is not an IPv4 multicast group", cfg.Group)
+		}
+	}
+	r := &StampReflector{
+		sources:  newSourceTable(cfg.MaxSources),
+		secret:   cfg.Secret,
+		mode:     cfg.Mode,
+		tsFormat: cfg.TimestampFormat,
+		minLen:   minLen,
+		retries:  cfg.SendRetries,
+		delay:    cfg.Delay,
+		workers:  cfg.Workers,
+		clock:    cfg.Clock,
+		crc:      cfg.PayloadCRC,
+		padTo:    cfg.ReplySize,
+		toPort:   cfg.ReplyPort,
+		replyTTL: byte(cfg.ReplyTTL),
+		dropRate: cfg.DropRate,
+		seed:     cfg.Seed,
+		group:    group,
+		iface:    iface,
+		bufs:     cfg.SocketBuffers,
+	}
+	if r.clock == nil {
+		r.clock = wire.SystemClock{}
+	}
+	r.stamps = r.clock
+	if cfg.MonotonicTimestamps {
+		r.stamps = wire.NewMonotonicClock(r.clock)
+	}
+	if r.workers == 0 {
+		r.workers = runtime.NumCPU()
+	}
+	r.maxReopens = wire.MaxReopens
+	if cfg.DropRate > 0 {
+		if r.seed == 0 {
+			r.seed = time.Now().UnixNano()
+		}
+		slog.Warn("dropping replies on purpose: the loss senders see on the way back is artificial", "drop_rate", cfg.DropRate,
+			"seed", r.seed)
+	}
+	var lc net.ListenConfig
+	for _, addr := range strings.Split(cfg.ListenAddr, ",") {
+		conn, err := r.openListener(ctx, strings.TrimSpace(addr))
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		l := &listener{conn: conn, addr: conn.LocalAddr().String()}
+		r.listeners = append(r.listeners, l)
+		if cfg.TCP {
+			// on the port the UDP socket was given, so that a sender can be pointed at the same address:port
+			tconn, err := lc.Listen(ctx, "tcp4", l.addr)
+			if err != nil {
+				r.close()
+				return nil, fmt.Errorf("error listening for TCP on %s: %w", l.addr, err)
+			}
+			l.tcp = tconn.(*net.TCPListener)
+		}
+	}
+	if cfg.SrcAddr != "" {
+		ip := net.ParseIP(cfg.SrcAddr).To4()
+		if ip == nil {
+			r.close()
+			return nil, fmt.Errorf("reply source %q is not an IPv4 address", cfg.SrcAddr)
+		}
+		ifi, err := localInterface(ip)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		if iface != nil && ifi.Index != iface.Index {
+			r.close()
+			return nil, fmt.Errorf("reply source %s is an address of %s, not %s", ip, ifi.Name, iface.Name)
+		}
+		r.replyCM = &ipv4.ControlMessage{Src: ip, IfIndex: ifi.Index}
+		slog.Info("sending replies from", "addr", ip, "interface", ifi.Name)
+	} else if iface != nil {
+		r.replyCM = &ipv4.ControlMessage{IfIndex: iface.Index}
+		slog.Info("sending replies out of", "interface", iface.Name)
+	}
+	return r, nil
+}
+
+// openListener opens a UDP socket on addr to receive on and reply from, with the reflector's socket buffers and
+// reply TTL, joined to its multicast group if it has one
+func (c *StampReflector) openListener(ctx context.Context, addr string) (*ipv4.PacketConn, error) {
+	var lc net.ListenConfig
+	uconn, err := lc.ListenPacket(ctx, "udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+	conn := ipv4.NewPacketConn(uconn)
+	local := conn.LocalAddr().String()
+	if c.bufs != (wire.Buffers{}) {
+		granted, err := wire.SetBuffers(uconn.(*net.UDPConn), c.bufs)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error setting the socket buffers on %s: %w", local, err)
+		}
+		wire.LogBuffers(c.bufs, granted, "listener", local)
+	}
+	if c.replyTTL != 0 {
+		err = conn.SetTTL(int(c.replyTTL))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error setting the reply TTL on %s: %w", local, err)
+		}
+	}
+	if c.group != nil {
+		err = conn.JoinGroup(c.iface, &net.UDPAddr{IP: c.group})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error joining multicast group %s on %s: %w", c.group, addr, err)
+		}
+		slog.Info("joined multicast group", "group", c.group, "listener", local)
+	}
+	return conn, nil
+}
+
+// close closes all of the reflector's sockets
+func (c *StampReflector) close() {
+	for _, l := range c.listeners {
+		l.socket().Close()
+		if l.tcp != nil {
+			l.tcp.Close()
+		}
+	}
+}
+
+// localInterface returns the interface that has the address ip
+func localInterface(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error listing interfaces: %w", err)
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s is not an address of any local interface", ip)
+}
+
+// Listen opens the sockets for each of the cfg.ListenAddr addresses, for Serve to reflect the packets received on.
+// It fails without listening on any if any of them can't be listened on.
+func Listen(ctx context.Context, cfg Config) (*StampReflector, error) {
+	r, err := newReflector(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StatusAddr != "" {
+		err = r.serveStatus(ctx, cfg.StatusAddr)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("error starting status endpoint: %w", err)
+		}
+	}
+	r.idleTimeout = cfg.IdleTimeout
+	r.quietAfter = cfg.QuietAfter
+	return r, nil
+}
+
+// Addrs returns the local address:port of each of the sockets the reflector listens on, in the order given in
+// Config.ListenAddr, with any port 0 replaced by the port chosen for it
+func (c *StampReflector) Addrs() []string {
+	addrs := make([]string, len(c.listeners))
+	for i, l := range c.listeners {
+		addrs[i] = l.addr
+	}
+	return addrs
+}
+
+// Serve reflects the packets received on the sockets opened by Listen until ctx is done, then closes them. If a
+// socket's reads keep failing however often it is reopened, Serve stops reflecting on all of them and returns the
+// error.
+func (c *StampReflector) Serve(ctx context.Context) error {
+	defer c.close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(c.listeners))
+	if c.idleTimeout > 0 {
+		go c.pruneSources(ctx, c.idleTimeout)
+	}
+	if c.quietAfter > 0 {
+		go c.watchQuiet(ctx, c.quietAfter)
+	}
+	var wg sync.WaitGroup
+	for _, l := range c.listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			err := c.receiver(ctx, l)
+			if err != nil {
+				errs <- err
+				cancel()
+			}
+		}(l)
+		if l.tcp != nil {
+			wg.Add(1)
+			go func(l *listener) {
+				defer wg.Done()
+				c.acceptTCP(ctx, l)
+			}(l)
+		}
+	}
+	wg.Wait()
+	c.pending.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Run reflects packets received on each of the cfg.ListenAddr addresses until ctx is done. It fails without
+// reflecting anything if any of them can't be listened on.
+func Run(ctx context.Context, cfg Config) error {
+	r, err := Listen(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	return r.Serve(ctx)
+}
@@ -0,0 +1,534 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stamp/wire"
+)
+
+func TestWorkersKeepSourceOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := newReflector(ctx, Config{ListenAddr: "127.0.0.1:0", Workers: 4, Mode: wire.ModeLegacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	done := make(chan struct{})
+	go func() {
+		r.receiver(ctx, r.listeners[0])
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	dst, err := net.ResolveUDPAddr("udp4", r.listeners[0].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const senders, packets = 8, 200
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packet := make([]byte, 16)
+			for i := uint32(0); i < packets; i++ {
+				binary.BigEndian.PutUint32(packet, i)
+				_, err := conn.WriteTo(packet, dst)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if i%10 == 9 {
+					time.Sleep(time.Millisecond) // don't overrun the socket buffers
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// loopback can still drop a packet under load, but the replies that arrive must be in order
+			reply := make([]byte, 100)
+			got, lastSeq, lastCount := 0, -1, -1
+			for lastSeq < packets-1 {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := conn.ReadFrom(reply)
+				if err != nil {
+					break
+				}
+				got++
+				if n != legacyReplyLen {
+					t.Errorf("%s: reply is %d bytes, want %d", conn.LocalAddr(), n, legacyReplyLen)
+				}
+				seq, count := int(binary.BigEndian.Uint32(reply[20:])), int(binary.BigEndian.Uint32(reply[0:]))
+				if seq <= lastSeq || count <= lastCount {
+					t.Errorf("%s: sender sequence %d count %d came after %d count %d", conn.LocalAddr(), seq, count, lastSeq, lastCount)
+				}
+				lastSeq, lastCount = seq, count
+			}
+			if got < packets/2 {
+				t.Errorf("%s: got %d of %d replies", conn.LocalAddr(), got, packets)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// fill returns n bytes of b
+func fill(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func TestLegacyReply(t *testing.T) {
+	c := &StampReflector{sources: newSourceTable(0), mode: wire.ModeLegacy, tsFormat: wire.TimestampUnixNano}
+	packet := fill(100, 0xaa)
+	binary.BigEndian.PutUint32(packet[0:], 7)
+	binary.BigEndian.PutUint64(packet[4:], 1234)
+	binary.BigEndian.PutUint32(packet[12:], 50)
+	sent := append([]byte(nil), packet...)
+	buf := fill(wire.MaxUDPPayload, 0xff)
+	src := key("10.0.0.1:9998")
+	for i, prevFlags := range []byte{0, FlagPrevSeqValid} {
+		count := c.sources.received(src, time.Now(), 64)
+		reply := c.legacyReply(buf, packet, src, count, 64, 5678)
+		want := make([]byte, legacyReplyLen)
+		binary.BigEndian.PutUint32(want[0:], uint32(i))
+		copy(want[4:12], reply[4:12]) // the timestamp is stamped by send
+		binary.BigEndian.PutUint64(want[12:], 5678)
+		binary.BigEndian.PutUint32(want[20:], 7)
+		binary.BigEndian.PutUint64(want[24:], 1234)
+		binary.BigEndian.PutUint32(want[32:], 50)
+		binary.BigEndian.PutUint32(want[36:], 100)
+		want[40], want[41], want[42] = 64, prevFlags, FormatVersion
+		binary.BigEndian.PutUint32(want[44:], 7*uint32(i))
+		if !bytes.Equal(reply, want) {
+			t.Errorf("reply %d\n got %x\nwant %x", i, reply, want)
+		}
+		if !bytes.Equal(packet, sent) {
+			t.Errorf("reply %d overwrote the sender packet", i)
+		}
+	}
+}
+
+func TestPayloadCRC(t *testing.T) {
+	c := &StampReflector{sources: newSourceTable(0), mode: wire.ModeLegacy, tsFormat: wire.TimestampUnixNano, crc: true}
+	packet := fill(100, 0xaa)
+	count := c.sources.received(key("10.0.0.1:9998"), time.Now(), 64)
+	reply := c.legacyReply(fill(wire.MaxUDPPayload, 0xff), packet, key("10.0.0.1:9998"), count, 64, 5678)
+	if len(reply) != legacyReplyLen+crc32.Size {
+		t.Fatalf("reply is %d bytes, want %d", len(reply), legacyReplyLen+crc32.Size)
+	}
+	if reply[41]&FlagPayloadCRC == 0 {
+		t.Errorf("flags %#x don't have FlagPayloadCRC", reply[41])
+	}
+	if got, want := binary.BigEndian.Uint32(reply[legacyReplyLen:]), crc32.ChecksumIEEE(packet[16:]); got != want {
+		t.Errorf("payload CRC %#x, want %#x", got, want)
+	}
+	_, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", Mode: wire.ModeSTAMP, PayloadCRC: true})
+	if err == nil {
+		t.Error("reflector started with payload CRCs in STAMP mode")
+	}
+}
+
+func TestReplySize(t *testing.T) {
+	for _, tt := range []struct {
+		padTo int
+		crc   bool
+		want  int
+	}{
+		{0, false, legacyReplyLen},
+		{20, false, legacyReplyLen}, // never cut short
+		{80, false, 80},
+		{80, true, 80},
+		{1000, false, 100}, // no longer than the packet answered
+	} {
+		c := &StampReflector{sources: newSourceTable(0), mode: wire.ModeLegacy, tsFormat: wire.TimestampUnixNano,
+			crc: tt.crc, padTo: tt.padTo}
+		reply := c.legacyReply(fill(wire.MaxUDPPayload, 0xff), fill(100, 0xaa), key("10.0.0.1:9998"), 0, 64, 5678)
+		if len(reply) != tt.want {
+			t.Errorf("padded to %d: reply is %d bytes, want %d", tt.padTo, len(reply), tt.want)
+			continue
+		}
+		fields := legacyReplyLen
+		if tt.crc {
+			fields += crc32.Size
+		}
+		if pad := reply[fields:]; !bytes.Equal(pad, make([]byte, len(pad))) {
+			t.Errorf("padded to %d: padding %x isn't zeros", tt.padTo, pad)
+		}
+	}
+	_, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", Mode: wire.ModeSTAMP, ReplySize: 100})
+	if err == nil {
+		t.Error("reflector started with a reply size in STAMP mode")
+	}
+}
+
+func TestReplyPort(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	c := &StampReflector{}
+	if dst := c.replyTo(src); dst.String() != "10.0.0.1:40000" {
+		t.Errorf("replying to %s without a reply port", dst)
+	}
+	c.toPort = 9998
+	if dst := c.replyTo(src); dst.String() != "10.0.0.1:9998" {
+		t.Errorf("replying to %s with reply port 9998, want 10.0.0.1:9998", dst)
+	}
+	_, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", ReplyPort: 70000})
+	if err == nil {
+		t.Error("reflector started with reply port 70000")
+	}
+}
+
+func TestReplyTTL(t *testing.T) {
+	r, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", ReplyTTL: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	if ttl, err := r.listeners[0].conn.TTL(); err != nil || ttl != 42 {
+		t.Errorf("listener TTL %d (%v), want 42", ttl, err)
+	}
+	reply := r.legacyReply(fill(wire.MaxUDPPayload, 0xff), fill(100, 0xaa), key("10.0.0.1:9998"), 0, 64, 5678)
+	if reply[43] != 42 {
+		t.Errorf("reply advertises TTL %d, want 42", reply[43])
+	}
+	_, err = newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", ReplyTTL: 256})
+	if err == nil {
+		t.Error("reflector started with reply TTL 256")
+	}
+}
+
+// TestReceiverReopensListener breaks a listener's socket under its receiver, and checks that it is reopened on the
+// same address with the same options and keeps answering
+func TestReceiverReopensListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := newReflector(ctx, Config{ListenAddr: "127.0.0.1:0", Workers: 1, ReplyTTL: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	l := r.listeners[0]
+	done := make(chan struct{})
+	go func() {
+		r.receiver(ctx, l)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	broken := l.socket()
+	broken.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for l.socket() == broken {
+		if time.Now().After(deadline) {
+			t.Fatal("listener wasn't reopened")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ttl, err := l.socket().TTL(); err != nil || ttl != 42 {
+		t.Errorf("reopened listener TTL %d (%v), want 42", ttl, err)
+	}
+
+	conn, err := net.Dial("udp4", l.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 100)
+	n, err := conn.Read(reply)
+	if err != nil || n != legacyReplyLen {
+		t.Errorf("reply of %d bytes (%v), want %d from the reopened listener", n, err, legacyReplyLen)
+	}
+}
+
+func TestServeGivesUpOnListenerThatWontReopen(t *testing.T) {
+	r, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.maxReopens = 3 // rather than waiting out all of wire.MaxReopens
+	l := r.listeners[0]
+	l.socket().Close()
+	// the port is taken, so every attempt to reopen the listener fails
+	thief, err := net.ListenPacket("udp4", l.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thief.Close()
+	served := make(chan error)
+	go func() {
+		served <- r.Serve(context.Background())
+	}()
+	select {
+	case err = <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve kept trying to reopen the listener")
+	}
+	if err == nil || !strings.Contains(err.Error(), "after reopening it 3 times") {
+		t.Errorf("Serve returned %v, want it to give up after 3 reopens", err)
+	}
+}
+
+// repliedTo sends packets 0 to n-1 to a reflector run with cfg and returns which of them were replied to
+func repliedTo(t *testing.T, cfg Config, n int) map[uint32]bool {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.ListenAddr = "127.0.0.1:0"
+	r, err := Listen(ctx, cfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = r.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	conn, err := net.Dial("udp4", r.Addrs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packet := make([]byte, 16)
+	for seq := 0; seq < n; seq++ {
+		binary.BigEndian.PutUint32(packet, uint32(seq))
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replied := make(map[uint32]bool)
+	reply := make([]byte, legacyReplyLen)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Read(reply); err != nil {
+			return replied
+		}
+		replied[binary.BigEndian.Uint32(reply[20:])] = true
+	}
+}
+
+func TestDropRateRepeatsWithSeed(t *testing.T) {
+	cfg := Config{Workers: 1, DropRate: 0.3, Seed: 7}
+	first, second := repliedTo(t, cfg, 200), repliedTo(t, cfg, 200)
+	if len(first) < 100 || len(first) > 180 {
+		t.Errorf("%d of 200 replied to, want about 140", len(first))
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("%d and %d replied to with the same seed, want the same replies dropped", len(first), len(second))
+	}
+	cfg.Seed = 8
+	if other := repliedTo(t, cfg, 200); reflect.DeepEqual(first, other) {
+		t.Error("another seed dropped the same replies")
+	}
+}
+
+func TestSTAMPReply(t *testing.T) {
+	tests := []struct {
+		mode      wire.Mode
+		packetLen int
+		replyLen  int
+		ssid      uint16
+	}{
+		{wire.ModeSTAMP, 60, 60, 0xbeef},
+		{wire.ModeTWAMPLight, wire.TWAMPSenderMinLen, wire.TWAMPReflectorLen, 0},
+		{wire.ModeTWAMPLight, 60, 60, 0},
+	}
+	for _, tt := range tests {
+		c := &StampReflector{sources: newSourceTable(0), mode: tt.mode}
+		packet := fill(tt.packetLen, 0xaa)
+		binary.BigEndian.PutUint32(packet[wire.STAMPSeqIdx:], 7)
+		binary.BigEndian.PutUint64(packet[wire.STAMPTimestampIdx:], 1234)
+		binary.BigEndian.PutUint16(packet[wire.STAMPErrorEstimateIdx:], 0x0101)
+		if tt.packetLen >= wire.STAMPReceiveTimestampIdx {
+			binary.BigEndian.PutUint16(packet[wire.STAMPSSIDIdx:], 0xbeef)
+		}
+		sent := append([]byte(nil), packet...)
+		reply := c.stampReply(fill(wire.MaxUDPPayload, 0xff), packet, key("10.0.0.1:9998"), 3, 64, 5678)
+		want := make([]byte, tt.replyLen)
+		copy(want, packet)
+		clear(want[wire.STAMPSSIDIdx:min(len(want), wire.STAMPPacketLen)])
+		binary.BigEndian.PutUint16(want[wire.STAMPSSIDIdx:], tt.ssid)
+		binary.BigEndian.PutUint32(want[wire.STAMPSeqIdx:], 3)
+		binary.BigEndian.PutUint16(want[wire.STAMPErrorEstimateIdx:], wire.ErrorEstimate)
+		wire.PutNTP(want[wire.STAMPReceiveTimestampIdx:], 5678)
+		binary.BigEndian.PutUint32(want[wire.STAMPSenderSeqIdx:], 7)
+		binary.BigEndian.PutUint64(want[wire.STAMPSenderTimestampIdx:], 1234)
+		binary.BigEndian.PutUint16(want[wire.STAMPSenderErrorIdx:], 0x0101)
+		want[wire.STAMPSenderTTLIdx] = 64
+		if !bytes.Equal(reply, want) {
+			t.Errorf("%s %d byte packet\n got %x\nwant %x", tt.mode, tt.packetLen, reply, want)
+		}
+		if !bytes.Equal(packet, sent) {
+			t.Errorf("%s %d byte packet was overwritten", tt.mode, tt.packetLen)
+		}
+	}
+}
+
+func TestInterface(t *testing.T) {
+	ctx := context.Background()
+	_, err := newReflector(ctx, Config{ListenAddr: "127.0.0.1:0", Interface: "nosuchif0"})
+	if err == nil {
+		t.Error("reflector started with an interface that doesn't exist")
+	}
+	lo, err := localInterface(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Skip(err)
+	}
+	r, err := newReflector(ctx, Config{ListenAddr: "127.0.0.1:0", Interface: lo.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	if r.replyCM == nil || r.replyCM.IfIndex != lo.Index {
+		t.Errorf("replies sent with %+v, want out of %s", r.replyCM, lo.Name)
+	}
+}
+
+func TestGroupMustBeMulticast(t *testing.T) {
+	for _, group := range []string{"10.0.0.1", "ff02::1", "nonsense"} {
+		r, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", Group: group})
+		if err == nil {
+			r.close()
+			t.Errorf("reflector started with group %s", group)
+		}
+	}
+}
+
+// fixedClock is a Clock stopped at one time
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestClockStampsReplies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	r, err := Listen(ctx, Config{ListenAddr: "127.0.0.1:0", Clock: fixedClock(at)})
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = r.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	conn, err := net.Dial("udp4", r.Addrs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, legacyReplyLen)
+	if _, err := conn.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint64(reply[12:]); got != uint64(at.UnixNano()) {
+		t.Errorf("receive timestamp %d, want the clock's %d", got, at.UnixNano())
+	}
+	if got := binary.BigEndian.Uint64(reply[4:]); got != uint64(at.UnixNano()) {
+		t.Errorf("transmit timestamp %d, want the clock's %d", got, at.UnixNano())
+	}
+}
+
+func TestMonotonicTimestamps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	r, err := Listen(ctx, Config{ListenAddr: "127.0.0.1:0", Clock: fixedClock(at), MonotonicTimestamps: true})
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = r.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	conn, err := net.Dial("udp4", r.Addrs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, legacyReplyLen)
+	if _, err := conn.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	rx := int64(binary.BigEndian.Uint64(reply[12:]))
+	tx := int64(binary.BigEndian.Uint64(reply[4:]))
+	// the stopped clock only anchors the timestamps, which go on by the monotonic clock
+	if rx <= at.UnixNano() || rx > at.Add(5*time.Second).UnixNano() {
+		t.Errorf("receive timestamp %d, want just after the clock's %d", rx, at.UnixNano())
+	}
+	if tx < rx || tx > at.Add(5*time.Second).UnixNano() {
+		t.Errorf("transmit timestamp %d, want from the receive timestamp %d on", tx, rx)
+	}
+	sources := r.sources.snapshot()
+	if len(sources) != 1 || !sources[0].LastSeen.Equal(at) {
+		t.Errorf("sources %+v, want one last seen at the clock's %s", sources, at)
+	}
+}
@@ -0,0 +1,181 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"container/list"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sourceKey identifies a sender by its address and the listener it sends to, so that a sender testing against
+// several of the reflector's ports is counted separately on each
+type sourceKey struct {
+	listener string // local address:port the packets are received on
+	addr     string // sender address:port
+}
+
+// source is what the reflector remembers about each sender
+type source struct {
+	key      sourceKey
+	count    uint32    // packets received, used as the reflector sequence number
+	lastSeq  uint32    // sender sequence number of the last packet reflected
+	seen     bool      // lastSeq is valid
+	lastSeen time.Time // when the last packet was received
+	ttl      uint8     // TTL of the last packet received
+	quiet    bool      // nothing has been received for the quiet window, and it has been reported
+}
+
+// sourceTable holds a source for each sender address on each listener. It is shared by the receiver, the status endpoint and the
+// pruning loop, so all access goes through its methods. Sources are kept in order of when they were last seen so
+// that the least recently seen can be evicted once there are max of them.
+type sourceTable struct {
+	mu  sync.Mutex
+	m   map[sourceKey]*list.Element
+	lru *list.List // of *source, most recently seen at the front
+	max int        // 0 for no limit
+}
+
+func newSourceTable(max int) *sourceTable {
+	return &sourceTable{m: make(map[sourceKey]*list.Element), lru: list.New(), max: max}
+}
+
+// len returns the number of sources
+func (t *sourceTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lru.Len()
+}
+
+// received records a packet from key and returns the reflector sequence number to use for it
+func (t *sourceTable) received(key sourceKey, now time.Time, ttl uint8) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var s *source
+	e, ok := t.m[key]
+	if ok {
+		s = e.Value.(*source)
+		t.lru.MoveToFront(e)
+	} else {
+		if t.max > 0 && t.lru.Len() >= t.max {
+			oldest := t.lru.Back()
+			delete(t.m, oldest.Value.(*source).key)
+			t.lru.Remove(oldest)
+		}
+		s = &source{key: key}
+		t.m[key] = t.lru.PushFront(s)
+	}
+	if s.quiet {
+		s.quiet = false
+		slog.Info("sender is back", "addr", key.addr, "listener", key.listener, "quiet_for", now.Sub(s.lastSeen))
+	}
+	count := s.count
+	s.count = count + 1
+	s.lastSeen = now
+	s.ttl = ttl
+	return count
+}
+
+// reflected records that seq from key is being reflected and returns the sender sequence number that was reflected
+// before it, with false if there wasn't one.
+func (t *sourceTable) reflected(key sourceKey, seq uint32) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.m[key]
+	if !ok {
+		return 0, false
+	}
+	s := e.Value.(*source)
+	prev, seen := s.lastSeq, s.seen
+	s.lastSeq = seq
+	s.seen = true
+	return prev, seen
+}
+
+// prune removes sources that haven't been seen since before, returning how many were removed
+func (t *sourceTable) prune(before time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for e := t.lru.Back(); e != nil && e.Value.(*source).lastSeen.Before(before); e = t.lru.Back() {
+		delete(t.m, e.Value.(*source).key)
+		t.lru.Remove(e)
+		n++
+	}
+	return n
+}
+
+// quiet marks the sources that haven't been seen since before as quiet and returns the ones that weren't already,
+// so that each is only reported once until it is heard from again
+func (t *sourceTable) quiet(before time.Time) []sourceStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var st []sourceStatus
+	for e := t.lru.Back(); e != nil && e.Value.(*source).lastSeen.Before(before); e = e.Prev() {
+		s := e.Value.(*source)
+		if !s.quiet {
+			s.quiet = true
+			st = append(st, s.status())
+		}
+	}
+	return st
+}
+
+// sourceStatus is the JSON form of a source on the status endpoint
+type sourceStatus struct {
+	Addr     string    `json:"addr"`
+	Listener string    `json:"listener"`
+	Packets  uint32    `json:"packets"`
+	LastSeen time.Time `json:"last_seen"`
+	TTL      uint8     `json:"ttl"`
+	Quiet    bool      `json:"quiet"`
+}
+
+func (s *source) status() sourceStatus {
+	return sourceStatus{
+		Addr:     s.key.addr,
+		Listener: s.key.listener,
+		Packets:  s.count,
+		LastSeen: s.lastSeen,
+		TTL:      s.ttl,
+		Quiet:    s.quiet,
+	}
+}
+
+// snapshot returns the status of every source, ordered by address and then listener
+func (t *sourceTable) snapshot() []sourceStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := make([]sourceStatus, 0, t.lru.Len())
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		st = append(st, e.Value.(*source).status())
+	}
+	sort.Slice(st, func(i, j int) bool {
+		if st[i].Addr != st[j].Addr {
+			return st[i].Addr < st[j].Addr
+		}
+		return st[i].Listener < st[j].Listener
+	})
+	return st
+}
@@ -0,0 +1,124 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// key is the sourceKey of addr on the default listener
+func key(addr string) sourceKey {
+	return sourceKey{listener: "0.0.0.0:9996", addr: addr}
+}
+
+func TestSourceTableBounded(t *testing.T) {
+	const max = 10
+	st := newSourceTable(max)
+	now := time.Now()
+	for i := 0; i < 3*max; i++ {
+		st.received(key(fmt.Sprintf("10.0.0.%d:9998", i)), now.Add(time.Duration(i)*time.Millisecond), 64)
+		if st.len() > max {
+			t.Fatalf("after %d sources the table has %d entries, want at most %d", i+1, st.len(), max)
+		}
+	}
+	if st.len() != max {
+		t.Errorf("table has %d entries, want %d", st.len(), max)
+	}
+	// the most recent sources survive, the oldest were evicted
+	snap := st.snapshot()
+	for _, s := range snap {
+		var i int
+		fmt.Sscanf(s.Addr, "10.0.0.%d:9998", &i)
+		if i < 2*max {
+			t.Errorf("source %s should have been evicted", s.Addr)
+		}
+	}
+}
+
+func TestSourceTableEvictsLeastRecentlySeen(t *testing.T) {
+	st := newSourceTable(2)
+	now := time.Now()
+	st.received(key("a"), now, 64)
+	st.received(key("b"), now, 64)
+	st.received(key("a"), now, 64) // a is now more recent than b
+	st.received(key("c"), now, 64) // evicts b
+	if _, ok := st.m[key("b")]; ok {
+		t.Error("b should have been evicted")
+	}
+	if got := st.received(key("a"), now, 64); got != 2 {
+		t.Errorf("a's count = %d, want 2", got)
+	}
+	// b comes back and starts counting again
+	if got := st.received(key("b"), now, 64); got != 0 {
+		t.Errorf("returning b's count = %d, want 0", got)
+	}
+}
+
+func TestSourceTablePrune(t *testing.T) {
+	st := newSourceTable(0)
+	now := time.Now()
+	st.received(key("old"), now.Add(-time.Hour), 64)
+	st.received(key("new"), now, 64)
+	if n := st.prune(now.Add(-time.Minute)); n != 1 {
+		t.Errorf("pruned %d sources, want 1", n)
+	}
+	if _, ok := st.m[key("new")]; !ok || st.len() != 1 {
+		t.Errorf("only new should remain, have %+v", st.snapshot())
+	}
+}
+
+func TestSourceTableListenersCountedSeparately(t *testing.T) {
+	st := newSourceTable(0)
+	now := time.Now()
+	a := sourceKey{listener: "0.0.0.0:9996", addr: "10.0.0.1:9998"}
+	b := sourceKey{listener: "0.0.0.0:9997", addr: "10.0.0.1:9998"}
+	st.received(a, now, 64)
+	st.received(a, now, 64)
+	if got := st.received(b, now, 64); got != 0 {
+		t.Errorf("count on the second listener = %d, want 0", got)
+	}
+	snap := st.snapshot()
+	if len(snap) != 2 || snap[0].Listener != a.listener || snap[1].Listener != b.listener {
+		t.Errorf("snapshot should have the sender once per listener, have %+v", snap)
+	}
+}
+
+func TestSourceTableQuiet(t *testing.T) {
+	st := newSourceTable(0)
+	now := time.Now()
+	st.received(key("old"), now.Add(-time.Hour), 64)
+	st.received(key("new"), now, 64)
+	quiet := st.quiet(now.Add(-time.Minute))
+	if len(quiet) != 1 || quiet[0].Addr != "old" || !quiet[0].Quiet {
+		t.Fatalf("quiet sources = %+v, want only old", quiet)
+	}
+	if quiet := st.quiet(now.Add(-time.Minute)); len(quiet) != 0 {
+		t.Errorf("old was reported quiet again: %+v", quiet)
+	}
+	// once old is heard from again it can go quiet again
+	st.received(key("old"), now, 64)
+	if quiet := st.quiet(now.Add(time.Minute)); len(quiet) != 2 {
+		t.Errorf("quiet sources = %+v, want both", quiet)
+	}
+}
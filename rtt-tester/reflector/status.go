@@ -0,0 +1,101 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveStatus serves the state of the source table as JSON on addr until ctx is done
+func (c *StampReflector) serveStatus(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(struct {
+			Sources    []sourceStatus `json:"sources"`
+			SendErrors int64          `json:"send_errors"`
+			Injected   int64          `json:"injected,omitempty"` // replies dropped on purpose, see Config.DropRate
+		}{c.sources.snapshot(), c.sendErrors.Load(), c.injected.Load()})
+		if err != nil {
+			slog.Warn("error writing status", "err", err)
+		}
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	slog.Info("serving status", "url", "http://"+ln.Addr().String()+"/status")
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("status server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// watchQuiet logs each source that goes quietAfter without sending, once until it sends again, checking every
+// quietAfter/2 until ctx is done. It only looks at the source table and never sends anything.
+func (c *StampReflector) watchQuiet(ctx context.Context, quietAfter time.Duration) {
+	ticker := time.NewTicker(quietAfter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, s := range c.sources.quiet(c.now().Add(-quietAfter)) {
+				slog.Info("sender went quiet", "addr", s.Addr, "listener", s.Listener, "last_seen", s.LastSeen,
+					"packets", s.Packets)
+			}
+		}
+	}
+}
+
+// pruneSources removes sources that have been idle for longer than idleTimeout, checking every idleTimeout/2,
+// until ctx is done.
+func (c *StampReflector) pruneSources(ctx context.Context, idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n := c.sources.prune(c.now().Add(-idleTimeout))
+			if n > 0 {
+				slog.Debug("pruned idle sources", "count", n)
+			}
+		}
+	}
+}
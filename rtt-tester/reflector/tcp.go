@@ -0,0 +1,107 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"stamp/wire"
+)
+
+// acceptTCP accepts connections on l.tcp until ctx is done, and reflects the frames sent on each back down it
+func (c *StampReflector) acceptTCP(ctx context.Context, l *listener) {
+	slog.Info("accepting TCP", "addr", l.tcp.Addr())
+	go func() {
+		<-ctx.Done()
+		l.tcp.Close()
+	}()
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := l.tcp.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("accept error", "listener", l.addr, "err", err)
+			time.Sleep(100 * time.Millisecond) // such as out of file descriptors, which won't clear straight away
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			c.reflectTCP(ctx, l, conn)
+		}()
+	}
+}
+
+// reflectTCP reads the frames sent on conn, accepted on l, and writes the reply to each back down it, until ctx is
+// done or the sender closes it. Each frame is one ModeLegacy packet. There's no IP header to read the TTL from, so
+// it is reflected as 0.
+func (c *StampReflector) reflectTCP(ctx context.Context, l *listener, conn net.Conn) {
+	defer conn.Close()
+	src := conn.RemoteAddr()
+	slog.Info("accepted connection", "from", src, "listener", l.addr)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	key := sourceKey{listener: l.addr, addr: src.String()}
+	r := bufio.NewReader(conn)
+	buf := make([]byte, wire.MaxFrameLen)
+	out := make([]byte, wire.MaxFrameLen)   // big enough for any padded reply
+	rng := rand.New(rand.NewSource(c.seed)) // each connection drops the same of its replies for the same seed
+	for {
+		packet, err := wire.ReadFrame(r, buf)
+		received := c.stampNow()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				slog.Warn("read error", "from", src, "listener", l.addr, "err", err)
+			}
+			slog.Info("connection closed", "from", src, "listener", l.addr)
+			return
+		}
+		count, ok := c.admit(packet, key, src, 0)
+		if !ok {
+			continue
+		}
+		slog.Debug("received", "from", src, "listener", l.addr, "count", count)
+		reply := c.legacyReply(out, packet, key, count, 0, received.UnixNano())
+		if c.dropReply(rng) {
+			slog.Debug("dropped reply on purpose", "to", src, "listener", l.addr, "count", count)
+			continue
+		}
+		c.stamp(reply)
+		err = wire.WriteFrame(conn, reply)
+		if err != nil {
+			c.sendErrors.Add(1)
+			slog.Warn("write error", "to", src, "listener", l.addr, "err", err)
+			return
+		}
+	}
+}
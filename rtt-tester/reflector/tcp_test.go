@@ -0,0 +1,104 @@
+package reflector
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"stamp/wire"
+)
+
+func TestReflectTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := Listen(ctx, Config{ListenAddr: "127.0.0.1:0", TCP: true, Secret: []byte("s")})
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = r.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	conn, err := net.DialTimeout("tcp4", r.Addrs()[0], time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// an unauthenticated packet is dropped without a reply, and the connection kept
+	err = wire.WriteFrame(conn, make([]byte, 16+wire.MACLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, 100)
+	for seq := uint32(7); seq < 9; seq++ {
+		binary.BigEndian.PutUint32(packet, seq)
+		binary.BigEndian.PutUint64(packet[4:], 1234)
+		copy(packet[16:], wire.MAC([]byte("s"), packet))
+		err = wire.WriteFrame(conn, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, wire.MaxFrameLen)
+	for seq := uint32(7); seq < 9; seq++ {
+		reply, err := wire.ReadFrame(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply) != legacyReplyLen {
+			t.Fatalf("reply of %d bytes, want %d", len(reply), legacyReplyLen)
+		}
+		if got := binary.BigEndian.Uint32(reply[20:]); got != seq {
+			t.Errorf("reflected sender sequence number %d, want %d", got, seq)
+		}
+		if got := binary.BigEndian.Uint64(reply[24:]); got != 1234 {
+			t.Errorf("reflected sender timestamp %d, want 1234", got)
+		}
+		if got := binary.BigEndian.Uint32(reply[36:]); got != 100 {
+			t.Errorf("reflected sender packet size %d, want 100", got)
+		}
+		if reply[40] != 0 {
+			t.Errorf("TTL %d, want 0 over TCP", reply[40])
+		}
+		if binary.BigEndian.Uint64(reply[4:]) == 0 {
+			t.Error("reply timestamp not stamped")
+		}
+	}
+}
+
+func TestTCPNeedsLegacyMode(t *testing.T) {
+	_, err := newReflector(context.Background(), Config{ListenAddr: "127.0.0.1:0", TCP: true, Mode: wire.ModeSTAMP})
+	if err == nil {
+		t.Error("TCP accepted in STAMP mode")
+	}
+}
@@ -0,0 +1,100 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLossAbort is returned by Run, wrapped, when it stopped early because the loss stayed over Config.AbortLoss
+var ErrLossAbort = errors.New("aborted on loss")
+
+const (
+	// DefaultAbortWindow is the default Config.AbortWindow
+	DefaultAbortWindow = 10 * time.Second
+	// lossSampleInterval is the least time between the samples of a lossWatch, which bounds how many a window
+	// holds when windows are sent back-to-back
+	lossSampleInterval = 100 * time.Millisecond
+)
+
+// lossSample is how many packets had been sent and reflected, after the warmup, at a point in the run
+type lossSample struct {
+	at       int64 // nanoseconds since the epoch
+	sent     int64
+	received int64
+}
+
+// lossWatch keeps the loss over the last window of the run, measured from the packets sent and the reflections
+// received rather than from the reports, as a dead path reports no drops until something gets through. It is
+// sampled by the sender and counted into by the receiver.
+type lossWatch struct {
+	limit    float64 // percent
+	window   time.Duration
+	received atomic.Int64 // reflections of packets sent after the warmup, less duplicates
+	samples  []lossSample // oldest first, from the last at or before a window ago
+	aborted  chan error
+}
+
+func newLossWatch(limit float64, window time.Duration) *lossWatch {
+	return &lossWatch{limit: limit, window: window, aborted: make(chan error, 1)}
+}
+
+// sample records that sent packets had been sent by now, and returns the percentage of those sent over the last
+// window that were lost, and whether it is over the limit. Nothing is over it until a whole window has been seen.
+// Packets still in flight count as lost until they return, which evens out across a window. A sample less than
+// lossSampleInterval after the last is skipped.
+func (w *lossWatch) sample(now int64, sent int64) (float64, bool) {
+	if n := len(w.samples); n > 0 && now-w.samples[n-1].at < lossSampleInterval.Nanoseconds() {
+		return 0, false
+	}
+	w.samples = append(w.samples, lossSample{at: now, sent: sent, received: w.received.Load()})
+	from := now - w.window.Nanoseconds()
+	for len(w.samples) > 1 && w.samples[1].at <= from {
+		w.samples = w.samples[1:]
+	}
+	first, last := w.samples[0], w.samples[len(w.samples)-1]
+	if first.at > from || last.sent == first.sent {
+		return 0, false
+	}
+	sent -= first.sent
+	lost := max(sent-(last.received-first.received), 0)
+	loss := 100 * float64(lost) / float64(sent)
+	return loss, loss > w.limit
+}
+
+// checkLoss samples the loss after the warmup, and once it is over the limit says why on aborted and returns
+// true
+func (c *StampClient) checkLoss(now int64) bool {
+	if c.lossWatch == nil || now < c.warmupUntil {
+		return false
+	}
+	loss, over := c.lossWatch.sample(now, int64(c.nextSendSeqNo-c.warmupSent))
+	if !over {
+		return false
+	}
+	c.lossWatch.aborted <- fmt.Errorf("%w: %.1f%% of the packets sent in the last %s were lost, over the limit of %g%%",
+		ErrLossAbort, loss, c.lossWatch.window, c.lossWatch.limit)
+	return true
+}
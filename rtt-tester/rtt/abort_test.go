@@ -0,0 +1,76 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLossWatch(t *testing.T) {
+	w := newLossWatch(50, time.Second)
+	tests := []struct {
+		at       time.Duration
+		sent     int64
+		received int64 // since the last sample
+		loss     float64
+		over     bool
+	}{
+		{0, 0, 0, 0, false},
+		{500 * time.Millisecond, 50, 50, 0, false}, // not a whole window yet
+		{time.Second, 100, 50, 0, false},
+		{1500 * time.Millisecond, 150, 10, 40, false}, // 60 of the 100 sent since 500ms back
+		{2 * time.Second, 200, 0, 90, true},
+		{2050 * time.Millisecond, 205, 0, 0, false}, // too soon after the last to be sampled
+		{2500 * time.Millisecond, 250, 90, 10, false},
+		{3 * time.Second, 300, 50, 0, false}, // more came back than were sent, those in flight at the start
+	}
+	for _, tt := range tests {
+		w.received.Add(tt.received)
+		loss, over := w.sample(tt.at.Nanoseconds(), tt.sent)
+		if loss != tt.loss || over != tt.over {
+			t.Errorf("%s: got %g%% lost, over %t, want %g%%, %t", tt.at, loss, over, tt.loss, tt.over)
+		}
+	}
+}
+
+func TestCheckLossAborts(t *testing.T) {
+	c := &StampClient{lossWatch: newLossWatch(90, time.Second), warmupUntil: time.Second.Nanoseconds()}
+	for now := int64(0); now <= 3*time.Second.Nanoseconds(); now += 100 * time.Millisecond.Nanoseconds() {
+		c.nextSendSeqNo += 10 // none of them reflected
+		if now < time.Second.Nanoseconds() {
+			c.warmupSent += 10
+		}
+		if c.checkLoss(now) {
+			if now < 2*time.Second.Nanoseconds() {
+				t.Errorf("aborted %s in, before a window after the warmup", time.Duration(now))
+			}
+			err := <-c.lossWatch.aborted
+			if !errors.Is(err, ErrLossAbort) {
+				t.Errorf("got %v, want ErrLossAbort", err)
+			}
+			return
+		}
+	}
+	t.Error("a run with nothing reflected wasn't aborted")
+}
@@ -0,0 +1,148 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import "fmt"
+
+// Encoding selects how reports are encoded for a unix:// output
+type Encoding int
+
+const (
+	EncodingJSON Encoding = iota // a JSON object per line
+	EncodingCBOR                 // a CBOR map per report, as a CBOR sequence (RFC 8742)
+)
+
+func (e Encoding) String() string {
+	if e == EncodingCBOR {
+		return "cbor"
+	}
+	return "json"
+}
+
+// ParseEncoding returns the Encoding named by s
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "json":
+		return EncodingJSON, nil
+	case "cbor":
+		return EncodingCBOR, nil
+	}
+	return EncodingJSON, fmt.Errorf("unknown encoding %q: expected json or cbor", s)
+}
+
+// CBOR major types (RFC 8949 section 3.1)
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborText   = 3
+	cborMap    = 5
+	cborFalse  = 0xf4
+	cborTrue   = 0xf5
+)
+
+// reportFields is the number of entries in the CBOR map of a report without labels
+const reportFields = 32
+
+// appendCBOR appends r to b as a CBOR map with the same keys and values as its JSON form: text keys, integer and
+// boolean values, loss_direction, reordered and reflector as text, and labels, if there are any, as a map of text
+func appendCBOR(b []byte, r Report) []byte {
+	fields := reportFields
+	if len(r.Labels) > 0 {
+		fields++
+	}
+	b = cborHead(b, cborMap, uint64(fields))
+	b = cborInt(cborString(b, "sequence_number"), int64(r.SequenceNumber))
+	b = cborBool(cborString(b, "dropped"), r.Dropped)
+	b = cborBool(cborString(b, "duplicate"), r.Duplicate)
+	b = cborInt(cborString(b, "window_size"), int64(r.WindowSize))
+	b = cborInt(cborString(b, "packet_length"), int64(r.PacketLength))
+	b = cborInt(cborString(b, "rtt"), r.MeasuredRTT)
+	b = cborInt(cborString(b, "turnaround"), r.Turnaround)
+	b = cborInt(cborString(b, "network_rtt"), r.NetworkRTT)
+	b = cborInt(cborString(b, "delta_ttl"), r.TTL)
+	b = cborInt(cborString(b, "owd_forward"), r.ForwardOWD)
+	b = cborInt(cborString(b, "owd_reverse"), r.ReverseOWD)
+	b = cborString(cborString(b, "loss_direction"), r.Direction.String())
+	b = cborInt(cborString(b, "timestamp"), r.Timestamp)
+	b = cborBool(cborString(b, "route_changed"), r.RouteChanged)
+	b = cborInt(cborString(b, "src_port"), int64(r.SourcePort))
+	b = cborBool(cborString(b, "warmup"), r.Warmup)
+	b = cborInt(cborString(b, "offered_bps"), r.OfferedBitrate)
+	b = cborInt(cborString(b, "reflector_seq"), int64(r.ReflectorSeq))
+	b = cborString(cborString(b, "reordered"), r.Reordered.String())
+	b = cborString(cborString(b, "reflector"), r.Reflector)
+	b = cborInt(cborString(b, "burst"), int64(r.Burst))
+	b = cborInt(cborString(b, "burst_pos"), int64(r.BurstPos))
+	b = cborBool(cborString(b, "ascending"), r.Ascending)
+	b = cborString(cborString(b, "reply_src"), r.ReplySource)
+	b = cborBool(cborString(b, "corrupted"), r.Corrupted)
+	b = cborInt(cborString(b, "reply_length"), int64(r.ReplyLength))
+	b = cborString(cborString(b, "target"), r.Target)
+	b = cborInt(cborString(b, "clock_offset"), r.ClockOffset)
+	b = cborInt(cborString(b, "owd_forward_corrected"), r.CorrectedForwardOWD)
+	b = cborInt(cborString(b, "owd_reverse_corrected"), r.CorrectedReverseOWD)
+	b = cborInt(cborString(b, "delta_ttl_reverse"), r.ReverseTTL)
+	b = cborBool(cborString(b, "fragmented"), r.Fragmented)
+	if len(r.Labels) > 0 {
+		b = cborHead(cborString(b, "labels"), cborMap, uint64(len(r.Labels)))
+		for _, l := range r.Labels {
+			b = cborString(cborString(b, l.Key), l.Value)
+		}
+	}
+	return b
+}
+
+// cborHead appends the head of a data item of major type major with argument n, in the shortest form
+func cborHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= 0xff:
+		return append(b, major|24, byte(n))
+	case n <= 0xffff:
+		return append(b, major|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(b, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, major|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32), byte(n>>24), byte(n>>16),
+		byte(n>>8), byte(n))
+}
+
+// cborString appends s as a text string
+func cborString(b []byte, s string) []byte {
+	return append(cborHead(b, cborText, uint64(len(s))), s...)
+}
+
+func cborInt(b []byte, v int64) []byte {
+	if v < 0 {
+		return cborHead(b, cborNegInt, uint64(-1-v))
+	}
+	return cborHead(b, cborUint, uint64(v))
+}
+
+func cborBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, cborTrue)
+	}
+	return append(b, cborFalse)
+}
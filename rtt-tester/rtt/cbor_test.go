@@ -0,0 +1,133 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCBORHead(t *testing.T) {
+	for _, c := range []struct {
+		v    int64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{23, []byte{0x17}},
+		{24, []byte{0x18, 0x18}},
+		{1000, []byte{0x19, 0x03, 0xe8}},
+		{1000000, []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{1666706602500000000, []byte{0x1b, 0x17, 0x21, 0x54, 0xd3, 0x0a, 0xcf, 0x89, 0x00}},
+		{-1, []byte{0x20}},
+		{-25, []byte{0x38, 0x18}},
+		{math.MinInt64, []byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		got := cborInt(nil, c.v)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%d encoded as % x, want % x", c.v, got, c.want)
+		}
+	}
+}
+
+func TestCBORMatchesJSON(t *testing.T) {
+	r := Report{SequenceNumber: 42, Dropped: true, WindowSize: 100, PacketLength: 200, MeasuredRTT: 1032000, TTL: -3,
+		ForwardOWD: -20, Direction: LossReverse, Timestamp: 1666706602500000000, SourcePort: 9998, OfferedBitrate: 1822400}
+	labeled := r
+	labeled.Labels = Labels{{"isp", "comcast"}, {"site", "nyc"}}
+	for _, r := range []Report{r, labeled} {
+		b := appendCBOR(nil, r)
+		got, rest, err := decodeCBOR(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rest) != 0 {
+			t.Errorf("%d bytes left over", len(rest))
+		}
+		j, _ := json.Marshal(r)
+		var want map[string]any
+		dec := json.NewDecoder(bytes.NewReader(j))
+		dec.UseNumber()
+		_ = dec.Decode(&want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("CBOR decodes to\n%v\nwant the JSON\n%v", got, want)
+		}
+	}
+}
+
+// decodeCBOR decodes the data item at the start of b, as far as appendCBOR encodes them, with integers as
+// json.Number so that they print as the JSON decoder's do
+func decodeCBOR(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	switch b[0] {
+	case cborFalse:
+		return false, b[1:], nil
+	case cborTrue:
+		return true, b[1:], nil
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	n := uint64(info)
+	if info >= 24 {
+		size := 1 << (info - 24)
+		if info > 27 || len(b) < size {
+			return nil, nil, fmt.Errorf("bad head %#x", info)
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[size:]
+	}
+	switch major {
+	case cborUint:
+		return json.Number(fmt.Sprint(n)), b, nil
+	case cborNegInt:
+		return json.Number(fmt.Sprint(-1 - int64(n))), b, nil
+	case cborText:
+		if uint64(len(b)) < n {
+			return nil, nil, fmt.Errorf("unexpected end of text")
+		}
+		return string(b[:n]), b[n:], nil
+	case cborMap:
+		m := make(map[string]any)
+		for i := uint64(0); i < n; i++ {
+			var k, v any
+			var err error
+			k, b, err = decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, b, err = decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k.(string)] = v
+		}
+		return m, b, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected major type %d", major)
+}
@@ -0,0 +1,263 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"time"
+
+	"stamp/wire"
+)
+
+const (
+	conformanceTimeout = time.Second // how long to wait for each conformance probe to be reflected
+	// conformanceSeq is the sequence number of the first conformance probe, with a different value in each byte
+	// so that a reflector that gets the byte order wrong is caught
+	conformanceSeq = 0x01020304
+	// conformanceTime is the send timestamp of the first conformance probe, in nanoseconds since the epoch,
+	// 2023-11-14 22:13:20.123456789 UTC. Each probe after it is a millisecond later.
+	conformanceTime = 1700000000123456789
+	// conformanceWindow is the window size sent with the first conformance probe, counting up by 1 after it
+	conformanceWindow = 0x0a0b0c01
+)
+
+// conformanceLens are the lengths of the conformance probes, one each, in order. The shortest is that of a STAMP
+// packet, which is longer than a legacy header and MAC; those longer than Config.MaxPacketLen are left out.
+var conformanceLens = []int{wire.STAMPPacketLen, 64, 100, 512, 1000, 1472}
+
+// ConformanceCheck is one behaviour a reflector is checked for by Conformance
+type ConformanceCheck struct {
+	Name   string `json:"name"`
+	Pass   bool   `json:"pass"`
+	Detail string `json:"detail,omitempty"` // how the reflector first failed the check
+}
+
+// ConformanceReport is the outcome of Conformance, with the checks in the order they were first made
+type ConformanceReport struct {
+	Reflector string             `json:"reflector"`
+	Mode      string             `json:"mode"`
+	Pass      bool               `json:"pass"` // every check passed
+	Checks    []ConformanceCheck `json:"checks"`
+}
+
+// check records the outcome of check name for one probe, keeping the detail of the first failure
+func (r *ConformanceReport) check(name string, ok bool, format string, args ...any) {
+	i := 0
+	for i < len(r.Checks) && r.Checks[i].Name != name {
+		i++
+	}
+	if i == len(r.Checks) {
+		r.Checks = append(r.Checks, ConformanceCheck{Name: name, Pass: true})
+	}
+	if !ok && r.Checks[i].Pass {
+		r.Checks[i].Pass = false
+		r.Checks[i].Detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// conformanceProbe is what a conformance probe was sent with
+type conformanceProbe struct {
+	seq    uint32
+	header []byte // the bytes of the header the reflector echoes, as sent
+	len    int
+	crc    uint32 // of the packet after the header, as Config.VerifyPayload checks
+}
+
+// Conformance checks that the reflector reflects a fixed sequence of probes as this sender expects, for testing
+// reflectors from elsewhere. The probes have known sequence numbers, timestamps, window sizes and lengths, and an
+// incrementing fill, and are sent one at a time. Each reflection is compared byte for byte with the fields of the
+// probe it echoes, as laid out by parseLegacy and parseSTAMP for the mode, and checked for what the reflector adds:
+// its timestamps, sequence number, the TTL it read, and in legacy mode the previous sequence number and any
+// payload CRC. Nothing is written to the database.
+func Conformance(ctx context.Context, cfg Config) (ConformanceReport, error) {
+	cfg.Fill = FillIncrementing
+	err := cfg.validate()
+	if err != nil {
+		return ConformanceReport{}, err
+	}
+	if cfg.Transport == TransportTCP || cfg.Proxy != "" || cfg.RecvPort != 0 {
+		return ConformanceReport{}, fmt.Errorf("conformance is tested over plain UDP, not TCP, a proxy or a receive port")
+	}
+	cfg.SrcPorts = PortRange{}
+	c, err := newClient(ctx, cfg)
+	if err != nil {
+		return ConformanceReport{}, err
+	}
+	defer c.close()
+	if c.multicast {
+		return ConformanceReport{}, fmt.Errorf("conformance is tested against one reflector, not a multicast group")
+	}
+	s := c.streams[0]
+	report := ConformanceReport{Reflector: c.reflectorAddr.String(), Mode: c.mode.String(), Pass: true}
+	slog.Info("testing conformance", "reflector", report.Reflector, "mode", report.Mode)
+	buf := make([]byte, c.replyBufLen())
+	var prev *conformanceProbe
+	var lastReflectorSeq uint32
+	for i, n := range conformanceLens {
+		if n > len(c.packet) {
+			continue
+		}
+		p := conformanceProbe{seq: conformanceSeq + uint32(i), len: n}
+		c.windowSize.current = conformanceWindow + i
+		c.putPacket(p.seq, conformanceTime+int64(i)*int64(time.Millisecond), n)
+		p.header = append([]byte(nil), c.packet[:16]...)
+		p.crc = crc32.ChecksumIEEE(c.packet[HeaderLen:n])
+		err := wire.WriteTo(s.conn, c.packet[:n], c.sendCM, c.reflectorAddr, c.sendRetries)
+		if err != nil {
+			return report, fmt.Errorf("error sending probe: %w", err)
+		}
+		reply, err := c.awaitConformance(ctx, s, buf, p.seq)
+		if err != nil {
+			return report, err
+		}
+		report.check("answered", reply != nil, "probe %d of %d bytes was not reflected within %s", p.seq, n,
+			conformanceTimeout)
+		if reply == nil {
+			continue
+		}
+		var reflectorSeq uint32
+		if c.mode == wire.ModeSTAMP {
+			reflectorSeq = c.checkSTAMPReflection(&report, p, reply)
+		} else {
+			reflectorSeq = c.checkLegacyReflection(&report, p, prev, reply)
+		}
+		if prev != nil {
+			report.check("reflector_seq", reflectorSeq > lastReflectorSeq,
+				"probe %d: reflector sequence number %d doesn't follow %d", p.seq, reflectorSeq, lastReflectorSeq)
+		}
+		prev, lastReflectorSeq = &p, reflectorSeq
+	}
+	for _, check := range report.Checks {
+		report.Pass = report.Pass && check.Pass
+	}
+	return report, nil
+}
+
+// awaitConformance reads s until the reflection of probe seq arrives from the reflector, returning it, or nil if it
+// doesn't within conformanceTimeout. Anything else read meanwhile, such as a late reflection, is skipped.
+func (c *StampClient) awaitConformance(ctx context.Context, s *stream, buf []byte, seq uint32) ([]byte, error) {
+	err := s.conn.SetReadDeadline(time.Now().Add(conformanceTimeout))
+	if err != nil {
+		return nil, err
+	}
+	seqIdx := 20 // of the sender sequence number echoed in a legacy reflection
+	if c.mode == wire.ModeSTAMP {
+		seqIdx = wire.STAMPSenderSeqIdx
+	}
+	for {
+		n, _, src, err := s.conn.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil
+		}
+		if err != nil {
+			slog.Warn("read error", "err", err)
+			continue
+		}
+		if !c.fromReflector(src) || n < seqIdx+4 || binary.BigEndian.Uint32(buf[seqIdx:]) != seq {
+			continue
+		}
+		return append([]byte(nil), buf[:n]...), nil
+	}
+}
+
+// checkLegacyReflection checks the legacy reflection b of probe p, sent after prev (nil for the first), returning
+// the reflector's sequence number
+func (c *StampClient) checkLegacyReflection(report *ConformanceReport, p conformanceProbe, prev *conformanceProbe, b []byte) uint32 {
+	report.check("reply_length", len(b) >= ReflectorPacketLen, "probe %d: reflection of %d bytes, want at least %d",
+		p.seq, len(b), ReflectorPacketLen)
+	if len(b) < ReflectorPacketLen {
+		return 0
+	}
+	report.check("format_version", b[reflectorFormatIdx] == ReflectorFormat, "probe %d: format version %d, want %d",
+		p.seq, b[reflectorFormatIdx], ReflectorFormat)
+	report.check("sender_seq", bytes.Equal(b[20:24], p.header[0:4]), "probe %d: echoed sequence number % x, want % x",
+		p.seq, b[20:24], p.header[0:4])
+	report.check("sender_timestamp", bytes.Equal(b[24:32], p.header[4:12]),
+		"probe %d: echoed timestamp % x, want % x", p.seq, b[24:32], p.header[4:12])
+	report.check("window_size", bytes.Equal(b[32:36], p.header[12:16]), "probe %d: echoed window size % x, want % x",
+		p.seq, b[32:36], p.header[12:16])
+	length := binary.BigEndian.Uint32(b[36:])
+	report.check("packet_length", length == uint32(p.len), "probe %d: packet length %d, want %d", p.seq, length, p.len)
+	report.check("ttl", b[40] > 0 && int(b[40]) <= c.ttl, "probe %d: TTL %d, want from 1 to the %d sent", p.seq,
+		b[40], c.ttl)
+	tx := c.tsFormat.Decode(binary.BigEndian.Uint64(b[4:]))
+	rx := c.tsFormat.Decode(binary.BigEndian.Uint64(b[12:]))
+	report.check("timestamps", rx > 0 && tx >= rx, "probe %d: receive timestamp %d and transmit timestamp %d, want "+
+		"a receive time no later than the transmit time", p.seq, rx, tx)
+	flags := b[reflectorFormatIdx-1]
+	if prev != nil {
+		prevSeq := binary.BigEndian.Uint32(b[44:])
+		report.check("prev_seq", flags&FlagPrevSeqValid != 0 && prevSeq == prev.seq,
+			"probe %d: previous sequence number %d (valid %v), want %d", p.seq, prevSeq, flags&FlagPrevSeqValid != 0,
+			prev.seq)
+	}
+	if flags&FlagPayloadCRC != 0 {
+		ok := len(b) >= ReflectorPacketLen+crc32.Size
+		crc := uint32(0)
+		if ok {
+			crc = binary.BigEndian.Uint32(b[ReflectorPacketLen:])
+		}
+		report.check("payload_crc", ok && crc == p.crc, "probe %d: payload CRC %08x, want %08x", p.seq, crc, p.crc)
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// checkSTAMPReflection checks the RFC 8762 reflection b of probe p, returning the reflector's sequence number
+func (c *StampClient) checkSTAMPReflection(report *ConformanceReport, p conformanceProbe, b []byte) uint32 {
+	// RFC 8762 section 4.3 has the reflector packet as long as the sender's, so that the load is symmetric
+	report.check("reply_length", len(b) == p.len, "probe %d: reflection of %d bytes, want %d", p.seq, len(b), p.len)
+	if len(b) < wire.TWAMPReflectorLen {
+		return 0
+	}
+	report.check("sender_seq", bytes.Equal(b[wire.STAMPSenderSeqIdx:wire.STAMPSenderSeqIdx+4], p.header[0:4]),
+		"probe %d: echoed sequence number % x, want % x", p.seq, b[wire.STAMPSenderSeqIdx:wire.STAMPSenderSeqIdx+4],
+		p.header[0:4])
+	report.check("sender_timestamp", bytes.Equal(b[wire.STAMPSenderTimestampIdx:wire.STAMPSenderErrorIdx], p.header[4:12]),
+		"probe %d: echoed timestamp % x, want % x", p.seq, b[wire.STAMPSenderTimestampIdx:wire.STAMPSenderErrorIdx],
+		p.header[4:12])
+	report.check("sender_error_estimate", bytes.Equal(b[wire.STAMPSenderErrorIdx:wire.STAMPSenderErrorIdx+2], p.header[12:14]),
+		"probe %d: echoed error estimate % x, want % x", p.seq, b[wire.STAMPSenderErrorIdx:wire.STAMPSenderErrorIdx+2],
+		p.header[12:14])
+	report.check("ssid", bytes.Equal(b[wire.STAMPSSIDIdx:wire.STAMPReceiveTimestampIdx], p.header[14:16]),
+		"probe %d: SSID % x, want the % x sent", p.seq, b[wire.STAMPSSIDIdx:wire.STAMPReceiveTimestampIdx],
+		p.header[14:16])
+	// RFC 4656 section 4.1.2: the multiplier of an error estimate must not be 0
+	report.check("error_estimate", b[wire.STAMPErrorEstimateIdx+1] != 0,
+		"probe %d: error estimate % x has a multiplier of 0", p.seq, b[wire.STAMPErrorEstimateIdx:wire.STAMPSSIDIdx])
+	ttl := b[wire.STAMPSenderTTLIdx]
+	report.check("ttl", ttl > 0 && int(ttl) <= c.ttl, "probe %d: TTL %d, want from 1 to the %d sent", p.seq, ttl, c.ttl)
+	tx := wire.NTP(b[wire.STAMPTimestampIdx:])
+	rx := wire.NTP(b[wire.STAMPReceiveTimestampIdx:])
+	report.check("timestamps", rx > 0 && tx >= rx, "probe %d: receive timestamp %d and transmit timestamp %d, want "+
+		"a receive time no later than the transmit time", p.seq, rx, tx)
+	return binary.BigEndian.Uint32(b[wire.STAMPSeqIdx:])
+}
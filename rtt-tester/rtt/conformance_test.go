@@ -0,0 +1,152 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"net"
+	"testing"
+
+	"stamp/reflector"
+	"stamp/wire"
+)
+
+func TestConformance(t *testing.T) {
+	for _, mode := range []wire.Mode{wire.ModeLegacy, wire.ModeSTAMP} {
+		rcfg := reflector.Config{Mode: mode, PayloadCRC: mode == wire.ModeLegacy}
+		report, err := Conformance(context.Background(), Config{
+			ReflectorAddr: startReflector(t, rcfg),
+			ListenAddr:    "127.0.0.1:0",
+			WindowSize:    NewVarParam(1, 1),
+			PacketLen:     NewVarParam(100, 100),
+			Mode:          mode,
+			DBPath:        "unused",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Pass {
+			t.Errorf("%s: this project's reflector failed: %+v", mode, report.Checks)
+		}
+		names := map[string]bool{}
+		for _, check := range report.Checks {
+			names[check.Name] = true
+		}
+		want := []string{"answered", "reply_length", "sender_seq", "sender_timestamp", "ttl", "timestamps", "reflector_seq"}
+		if mode == wire.ModeLegacy {
+			want = append(want, "format_version", "window_size", "packet_length", "prev_seq", "payload_crc")
+		} else {
+			want = append(want, "sender_error_estimate", "ssid", "error_estimate")
+		}
+		for _, name := range want {
+			if !names[name] {
+				t.Errorf("%s: no %s check in %+v", mode, name, report.Checks)
+			}
+		}
+	}
+}
+
+// manglingProxy relays packets between the sender and the reflector at reflectorAddr, passing each reply through
+// mangle on the way back. It returns the address to send to.
+func manglingProxy(t *testing.T, reflectorAddr string, mangle func([]byte)) string {
+	reflector, err := net.ResolveUDPAddr("udp4", reflectorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		var sender *net.UDPAddr
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if src.Port == reflector.Port && src.IP.Equal(reflector.IP) {
+				if sender != nil {
+					mangle(buf[:n])
+					_, _ = conn.WriteToUDP(buf[:n], sender)
+				}
+				continue
+			}
+			sender = src
+			_, _ = conn.WriteToUDP(buf[:n], reflector)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// TestConformanceFails checks that a reflector that gets a field wrong fails only the check of that field
+func TestConformanceFails(t *testing.T) {
+	addr := manglingProxy(t, startReflector(t, reflector.Config{}), func(b []byte) {
+		b[31] ^= 0xff // the last byte of the echoed timestamp
+		b[41] = 0     // flags, without the previous sequence number valid
+	})
+	report, err := Conformance(context.Background(), Config{
+		ReflectorAddr: addr,
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		DBPath:        "unused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pass {
+		t.Error("a mangled reflection passed")
+	}
+	for _, check := range report.Checks {
+		wantPass := check.Name != "sender_timestamp" && check.Name != "prev_seq"
+		if check.Pass != wantPass {
+			t.Errorf("%s passed %v, want %v: %s", check.Name, check.Pass, wantPass, check.Detail)
+		}
+		if !check.Pass && check.Detail == "" {
+			t.Errorf("%s failed with no detail", check.Name)
+		}
+	}
+}
+
+func TestConformanceUnanswered(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	report, err := Conformance(context.Background(), Config{
+		ReflectorAddr: conn.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(48, 48),
+		MaxPacketLen:  64, // two probes, to keep the test short
+		DBPath:        "unused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pass || len(report.Checks) != 1 || report.Checks[0].Name != "answered" {
+		t.Errorf("checks %+v, want only answered, failed", report.Checks)
+	}
+}
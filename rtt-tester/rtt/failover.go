@@ -0,0 +1,227 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stamp/wire"
+)
+
+// target is one of the addresses the reflector's name resolved to
+type target struct {
+	addr  *net.UDPAddr
+	heard atomic.Int64 // receive time of the last reflection of a packet sent to it, 0 for none
+}
+
+// targets are the addresses the reflector's name resolved to, one of which is probed at a time, see
+// Config.Failover. It is shared by the sender, which fails over, the receiver and the resolver.
+type targets struct {
+	name    string // ReflectorAddr, resolved by resolveReflector
+	mu      sync.Mutex
+	list    []*target
+	current *target
+	since   int64 // when current was first probed, in nanoseconds since the epoch
+}
+
+// isSRV reports whether name is that of an SRV record, such as _stamp._udp.example.com, rather than a host:port
+func isSRV(name string) bool {
+	return strings.HasPrefix(name, "_") && !strings.Contains(name, ":")
+}
+
+// resolveReflector resolves name, a host:port or the name of an SRV record, to every IPv4 address:port of the
+// reflector, in the order DNS gives them, or for an SRV record the order of its targets' priority and weight
+func resolveReflector(ctx context.Context, name string) ([]*net.UDPAddr, error) {
+	hosts := []string{name}
+	if isSRV(name) {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up reflector SRV record: %w", err)
+		}
+		hosts = hosts[:0]
+		for _, srv := range srvs {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	var addrs []*net.UDPAddr
+	for _, hostPort := range hosts {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving reflector address: %w", err)
+		}
+		portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving reflector address: %w", err)
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving reflector address: %w", err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: portNum})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("reflector %s has no IPv4 addresses", name)
+	}
+	return addrs, nil
+}
+
+// newTargets resolves name and starts probing the first of its addresses at now
+func newTargets(ctx context.Context, name string, now int64) (*targets, error) {
+	addrs, err := resolveReflector(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	t := &targets{name: name}
+	t.update(addrs, now)
+	if len(addrs) > 1 {
+		slog.Info("reflector resolved to several addresses", "reflector", name, "addresses", addrs)
+	}
+	return t, nil
+}
+
+// get returns the target being probed
+func (t *targets) get() *target {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// has reports whether addr is one of the targets
+func (t *targets) has(addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tg := range t.list {
+		if tg.addr.Port == addr.Port && tg.addr.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// failover moves on to the next target if the one being probed has reflected nothing for timeout by now, counting
+// from when it was first probed, and returns the target it left, or nil if it stayed
+func (t *targets) failover(now int64, timeout time.Duration) *target {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := max(t.current.heard.Load(), t.since)
+	if len(t.list) < 2 || now-last < timeout.Nanoseconds() {
+		return nil
+	}
+	from := t.current
+	for i, tg := range t.list {
+		if tg == from {
+			t.current = t.list[(i+1)%len(t.list)]
+			break
+		}
+	}
+	t.since = now
+	slog.Warn("reflector has gone silent, failing over to the next address", "from", from.addr, "to", t.current.addr,
+		"silent", time.Duration(now-last))
+	return from
+}
+
+// update replaces the targets with addrs, keeping those that are still there, and the one being probed if it is.
+// If it isn't, the first of addrs is probed from now.
+func (t *targets) update(addrs []*net.UDPAddr, now int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*target, 0, len(addrs))
+	for _, addr := range addrs {
+		tg := &target{addr: addr}
+		for _, old := range t.list {
+			if old.addr.Port == addr.Port && old.addr.IP.Equal(addr.IP) {
+				tg = old
+			}
+		}
+		list = append(list, tg)
+	}
+	if t.current != nil && !slices.Contains(list, t.current) {
+		slog.Warn("reflector address no longer resolved, moving to the first of the new ones", "was", t.current.addr,
+			"to", list[0].addr)
+		t.current = nil
+	}
+	if t.current == nil {
+		t.current, t.since = list[0], now
+	}
+	t.list = list
+}
+
+// pickTarget fails over from a reflector address that has gone silent by now, with Config.Failover, and picks the
+// address the next window is sent to
+func (c *StampClient) pickTarget(now int64) {
+	if c.targets == nil {
+		return
+	}
+	if c.failover > 0 && c.targets.failover(now, c.failover) != nil {
+		c.failovers++
+	}
+	c.sendTo = c.targets.get()
+}
+
+// dest returns the address to send to
+func (c *StampClient) dest() *net.UDPAddr {
+	if c.sendTo != nil {
+		return c.sendTo.addr
+	}
+	return c.reflectorAddr
+}
+
+// targetOf returns the address sent was sent to for its report, empty unless the reflector's addresses are followed
+func targetOf(sent sentPacket) string {
+	if sent.target == nil {
+		return ""
+	}
+	return sent.target.addr.String()
+}
+
+// refresh resolves the name again every interval until ctx is done. A failed lookup is logged and the addresses
+// kept.
+func (t *targets) refresh(ctx context.Context, clock wire.Clock, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		addrs, err := resolveReflector(ctx, t.name)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("error resolving the reflector again, keeping its addresses", "err", err)
+			}
+			continue
+		}
+		t.update(addrs, clock.Now().UnixNano())
+	}
+}
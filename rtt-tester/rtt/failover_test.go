@@ -0,0 +1,95 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolveReflector(t *testing.T) {
+	addrs, err := resolveReflector(context.Background(), "127.0.0.1:9996")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "127.0.0.1:9996" {
+		t.Errorf("resolved to %v", addrs)
+	}
+	_, err = resolveReflector(context.Background(), "127.0.0.1")
+	if err == nil {
+		t.Error("resolved an address without a port")
+	}
+	if !isSRV("_stamp._udp.example.com") || isSRV("example.com:9996") || isSRV("_host:9996") {
+		t.Error("SRV names not told from host:port")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9996}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 9996}
+	ts := &targets{}
+	ts.update([]*net.UDPAddr{a, b}, 0)
+	timeout := time.Second
+	if ts.failover(int64(500*time.Millisecond), timeout) != nil {
+		t.Error("failed over before the timeout")
+	}
+	ts.get().heard.Store(int64(900 * time.Millisecond))
+	if ts.failover(int64(1500*time.Millisecond), timeout) != nil {
+		t.Error("failed over from an address that has answered within the timeout")
+	}
+	if from := ts.failover(int64(2*time.Second), timeout); from == nil || from.addr != a || ts.get().addr != b {
+		t.Fatalf("failed over from %v to %v, want from %s to %s", from, ts.get().addr, a, b)
+	}
+	// b has never answered, so it gets the timeout from when it was first probed before failing back
+	if ts.failover(int64(2500*time.Millisecond), timeout) != nil {
+		t.Error("failed over straight away from an address just switched to")
+	}
+	if ts.failover(int64(3*time.Second), timeout) == nil || ts.get().addr != a {
+		t.Error("didn't fail back to the first address")
+	}
+	if !ts.has(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 9996}) || ts.has(&net.UDPAddr{IP: b.IP, Port: 9997}) {
+		t.Error("addresses not told apart")
+	}
+}
+
+func TestTargetsUpdate(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9996}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 9996}
+	c := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 9996}
+	ts := &targets{}
+	ts.update([]*net.UDPAddr{a, b}, 0)
+	first := ts.get()
+	first.heard.Store(5)
+	ts.update([]*net.UDPAddr{c, {IP: net.IPv4(192, 0, 2, 1), Port: 9996}}, 10)
+	if ts.get() != first || first.heard.Load() != 5 {
+		t.Error("the address being probed wasn't kept when it was resolved again")
+	}
+	ts.update([]*net.UDPAddr{b, c}, 20)
+	if ts.get().addr != b || ts.since != 20 {
+		t.Errorf("probing %s from %d once the address is gone, want %s from 20", ts.get().addr, ts.since, b)
+	}
+	if ts.has(a) {
+		t.Error("an address no longer resolved is still a target")
+	}
+}
@@ -0,0 +1,78 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"log/slog"
+	"net"
+)
+
+// egressMTU returns the name and MTU of the interface packets to dst are sent out of: ifi if it is set, or else the
+// one with the local address the OS would send to dst from. It returns an MTU of 0 if the interface can't be found.
+func egressMTU(ifi *net.Interface, dst *net.UDPAddr) (string, int) {
+	if ifi != nil {
+		return ifi.Name, ifi.MTU
+	}
+	conn, err := net.DialUDP("udp4", nil, dst) // only picks a route, nothing is sent
+	if err != nil {
+		slog.Debug("could not find the interface to the reflector", "err", err)
+		return "", 0
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Debug("could not list the interfaces", "err", err)
+		return "", 0
+	}
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				return ifi.Name, ifi.MTU
+			}
+		}
+	}
+	return "", 0
+}
+
+// longestPacket returns the longest packet cfg sends, or that the windows of replay are sent with
+func (cfg Config) longestPacket(replay []replayWindow) int {
+	longest := max(cfg.PacketLen.start, cfg.PacketLen.end, cfg.SizeDist.Max())
+	for _, w := range replay {
+		longest = max(longest, w.packetLen)
+		for _, n := range w.lengths {
+			longest = max(longest, n)
+		}
+	}
+	return longest
+}
+
+// fragmented reports whether a packet of packetLen is too long for the interface it is sent out of, so that the IP
+// layer sends it in fragments, of which losing any loses the packet. With Config.DF set it fails to send instead.
+// Fragmentation further along the path, by a router with a lower MTU, can't be seen from here.
+func (c *StampClient) fragmented(packetLen int) bool {
+	return !c.df && c.mtu > 0 && packetLen+IPUDPHeaderLen > c.mtu
+}
@@ -0,0 +1,75 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressMTU(t *testing.T) {
+	name, mtu := egressMTU(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9996})
+	if name == "" {
+		t.Skip("no interface has 127.0.0.1")
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifi.Flags&net.FlagLoopback == 0 || mtu != ifi.MTU {
+		t.Errorf("egress %s with MTU %d, want the loopback interface and its MTU %d", name, mtu, ifi.MTU)
+	}
+	chosen := &net.Interface{Name: "eth1", MTU: 1400}
+	if name, mtu := egressMTU(chosen, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9996}); name != "eth1" || mtu != 1400 {
+		t.Errorf("egress %s with MTU %d, want the chosen eth1 with 1400", name, mtu)
+	}
+}
+
+func TestFragmented(t *testing.T) {
+	tests := []struct {
+		mtu       int
+		df        bool
+		packetLen int
+		want      bool
+	}{
+		{1500, false, 1472, false},
+		{1500, false, 1473, true},
+		{1500, true, 1473, false}, // fails to send instead
+		{0, false, 9000, false},   // MTU not known
+	}
+	for _, tt := range tests {
+		c := &StampClient{mtu: tt.mtu, df: tt.df}
+		if got := c.fragmented(tt.packetLen); got != tt.want {
+			t.Errorf("%d bytes with an MTU of %d and DF %v fragmented = %v, want %v", tt.packetLen, tt.mtu, tt.df, got, tt.want)
+		}
+	}
+}
+
+func TestLongestPacket(t *testing.T) {
+	cfg := Config{PacketLen: NewVarParam(1400, 200)}
+	if got := cfg.longestPacket(nil); got != 1400 {
+		t.Errorf("longest packet %d, want 1400", got)
+	}
+	if got := cfg.longestPacket([]replayWindow{{packets: 10, packetLen: 2000}}); got != 2000 {
+		t.Errorf("longest packet of a replay %d, want 2000", got)
+	}
+}
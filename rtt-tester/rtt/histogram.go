@@ -0,0 +1,110 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// logBinsPerDecade is how many logarithmic histogram bins there are from one power of ten to the next
+const logBinsPerDecade = 10
+
+// HistogramBin counts the round-trip times from Low up to but not including High
+type HistogramBin struct {
+	Low   time.Duration `json:"low_ns"`
+	High  time.Duration `json:"high_ns"`
+	Count int           `json:"count"`
+}
+
+// histogram counts round-trip times in bins of width, or in logarithmic bins if width is 0
+type histogram struct {
+	width  time.Duration
+	counts map[int]int // by bin index
+}
+
+func newHistogram(width time.Duration) *histogram {
+	return &histogram{width: width, counts: make(map[int]int)}
+}
+
+func (h *histogram) add(rtt int64) {
+	h.counts[h.index(rtt)]++
+}
+
+// index returns the index of the bin that rtt falls in
+func (h *histogram) index(rtt int64) int {
+	if h.width > 0 {
+		return int(rtt / int64(h.width))
+	}
+	return int(math.Floor(math.Log10(float64(max(rtt, 1))) * logBinsPerDecade))
+}
+
+// bounds returns the range of bin i
+func (h *histogram) bounds(i int) (time.Duration, time.Duration) {
+	if h.width > 0 {
+		return time.Duration(i) * h.width, time.Duration(i+1) * h.width
+	}
+	edge := func(i int) time.Duration {
+		return time.Duration(math.Round(math.Pow(10, float64(i)/logBinsPerDecade)))
+	}
+	return edge(i), edge(i + 1)
+}
+
+// bins returns the bins from the lowest that has a count to the highest, including the empty ones in between so
+// that the shape of the distribution shows, or nil if nothing was counted
+func (h *histogram) bins() []HistogramBin {
+	if len(h.counts) == 0 {
+		return nil
+	}
+	var indexes []int
+	for i := range h.counts {
+		indexes = append(indexes, i)
+	}
+	lo, hi := slices.Min(indexes), slices.Max(indexes)
+	bins := make([]HistogramBin, 0, hi-lo+1)
+	for i := lo; i <= hi; i++ {
+		low, high := h.bounds(i)
+		bins = append(bins, HistogramBin{Low: low, High: high, Count: h.counts[i]})
+	}
+	return bins
+}
+
+// writeHistogram creates the histogram table in db and writes bins to it, a row each
+func writeHistogram(db *sql.DB, bins []HistogramBin) error {
+	sqlStmt := `
+	create table histogram (low integer, high integer, count integer);
+	`
+	_, err := db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+	for _, b := range bins {
+		_, err = db.Exec("insert into histogram values(?, ?, ?)", b.Low.Nanoseconds(), b.High.Nanoseconds(), b.Count)
+		if err != nil {
+			return fmt.Errorf("error writing histogram: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHistogramLinear(t *testing.T) {
+	h := newHistogram(time.Millisecond)
+	for _, rtt := range []time.Duration{1200 * time.Microsecond, 1900 * time.Microsecond, 3 * time.Millisecond, 3999 * time.Microsecond} {
+		h.add(rtt.Nanoseconds())
+	}
+	want := []HistogramBin{
+		{Low: time.Millisecond, High: 2 * time.Millisecond, Count: 2},
+		{Low: 2 * time.Millisecond, High: 3 * time.Millisecond, Count: 0},
+		{Low: 3 * time.Millisecond, High: 4 * time.Millisecond, Count: 2},
+	}
+	if got := h.bins(); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHistogramLogarithmic(t *testing.T) {
+	h := newHistogram(0)
+	if got := h.bins(); got != nil {
+		t.Errorf("empty histogram has bins %v", got)
+	}
+	// two paths, one around 1ms and one around 10ms
+	for _, rtt := range []time.Duration{time.Millisecond, 1100 * time.Microsecond, 10 * time.Millisecond, 11 * time.Millisecond} {
+		h.add(rtt.Nanoseconds())
+	}
+	bins := h.bins()
+	if len(bins) != logBinsPerDecade+1 {
+		t.Fatalf("got %d bins, want a decade of them: %v", len(bins), bins)
+	}
+	if bins[0].Low != time.Millisecond || bins[0].Count != 2 {
+		t.Errorf("first bin is %v, want 2 from 1ms", bins[0])
+	}
+	last := bins[len(bins)-1]
+	if last.Low != 10*time.Millisecond || last.Count != 2 {
+		t.Errorf("last bin is %v, want 2 from 10ms", last)
+	}
+	for i, b := range bins {
+		if i > 0 && b.Low != bins[i-1].High {
+			t.Errorf("bin %d starts at %s, after one ending at %s", i, b.Low, bins[i-1].High)
+		}
+		if i > 0 && i < len(bins)-1 && b.Count != 0 {
+			t.Errorf("bin %v between the two paths isn't empty", b)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	influxBatchLen      = 5000            // most reports written to InfluxDB in one request
+	influxFlushInterval = time.Second     // longest a report waits to be written to InfluxDB
+	influxTimeout       = 5 * time.Second // for each write request
+)
+
+// influxEscaper escapes tag values for line protocol
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLine appends r to b as a line of InfluxDB line protocol, in measurement rtt tagged with the reflector
+// address target, the address of the reflector that answered if target is a multicast group, the run's labels and
+// the window size, timestamped in nanoseconds with the send time. A dropped packet has no window size, rtt or delta_ttl.
+func influxLine(b []byte, r Report, target string) []byte {
+	b = append(b, "rtt,target="...)
+	b = append(b, influxEscaper.Replace(target)...)
+	if r.Reflector != "" {
+		b = append(b, ",reflector="...)
+		b = append(b, influxEscaper.Replace(r.Reflector)...)
+	}
+	for _, l := range r.Labels {
+		b = append(b, ',')
+		b = append(b, influxEscaper.Replace(l.Key)...)
+		b = append(b, '=')
+		b = append(b, influxEscaper.Replace(l.Value)...)
+	}
+	if !r.Dropped {
+		b = append(b, ",window_size="...)
+		b = strconv.AppendInt(b, int64(r.WindowSize), 10)
+	}
+	b = append(b, " sequence_number="...)
+	b = strconv.AppendInt(b, int64(r.SequenceNumber), 10)
+	b = append(b, "i,dropped="...)
+	b = strconv.AppendBool(b, r.Dropped)
+	if !r.Dropped {
+		b = append(b, ",rtt="...)
+		b = strconv.AppendInt(b, r.MeasuredRTT, 10)
+		b = append(b, "i,delta_ttl="...)
+		b = strconv.AppendInt(b, r.TTL, 10)
+		b = append(b, "i,packet_length="...)
+		b = strconv.AppendInt(b, int64(r.PacketLength), 10)
+		b = append(b, 'i')
+		if r.Turnaround > 0 {
+			b = append(b, ",turnaround="...)
+			b = strconv.AppendInt(b, r.Turnaround, 10)
+			b = append(b, "i,network_rtt="...)
+			b = strconv.AppendInt(b, r.NetworkRTT, 10)
+			b = append(b, 'i')
+		}
+	}
+	if r.Duplicate {
+		b = append(b, ",duplicate=true"...)
+	}
+	if r.Fragmented {
+		b = append(b, ",fragmented=true"...)
+	}
+	if r.Burst > 0 {
+		b = append(b, ",burst="...)
+		b = strconv.AppendInt(b, int64(r.Burst), 10)
+		b = append(b, "i,burst_pos="...)
+		b = strconv.AppendInt(b, int64(r.BurstPos), 10)
+		b = append(b, 'i')
+	}
+	if r.Reordered != LossUnknown {
+		b = append(b, ",reordered=\""...)
+		b = append(b, r.Reordered.String()...)
+		b = append(b, '"')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, r.Timestamp, 10)
+	return append(b, '\n')
+}
+
+// influxFileOutput writes reports as line protocol to a file, to be loaded into InfluxDB later
+type influxFileOutput struct {
+	f      *os.File
+	w      *bufio.Writer
+	target string
+	line   []byte
+}
+
+func openInfluxFile(path, target string) (*influxFileOutput, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating output directory: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating line protocol file: %w", err)
+	}
+	return &influxFileOutput{f: f, w: bufio.NewWriter(f), target: target}, nil
+}
+
+func (o *influxFileOutput) write(r Report) error {
+	o.line = influxLine(o.line[:0], r, o.target)
+	_, err := o.w.Write(o.line)
+	return err
+}
+
+func (o *influxFileOutput) close() {
+	err := o.w.Flush()
+	if err != nil {
+		slog.Error("error writing line protocol file", "err", err)
+	}
+	o.f.Close()
+}
+
+// influxHTTPOutput POSTs reports as line protocol to an InfluxDB write endpoint in batches of up to influxBatchLen,
+// or whatever has built up over influxFlushInterval. A batch that can't be written is dropped with a warning, so
+// that a struggling InfluxDB doesn't stop the test.
+type influxHTTPOutput struct {
+	url       string // the write endpoint, with its query naming the database or bucket
+	token     string // API token, empty for none
+	target    string
+	client    *http.Client
+	batch     []byte
+	n         int // reports in batch
+	lastFlush time.Time
+	dropped   int // reports in batches that failed to be written
+}
+
+func newInfluxHTTP(url, token, target string) *influxHTTPOutput {
+	return &influxHTTPOutput{
+		url:       url,
+		token:     token,
+		target:    target,
+		client:    &http.Client{Timeout: influxTimeout},
+		lastFlush: time.Now(),
+	}
+}
+
+func (o *influxHTTPOutput) write(r Report) error {
+	o.batch = influxLine(o.batch, r, o.target)
+	o.n++
+	if o.n >= influxBatchLen || time.Since(o.lastFlush) >= influxFlushInterval {
+		o.flush()
+	}
+	return nil
+}
+
+// flush writes the batch to InfluxDB and starts a new one
+func (o *influxHTTPOutput) flush() {
+	o.lastFlush = time.Now()
+	if o.n == 0 {
+		return
+	}
+	err := o.post()
+	if err != nil {
+		o.dropped += o.n
+		slog.Warn("error writing to InfluxDB, dropping reports", "reports", o.n, "dropped", o.dropped, "err", err)
+	}
+	o.batch = o.batch[:0]
+	o.n = 0
+}
+
+func (o *influxHTTPOutput) post() error {
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(o.batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.token != "" {
+		req.Header.Set("Authorization", "Token "+o.token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (o *influxHTTPOutput) close() {
+	o.flush()
+}
@@ -0,0 +1,85 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxLine(t *testing.T) {
+	received := Report{SequenceNumber: 42, WindowSize: 100, PacketLength: 200, MeasuredRTT: 1032000, TTL: -3,
+		Timestamp: 1666706602500000000}
+	want := "rtt,target=10.0.1.1:9996,window_size=100 sequence_number=42i,dropped=false,rtt=1032000i,delta_ttl=-3i,packet_length=200i 1666706602500000000\n"
+	if got := string(influxLine(nil, received, "10.0.1.1:9996")); got != want {
+		t.Errorf("received line = %q, want %q", got, want)
+	}
+	dropped := Report{SequenceNumber: 43, Dropped: true, Timestamp: 1666706602600000000}
+	want = `rtt,target=edge\ 1\,a sequence_number=43i,dropped=true 1666706602600000000` + "\n"
+	if got := string(influxLine(nil, dropped, "edge 1,a")); got != want {
+		t.Errorf("dropped line = %q, want %q", got, want)
+	}
+	dropped.Labels = Labels{{"isp", "comcast"}, {"site", "new york"}}
+	want = `rtt,target=10.0.1.1:9996,isp=comcast,site=new\ york sequence_number=43i,dropped=true 1666706602600000000` + "\n"
+	if got := string(influxLine(nil, dropped, "10.0.1.1:9996")); got != want {
+		t.Errorf("labeled line = %q, want %q", got, want)
+	}
+	dropped.Labels, dropped.Fragmented = nil, true
+	want = `rtt,target=10.0.1.1:9996 sequence_number=43i,dropped=true,fragmented=true 1666706602600000000` + "\n"
+	if got := string(influxLine(nil, dropped, "10.0.1.1:9996")); got != want {
+		t.Errorf("fragmented line = %q, want %q", got, want)
+	}
+}
+
+func TestInfluxHTTPBatches(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("authorization = %q", r.Header.Get("Authorization"))
+		}
+		b, _ := io.ReadAll(r.Body)
+		requests = append(requests, string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	out, err := openOutput(srv.URL+"/api/v2/write?bucket=rtt", runMeta{Reflector: "r"}, outputOptions{influxToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < influxBatchLen+10; i++ {
+		out.write(Report{SequenceNumber: i, WindowSize: 1})
+	}
+	out.close()
+	if len(requests) != 2 {
+		t.Fatalf("made %d requests, want 2", len(requests))
+	}
+	if n := strings.Count(requests[0], "\n"); n != influxBatchLen {
+		t.Errorf("first batch has %d lines, want %d", n, influxBatchLen)
+	}
+	if n := strings.Count(requests[1], "\n"); n != 10 {
+		t.Errorf("last batch has %d lines, want 10", n)
+	}
+}
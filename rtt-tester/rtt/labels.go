@@ -0,0 +1,96 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Label is a key=value tag of a run, see Config.Labels
+type Label struct {
+	Key   string
+	Value string
+}
+
+// Labels tag a run, such as site=nyc,isp=comcast, so that its results can be told apart from other runs' once
+// they are gathered in one place. They are kept sorted by key, and are encoded in JSON as an object.
+type Labels []Label
+
+// labelTags are the tags every InfluxDB point has, which a label can't be named after
+var labelTags = []string{"target", "reflector", "window_size"}
+
+// ParseLabels parses a comma-separated list of key=value pairs, such as site=nyc,isp=comcast. Keys must be unique,
+// and neither keys nor values can be empty or contain a comma or an equals sign.
+func ParseLabels(s string) (Labels, error) {
+	var labels Labels
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" || value == "" || strings.Contains(value, "=") {
+			return nil, fmt.Errorf("label %q is not key=value", pair)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("label %q is given more than once", key)
+		}
+		for _, tag := range labelTags {
+			if key == tag {
+				return nil, fmt.Errorf("label %q clashes with the InfluxDB tag of that name", key)
+			}
+		}
+		seen[key] = true
+		labels = append(labels, Label{Key: key, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+	return labels, nil
+}
+
+// String returns the labels as ParseLabels takes them, sorted by key
+func (l Labels) String() string {
+	pairs := make([]string, len(l))
+	for i, label := range l {
+		pairs[i] = label.Key + "=" + label.Value
+	}
+	return strings.Join(pairs, ",")
+}
+
+// MarshalJSON encodes the labels as an object of their keys and values
+func (l Labels) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, label := range l {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		key, err := json.Marshal(label.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(label.Value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(append(append(b, key...), ':'), value...)
+	}
+	return append(b, '}'), nil
+}
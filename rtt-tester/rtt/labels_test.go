@@ -0,0 +1,50 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("site=nyc, isp=comcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Labels{{"isp", "comcast"}, {"site", "nyc"}}); !reflect.DeepEqual(labels, want) {
+		t.Errorf("parsed %v, want %v", labels, want)
+	}
+	if s := labels.String(); s != "isp=comcast,site=nyc" {
+		t.Errorf("String() = %q", s)
+	}
+	b, err := json.Marshal(labels)
+	if err != nil || string(b) != `{"isp":"comcast","site":"nyc"}` {
+		t.Errorf("JSON %s (%v)", b, err)
+	}
+	for _, s := range []string{"", "site", "site=", "=nyc", "site=nyc=1", "site=nyc,site=lon", "target=x"} {
+		if _, err := ParseLabels(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"stamp/reflector"
+)
+
+// startReflector starts a reflector with cfg in the process on a loopback port, returning its address. It is
+// stopped when the test ends.
+func startReflector(t *testing.T, cfg reflector.Config) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.ListenAddr = "127.0.0.1:0"
+	r, err := reflector.Listen(ctx, cfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return r.Addrs()[0]
+}
+
+// TestLoopbackRun sends to a reflector in the same process over loopback, as the sender's -loopback does
+func TestLoopbackRun(t *testing.T) {
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(20, 20),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         200,
+		Interval:      10 * time.Millisecond,
+		DBPath:        filepath.Join(t.TempDir(), "rtt.db"),
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 200 || summary.Received < 198 {
+		t.Errorf("%d of %d received, want nearly all of 200", summary.Received, summary.Sent)
+	}
+	if summary.RTT.Mean <= 0 || summary.RTT.Mean > 50*time.Millisecond {
+		t.Errorf("mean RTT %s, want a small positive one", summary.RTT.Mean)
+	}
+}
+
+// TestLoopbackDrain holds every reflection for longer than the old second after the last window, which the run
+// waits out, and ends as soon as they are all in rather than at the end of the drain
+func TestLoopbackDrain(t *testing.T) {
+	hold := 1200 * time.Millisecond
+	start := time.Now()
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{Delay: reflector.Delay{Min: hold, Max: hold}}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(10, 10),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         10,
+		Interval:      10 * time.Millisecond,
+		Drain:         10 * time.Second,
+		NoDB:          true,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 10 || summary.Received != 10 {
+		t.Errorf("%d of %d received, want all of 10", summary.Received, summary.Sent)
+	}
+	if took := time.Since(start); took < hold || took > 5*time.Second {
+		t.Errorf("run took %s, want it to end once the reflections held for %s are in", took, hold)
+	}
+}
+
+// TestLoopbackDropRate checks that the packets dropped on purpose are the ones reported lost, all of them on the
+// way to the reflector, and that the run doesn't wait out the drain for them
+func TestLoopbackDropRate(t *testing.T) {
+	start := time.Now()
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(50, 50),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         1000,
+		Interval:      10 * time.Millisecond,
+		DropRate:      0.2,
+		Drain:         10 * time.Second,
+		NoDB:          true,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Injected < 150 || summary.Injected > 250 {
+		t.Errorf("%d of %d dropped on purpose, want about 200", summary.Injected, summary.Sent)
+	}
+	if summary.Sent != 1000 || summary.Dropped != summary.Injected || summary.ForwardLoss != summary.Injected {
+		t.Errorf("%d sent, %d dropped and %d lost forward, want 1000 sent and the %d dropped on purpose lost forward",
+			summary.Sent, summary.Dropped, summary.ForwardLoss, summary.Injected)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("run took %s, want it not to wait for the packets never sent", took)
+	}
+}
+
+// TestLoopbackDropRateBothWays drops packets on purpose on the way to the reflector and on the way back, and checks
+// that no loss is put down to the wrong direction. A loss followed by one the other way back can't be told apart,
+// so a few are left unknown.
+func TestLoopbackDropRateBothWays(t *testing.T) {
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{DropRate: 0.05}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(50, 50),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         2000,
+		Interval:      10 * time.Millisecond,
+		DropRate:      0.05,
+		Drain:         500 * time.Millisecond,
+		NoDB:          true,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// on loopback, everything the sender didn't drop was dropped by the reflector, about 5% of 1900
+	reverse := summary.Dropped - summary.Injected
+	if reverse < 50 || reverse > 150 {
+		t.Errorf("%d dropped by the reflector, want about 95", reverse)
+	}
+	if summary.ForwardLoss > summary.Injected || summary.ReverseLoss > reverse {
+		t.Errorf("%d lost forward and %d reverse, want no more than the %d and %d dropped each way",
+			summary.ForwardLoss, summary.ReverseLoss, summary.Injected, reverse)
+	}
+	if unknown := summary.Dropped - summary.ForwardLoss - summary.ReverseLoss; unknown > summary.Dropped/5 {
+		t.Errorf("%d of %d lost in an unknown direction, want nearly all told apart", unknown, summary.Dropped)
+	}
+}
+
+// TestRecvPort has the reflector reply to a fixed port, from which the sender reads the reflections of every one
+// of its source ports
+func TestRecvPort(t *testing.T) {
+	port := freePort(t)
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{ReplyPort: port}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(20, 20),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         200,
+		Interval:      10 * time.Millisecond,
+		RecvPort:      port,
+		DBPath:        filepath.Join(t.TempDir(), "rtt.db"),
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 200 || summary.Received < 198 || summary.Dropped > 2 {
+		t.Errorf("%d of %d received and %d dropped, want nearly all received", summary.Received, summary.Sent,
+			summary.Dropped)
+	}
+}
+
+// freePort returns a loopback UDP port that nothing is listening on
+func freePort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestRecvPortWarnsWhenNothingComesBack has the reflector reply to a port other than the sender's receive port, and
+// checks that the sender warns once the first window should have come back, rather than only at the end of the run
+func TestRecvPortWarnsWhenNothingComesBack(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	_, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{ReplyPort: freePort(t)}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         300,
+		Interval:      10 * time.Millisecond,
+		RecvPort:      freePort(t),
+		Drain:         100 * time.Millisecond,
+		NoDB:          true,
+		Quiet:         true,
+	})
+	slog.SetDefault(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "nothing has come back on the receive port yet") {
+		t.Errorf("no warning while the run was going, logged %q", buf.String())
+	}
+}
+
+// TestRecvPortLeavesSendSocketsUnread has the reflector reply to the port each packet came from, and checks that the
+// sender, receiving on a port of its own, never reads the reflections from the sockets it sends on
+func TestRecvPortLeavesSendSocketsUnread(t *testing.T) {
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(5, 5),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         50,
+		Interval:      10 * time.Millisecond,
+		RecvPort:      freePort(t),
+		Drain:         100 * time.Millisecond,
+		NoDB:          true,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 50 || summary.Received != 0 {
+		t.Errorf("%d of %d received, want none read from the send socket", summary.Received, summary.Sent)
+	}
+}
+
+// lossyProxy relays legacy packets between the sender and the reflector at reflectorAddr, dropping the sender
+// packets with a sequence number in forward and the replies to those in reverse. It returns the address to send to.
+func lossyProxy(t *testing.T, reflectorAddr string, forward, reverse map[uint32]bool) string {
+	reflector, err := net.ResolveUDPAddr("udp4", reflectorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		var sender *net.UDPAddr
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if src.Port == reflector.Port && src.IP.Equal(reflector.IP) {
+				if sender != nil && n >= ReflectorPacketLen && !reverse[binary.BigEndian.Uint32(buf[20:])] {
+					_, _ = conn.WriteToUDP(buf[:n], sender)
+				}
+				continue
+			}
+			sender = src
+			if n >= 4 && !forward[binary.BigEndian.Uint32(buf)] {
+				_, _ = conn.WriteToUDP(buf[:n], reflector)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// TestLoopbackLoss checks that exactly the packets lost between the sender and reflector are recorded as dropped,
+// in the right direction
+func TestLoopbackLoss(t *testing.T) {
+	forward := map[uint32]bool{0: true, 7: true, 8: true, 9: true, 50: true}
+	reverse := map[uint32]bool{30: true, 31: true}
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: lossyProxy(t, startReflector(t, reflector.Config{}), forward, reverse),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(10, 10),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         100,
+		Interval:      5 * time.Millisecond,
+		DBPath:        dbPath,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 100 || summary.Dropped != 7 || summary.Received != 93 {
+		t.Errorf("%d sent, %d dropped and %d received, want 100, 7 and 93", summary.Sent, summary.Dropped, summary.Received)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select sequence_number, loss_direction from rtt where rtt is null order by sequence_number")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[int]string{}
+	for rows.Next() {
+		var seq int
+		var direction sql.NullString
+		err = rows.Scan(&seq, &direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[seq] = direction.String
+	}
+	// 31's loss is revealed by 32, whose reflection says the reflector last saw 31, so it can be told was lost on
+	// the way back; 30's can't, as the reflection that would have said so was 31's
+	want := map[int]string{0: "forward", 7: "forward", 8: "forward", 9: "forward", 30: "", 31: "reverse", 50: "forward"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dropped packets %v, want %v", got, want)
+	}
+}
+
+// TestSummarizeDrops checks that drops in a row are recorded as one range, split where the direction changes,
+// and still each counted in the summary
+func TestSummarizeDrops(t *testing.T) {
+	forward := map[uint32]bool{0: true, 7: true, 8: true, 9: true, 50: true}
+	reverse := map[uint32]bool{30: true, 31: true}
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr:  lossyProxy(t, startReflector(t, reflector.Config{}), forward, reverse),
+		ListenAddr:     "127.0.0.1:0",
+		WindowSize:     NewVarParam(10, 10),
+		PacketLen:      NewVarParam(100, 100),
+		Count:          100,
+		Interval:       5 * time.Millisecond,
+		DBPath:         dbPath,
+		SummarizeDrops: true,
+		Quiet:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 100 || summary.Dropped != 7 || summary.ForwardLoss != 5 || summary.ReverseLoss != 1 {
+		t.Errorf("%d sent, %d dropped, %d forward and %d reverse, want 100, 7, 5 and 1", summary.Sent, summary.Dropped,
+			summary.ForwardLoss, summary.ReverseLoss)
+	}
+	if summary.LossPercent() != 7 {
+		t.Errorf("loss %g%%, want 7%%", summary.LossPercent())
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rttDrops int
+	err = db.QueryRow("select count(*) from rtt where rtt is null").Scan(&rttDrops)
+	if err != nil || rttDrops != 0 {
+		t.Errorf("%d dropped packets in the rtt table (%v), want none", rttDrops, err)
+	}
+	rows, err := db.Query("select first_seq, last_seq, count, loss_direction from drops order by first_seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	type dropRange struct {
+		first, last, count int
+		direction          string
+	}
+	var got []dropRange
+	for rows.Next() {
+		var d dropRange
+		var direction sql.NullString
+		err = rows.Scan(&d.first, &d.last, &d.count, &direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.direction = direction.String
+		got = append(got, d)
+	}
+	want := []dropRange{{0, 0, 1, "forward"}, {7, 9, 3, "forward"}, {30, 30, 1, ""}, {31, 31, 1, "reverse"},
+		{50, 50, 1, "forward"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("drop ranges %v, want %v", got, want)
+	}
+}
+
+// TestLoopbackTurnaround checks that the time a slow reflector holds each packet is taken out of the network RTT
+func TestLoopbackTurnaround(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	delay := 20 * time.Millisecond
+	_, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{Delay: reflector.Delay{Min: delay, Max: delay}}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(5, 5),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         20,
+		Interval:      5 * time.Millisecond,
+		DBPath:        dbPath,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	var minRTT, minTurnaround, maxNetworkRTT time.Duration
+	err = db.QueryRow("select count(*), min(rtt), min(turnaround), max(network_rtt) from rtt where network_rtt = rtt - turnaround").
+		Scan(&n, &minRTT, &minTurnaround, &maxNetworkRTT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatalf("%d rows with network_rtt = rtt - turnaround, want 20", n)
+	}
+	if minRTT < delay || minTurnaround < delay || maxNetworkRTT >= delay {
+		t.Errorf("rtt from %s, turnaround from %s and network RTT up to %s, want the %s delay in the first two only",
+			minRTT, minTurnaround, maxNetworkRTT, delay)
+	}
+}
+
+// TestLoopbackReplyTTL checks that the reply's delta TTL is recorded from a reflector that sends with a fixed TTL,
+// which over loopback is 0 as the forward one is
+func TestLoopbackReplyTTL(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	_, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{ReplyTTL: 64}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(5, 5),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         20,
+		Interval:      5 * time.Millisecond,
+		DBPath:        dbPath,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var received, known int
+	err = db.QueryRow("select count(rtt), count(*) filter (where delta_ttl_reverse = 0 and delta_ttl = 0) from rtt").
+		Scan(&received, &known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received == 0 || known != received {
+		t.Errorf("%d of %d received packets have a reverse delta TTL of 0, want all", known, received)
+	}
+}
+
+// TestLoopbackProgress checks that Config.Progress is called as the run goes, and once more at the end with every
+// packet counted
+func TestLoopbackProgress(t *testing.T) {
+	var updates []Progress
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(10, 10),
+		PacketLen:     NewVarParam(100, 100),
+		Duration:      1500 * time.Millisecond, // long enough for an update before the one at the end
+		Interval:      10 * time.Millisecond,
+		NoDB:          true,
+		Quiet:         true,
+		Progress:      func(p Progress) { updates = append(updates, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) < 2 {
+		t.Fatalf("%d progress updates, want one a second and one at the end", len(updates))
+	}
+	last := updates[len(updates)-1]
+	if last.Sent != summary.Received+summary.Dropped || last.Received != summary.Received {
+		t.Errorf("last progress %d sent and %d received, want the summary's %d and %d", last.Sent, last.Received,
+			summary.Received+summary.Dropped, summary.Received)
+	}
+	if last.WindowSize != 10 || last.PacketLength != 100 || last.RTT.P50 <= 0 {
+		t.Errorf("last progress %+v, want windows of 10 packets of 100 bytes and an RTT", last)
+	}
+}
@@ -0,0 +1,164 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+)
+
+// remote is what the client knows about one of the reflectors answering it. Unless the reflector address is a
+// multicast group there is just the one, whatever address its reflections come from.
+type remote struct {
+	key         string // see remoteKey
+	index       int    // order the reflector first answered in, which is its bit in sentPacket.received
+	received    bool
+	baselineTTL int64 // delta TTL of the first packet received from it
+	lastTTL     int64 // delta TTL of the last packet received from it
+	// offset is the estimate of its clock's offset from the sender's, made from a reflection with a network RTT of
+	// offsetRTT, once offsetKnown, see correctOWD
+	offset      int64
+	offsetRTT   int64
+	offsetKnown bool
+}
+
+// name returns the reflector's address for logging
+func (r *remote) name() string {
+	if r.key == "" {
+		return "reflector"
+	}
+	return r.key
+}
+
+// remoteKey returns the key of the reflector a reflection from src is from: its address when sending to a
+// multicast group, which any number of reflectors may answer, otherwise "" for the one reflector
+func (c *StampClient) remoteKey(src net.Addr) string {
+	if !c.multicast {
+		return ""
+	}
+	return src.String()
+}
+
+// remote returns the reflector with key, remembering it if it hasn't answered before
+func (c *StampClient) remote(key string) *remote {
+	r, ok := c.remotes[key]
+	if !ok {
+		if c.remotes == nil {
+			c.remotes = make(map[string]*remote)
+		}
+		r = &remote{key: key, index: len(c.remotes)}
+		c.remotes[key] = r
+		if c.multicast {
+			slog.Info("reflector answered the multicast group", "reflector", key, "reflectors", len(c.remotes))
+		}
+	}
+	return r
+}
+
+// setMulticast sets up conn to send to a multicast group out of ifi, or the interface the OS chooses if it is nil,
+// with ttl, the TTL it sends unicast packets with, rather than the multicast default of 1, so that they can be
+// routed and the delta TTL is measured the same way
+func setMulticast(conn *ipv4.PacketConn, ifi *net.Interface, ttl int) error {
+	err := conn.SetMulticastTTL(ttl)
+	if err != nil {
+		return fmt.Errorf("error in SetMulticastTTL: %w", err)
+	}
+	if ifi != nil {
+		err = conn.SetMulticastInterface(ifi)
+		if err != nil {
+			return fmt.Errorf("error setting multicast interface %s: %w", ifi.Name, err)
+		}
+	}
+	return nil
+}
+
+// ReflectorSummary holds the totals of one of the reflectors that answered a multicast group
+type ReflectorSummary struct {
+	Addr     string   `json:"addr"`
+	Received int      `json:"received"`
+	Dropped  int      `json:"dropped"` // packets sent but not reflected back by this reflector
+	RTT      RTTStats `json:"rtt"`
+}
+
+// reflectorTally counts the reports of one reflector of a multicast group, after the warmup
+type reflectorTally struct {
+	received int
+	dropped  int
+	rtts     rttSamples
+}
+
+func (t *reflectorTally) add(r Report) {
+	switch {
+	case r.Duplicate:
+	case r.Dropped:
+		t.dropped += r.drops()
+	default:
+		t.received++
+		t.rtts.add(r.MeasuredRTT)
+	}
+}
+
+// reflector returns the tally of the reflector at addr
+func (t *tally) reflector(addr string) *reflectorTally {
+	rt, ok := t.reflectors[addr]
+	if !ok {
+		if t.reflectors == nil {
+			t.reflectors = make(map[string]*reflectorTally)
+		}
+		rt = new(reflectorTally)
+		t.reflectors[addr] = rt
+	}
+	return rt
+}
+
+// reflectorSummaries returns the totals of each reflector of a multicast group, by address, or nil if not sending
+// to one
+func (t *tally) reflectorSummaries() []ReflectorSummary {
+	var summaries []ReflectorSummary
+	for addr, rt := range t.reflectors {
+		summaries = append(summaries, ReflectorSummary{Addr: addr, Received: rt.received, Dropped: rt.dropped,
+			RTT: rt.rtts.stats()})
+	}
+	slices.SortFunc(summaries, func(a, b ReflectorSummary) int { return strings.Compare(a.Addr, b.Addr) })
+	return summaries
+}
+
+// logReflectors logs the summary of each reflector of a multicast group, or warns that none answered
+func (c *StampClient) logReflectors() {
+	if !c.multicast {
+		return
+	}
+	if len(c.remotes) == 0 {
+		slog.Warn("no reflector answered the multicast group, so every packet was lost: check that reflectors "+
+			"have joined it and that it is routed to them", "group", c.reflectorAddr)
+		return
+	}
+	for _, r := range c.summary.Reflectors {
+		slog.Info("reflector summary", "reflector", r.Addr, "received", r.Received, "dropped", r.Dropped,
+			"rtt_p50", r.RTT.P50, "rtt_p99", r.RTT.P99)
+	}
+}
@@ -0,0 +1,73 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMulticastReflectorsAreTrackedApart(t *testing.T) {
+	ctx := context.Background()
+	group := &net.UDPAddr{IP: net.IPv4(239, 1, 2, 3), Port: 9996}
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 9996}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 2), Port: 9996}
+	c := &StampClient{streams: []*stream{{port: 9998}}, dbChan: make(chan Report, 100), history: new(sentHistory),
+		reflectorAddr: group, multicast: true, quiet: true, tally: tally{histogram: newHistogram(0)}}
+	sent := time.Now().UnixNano()
+	for seq := uint32(0); seq < 4; seq++ {
+		c.history.add(sentPacket{seq: seq})
+	}
+	for _, reply := range []struct {
+		from *net.UDPAddr
+		seq  uint32
+	}{
+		{a, 0}, {b, 0}, {a, 1}, {a, 2}, {b, 2}, {a, 2}, {a, 3}, {b, 3},
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 1, 3), Port: 1234}, 3}, // not from a reflector's port
+	} {
+		packet := make([]byte, ReflectorPacketLen)
+		binary.BigEndian.PutUint32(packet[20:], reply.seq)
+		binary.BigEndian.PutUint64(packet[24:], uint64(sent))
+		if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: packet, src: reply.from, receiveTime: sent + 1000}) {
+			t.Fatal("handle gave up")
+		}
+	}
+	close(c.dbChan)
+	for r := range c.dbChan {
+		c.tally.add(r)
+	}
+	want := []ReflectorSummary{
+		{Addr: a.String(), Received: 4, RTT: RTTStats{Min: 1000, Mean: 1000, P50: 1000, P90: 1000, P95: 1000, P99: 1000, Max: 1000}},
+		{Addr: b.String(), Received: 3, Dropped: 1, RTT: RTTStats{Min: 1000, Mean: 1000, P50: 1000, P90: 1000, P95: 1000, P99: 1000, Max: 1000}},
+	}
+	if got := c.reflectorSummaries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reflector summaries\n got %+v\nwant %+v", got, want)
+	}
+	if c.summary.Received != 7 || c.summary.Dropped != 1 || c.summary.Duplicates != 1 || c.rejected != 1 {
+		t.Errorf("%d received, %d dropped, %d duplicates and %d rejected, want 7, 1, 1 and 1", c.summary.Received,
+			c.summary.Dropped, c.summary.Duplicates, c.rejected)
+	}
+}
@@ -0,0 +1,68 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import "time"
+
+// offsetAssumption is what the clock offset, and the one-way delays corrected by it, rest on
+const offsetAssumption = "the reflection with the lowest network RTT took as long each way"
+
+// OffsetEstimate is the offset of the reflector's clock from the sender's, see Config.EstimateOffset
+type OffsetEstimate struct {
+	Offset     time.Duration `json:"offset_ns"`      // reflector clock minus sender clock
+	NetworkRTT time.Duration `json:"network_rtt_ns"` // of the reflection it was estimated from
+	Assumes    string        `json:"assumes"`
+}
+
+// correctOWD sets the clock offset of report, a reflection from rem, and its one-way delays corrected by it. The
+// offset is estimated as NTP does from the four timestamps, ((t2-t1)+(t3-t4))/2, which is right only if the packet
+// took as long each way. That is most nearly so for the reflection least held up in queues, so the estimate is
+// that of the reflection with the lowest network RTT so far.
+func (rem *remote) correctOWD(report *Report) {
+	rtt := report.MeasuredRTT
+	if report.Turnaround > 0 {
+		rtt = report.NetworkRTT
+	}
+	if !rem.offsetKnown || rtt < rem.offsetRTT {
+		rem.offset = (report.ForwardOWD - report.ReverseOWD) / 2
+		rem.offsetRTT = rtt
+		rem.offsetKnown = true
+	}
+	report.ClockOffset = rem.offset
+	report.CorrectedForwardOWD = report.ForwardOWD - rem.offset
+	report.CorrectedReverseOWD = report.ReverseOWD + rem.offset
+	report.offsetKnown = true
+}
+
+// offsetEstimate returns the clock offset of the reflector for the summary, nil unless it was estimated. A
+// multicast group's reflectors each have their own, so it has none.
+func (c *StampClient) offsetEstimate() *OffsetEstimate {
+	if !c.estOffset || c.multicast {
+		return nil
+	}
+	for _, rem := range c.remotes {
+		if rem.offsetKnown {
+			return &OffsetEstimate{Offset: time.Duration(rem.offset), NetworkRTT: time.Duration(rem.offsetRTT), Assumes: offsetAssumption}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stamp/reflector"
+)
+
+func TestCorrectOWD(t *testing.T) {
+	const ms = int64(time.Millisecond)
+	// the reflector's clock is 5ms ahead
+	tests := []struct {
+		forward, reverse int64 // true one-way delays
+		offset           int64 // estimate after the reflection
+	}{
+		{4 * ms, 2 * ms, 6 * ms}, // 1ms more each way than the other, taken for the clock
+		{2 * ms, 2 * ms, 5 * ms}, // the lowest RTT yet, so it replaces the estimate
+		{9 * ms, 1 * ms, 5 * ms}, // a longer RTT, so it doesn't
+	}
+	rem := &remote{}
+	for i, tt := range tests {
+		report := Report{
+			MeasuredRTT: tt.forward + tt.reverse,
+			ForwardOWD:  tt.forward + 5*ms,
+			ReverseOWD:  tt.reverse - 5*ms,
+		}
+		rem.correctOWD(&report)
+		if report.ClockOffset != tt.offset {
+			t.Errorf("reflection %d: offset %s, want %s", i, time.Duration(report.ClockOffset), time.Duration(tt.offset))
+		}
+		if report.CorrectedForwardOWD+report.CorrectedReverseOWD != report.MeasuredRTT {
+			t.Errorf("reflection %d: corrected delays %d and %d don't add up to the RTT %d", i,
+				report.CorrectedForwardOWD, report.CorrectedReverseOWD, report.MeasuredRTT)
+		}
+		if want := tt.forward + 5*ms - tt.offset; report.CorrectedForwardOWD != want {
+			t.Errorf("reflection %d: corrected forward delay %d, want %d", i, report.CorrectedForwardOWD, want)
+		}
+	}
+}
+
+// aheadClock is the system clock moved on by ahead
+type aheadClock struct {
+	ahead time.Duration
+}
+
+func (c aheadClock) Now() time.Time {
+	return time.Now().Add(c.ahead)
+}
+
+// TestEstimateOffset runs against a reflector whose clock is a second ahead, which the corrected one-way delays
+// should take out
+func TestEstimateOffset(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr:  startReflector(t, reflector.Config{Clock: aheadClock{time.Second}}),
+		ListenAddr:     "127.0.0.1:0",
+		WindowSize:     NewVarParam(10, 10),
+		PacketLen:      NewVarParam(100, 100),
+		Count:          100,
+		Interval:       10 * time.Millisecond,
+		EstimateOffset: true,
+		DBPath:         dbPath,
+		Quiet:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := summary.ClockOffset
+	if offset == nil || offset.Offset < time.Second-time.Millisecond || offset.Offset > time.Second+time.Millisecond {
+		t.Fatalf("estimated clock offset %+v, want about 1s", offset)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var corrected int
+	var maxForward time.Duration
+	err = db.QueryRow("select count(owd_forward_corrected), max(owd_forward_corrected) from rtt").Scan(&corrected, &maxForward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrected != summary.Received || maxForward > 50*time.Millisecond {
+		t.Errorf("%d of %d reflections corrected, the longest forward delay %s, want all of them a few ms at most",
+			corrected, summary.Received, maxForward)
+	}
+}
@@ -0,0 +1,306 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VarParam is a parameter that can vary over a run, from start to end
+type VarParam struct {
+	start   int
+	end     int
+	current int
+	// from and to are the percentages of the run the ramp begins and ends at, holding start before and end after.
+	// Both 0 is the whole run, as for 0 and 100.
+	from float64
+	to   float64
+}
+
+// NewVarParam returns a VarParam that ramps from start to end. Use the same value for both to keep it constant.
+func NewVarParam(start, end int) VarParam {
+	return VarParam{start: start, end: end, current: start}
+}
+
+// WithPhase returns vp ramping over only the part of the run from from to to percent, so that it can ramp apart
+// from the other parameters, holding its start value before and its end value after
+func (vp VarParam) WithPhase(from, to float64) (VarParam, error) {
+	if from < 0 || to > 100 || from >= to {
+		return vp, fmt.Errorf("bad phase %g-%g%%: expected percentages from 0 to 100, lowest first", from, to)
+	}
+	vp.from, vp.to = from, to
+	if from == 0 && to == 100 {
+		vp.to = 0
+	}
+	return vp, nil
+}
+
+// progress maps percent (0 to 1) of the way through the run to how far through its own phase vp is
+func (vp VarParam) progress(percent float64) float64 {
+	if vp.to == 0 {
+		return percent
+	}
+	p := (percent*100 - vp.from) / (vp.to - vp.from)
+	return min(max(p, 0), 1)
+}
+
+// ParseVarParam parses either a single value e.g. 100, or a range from start to end e.g. 100-200.
+// A reversed range such as 200-100 is not an error: it ramps down from 200 to 100.
+// A leading minus sign is read as part of the start value, so -5 and -5-10 parse; rejecting
+// values that make no sense for a given parameter is left to the caller.
+// A range can be followed by the phase of the run it ramps over, see WithPhase, such as 100-200@50-100% to hold
+// 100 for the first half and ramp over the second.
+func ParseVarParam(s string) (VarParam, error) {
+	if at := strings.Index(s, "@"); at >= 0 {
+		vp, err := ParseVarParam(s[:at])
+		if err != nil {
+			return VarParam{}, err
+		}
+		from, to, ok := strings.Cut(strings.TrimSuffix(s[at+1:], "%"), "-")
+		if !ok || !strings.HasSuffix(s, "%") {
+			return VarParam{}, fmt.Errorf("error parsing phase of %q: expected percentages such as 0-50%%", s)
+		}
+		f, err := strconv.ParseFloat(from, 64)
+		if err != nil {
+			return VarParam{}, fmt.Errorf("error parsing start of phase %q: %w", s, err)
+		}
+		t, err := strconv.ParseFloat(to, 64)
+		if err != nil {
+			return VarParam{}, fmt.Errorf("error parsing end of phase %q: %w", s, err)
+		}
+		return vp.WithPhase(f, t)
+	}
+	if s == "" {
+		return VarParam{}, fmt.Errorf("empty value: expected a number or a range such as 100-200")
+	}
+	n, err := strconv.Atoi(s)
+	if err == nil {
+		return NewVarParam(n, n), nil
+	}
+	i := strings.Index(s[1:], "-") + 1
+	if i == 0 {
+		return VarParam{}, fmt.Errorf("error parsing %q: expected a number or a range such as 100-200", s)
+	}
+	start, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return VarParam{}, fmt.Errorf("error parsing start of range %q: %w", s, err)
+	}
+	end, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return VarParam{}, fmt.Errorf("error parsing end of range %q: %w", s, err)
+	}
+	return NewVarParam(start, end), nil
+}
+
+func (vp VarParam) String() string {
+	if vp.end != vp.start && vp.to != 0 {
+		return fmt.Sprintf("%d-%d@%g-%g%%", vp.start, vp.end, vp.from, vp.to)
+	}
+	if vp.end != vp.start {
+		return fmt.Sprintf("%d-%d", vp.start, vp.end)
+	}
+	return fmt.Sprintf("%d", vp.start)
+}
+
+// RampMode selects how window size and packet length move from start to end over the duration
+type RampMode int
+
+const (
+	RampLinear RampMode = iota
+	RampExponential
+	RampStep
+)
+
+func (m RampMode) String() string {
+	switch m {
+	case RampExponential:
+		return "exponential"
+	case RampStep:
+		return "step"
+	}
+	return "linear"
+}
+
+// ParseRampMode returns the RampMode named by s
+func ParseRampMode(s string) (RampMode, error) {
+	switch s {
+	case "linear":
+		return RampLinear, nil
+	case "exponential":
+		return RampExponential, nil
+	case "step":
+		return RampStep, nil
+	}
+	return RampLinear, fmt.Errorf("unknown ramp mode %q: expected linear, exponential or step", s)
+}
+
+// RampShape selects the course of the ramp over the run
+type RampShape int
+
+const (
+	RampUp       RampShape = iota // from start to end
+	RampTriangle                  // from start to end over the first half, and back to start over the second
+)
+
+func (s RampShape) String() string {
+	if s == RampTriangle {
+		return "triangle"
+	}
+	return "up"
+}
+
+// ParseRampShape returns the RampShape named by s
+func ParseRampShape(s string) (RampShape, error) {
+	switch s {
+	case "up":
+		return RampUp, nil
+	case "triangle":
+		return RampTriangle, nil
+	}
+	return RampUp, fmt.Errorf("unknown ramp shape %q: expected up or triangle", s)
+}
+
+// TimestampSource selects where the receive time of a reflected packet comes from
+type TimestampSource int
+
+const (
+	TimestampSoftware  TimestampSource = iota // the kernel's timestamp, or the time the packet is read where there isn't one
+	TimestampHardware                         // the NIC's PTP clock, on Linux with an interface that supports it
+	TimestampUserspace                        // the time the packet is read
+)
+
+func (s TimestampSource) String() string {
+	switch s {
+	case TimestampHardware:
+		return "hardware"
+	case TimestampUserspace:
+		return "userspace"
+	}
+	return "software"
+}
+
+// ParseTimestampSource returns the TimestampSource named by s
+func ParseTimestampSource(s string) (TimestampSource, error) {
+	switch s {
+	case "software":
+		return TimestampSoftware, nil
+	case "hardware":
+		return TimestampHardware, nil
+	case "userspace":
+		return TimestampUserspace, nil
+	}
+	return TimestampSoftware, fmt.Errorf("unknown timestamp source %q: expected software, hardware or userspace", s)
+}
+
+// FillPattern selects what is written into the packet payload after the header
+type FillPattern int
+
+const (
+	FillZero FillPattern = iota
+	FillRandom
+	FillIncrementing
+)
+
+func (f FillPattern) String() string {
+	switch f {
+	case FillRandom:
+		return "random"
+	case FillIncrementing:
+		return "incrementing"
+	}
+	return "zero"
+}
+
+// ParseFillPattern returns the FillPattern named by s
+func ParseFillPattern(s string) (FillPattern, error) {
+	switch s {
+	case "zero":
+		return FillZero, nil
+	case "random":
+		return FillRandom, nil
+	case "incrementing":
+		return FillIncrementing, nil
+	}
+	return FillZero, fmt.Errorf("unknown fill pattern %q: expected zero, random or incrementing", s)
+}
+
+// Schedule selects how the time between windows is chosen
+type Schedule int
+
+const (
+	SchedulePeriodic Schedule = iota // every Interval
+	SchedulePoisson                  // drawn from an exponential distribution with a mean of Interval
+)
+
+func (s Schedule) String() string {
+	if s == SchedulePoisson {
+		return "poisson"
+	}
+	return "periodic"
+}
+
+// ParseSchedule returns the Schedule named by s
+func ParseSchedule(s string) (Schedule, error) {
+	switch s {
+	case "periodic":
+		return SchedulePeriodic, nil
+	case "poisson":
+		return SchedulePoisson, nil
+	}
+	return SchedulePeriodic, fmt.Errorf("unknown schedule %q: expected periodic or poisson", s)
+}
+
+// PortRange is an inclusive range of UDP ports. The zero value is no range.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// ParsePortRange parses either a single port e.g. 40000, or a range e.g. 40000-40015
+func ParsePortRange(s string) (PortRange, error) {
+	vp, err := ParseVarParam(s)
+	if err != nil {
+		return PortRange{}, err
+	}
+	pr := PortRange{First: vp.start, Last: vp.end}
+	if vp.to != 0 || pr.First < 1 || pr.Last > 65535 || pr.First > pr.Last {
+		return PortRange{}, fmt.Errorf("bad port range %q: expected ports from 1 to 65535, lowest first", s)
+	}
+	return pr, nil
+}
+
+// Len returns the number of ports in the range
+func (pr PortRange) Len() int {
+	if pr.First == 0 || pr.Last < pr.First {
+		return 0
+	}
+	return pr.Last - pr.First + 1
+}
+
+func (pr PortRange) String() string {
+	if pr.Last != pr.First {
+		return fmt.Sprintf("%d-%d", pr.First, pr.Last)
+	}
+	return fmt.Sprintf("%d", pr.First)
+}
@@ -0,0 +1,110 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"testing"
+)
+
+func TestParseVarParam(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    VarParam
+		wantErr bool
+	}{
+		{in: "100", want: NewVarParam(100, 100)},
+		{in: "100-200", want: NewVarParam(100, 200)},
+		{in: "200-100", want: NewVarParam(200, 100)}, // descending ramp
+		{in: "0", want: NewVarParam(0, 0)},
+		{in: "-5", want: NewVarParam(-5, -5)},
+		{in: "-5-10", want: NewVarParam(-5, 10)},
+		{in: "", wantErr: true},
+		{in: "-", wantErr: true},
+		{in: "100-", wantErr: true},
+		{in: "-100-", wantErr: true},
+		{in: "1-2-3", wantErr: true},
+		{in: "10--5", want: NewVarParam(10, -5)},
+		{in: "abc", wantErr: true},
+		{in: "100-abc", wantErr: true},
+		{in: " 100", wantErr: true},
+		{in: "100-200@50-100%", want: VarParam{start: 100, end: 200, current: 100, from: 50, to: 100}},
+		{in: "100-200@0-100%", want: NewVarParam(100, 200)},
+		{in: "100-200@0-12.5%", want: VarParam{start: 100, end: 200, current: 100, from: 0, to: 12.5}},
+		{in: "100-200@50-100", wantErr: true},
+		{in: "100-200@50%", wantErr: true},
+		{in: "100-200@60-40%", wantErr: true},
+		{in: "100-200@0-150%", wantErr: true},
+		{in: "100-200@", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVarParam(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseVarParam(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVarParam(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseVarParam(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortRange
+		wantErr bool
+	}{
+		{in: "40000", want: PortRange{First: 40000, Last: 40000}},
+		{in: "40000-40015", want: PortRange{First: 40000, Last: 40015}},
+		{in: "1-65535", want: PortRange{First: 1, Last: 65535}},
+		{in: "40015-40000", wantErr: true},
+		{in: "0-10", wantErr: true},
+		{in: "65535-65536", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePortRange(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePortRange(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+	if n := (PortRange{}).Len(); n != 0 {
+		t.Errorf("PortRange{}.Len() = %d, want 0", n)
+	}
+}
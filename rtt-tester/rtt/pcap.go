@@ -0,0 +1,243 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// pcapBurstGap is the longest gap between the packets of a capture sent back-to-back as one window
+const pcapBurstGap = time.Millisecond
+
+// capturedPacket is a UDP packet read from a capture: its payload length and when it was captured, since the epoch
+// as read, and then since the first packet of the capture
+type capturedPacket struct {
+	at     time.Duration
+	length int
+}
+
+// pcap link types whose frames readPcap can find the IP header in
+const (
+	linkNull     = 0   // BSD loopback: the address family in the host's byte order
+	linkEthernet = 1   // Ethernet, with or without 802.1Q tags
+	linkRaw      = 101 // raw IP
+	linkSLL      = 113 // Linux cooked capture, as from tcpdump -i any
+	linkIPv4     = 228 // raw IPv4
+	linkSLL2     = 276 // Linux cooked capture v2
+)
+
+// readPcap reads the UDP packets, over IPv4 or IPv6, out of the pcap capture at path, skipping anything else. The
+// payload length is taken from the UDP header, so a capture cut short by its snap length still gives the lengths
+// sent. pcapng captures aren't read, and can be converted with editcap -F pcap.
+func readPcap(path string) ([]capturedPacket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening capture: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]byte, 24)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("error reading capture %s: %w", path, err)
+	}
+	var order binary.ByteOrder
+	tsUnit := time.Microsecond
+	switch magic := binary.LittleEndian.Uint32(header); magic {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0xa1b23c4d:
+		order, tsUnit = binary.LittleEndian, time.Nanosecond
+	case 0x4d3cb2a1:
+		order, tsUnit = binary.BigEndian, time.Nanosecond
+	case 0x0a0d0d0a:
+		return nil, fmt.Errorf("%s is a pcapng capture, convert it with editcap -F pcap first", path)
+	default:
+		return nil, fmt.Errorf("%s is not a pcap capture", path)
+	}
+	linkType := order.Uint32(header[20:]) & 0xffff
+	switch linkType {
+	case linkNull, linkEthernet, linkRaw, linkSLL, linkIPv4, linkSLL2:
+	default:
+		return nil, fmt.Errorf("capture %s has link type %d, which isn't supported", path, linkType)
+	}
+	var packets []capturedPacket
+	record := make([]byte, 16)
+	var frame []byte
+	for {
+		_, err = io.ReadFull(r, record)
+		if errors.Is(err, io.EOF) {
+			return packets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading capture %s: %w", path, err)
+		}
+		at := time.Duration(order.Uint32(record))*time.Second + time.Duration(order.Uint32(record[4:]))*tsUnit
+		n := int(order.Uint32(record[8:]))
+		if n > 1<<18 {
+			return nil, fmt.Errorf("capture %s has a %d byte record, it may be corrupt", path, n)
+		}
+		if cap(frame) < n {
+			frame = make([]byte, n)
+		}
+		frame = frame[:n]
+		_, err = io.ReadFull(r, frame)
+		if err != nil {
+			return nil, fmt.Errorf("error reading capture %s: %w", path, err)
+		}
+		length, ok := udpPayloadLen(frame, linkType)
+		if !ok {
+			continue
+		}
+		packets = append(packets, capturedPacket{at: at, length: length})
+	}
+}
+
+// loadCapture reads the windows of the cfg.ReplayPcap capture, cut off at cfg.Duration if it is set, and checks that
+// they can be sent with cfg. Packets shorter than minLen, the header cfg's packets start with, are padded out to it.
+func (cfg Config) loadCapture(minLen int) ([]replayWindow, error) {
+	packets, err := readPcap(cfg.ReplayPcap)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("capture %s has no UDP packets", cfg.ReplayPcap)
+	}
+	// a capture from several interfaces can be out of order
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].at < packets[j].at })
+	first := packets[0].at
+	for i := range packets {
+		packets[i].at -= first
+	}
+	if cfg.Duration > 0 {
+		n := sort.Search(len(packets), func(i int) bool { return packets[i].at >= cfg.Duration })
+		if n < len(packets) {
+			slog.Info("the capture is longer than the duration, replaying the start of it", "capture", cfg.ReplayPcap,
+				"capture_length", packets[len(packets)-1].at, "packets", len(packets), "replayed", n)
+			packets = packets[:n]
+		}
+	}
+	padded := 0
+	for i := range packets {
+		p := &packets[i]
+		if p.length < minLen {
+			p.length = minLen
+			padded++
+		}
+		if limit := cfg.maxPacketLen(); p.length > limit {
+			return nil, fmt.Errorf("capture has packets of %d bytes, larger than the maximum permitted size of %d", p.length, limit)
+		}
+	}
+	if padded > 0 {
+		slog.Info("padding the captured packets shorter than the header", "packets", padded, "length", minLen)
+	}
+	return captureWindows(packets), nil
+}
+
+// udpPayloadLen returns the length of the payload of the UDP datagram in frame, of linkType, or false if it isn't
+// one or is a fragment after the first
+func udpPayloadLen(frame []byte, linkType uint32) (int, bool) {
+	var ip []byte
+	switch linkType {
+	case linkNull:
+		if len(frame) < 4 {
+			return 0, false
+		}
+		ip = frame[4:]
+	case linkEthernet:
+		offset := 12
+		for len(frame) >= offset+2 {
+			etherType := binary.BigEndian.Uint16(frame[offset:])
+			if etherType != 0x8100 && etherType != 0x88a8 {
+				break
+			}
+			offset += 4 // past an 802.1Q or 802.1ad tag
+		}
+		ip = frame[min(offset+2, len(frame)):]
+	case linkSLL:
+		ip = frame[min(16, len(frame)):]
+	case linkSLL2:
+		ip = frame[min(20, len(frame)):]
+	default:
+		ip = frame
+	}
+	if len(ip) == 0 {
+		return 0, false
+	}
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0f) * 4
+		if len(ip) < 20 || ihl < 20 || ip[9] != 17 || binary.BigEndian.Uint16(ip[6:])&0x1fff != 0 {
+			return 0, false
+		}
+		udp = ip[min(ihl, len(ip)):]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 {
+			return 0, false // not UDP, or behind extension headers
+		}
+		udp = ip[40:]
+	default:
+		return 0, false
+	}
+	if len(udp) < 8 {
+		return 0, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < 8 {
+		return 0, false
+	}
+	return length - 8, true
+}
+
+// captureWindows groups packets into the windows they are sent in: each window is the packets captured within
+// pcapBurstGap of the one before, sent back-to-back at the time the first of them was captured
+func captureWindows(packets []capturedPacket) []replayWindow {
+	var windows []replayWindow
+	for i, p := range packets {
+		if i == 0 || p.at-packets[i-1].at > pcapBurstGap {
+			windows = append(windows, replayWindow{at: p.at})
+		}
+		w := &windows[len(windows)-1]
+		w.lengths = append(w.lengths, p.length)
+		w.packets++
+	}
+	for i := range windows {
+		w := &windows[i]
+		total := 0
+		for _, n := range w.lengths {
+			total += n
+		}
+		w.packetLen = (total + w.packets/2) / w.packets
+	}
+	return windows
+}
@@ -0,0 +1,225 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFrame is a frame of a test capture and when it was captured
+type testFrame struct {
+	at    time.Duration
+	frame []byte
+}
+
+// writePcap writes frames of linkType to a pcap capture in the test's temporary directory, with nanosecond
+// timestamps if nano is set, and returns its path
+func writePcap(t *testing.T, order binary.AppendByteOrder, nano bool, linkType uint32, frames []testFrame) string {
+	t.Helper()
+	magic := uint32(0xa1b2c3d4)
+	unit := time.Microsecond
+	if nano {
+		magic, unit = 0xa1b23c4d, time.Nanosecond
+	}
+	buf := order.AppendUint32(nil, magic)
+	buf = order.AppendUint16(buf, 2)
+	buf = order.AppendUint16(buf, 4)
+	buf = append(buf, make([]byte, 8)...)
+	buf = order.AppendUint32(buf, 65535)
+	buf = order.AppendUint32(buf, linkType)
+	base := 1700000000 * time.Second
+	for _, f := range frames {
+		at := base + f.at
+		buf = order.AppendUint32(buf, uint32(at/time.Second))
+		buf = order.AppendUint32(buf, uint32(at%time.Second/unit))
+		buf = order.AppendUint32(buf, uint32(len(f.frame)))
+		buf = order.AppendUint32(buf, uint32(len(f.frame)))
+		buf = append(buf, f.frame...)
+	}
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	err := os.WriteFile(path, buf, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// ipv4Packet returns an IPv4 packet of protocol carrying a payload of n bytes, only as much of it as readPcap
+// looks at
+func ipv4Packet(protocol byte, n int) []byte {
+	ip := make([]byte, 28)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(28+n))
+	ip[9] = protocol
+	binary.BigEndian.PutUint16(ip[24:], uint16(8+n))
+	return ip
+}
+
+// ethernetFrame returns an Ethernet frame of etherType carrying payload, behind the given 802.1Q tags
+func ethernetFrame(etherType uint16, tags int, payload []byte) []byte {
+	frame := make([]byte, 12)
+	for i := 0; i < tags; i++ {
+		frame = binary.BigEndian.AppendUint16(frame, 0x8100)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(i+1))
+	}
+	frame = binary.BigEndian.AppendUint16(frame, etherType)
+	return append(frame, payload...)
+}
+
+func TestReadPcap(t *testing.T) {
+	ipv6 := make([]byte, 48)
+	ipv6[0] = 0x60
+	ipv6[6] = 17
+	binary.BigEndian.PutUint16(ipv6[44:], 8+300)
+	fragment := ipv4Packet(17, 400)
+	binary.BigEndian.PutUint16(fragment[6:], 185) // a second fragment, with no UDP header
+	frames := []testFrame{
+		{at: 0, frame: ethernetFrame(0x0800, 0, ipv4Packet(17, 100))},
+		{at: 500 * time.Microsecond, frame: ethernetFrame(0x0800, 1, ipv4Packet(17, 200))},
+		{at: 600 * time.Microsecond, frame: ethernetFrame(0x0800, 0, ipv4Packet(6, 1000))}, // TCP
+		{at: 700 * time.Microsecond, frame: ethernetFrame(0x0806, 0, make([]byte, 28))},    // ARP
+		{at: 800 * time.Microsecond, frame: ethernetFrame(0x0800, 0, fragment)},
+		{at: 20 * time.Millisecond, frame: ethernetFrame(0x86dd, 2, ipv6)},
+	}
+	want := []int{100, 200, 300}
+	for _, tc := range []struct {
+		name  string
+		order binary.AppendByteOrder
+		nano  bool
+	}{
+		{"little endian", binary.LittleEndian, false},
+		{"big endian nanoseconds", binary.BigEndian, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			packets, err := readPcap(writePcap(t, tc.order, tc.nano, linkEthernet, frames))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lengths []int
+			for _, p := range packets {
+				lengths = append(lengths, p.length)
+			}
+			if !reflect.DeepEqual(lengths, want) {
+				t.Fatalf("lengths = %v, want %v", lengths, want)
+			}
+			if gap := packets[2].at - packets[0].at; gap != 20*time.Millisecond {
+				t.Errorf("last packet captured %s after the first, want 20ms", gap)
+			}
+		})
+	}
+}
+
+func TestReadPcapRejected(t *testing.T) {
+	dir := t.TempDir()
+	pcapng := filepath.Join(dir, "test.pcapng")
+	err := os.WriteFile(pcapng, binary.LittleEndian.AppendUint32(make([]byte, 0, 24), 0x0a0d0d0a), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readPcap(pcapng)
+	if err == nil || !strings.Contains(err.Error(), "pcapng") {
+		t.Errorf("error = %v, want one naming pcapng", err)
+	}
+	_, err = readPcap(writePcap(t, binary.LittleEndian, false, 105, nil)) // 802.11
+	if err == nil || !strings.Contains(err.Error(), "link type 105") {
+		t.Errorf("error = %v, want one naming the link type", err)
+	}
+}
+
+func TestUDPPayloadLen(t *testing.T) {
+	udp := ipv4Packet(17, 64)
+	for _, tc := range []struct {
+		name     string
+		linkType uint32
+		frame    []byte
+	}{
+		{"null", linkNull, append([]byte{2, 0, 0, 0}, udp...)},
+		{"raw", linkRaw, udp},
+		{"ipv4", linkIPv4, udp},
+		{"sll", linkSLL, append(make([]byte, 16), udp...)},
+		{"sll2", linkSLL2, append(make([]byte, 20), udp...)},
+	} {
+		n, ok := udpPayloadLen(tc.frame, tc.linkType)
+		if !ok || n != 64 {
+			t.Errorf("%s: payload length = %d, %v, want 64, true", tc.name, n, ok)
+		}
+	}
+	if _, ok := udpPayloadLen(udp[:20], linkRaw); ok {
+		t.Errorf("found a payload length in a packet cut off before its UDP header")
+	}
+}
+
+func TestCaptureWindows(t *testing.T) {
+	packets := []capturedPacket{
+		{at: 0, length: 100},
+		{at: 300 * time.Microsecond, length: 101},
+		{at: 1200 * time.Microsecond, length: 200}, // within a millisecond of the one before
+		{at: 10 * time.Millisecond, length: 50},
+		{at: 30 * time.Millisecond, length: 60},
+		{at: 30 * time.Millisecond, length: 70},
+	}
+	want := []replayWindow{
+		{packets: 3, packetLen: 134, at: 0, lengths: []int{100, 101, 200}},
+		{packets: 1, packetLen: 50, at: 10 * time.Millisecond, lengths: []int{50}},
+		{packets: 2, packetLen: 65, at: 30 * time.Millisecond, lengths: []int{60, 70}},
+	}
+	got := captureWindows(packets)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("windows = %+v, want %+v", got, want)
+	}
+}
+
+func TestPlanCapture(t *testing.T) {
+	frame := func(n int) []byte { return ethernetFrame(0x0800, 0, ipv4Packet(17, n)) }
+	path := writePcap(t, binary.LittleEndian, false, linkEthernet, []testFrame{
+		{at: 2 * time.Second, frame: frame(1000)}, // out of order, as from several interfaces
+		{at: time.Second, frame: frame(500)},
+		{at: time.Second + 100*time.Microsecond, frame: frame(10)}, // padded out to the header
+		{at: 2500 * time.Millisecond, frame: frame(800)},
+		{at: 4 * time.Second, frame: frame(800)}, // after the duration
+	})
+	windows, err := Plan(Config{
+		WindowSize: NewVarParam(100, 100),
+		PacketLen:  NewVarParam(100, 100),
+		Duration:   2 * time.Second,
+		Interval:   time.Second,
+		DBPath:     "unused",
+		ReplayPcap: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlannedWindow{
+		{Start: 0, Packets: 2, PacketLen: (500 + HeaderLen + 1) / 2},
+		{Start: time.Second, Packets: 1, PacketLen: 1000},
+		{Start: 1500 * time.Millisecond, Packets: 1, PacketLen: 800},
+	}
+	if !reflect.DeepEqual(windows, want) {
+		t.Errorf("windows = %+v, want %+v", windows, want)
+	}
+}
@@ -0,0 +1,112 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// maxPlannedWindows stops Plan going on forever for a run that would never finish, such as a count of packets sent
+// in windows of none
+const maxPlannedWindows = 10000000
+
+// PlannedWindow is one window of a planned run
+type PlannedWindow struct {
+	Start     time.Duration // from the start of the run
+	Packets   int
+	PacketLen int  // the mean length, rounded, if the lengths are drawn from Config.SizeDist
+	Warmup    bool // sent during the warmup
+}
+
+// Plan works out the windows a run of cfg would send, using the same ramp as Run but a simulated clock, without
+// opening a socket or the database. Sending is taken to be instant apart from the pacing of Config.PPS. A run with
+// neither a duration nor a count can't be planned, as it goes on until it is interrupted, and nor can one that sends
+// windows back-to-back for a length of time, as how many are sent depends on how fast the host is.
+func Plan(cfg Config) ([]PlannedWindow, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	replay, err := cfg.loadReplay()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Duration == 0 && cfg.Count == 0 && replay == nil {
+		return nil, fmt.Errorf("a run with no duration or count goes on until it is interrupted")
+	}
+	if cfg.Interval == 0 && cfg.PPS == 0 && replay == nil && (cfg.Count == 0 || cfg.Warmup > 0) {
+		return nil, fmt.Errorf("back-to-back windows can't be planned over a length of time")
+	}
+	c := &StampClient{
+		windowSize: cfg.WindowSize,
+		packetLen:  cfg.PacketLen,
+		duration:   cfg.Duration.Nanoseconds(),
+		count:      uint32(cfg.Count),
+		interval:   cfg.interval(),
+		pps:        cfg.PPS,
+		ramp:       cfg.Ramp,
+		rampSteps:  cfg.RampSteps,
+		rampShape:  cfg.RampShape,
+		replay:     replay,
+	}
+	begin := time.Now().UnixNano()
+	start := begin
+	if cfg.Warmup > 0 {
+		c.warmupUntil = begin + cfg.Warmup.Nanoseconds()
+		start = c.warmupUntil
+	}
+	var windows []PlannedWindow
+	now := begin
+	for {
+		numPackets, done := c.nextWindow(start, now)
+		if done {
+			return windows, nil
+		}
+		if len(windows) == maxPlannedWindows {
+			return nil, fmt.Errorf("run doesn't finish within %d windows", maxPlannedWindows)
+		}
+		packetLen := c.packetLen.current
+		if cfg.SizeDist.Len() > 0 {
+			packetLen = int(math.Round(cfg.SizeDist.Mean()))
+		}
+		windows = append(windows, PlannedWindow{
+			Start:     time.Duration(now - begin),
+			Packets:   numPackets,
+			PacketLen: packetLen,
+			Warmup:    now < c.warmupUntil,
+		})
+		// as sendPacketWindow does
+		elapsed := int64(0)
+		for i := 0; i < numPackets; i++ {
+			if c.pps > 0 {
+				elapsed = int64(i) * int64(time.Second) / int64(c.pps)
+			}
+			if now+elapsed < c.warmupUntil {
+				c.warmupSent++
+			}
+		}
+		c.nextSendSeqNo += uint32(numPackets)
+		now += max(c.nextInterval().Nanoseconds(), elapsed)
+	}
+}
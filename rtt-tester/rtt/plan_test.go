@@ -0,0 +1,194 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanCount(t *testing.T) {
+	windows, err := Plan(Config{
+		WindowSize: NewVarParam(100, 100),
+		PacketLen:  NewVarParam(100, 200),
+		Count:      250,
+		Interval:   time.Second,
+		DBPath:     "unused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlannedWindow{
+		{Start: 0, Packets: 100, PacketLen: 100},
+		{Start: time.Second, Packets: 100, PacketLen: 140},
+		{Start: 2 * time.Second, Packets: 50, PacketLen: 180},
+	}
+	if len(windows) != len(want) {
+		t.Fatalf("got %d windows %+v, want %d", len(windows), windows, len(want))
+	}
+	for i := range want {
+		if windows[i] != want[i] {
+			t.Errorf("window %d = %+v, want %+v", i, windows[i], want[i])
+		}
+	}
+}
+
+// TestPlanDurationShorterThanInterval checks that a ramp over less than one interval is sent in windows through it,
+// rather than a window at the start values and one at the end values
+func TestPlanDurationShorterThanInterval(t *testing.T) {
+	cfg := Config{
+		WindowSize: NewVarParam(10, 20),
+		PacketLen:  NewVarParam(100, 100),
+		Duration:   500 * time.Millisecond,
+		Interval:   time.Second,
+		DBPath:     "unused",
+	}
+	windows, err := Plan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// minRampWindows over the duration, and the end value
+	if len(windows) != minRampWindows+1 {
+		t.Fatalf("got %d windows %+v, want %d", len(windows), windows, minRampWindows+1)
+	}
+	for i, w := range windows {
+		if want := time.Duration(i) * 50 * time.Millisecond; w.Start != want {
+			t.Errorf("window %d starts at %s, want %s", i, w.Start, want)
+		}
+		if i > 0 && w.Packets <= windows[i-1].Packets {
+			t.Errorf("window %d has %d packets, not more than the window before", i, w.Packets)
+		}
+	}
+	if windows[0].Packets != 10 || windows[minRampWindows].Packets != 20 {
+		t.Errorf("windows don't ramp from 10 to 20: %+v", windows)
+	}
+	cfg.WindowSize = NewVarParam(10, 10)
+	windows, err = Plan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 1 {
+		t.Errorf("a run with no ramp got %d windows %+v, want the one", len(windows), windows)
+	}
+}
+
+func TestPlanDurationWithWarmup(t *testing.T) {
+	windows, err := Plan(Config{
+		WindowSize: NewVarParam(10, 20),
+		PacketLen:  NewVarParam(100, 100),
+		Duration:   10 * time.Second,
+		Interval:   time.Second,
+		Warmup:     2 * time.Second,
+		DBPath:     "unused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two warmup windows, one a second over the 10 second ramp, and the end value
+	if len(windows) != 13 {
+		t.Fatalf("got %d windows %+v, want 13", len(windows), windows)
+	}
+	for i, w := range windows {
+		if w.Warmup != (i < 2) {
+			t.Errorf("window %d warmup = %v", i, w.Warmup)
+		}
+	}
+	if windows[0].Packets != 10 || windows[2].Packets != 10 || windows[12].Packets != 20 {
+		t.Errorf("windows don't ramp from 10 to 20 after the warmup: %+v", windows)
+	}
+}
+
+func TestPlanUnbounded(t *testing.T) {
+	_, err := Plan(Config{
+		WindowSize: NewVarParam(10, 10),
+		PacketLen:  NewVarParam(100, 100),
+		Interval:   time.Second,
+		DBPath:     "unused",
+	})
+	if err == nil {
+		t.Error("planned a run with no duration or count")
+	}
+}
+
+func TestPlanPhases(t *testing.T) {
+	windowSize, err := ParseVarParam("10-20@0-50%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetLen, err := ParseVarParam("100-200@50-100%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows, err := Plan(Config{
+		WindowSize: windowSize,
+		PacketLen:  packetLen,
+		Duration:   10 * time.Second,
+		Interval:   time.Second,
+		DBPath:     "unused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one window a second over the 10 second ramp, and the end values
+	if len(windows) != 11 {
+		t.Fatalf("got %d windows %+v, want 11", len(windows), windows)
+	}
+	for i, w := range windows {
+		wantPackets, wantLen := 10+2*i, 100
+		if i >= 5 {
+			wantPackets, wantLen = 20, 100+20*(i-5)
+		}
+		if w.Packets != wantPackets || w.PacketLen != wantLen {
+			t.Errorf("window %d = %d packets of %d bytes, want %d of %d", i, w.Packets, w.PacketLen, wantPackets, wantLen)
+		}
+	}
+	if windowSize.String() != "10-20@0-50%" {
+		t.Errorf("phased window size recorded as %q", windowSize)
+	}
+}
+
+func TestPlanTriangle(t *testing.T) {
+	windowSize, err := ParseVarParam("10-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows, err := Plan(Config{
+		WindowSize: windowSize,
+		PacketLen:  VarParam{start: 100, end: 100},
+		RampShape:  RampTriangle,
+		Duration:   10 * time.Second,
+		Interval:   time.Second,
+		DBPath:     "unused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// up over the first 5 seconds, down over the next 5, and the start values again
+	if len(windows) != 11 {
+		t.Fatalf("got %d windows %+v, want 11", len(windows), windows)
+	}
+	for i, w := range windows {
+		if want := 10 + 4*min(i, 10-i); w.Packets != want {
+			t.Errorf("window %d = %d packets, want %d", i, w.Packets, want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// PlayoutStats estimate what a video receiver would have made of a run, see Playout
+type PlayoutStats struct {
+	Depth   time.Duration `json:"depth_ns"` // of the jitter buffer
+	Packets int           `json:"packets"`  // sent after the warmup
+	Played  int           `json:"played"`   // arrived in time to be played
+	Late    int           `json:"late"`     // arrived after their playout time, so were as good as lost
+	Lost    int           `json:"lost"`
+	// Freezes are the runs of packets in a row that couldn't be played, lost or late, each of which would freeze
+	// the picture. FrozenTime is how long they lasted in all, from the send time of the packet played before each
+	// to that of the one played after, and LongestFreeze the longest of them.
+	Freezes       int           `json:"freezes"`
+	FrozenTime    time.Duration `json:"frozen_ns"`
+	LongestFreeze time.Duration `json:"longest_freeze_ns"`
+}
+
+// LatePercent is the percentage of the packets that arrived too late to be played
+func (s PlayoutStats) LatePercent() float64 {
+	if s.Packets == 0 {
+		return 0
+	}
+	return 100 * float64(s.Late) / float64(s.Packets)
+}
+
+// Playout models a receiver playing out the packets of a run, as if they were a video stream, through a jitter
+// buffer of a fixed depth. Playout starts when the first packet arrives, once the buffer's depth has passed, and
+// each packet after that is due its send interval after the one before, so a packet is late if its RTT is more
+// than the buffer's depth above the first packet's. A lost or late packet can't be played. The RTT stands in for
+// the one-way delay, which can't be measured without synchronized clocks, so the delay variation is that of the
+// round trip. Duplicates and the warmup are left out, as they are from the summary.
+type Playout struct {
+	depth       int64 // of the buffer in nanoseconds
+	due         int64 // RTT a packet can have and still be played, 0 until the first packet is received
+	stats       PlayoutStats
+	played      bool  // a packet has been played
+	lastPlayed  int64 // send time of the last packet played
+	missed      bool  // the packets since the last one played couldn't be played either
+	missedSince int64 // lastPlayed when the current run of missed packets began, -1 if none had been played
+}
+
+// NewPlayout returns a Playout through a jitter buffer depth deep
+func NewPlayout(depth time.Duration) *Playout {
+	return &Playout{depth: depth.Nanoseconds(), stats: PlayoutStats{Depth: depth}}
+}
+
+// Add plays out the packet of r, which must come after those added before in the order the reports were written
+func (p *Playout) Add(r Report) {
+	if r.Duplicate || r.Warmup {
+		return
+	}
+	p.stats.Packets++
+	if r.Dropped {
+		p.stats.Lost++
+		p.miss()
+		return
+	}
+	if p.due == 0 {
+		p.due = max(r.MeasuredRTT+p.depth, 1)
+	}
+	if r.MeasuredRTT > p.due {
+		p.stats.Late++
+		p.miss()
+		return
+	}
+	p.stats.Played++
+	if p.missed && p.missedSince >= 0 {
+		frozen := time.Duration(r.Timestamp - p.missedSince)
+		p.stats.FrozenTime += frozen
+		p.stats.LongestFreeze = max(p.stats.LongestFreeze, frozen)
+	}
+	p.missed = false
+	p.played = true
+	p.lastPlayed = r.Timestamp
+}
+
+// miss notes a packet that couldn't be played, which starts a freeze unless the one before couldn't be either
+func (p *Playout) miss() {
+	if p.missed {
+		return
+	}
+	p.missed = true
+	p.missedSince = -1
+	if p.played {
+		p.missedSince = p.lastPlayed
+	}
+	p.stats.Freezes++
+}
+
+// Stats returns the playout of the packets added so far. A freeze before the first packet played, or still going
+// on after the last, is counted but its length isn't known.
+func (p *Playout) Stats() PlayoutStats {
+	return p.stats
+}
+
+// PlayoutOf plays out the run recorded in the results database at path through a jitter buffer depth deep, see
+// Playout
+func PlayoutOf(path string, depth time.Duration) (PlayoutStats, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return PlayoutStats{}, fmt.Errorf("error opening results database: %w", err)
+	}
+	t := &tailer{path: path}
+	defer t.close()
+	err = t.open()
+	if err != nil {
+		return PlayoutStats{}, err
+	}
+	if t.db == nil {
+		return PlayoutStats{}, fmt.Errorf("%s has no results: %w", path, errNoRTTTable)
+	}
+	p := NewPlayout(depth)
+	err = t.read(p.Add)
+	if err != nil {
+		return PlayoutStats{}, err
+	}
+	return p.Stats(), nil
+}
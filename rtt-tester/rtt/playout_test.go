@@ -0,0 +1,84 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// playoutRun is a run of packets sent 10ms apart, with the RTT of each in milliseconds and -1 for a dropped packet
+func playoutRun(rtts ...int64) []Report {
+	var reports []Report
+	for i, rtt := range rtts {
+		r := Report{SequenceNumber: i, Timestamp: int64(i) * int64(10*time.Millisecond), MeasuredRTT: rtt * int64(time.Millisecond)}
+		if rtt < 0 {
+			r = Report{SequenceNumber: i, Timestamp: r.Timestamp, Dropped: true}
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+func TestPlayout(t *testing.T) {
+	// the buffer allows 30ms over the first packet's 20ms RTT
+	reports := playoutRun(20, 25, 49, 51, 60, 30, -1, 30, 60, -1, 20)
+	reports = append(reports, Report{SequenceNumber: 1, MeasuredRTT: 100, Duplicate: true}, Report{Warmup: true, Dropped: true})
+	p := NewPlayout(30 * time.Millisecond)
+	for _, r := range reports {
+		p.Add(r)
+	}
+	want := PlayoutStats{Depth: 30 * time.Millisecond, Packets: 11, Played: 6, Late: 3, Lost: 2, Freezes: 3,
+		FrozenTime: 80 * time.Millisecond, LongestFreeze: 30 * time.Millisecond}
+	if got := p.Stats(); got != want {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestPlayoutOf(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	out, err := openDB(dbPath, runMeta{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range playoutRun(20, 80, -1, 20) {
+		err = out.write(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	out.close()
+	got, err := PlayoutOf(dbPath, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PlayoutStats{Depth: 50 * time.Millisecond, Packets: 4, Played: 2, Late: 1, Lost: 1, Freezes: 1,
+		FrozenTime: 30 * time.Millisecond, LongestFreeze: 30 * time.Millisecond}
+	if got != want {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+	_, err = PlayoutOf(filepath.Join(t.TempDir(), "missing.db"), time.Second)
+	if err == nil {
+		t.Error("played out a database that doesn't exist")
+	}
+}
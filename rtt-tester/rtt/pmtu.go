@@ -0,0 +1,149 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"stamp/wire"
+)
+
+const (
+	pmtuProbes     = 3           // probes sent at a packet length before it is taken as too long for the path
+	pmtuTimeout    = time.Second // how long to wait for each probe to be reflected
+	IPUDPHeaderLen = 28          // IPv4 header without options plus the UDP header, the MTU overhead of a packet
+)
+
+// DiscoverPMTU finds the longest packet length the reflector returns when sent with the don't-fragment bit set,
+// searching between the start and end of cfg.PacketLen, or from its start up to the maximum packet length if it is
+// constant. A length that fails to send because the kernel knows it is over the path MTU, from the interface or an
+// ICMP fragmentation needed message, is too long straight away; otherwise a length is too long once pmtuProbes probes
+// of it go unreflected. The path MTU is the result plus IPUDPHeaderLen. Nothing is written to the database.
+func DiscoverPMTU(ctx context.Context, cfg Config) (int, error) {
+	err := cfg.validate()
+	if err != nil {
+		return 0, err
+	}
+	if cfg.Transport == TransportTCP {
+		return 0, fmt.Errorf("the path MTU can't be discovered over TCP")
+	}
+	if cfg.Proxy != "" || cfg.RecvPort != 0 {
+		return 0, fmt.Errorf("the path MTU can't be discovered through a proxy or with a receive port")
+	}
+	cfg.DF = true
+	cfg.SrcPorts = PortRange{}
+	c, err := newClient(ctx, cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+	conn := c.streams[0].conn
+
+	lo, hi := cfg.PacketLen.start, cfg.PacketLen.end
+	if hi <= lo {
+		hi = cfg.maxPacketLen()
+	}
+	slog.Info("discovering path MTU", "reflector", cfg.ReflectorAddr, "min", lo, "max", hi)
+	ok, err := c.probe(ctx, conn, lo)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no reflection of a %d byte probe from %s", lo, cfg.ReflectorAddr)
+	}
+	// binary search, with good always reflected and bad never
+	good, bad := lo, hi+1
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		ok, err := c.probe(ctx, conn, mid)
+		if err != nil {
+			return 0, err
+		}
+		slog.Info("probe", "packet_length", mid, "reflected", ok)
+		if ok {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	if good == hi {
+		slog.Warn("every probe length was reflected, the path MTU may be larger", "max", hi)
+	}
+	return good, nil
+}
+
+// probe sends packets of packetLen on conn until one is reflected, returning false if none are after pmtuProbes
+// tries or the kernel refuses to send them for being over the path MTU
+func (c *StampClient) probe(ctx context.Context, conn *ipv4.PacketConn, packetLen int) (bool, error) {
+	for i := 0; i < pmtuProbes; i++ {
+		seq := c.nextSendSeqNo
+		c.nextSendSeqNo++
+		c.putPacket(seq, c.clock.Now().UnixNano(), packetLen)
+		err := wire.WriteTo(conn, c.packet[:packetLen], c.sendCM, c.reflectorAddr, c.sendRetries)
+		if tooBig(err) {
+			slog.Debug("probe is over the path MTU", "packet_length", packetLen, "err", err)
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error sending probe: %w", err)
+		}
+		ok, err := c.awaitReflection(ctx, conn, seq)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// awaitReflection reads from conn until packet seq is reflected, returning false if it isn't within pmtuTimeout.
+// Late reflections of earlier probes are skipped.
+func (c *StampClient) awaitReflection(ctx context.Context, conn *ipv4.PacketConn, seq uint32) (bool, error) {
+	err := conn.SetReadDeadline(time.Now().Add(pmtuTimeout))
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, c.replyBufLen())
+	for {
+		n, _, src, err := conn.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, nil
+		}
+		if err != nil {
+			slog.Warn("read error", "err", err)
+			continue
+		}
+		r, ok := c.parse(buf[:n])
+		if ok && r.seq == seq && c.fromReflector(src) {
+			return true, nil
+		}
+	}
+}
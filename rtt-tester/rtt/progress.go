@@ -0,0 +1,65 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import "time"
+
+const (
+	// progressInterval is how often Config.Progress is called during a run
+	progressInterval = time.Second
+	// ProgressLast is how many of the last packets Progress.LossPercent and Progress.RTT are of
+	ProgressLast = 1000
+)
+
+// Progress is a snapshot of a run under way, taken by the reporter from the results it has recorded, see
+// Config.Progress
+type Progress struct {
+	Elapsed time.Duration // since the reporter started
+	// WindowSize and PacketLength are those of the last packet received, and Warmup whether it was sent during the
+	// warmup
+	WindowSize   int
+	PacketLength int
+	Warmup       bool
+	// Sent, Received and Dropped count the packets with a result so far, leaving out the warmup as the summary does.
+	// Sent is the packets received or dropped, so it leaves out those still in flight.
+	Sent     int
+	Received int
+	Dropped  int
+	// LossPercent and RTT are of the last ProgressLast packets with a result
+	LossPercent float64
+	RTT         RTTStats
+}
+
+// snapshot returns the progress of the run, whose reporter started at start
+func (c *StampClient) snapshot(start time.Time) Progress {
+	return Progress{
+		Elapsed:      time.Since(start),
+		WindowSize:   c.latest.WindowSize,
+		PacketLength: c.latest.PacketLength,
+		Warmup:       c.latest.Warmup,
+		Sent:         c.summary.Received + c.summary.Dropped,
+		Received:     c.summary.Received,
+		Dropped:      c.summary.Dropped,
+		LossPercent:  c.rolling.LossPercent(),
+		RTT:          c.rolling.RTT(),
+	}
+}
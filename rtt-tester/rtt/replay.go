@@ -0,0 +1,199 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"stamp/wire"
+)
+
+// replayWindow is one window of a recorded run, or of a capture
+type replayWindow struct {
+	packets   int
+	packetLen int // the mean of lengths for a capture
+	// at is when to send the window from the start of the run, and lengths the length of each of its packets, for a
+	// capture. A recorded run's windows are sent Config.Interval apart, with packets all of packetLen.
+	at      time.Duration
+	lengths []int
+}
+
+// recordedPacket is a row of the rtt table, with a window size and packet length of 0 where they weren't recorded
+type recordedPacket struct {
+	seq       int64
+	windowLen int
+	packetLen int
+}
+
+// loadReplay reads back the windows of the run recorded in the cfg.Replay database, or of the cfg.ReplayPcap
+// capture, in the order they were sent, and checks that they can be sent with cfg. It returns nil if there is no
+// replay.
+func (cfg Config) loadReplay() ([]replayWindow, error) {
+	minLen := HeaderLen
+	if cfg.Secret != nil {
+		minLen += wire.MACLen
+	}
+	if cfg.Mode == wire.ModeSTAMP {
+		minLen = wire.STAMPPacketLen
+	}
+	if cfg.ReplayPcap != "" {
+		return cfg.loadCapture(minLen)
+	}
+	if cfg.Replay == "" {
+		return nil, nil
+	}
+	windows, err := readReplay(cfg.Replay)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range windows {
+		if w.packetLen < minLen {
+			return nil, fmt.Errorf("replay has packets of %d bytes, shorter than the %d bytes needed in %s mode", w.packetLen, minLen, cfg.Mode)
+		}
+		if limit := cfg.maxPacketLen(); w.packetLen > limit {
+			return nil, fmt.Errorf("replay has packets of %d bytes, larger than the maximum permitted size of %d", w.packetLen, limit)
+		}
+	}
+	return windows, nil
+}
+
+// readReplay reads back the windows of the run recorded in the results database at path
+func readReplay(path string) ([]replayWindow, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening replay database: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("error opening replay database: %w", err)
+	}
+	defer db.Close()
+	err = checkColumns(db, "sequence_number", "window_size", "packet_length")
+	if err != nil {
+		return nil, fmt.Errorf("%s can't be replayed: %w", path, err)
+	}
+	rows, err := db.Query("select sequence_number, window_size, packet_length from rtt order by sequence_number")
+	if err != nil {
+		return nil, fmt.Errorf("error reading replay database: %w", err)
+	}
+	defer rows.Close()
+	var packets []recordedPacket
+	for rows.Next() {
+		var seq int64
+		var windowLen, packetLen sql.NullInt64
+		err = rows.Scan(&seq, &windowLen, &packetLen)
+		if err != nil {
+			return nil, fmt.Errorf("error reading replay database: %w", err)
+		}
+		packets = append(packets, recordedPacket{seq: seq, windowLen: int(windowLen.Int64), packetLen: int(packetLen.Int64)})
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error reading replay database: %w", err)
+	}
+	windows := replayWindows(packets)
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("%s can't be replayed: no packets of the run were received, so its windows aren't known", path)
+	}
+	return windows, nil
+}
+
+// errNoRTTTable is returned by checkColumns for a database with no rtt table
+var errNoRTTTable = errors.New("there is no rtt table")
+
+// checkColumns returns an error naming any of columns the rtt table of db doesn't have
+func checkColumns(db *sql.DB, columns ...string) error {
+	rows, err := db.Query("select name from pragma_table_info('rtt')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		have[name] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	if len(have) == 0 {
+		return errNoRTTTable
+	}
+	var missing []string
+	for _, c := range columns {
+		if !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the rtt table has no %s column", strings.Join(missing, " or "))
+	}
+	return nil
+}
+
+// replayWindows splits packets, in sequence order, into the windows they were sent in. A window is a run of
+// consecutive sequence numbers sent with the same window size and packet length, up to the window size. Dropped
+// packets have neither recorded, so they are taken to be from the window being built, or if they start one, from
+// the window of the next packet that was received.
+func replayWindows(packets []recordedPacket) []replayWindow {
+	var windows []replayWindow
+	for i := 0; i < len(packets); {
+		windowLen, packetLen := 0, 0
+		for _, p := range packets[i:] {
+			if p.windowLen > 0 && p.packetLen > 0 {
+				windowLen, packetLen = p.windowLen, p.packetLen
+				break
+			}
+		}
+		if windowLen == 0 {
+			if len(windows) == 0 {
+				return nil
+			}
+			// dropped packets at the end of the run
+			last := windows[len(windows)-1]
+			windowLen, packetLen = last.packets, last.packetLen
+		}
+		n := 1
+		for ; i+n < len(packets) && n < windowLen; n++ {
+			p := packets[i+n]
+			if p.seq != packets[i+n-1].seq+1 {
+				break
+			}
+			if p.windowLen > 0 && p.packetLen > 0 && (p.windowLen != windowLen || p.packetLen != packetLen) {
+				break
+			}
+		}
+		windows = append(windows, replayWindow{packets: n, packetLen: packetLen})
+		i += n
+	}
+	return windows
+}
@@ -0,0 +1,75 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplayWindows(t *testing.T) {
+	packets := []recordedPacket{
+		{seq: 0}, // dropped at the start of the first window
+		{seq: 1, windowLen: 3, packetLen: 100},
+		{seq: 2, windowLen: 3, packetLen: 100},
+		{seq: 3}, // dropped at the start of the second window
+		{seq: 4, windowLen: 3, packetLen: 100},
+		{seq: 5, windowLen: 3, packetLen: 100},
+		{seq: 6, windowLen: 4, packetLen: 120},
+		{seq: 7}, // dropped inside the third window
+		{seq: 8, windowLen: 4, packetLen: 120},
+		{seq: 9, windowLen: 4, packetLen: 120},
+		{seq: 10, windowLen: 4, packetLen: 150}, // a count run's last window, cut short
+		{seq: 11, windowLen: 4, packetLen: 150},
+	}
+	want := []replayWindow{{packets: 3, packetLen: 100}, {packets: 3, packetLen: 100}, {packets: 4, packetLen: 120}, {packets: 2, packetLen: 150}}
+	got := replayWindows(packets)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("windows = %v, want %v", got, want)
+	}
+}
+
+func TestReplayWindowsAllDropped(t *testing.T) {
+	if got := replayWindows([]recordedPacket{{seq: 0}, {seq: 1}}); got != nil {
+		t.Errorf("windows = %v, want none", got)
+	}
+}
+
+func TestReadReplayMissingColumn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("create table rtt (id integer primary key asc, sequence_number integer not null, rtt numeric)")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readReplay(path)
+	if err == nil || !strings.Contains(err.Error(), "no window_size or packet_length column") {
+		t.Errorf("error = %v, want one naming the missing columns", err)
+	}
+}
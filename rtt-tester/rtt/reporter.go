@@ -0,0 +1,810 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// LossDirection says which leg of the round trip a dropped packet was lost on, or a received one reordered on
+type LossDirection int
+
+const (
+	LossUnknown LossDirection = iota
+	LossForward               // sender to reflector
+	LossReverse               // reflector to sender
+)
+
+func (d LossDirection) String() string {
+	switch d {
+	case LossForward:
+		return "forward"
+	case LossReverse:
+		return "reverse"
+	}
+	return "unknown"
+}
+
+func (d LossDirection) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *LossDirection) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "forward":
+		*d = LossForward
+	case "reverse":
+		*d = LossReverse
+	case "unknown":
+		*d = LossUnknown
+	default:
+		return fmt.Errorf("unknown loss direction %q", b)
+	}
+	return nil
+}
+
+// Report is the result for one packet. Its JSON form, as streamed to a unix:// output, uses the column names of the
+// rtt table.
+type Report struct {
+	SequenceNumber int           `json:"sequence_number"`
+	Dropped        bool          `json:"dropped"`
+	Duplicate      bool          `json:"duplicate"` // a second copy of a packet already received, left out of the summary's RTTs
+	WindowSize     int           `json:"window_size"`
+	PacketLength   int           `json:"packet_length"`
+	MeasuredRTT    int64         `json:"rtt"`
+	Turnaround     int64         `json:"turnaround"`  // reflector transmit time minus receive time, 0 if not known
+	NetworkRTT     int64         `json:"network_rtt"` // MeasuredRTT less Turnaround, 0 if Turnaround isn't known
+	TTL            int64         `json:"delta_ttl"`
+	ForwardOWD     int64         `json:"owd_forward"`    // reflector receive time minus sender send time, assumes synchronized clocks
+	ReverseOWD     int64         `json:"owd_reverse"`    // sender receive time minus reflector send time, assumes synchronized clocks
+	Direction      LossDirection `json:"loss_direction"` // for dropped packets
+	Timestamp      int64         `json:"timestamp"`      // send time in nanoseconds since the epoch, estimated for dropped packets
+	RouteChanged   bool          `json:"route_changed"`  // delta TTL is off the first packet's by more than the threshold
+	SourcePort     int           `json:"src_port"`       // local port the packet was sent from
+	Warmup         bool          `json:"warmup"`         // sent during the warmup, so left out of the summary
+	OfferedBitrate int64         `json:"offered_bps"`    // offered bitrate of the packet's window in bits per second, 0 if not known
+	ReflectorSeq   int           `json:"reflector_seq"`  // the reflector's number for the reply, for received packets
+	Reordered      LossDirection `json:"reordered"`      // leg the packet was reordered on, unknown if it wasn't
+	Reflector      string        `json:"reflector"`      // address of the reflector when sending to a multicast group, else ""
+	Burst          int           `json:"burst"`          // number of the packet's burst in its window from 1, 0 if not sent in bursts
+	BurstPos       int           `json:"burst_pos"`      // number of the packet in its burst from 1, 0 if not sent in bursts
+	Ascending      bool          `json:"ascending"`      // sent on the way from the start values to the end values, see RampTriangle
+	ReplySource    string        `json:"reply_src"`      // address:port the reflection came from, empty for a dropped packet
+	Corrupted      bool          `json:"corrupted"`      // the payload reached the reflector changed, see Config.VerifyPayload
+	ReplyLength    int           `json:"reply_length"`   // bytes in the reflection, 0 for a dropped packet
+	Target         string        `json:"target"`         // reflector address the packet was sent to, see Config.Failover, else ""
+	Fragmented     bool          `json:"fragmented"`     // too long for the interface it was sent out of, so sent in fragments
+
+	// ClockOffset is the estimated offset of the reflector's clock from the sender's, see Config.EstimateOffset, and
+	// CorrectedForwardOWD and CorrectedReverseOWD are ForwardOWD and ReverseOWD corrected by it, which doesn't need
+	// the clocks synchronized. All three are 0, and null in the database, unless offsetKnown.
+	ClockOffset         int64 `json:"clock_offset"`
+	CorrectedForwardOWD int64 `json:"owd_forward_corrected"`
+	CorrectedReverseOWD int64 `json:"owd_reverse_corrected"`
+	offsetKnown         bool
+
+	// ReverseTTL is the reply's delta TTL, the TTL it arrived with less the TTL the reflector sent it with, as
+	// TTL is the sender packet's. It is 0, and null in the database, unless reverseTTLKnown, which needs a ModeLegacy
+	// reflector run with a reply TTL (see reflector.Config.ReplyTTL) answering over UDP without a proxy.
+	ReverseTTL      int64 `json:"delta_ttl_reverse"`
+	reverseTTLKnown bool
+
+	// Labels are Config.Labels, on every report so that the reports of many runs streamed to one place can be told
+	// apart. They aren't stored in the rtt table, as the database's run_meta has them.
+	Labels Labels `json:"labels,omitempty"`
+
+	// dropCount, if above 0, makes a dropped report stand for that many packets dropped in a row, from
+	// SequenceNumber to dropLast, see Config.SummarizeDrops
+	dropCount int
+	dropLast  int
+}
+
+// drops returns the number of packets r is a drop of
+func (r Report) drops() int {
+	if !r.Dropped {
+		return 0
+	}
+	return max(r.dropCount, 1)
+}
+
+// Summary holds the totals for a run
+type Summary struct {
+	Sent        int `json:"sent"`         // packets sent
+	Received    int `json:"received"`     // packets reflected back
+	Dropped     int `json:"dropped"`      // packets sent but never reflected back
+	ForwardLoss int `json:"forward_loss"` // dropped packets that never reached the reflector
+	ReverseLoss int `json:"reverse_loss"` // dropped packets that reached the reflector but were not returned
+	// ForwardReordered and ReverseReordered are the received packets that were reordered on the way to the
+	// reflector and on the way back
+	ForwardReordered int `json:"forward_reordered"`
+	ReverseReordered int `json:"reverse_reordered"`
+	NegativeOWD      int `json:"negative_owd"` // received packets with a negative one-way delay, a sign of clock skew
+	Duplicates       int `json:"duplicates"`   // extra copies of received packets, which aren't counted in Received
+	Corrupted        int `json:"corrupted"`    // received packets whose payload reached the reflector changed
+	SendErrors       int `json:"send_errors"`  // packets that failed to send even after retrying
+	WriteErrors      int `json:"write_errors"` // reports that could not be written to the output
+	Rejected         int `json:"rejected"`     // packets from a source other than the reflector, see Config.AnySource
+	// ReportsDropped is the reports dropped because the output fell behind, see Config.ReportQueueLen. They are
+	// missing from the output and from the other totals, but weren't lost on the network.
+	ReportsDropped int `json:"reports_dropped"`
+	// Injected is the packets kept from being sent by Config.DropRate, which are counted in Sent and as lost
+	Injected int `json:"injected,omitempty"`
+	// MeanOfferedBitrate and PeakOfferedBitrate are the average and highest offered bitrates of the windows sent, in
+	// bits per second
+	MeanOfferedBitrate int64    `json:"mean_offered_bps"`
+	PeakOfferedBitrate int64    `json:"peak_offered_bps"`
+	RTT                RTTStats `json:"rtt"`
+	// RTTHistogram counts the RTTs in bins, from the lowest bin with a count to the highest, see Config.HistogramBin
+	RTTHistogram []HistogramBin `json:"rtt_histogram"`
+	// MinDeltaTTL and MaxDeltaTTL are the range of delta TTL of the received packets, and RouteChanges how many of
+	// them were flagged as a route change
+	MinDeltaTTL  int64 `json:"min_delta_ttl"`
+	MaxDeltaTTL  int64 `json:"max_delta_ttl"`
+	RouteChanges int   `json:"route_changes"`
+	// ReplySources are the addresses reflections came from, in the order they were first seen, and SourceChanges
+	// how many times the address changed from one reflection to the next, as when a NAT in front of the reflector
+	// rebinds or fails over. Neither is kept for a multicast group, whose reflectors each have their own address.
+	ReplySources  []string `json:"reply_sources,omitempty"`
+	SourceChanges int      `json:"source_changes"`
+	// Failovers is how many times the reflector went silent and the next of its addresses was probed, see
+	// Config.Failover
+	Failovers int `json:"failovers"`
+	// Playout is how a video receiver with a jitter buffer would have played the run out, nil unless
+	// Config.JitterBuffer is set
+	Playout *PlayoutStats `json:"playout,omitempty"`
+	// ClockOffset is the reflector's clock offset from the sender's that the one-way delays were corrected by, nil
+	// unless Config.EstimateOffset is set
+	ClockOffset *OffsetEstimate `json:"clock_offset,omitempty"`
+	// Reflectors holds the totals of each reflector that answered a multicast group, in which case the totals above
+	// count the packets of every reflector, so Received can be more than Sent
+	Reflectors []ReflectorSummary `json:"reflectors,omitempty"`
+}
+
+// runMeta describes a run, and is written to the run_meta table and the summary file so that results say what
+// produced them
+type runMeta struct {
+	Reflector    string `json:"reflector"`
+	Listen       string `json:"listen"`
+	WindowSize   string `json:"window_size"`
+	PacketLen    string `json:"packet_length"`
+	Duration     int64  `json:"duration"` // nanoseconds
+	Count        int    `json:"count"`
+	Interval     int64  `json:"interval"` // nanoseconds
+	Schedule     string `json:"schedule"`
+	PPS          int    `json:"pps"`
+	Ramp         string `json:"ramp"`
+	RampSteps    int    `json:"ramp_steps"`
+	RampShape    string `json:"ramp_shape"`
+	Fill         string `json:"fill"`
+	Seed         int64  `json:"seed"`
+	SrcPorts     string `json:"src_ports"`
+	Warmup       int64  `json:"warmup"` // nanoseconds
+	Mode         string `json:"mode"`
+	Transport    string `json:"transport"`
+	RxTimestamps string `json:"timestamp_source"` // after any fallback, see TimestampSource
+	Timestamps   string `json:"timestamp_format"`
+	Format       int    `json:"reflector_format"`
+	MaxPacketLen int    `json:"max_packet_length"`
+	TTL          int    `json:"ttl"`
+	Replay       string `json:"replay"` // results database or capture replayed, empty for none
+	Version      string `json:"version"`
+	GitRev       string `json:"git_rev"`
+	Hostname     string `json:"hostname"`
+	StartTime    int64  `json:"start_time"` // nanoseconds since the epoch
+	Proxy        string `json:"proxy"`      // SOCKS5 proxy the packets went through, empty for none
+	SizeDist     string `json:"size_dist"`  // distribution the packet lengths were drawn from, empty for none
+	DSCP         int    `json:"dscp"`
+	// SummarizeDrops is set when the dropped packets are in the drops table rather than the rtt table
+	SummarizeDrops bool   `json:"summarize_drops"`
+	Labels         string `json:"labels"` // see Config.Labels, empty for none
+	// DropRate is the fraction of packets dropped on purpose, see Config.DropRate
+	DropRate float64 `json:"drop_rate"`
+}
+
+// newRunMeta returns the metadata of a run of cfg starting at start. The secret is left out.
+func newRunMeta(cfg Config, start time.Time) runMeta {
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("error getting hostname", "err", err)
+	}
+	srcPorts := ""
+	if cfg.SrcPorts.Len() > 0 {
+		srcPorts = cfg.SrcPorts.String()
+	}
+	return runMeta{
+		Reflector:    cfg.ReflectorAddr,
+		Listen:       cfg.ListenAddr,
+		WindowSize:   cfg.WindowSize.String(),
+		PacketLen:    cfg.PacketLen.String(),
+		Duration:     cfg.Duration.Nanoseconds(),
+		Count:        cfg.Count,
+		Interval:     cfg.interval().Nanoseconds(),
+		Schedule:     cfg.Schedule.String(),
+		PPS:          cfg.PPS,
+		Ramp:         cfg.Ramp.String(),
+		RampSteps:    cfg.RampSteps,
+		RampShape:    cfg.RampShape.String(),
+		Fill:         cfg.Fill.String(),
+		Seed:         cfg.Seed,
+		SrcPorts:     srcPorts,
+		Warmup:       cfg.Warmup.Nanoseconds(),
+		Mode:         cfg.Mode.String(),
+		Transport:    cfg.Transport.String(),
+		Timestamps:   cfg.TimestampFormat.String(),
+		Format:       ReflectorFormat,
+		MaxPacketLen: cfg.maxPacketLen(),
+		TTL:          cfg.ttl(),
+		Replay:       cfg.Replay + cfg.ReplayPcap, // only one can be set
+		Version:      cfg.Version,
+		GitRev:       cfg.GitRev,
+		Hostname:     hostname,
+		StartTime:    start.UnixNano(),
+		Proxy:        cfg.Proxy,
+		SizeDist:     cfg.SizeDist.String(),
+		DSCP:         cfg.DSCP,
+
+		SummarizeDrops: cfg.SummarizeDrops,
+		Labels:         cfg.Labels.String(),
+		DropRate:       cfg.DropRate,
+	}
+}
+
+// errWriteErrors is returned by the reporter when it gives up after Config.MaxWriteErrors reports in a row could
+// not be written
+var errWriteErrors = fmt.Errorf("%w: too many errors writing reports", ErrFatal)
+
+// reporter writes meta and then the reports from dbChan to the output at dbPath, see openOutput. When ctx is done it writes any
+// reports still queued in dbChan and then signals on done. An error setting up the database, or errWriteErrors, is
+// sent on done straight away. A report that can't be written is counted in Summary.WriteErrors and skipped.
+func (c *StampClient) reporter(ctx context.Context, dbPath string, meta runMeta, done chan error) {
+	done <- c.report(ctx, dbPath, meta)
+}
+
+func (c *StampClient) report(ctx context.Context, dbPath string, meta runMeta) error {
+	out, err := openOutput(dbPath, meta, outputOptions{influxToken: c.influxToken, wal: c.wal, encoding: c.encoding})
+	if err != nil {
+		return err
+	}
+	var rotate <-chan time.Time
+	if c.rotate > 0 {
+		ticker := time.NewTicker(c.rotate)
+		defer ticker.Stop()
+		rotate = ticker.C
+		c.startSegment()
+	}
+	var commit <-chan time.Time
+	if isDBPath(dbPath) {
+		ticker := time.NewTicker(dbCommitInterval)
+		defer ticker.Stop()
+		commit = ticker.C
+	}
+	start := time.Now()
+	var progress <-chan time.Time
+	if c.onProgress != nil {
+		c.rolling = NewRollingStats(ProgressLast)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Debug("reporter received done signal")
+			for {
+				select {
+				case r := <-c.dbChan:
+					err = c.record(out, r)
+					if err != nil {
+						c.closeOutput(out, dbPath, meta)
+						return err
+					}
+				default:
+					if c.onProgress != nil {
+						c.onProgress(c.snapshot(start))
+					}
+					c.logSummary()
+					return c.closeOutput(out, dbPath, meta)
+				}
+			}
+		case <-rotate:
+			// reports wait in dbChan while the databases are swapped, with queue waiting for room rather than
+			// dropping them if it fills up
+			c.swapping.Store(true)
+			err = c.closeOutput(out, dbPath, meta)
+			if err == nil {
+				out, err = openDB(dbPath, meta, c.wal)
+			}
+			c.swapping.Store(false)
+			if err != nil {
+				return err
+			}
+			c.startSegment()
+			slog.Info("rotated results database", "path", dbPath)
+		case <-commit:
+			lost, cerr := out.(*dbOutput).commit()
+			if cerr != nil {
+				err = c.writeFailed(lost, cerr)
+				if err != nil {
+					c.closeOutput(out, dbPath, meta)
+					return err
+				}
+			}
+		case <-progress:
+			c.onProgress(c.snapshot(start))
+		case r := <-c.dbChan:
+			err = c.record(out, r)
+			if err != nil {
+				c.closeOutput(out, dbPath, meta) // most likely failing too, err says why
+				return err
+			}
+		}
+	}
+}
+
+// closeOutput closes out, first writing the RTT histogram to it if it is a database. If the database is being
+// rotated it is then moved out of the way to its segmentPath, and the summary of the segment written beside it.
+func (c *StampClient) closeOutput(out output, dbPath string, meta runMeta) error {
+	db, ok := out.(*dbOutput)
+	if !ok {
+		out.close()
+		return nil
+	}
+	t := &c.tally
+	if c.segment != nil {
+		t = c.segment
+	}
+	// the histogram is written outside the transaction, which would lock it out
+	lost, err := db.commit()
+	if err != nil {
+		err = c.writeFailed(lost, err)
+	}
+	if err == nil {
+		err = writeHistogram(db.db, t.histogram.bins())
+	}
+	db.close()
+	if err != nil || c.segment == nil {
+		return err
+	}
+	path := segmentPath(dbPath, c.segmentStart)
+	err = os.Rename(dbPath, path)
+	if err != nil {
+		return fmt.Errorf("error rotating database: %w", err)
+	}
+	return writeSummary(path+".summary.json", summaryFile{
+		Summary:      c.segment.segmentSummary(),
+		Run:          meta,
+		SegmentStart: c.segmentStart.UnixNano(),
+		SegmentEnd:   time.Now().UnixNano(),
+	})
+}
+
+// startSegment starts counting the reports of a new rotated database
+func (c *StampClient) startSegment() {
+	c.segment = &tally{histogram: newHistogram(c.histogramBin)}
+	c.segmentStart = time.Now()
+}
+
+// segmentPath returns the path a rotated database at dbPath, opened at start, is moved to: dbPath with the UTC
+// time added before the extension, such as /tmp/rtt-20221025T140322Z.db
+func segmentPath(dbPath string, start time.Time) string {
+	ext := filepath.Ext(dbPath)
+	return strings.TrimSuffix(dbPath, ext) + "-" + start.UTC().Format("20060102T150405Z") + ext
+}
+
+// isDBPath reports whether path is of a database, rather than one of the other outputs of openOutput
+func isDBPath(path string) bool {
+	return path != "" && !strings.HasPrefix(path, "unix://") && !strings.HasPrefix(path, "influx://") &&
+		!strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://")
+}
+
+// output is where the reports of a run are written
+type output interface {
+	write(r Report) error
+	close()
+}
+
+// nullOutput discards the reports written to it, which are still counted in the summary
+type nullOutput struct{}
+
+func (nullOutput) write(Report) error { return nil }
+
+func (nullOutput) close() {}
+
+// outputOptions are the settings of the outputs that have any
+type outputOptions struct {
+	influxToken string   // for an InfluxDB URL, empty for none
+	wal         bool     // for a database, see openDB
+	encoding    Encoding // for a socket
+}
+
+// openOutput opens the output at path, which is one of
+//
+//	unix:///path/to.sock                      stream reports to a socket as JSON lines, or CBOR
+//	influx:///path/to/file                    write reports to a file as InfluxDB line protocol
+//	http://host:8086/api/v2/write?bucket=...  POST reports to InfluxDB as line protocol
+//	""                                        discard reports, see Config.NoDB
+//
+// or else the path of a database to create.
+func openOutput(path string, meta runMeta, opts outputOptions) (output, error) {
+	if path == "" {
+		return nullOutput{}, nil
+	}
+	sockPath, ok := strings.CutPrefix(path, "unix://")
+	if ok {
+		return newSocketOutput(sockPath, opts.encoding), nil
+	}
+	filePath, ok := strings.CutPrefix(path, "influx://")
+	if ok {
+		return openInfluxFile(filePath, meta.Reflector)
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return newInfluxHTTP(path, opts.influxToken, meta.Reflector), nil
+	}
+	return openDB(path, meta, opts.wal)
+}
+
+const (
+	dbBatchLen       = 1000                   // most reports inserted in one transaction
+	dbCommitInterval = 500 * time.Millisecond // longest a report waits to be committed
+	// DefaultReportQueueLen is the default Config.ReportQueueLen, long enough to hold the reports that arrive
+	// while a transaction is committed without holding up the receiver
+	DefaultReportQueueLen = 4 * dbBatchLen
+)
+
+// dbOutput writes reports to the rtt table of a SQLite database. Reports are inserted in transactions of up to
+// dbBatchLen, rather than each committed on its own, and the reporter commits whatever has built up every
+// dbCommitInterval, so that a crash loses at most that much of the run and leaves a valid database.
+type dbOutput struct {
+	db         *sql.DB
+	insert     *sql.Stmt // prepared on db
+	insertDrop *sql.Stmt // into the drops table, prepared on db
+	tx         *sql.Tx   // the transaction being built up, nil for none
+	stmt       *sql.Stmt // insert, in tx
+	dropStmt   *sql.Stmt // insertDrop, in tx
+	pending    int       // reports inserted in tx
+}
+
+// openDB creates the database at dbPath, replacing any there already, and writes meta to it. With wal the database
+// is written in write-ahead log mode with synchronous=NORMAL, so that it can be read while the run goes on without
+// holding up the writer, at the cost of the last commits if the host loses power.
+func openDB(dbPath string, meta runMeta, wal bool) (*dbOutput, error) {
+	err := os.MkdirAll(filepath.Dir(dbPath), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating database directory: %w", err)
+	}
+	os.Remove(dbPath)
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+	dsn := dbPath
+	if wal {
+		dsn += "?_journal_mode=WAL&_synchronous=NORMAL" // applied to every connection
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlStmt := `
+	create table rtt (id integer primary key asc, sequence_number integer not null, window_size integer, packet_length integer, rtt numeric, delta_ttl numeric,
+	                  owd_forward numeric, owd_reverse numeric, loss_direction text, timestamp integer, route_changed boolean,
+	                  src_port integer, warmup boolean, offered_bps integer, duplicate boolean, reflector_seq integer,
+	                  reordered text, reflector text, burst integer, burst_pos integer, turnaround numeric, network_rtt numeric,
+	                  ascending boolean, reply_src text, corrupted boolean, reply_length integer, target text,
+	                  clock_offset integer, owd_forward_corrected integer, owd_reverse_corrected integer,
+	                  delta_ttl_reverse numeric, fragmented boolean);
+	delete from rtt;
+	create table drops (first_seq integer, last_seq integer, count integer, loss_direction text, timestamp integer,
+	                    warmup boolean, src_port integer, reflector text);
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+	err = writeRunMeta(db, meta)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	stmt, err := db.Prepare("insert into rtt(sequence_number, window_size, packet_length, rtt, delta_ttl, owd_forward, owd_reverse, loss_direction, timestamp, route_changed, src_port, warmup, offered_bps, duplicate, reflector_seq, reordered, reflector, burst, burst_pos, turnaround, network_rtt, ascending, reply_src, corrupted, reply_length, target, clock_offset, owd_forward_corrected, owd_reverse_corrected, delta_ttl_reverse, fragmented) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	dropStmt, err := db.Prepare("insert into drops(first_seq, last_seq, count, loss_direction, timestamp, warmup, src_port, reflector) values(?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		stmt.Close()
+		db.Close()
+		return nil, err
+	}
+	return &dbOutput{db: db, insert: stmt, insertDrop: dropStmt}, nil
+}
+
+// write inserts r into the rtt table, or a range of drops into the drops table, committing the transaction once it
+// holds dbBatchLen reports
+func (o *dbOutput) write(r Report) error {
+	var err error
+	if o.tx == nil {
+		o.tx, err = o.db.Begin()
+		if err != nil {
+			return err
+		}
+		o.stmt = o.tx.Stmt(o.insert)
+		o.dropStmt = o.tx.Stmt(o.insertDrop)
+	}
+	reflector := sql.NullString{String: r.Reflector, Valid: r.Reflector != ""}
+	burst := sql.NullInt64{Int64: int64(r.Burst), Valid: r.Burst > 0}
+	burstPos := sql.NullInt64{Int64: int64(r.BurstPos), Valid: r.BurstPos > 0}
+	target := sql.NullString{String: r.Target, Valid: r.Target != ""}
+	if r.Dropped {
+		direction := sql.NullString{}
+		if r.Direction != LossUnknown {
+			direction = sql.NullString{String: r.Direction.String(), Valid: true}
+		}
+		if r.dropCount > 0 {
+			_, err = o.dropStmt.Exec(r.SequenceNumber, r.dropLast, r.dropCount, direction, r.Timestamp, r.Warmup,
+				r.SourcePort, reflector)
+		} else {
+			_, err = o.stmt.Exec(r.SequenceNumber, sql.NullInt32{}, sql.NullInt32{}, sql.NullInt64{}, sql.NullInt64{},
+				sql.NullInt64{}, sql.NullInt64{}, direction, r.Timestamp, sql.NullBool{}, r.SourcePort, r.Warmup, offeredBitrate(r), false,
+				sql.NullInt64{}, sql.NullString{}, reflector, burst, burstPos, sql.NullInt64{}, sql.NullInt64{}, r.Ascending, sql.NullString{},
+				sql.NullBool{}, sql.NullInt32{}, target, sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{},
+				r.Fragmented)
+		}
+	} else {
+		reordered := sql.NullString{}
+		if r.Reordered != LossUnknown {
+			reordered = sql.NullString{String: r.Reordered.String(), Valid: true}
+		}
+		turnaround := sql.NullInt64{Int64: r.Turnaround, Valid: r.Turnaround > 0}
+		networkRTT := sql.NullInt64{Int64: r.NetworkRTT, Valid: r.Turnaround > 0}
+		replySrc := sql.NullString{String: r.ReplySource, Valid: r.ReplySource != ""}
+		offset := sql.NullInt64{Int64: r.ClockOffset, Valid: r.offsetKnown}
+		forward := sql.NullInt64{Int64: r.CorrectedForwardOWD, Valid: r.offsetKnown}
+		reverse := sql.NullInt64{Int64: r.CorrectedReverseOWD, Valid: r.offsetKnown}
+		reverseTTL := sql.NullInt64{Int64: r.ReverseTTL, Valid: r.reverseTTLKnown}
+		_, err = o.stmt.Exec(r.SequenceNumber, r.WindowSize, r.PacketLength, r.MeasuredRTT, r.TTL, r.ForwardOWD, r.ReverseOWD,
+			sql.NullString{}, r.Timestamp, r.RouteChanged, r.SourcePort, r.Warmup, offeredBitrate(r), r.Duplicate,
+			r.ReflectorSeq, reordered, reflector, burst, burstPos, turnaround, networkRTT, r.Ascending, replySrc,
+			r.Corrupted, r.ReplyLength, target, offset, forward, reverse, reverseTTL, r.Fragmented)
+	}
+	if err != nil {
+		return err
+	}
+	o.pending++
+	if o.pending >= dbBatchLen {
+		lost, err := o.commit()
+		if err != nil {
+			return &commitError{lost: lost, err: err}
+		}
+	}
+	return nil
+}
+
+// commitError is returned by dbOutput.write when the commit of a full transaction fails, losing every report in it
+type commitError struct {
+	lost int
+	err  error
+}
+
+func (e *commitError) Error() string { return e.err.Error() }
+func (e *commitError) Unwrap() error { return e.err }
+
+// commit commits the reports inserted since the last commit, if any. If the commit fails they are lost, and how
+// many is returned with the error.
+func (o *dbOutput) commit() (int, error) {
+	if o.tx == nil {
+		return 0, nil
+	}
+	pending := o.pending
+	err := o.tx.Commit()
+	o.tx, o.stmt, o.dropStmt, o.pending = nil, nil, nil, 0
+	if err != nil {
+		return pending, fmt.Errorf("error committing %d reports: %w", pending, err)
+	}
+	return 0, nil
+}
+
+func (o *dbOutput) close() {
+	lost, err := o.commit()
+	if err != nil {
+		slog.Error("error closing database", "lost", lost, "err", err)
+	}
+	o.insert.Close()
+	o.insertDrop.Close()
+	o.db.Close()
+}
+
+// writeRunMeta creates the run_meta table and writes the one row of meta to it
+func writeRunMeta(db *sql.DB, meta runMeta) error {
+	sqlStmt := `
+	create table run_meta (reflector text, listen text, window_size text, packet_length text, duration integer, count integer,
+	                       interval integer, schedule text, pps integer, ramp text, ramp_steps integer, ramp_shape text, fill text, seed integer, src_ports text,
+	                       warmup integer, mode text, transport text, timestamp_source text, timestamp_format text, reflector_format integer, max_packet_length integer, ttl integer,
+	                       replay text, version text, git_rev text, hostname text, start_time integer, proxy text,
+	                       size_dist text, dscp integer, summarize_drops boolean, labels text, drop_rate numeric);
+	`
+	_, err := db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+	_, err = db.Exec("insert into run_meta values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		meta.Reflector, meta.Listen, meta.WindowSize, meta.PacketLen, meta.Duration, meta.Count, meta.Interval, meta.Schedule, meta.PPS,
+		meta.Ramp, meta.RampSteps, meta.RampShape, meta.Fill, meta.Seed, meta.SrcPorts, meta.Warmup, meta.Mode, meta.Transport, meta.RxTimestamps, meta.Timestamps,
+		meta.Format, meta.MaxPacketLen, meta.TTL, meta.Replay, meta.Version, meta.GitRev, meta.Hostname, meta.StartTime, meta.Proxy, meta.SizeDist, meta.DSCP, meta.SummarizeDrops,
+		meta.Labels, meta.DropRate)
+	if err != nil {
+		return fmt.Errorf("error writing run metadata: %w", err)
+	}
+	return nil
+}
+
+// record writes one report to out and counts it in the summary, and that of the segment if the database is being
+// rotated. A report that can't be written is logged and counted, unless it is one of a run of failures, in which
+// case the run is logged when it ends. A failed commit counts every report in the transaction it lost.
+// errWriteErrors is returned once writeLimit reports in a row have failed.
+func (c *StampClient) record(out output, r Report) error {
+	if r.Dropped {
+		c.logPacket(slog.LevelDebug, "dropped", "seq", r.SequenceNumber, "direction", r.Direction)
+	}
+	c.tally.add(r)
+	if c.segment != nil {
+		c.segment.add(r)
+	}
+	if c.playout != nil {
+		c.playout.Add(r)
+	}
+	if c.rolling != nil {
+		c.rolling.Add(r)
+		if !r.Dropped {
+			c.latest = r
+		}
+	}
+	r.Labels = c.labels
+	err := out.write(r)
+	if err != nil {
+		lost := 1
+		var ce *commitError
+		if errors.As(err, &ce) {
+			lost = ce.lost // the whole transaction r was committed in
+		}
+		return c.writeFailed(lost, err, "seq", r.SequenceNumber)
+	}
+	if c.failedWrites > 0 {
+		slog.Warn("recording reports again", "failed", c.failedWrites)
+		c.failedWrites = 0
+	}
+	return nil
+}
+
+// writeFailed counts n reports that weren't written because of err in the summary, and that of the segment if the
+// database is being rotated, and against writeLimit, logging err with args if it starts a run of failures.
+// errWriteErrors is returned once writeLimit reports in a row have failed.
+func (c *StampClient) writeFailed(n int, err error, args ...any) error {
+	c.summary.WriteErrors += n
+	if c.segment != nil {
+		c.segment.summary.WriteErrors += n
+	}
+	if c.failedWrites == 0 {
+		slog.Error("error recording reports, carrying on", append(args, "reports", n, "err", err)...)
+	}
+	c.failedWrites += n
+	if c.writeLimit > 0 && c.failedWrites >= c.writeLimit {
+		return fmt.Errorf("%w: %d in a row, the last: %v", errWriteErrors, c.failedWrites, err)
+	}
+	return nil
+}
+
+// tally counts reports into a summary, along with the RTTs of the received packets
+type tally struct {
+	summary    Summary
+	rtts       rttSamples                 // of the packets received after the warmup
+	histogram  *histogram                 // of the same RTTs as rtts
+	reflectors map[string]*reflectorTally // by address, when sending to a multicast group
+}
+
+// add counts r, unless it is from the warmup
+func (t *tally) add(r Report) {
+	summary := &t.summary
+	if r.Warmup {
+		summary = &Summary{} // still recorded, just not counted
+	}
+	if r.Duplicate {
+		summary.Duplicates++
+	} else if r.Dropped {
+		summary.Dropped += r.drops()
+		switch r.Direction {
+		case LossForward:
+			summary.ForwardLoss += r.drops()
+		case LossReverse:
+			summary.ReverseLoss += r.drops()
+		}
+	} else {
+		summary.Received++
+		switch r.Reordered {
+		case LossForward:
+			summary.ForwardReordered++
+		case LossReverse:
+			summary.ReverseReordered++
+		}
+		if r.ForwardOWD < 0 || r.ReverseOWD < 0 {
+			summary.NegativeOWD++
+		}
+		if summary.Received == 1 || r.TTL < summary.MinDeltaTTL {
+			summary.MinDeltaTTL = r.TTL
+		}
+		if summary.Received == 1 || r.TTL > summary.MaxDeltaTTL {
+			summary.MaxDeltaTTL = r.TTL
+		}
+		if r.RouteChanged {
+			summary.RouteChanges++
+		}
+		if r.Corrupted {
+			summary.Corrupted++
+		}
+		if !r.Warmup {
+			t.rtts.add(r.MeasuredRTT)
+			t.histogram.add(r.MeasuredRTT)
+		}
+	}
+	if r.Reflector != "" && !r.Warmup {
+		t.reflector(r.Reflector).add(r)
+	}
+}
+
+// segmentSummary returns the summary of a rotated database. Packets are counted in the database their result
+// is in, so Sent is the packets received or dropped; send errors and offered bitrates are only in the run's summary.
+func (t *tally) segmentSummary() Summary {
+	s := t.summary
+	s.Sent = s.Received + s.Dropped
+	s.RTT = t.rtts.stats()
+	s.RTTHistogram = t.histogram.bins()
+	s.Reflectors = t.reflectorSummaries()
+	return s
+}
+
+// offeredBitrate returns the offered bitrate of r for the database, null if it isn't known
+func offeredBitrate(r Report) sql.NullInt64 {
+	return sql.NullInt64{Int64: r.OfferedBitrate, Valid: r.OfferedBitrate != 0}
+}
+
+// logSummary logs the end-of-run notes gathered by the reporter
+func (c *StampClient) logSummary() {
+	slog.Info("one-way delays (owd_forward, owd_reverse) assume the sender and reflector clocks are synchronized")
+	if c.estOffset {
+		slog.Info("corrected one-way delays (owd_forward_corrected, owd_reverse_corrected) assume instead that " + offsetAssumption)
+	}
+	if c.summary.NegativeOWD > 0 {
+		slog.Warn("packets had a negative one-way delay: the sender and reflector clocks are likely skewed",
+			"packets", c.summary.NegativeOWD)
+	}
+}
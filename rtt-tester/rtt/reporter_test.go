@@ -0,0 +1,365 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRotateKeepsEveryReport(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	c := &StampClient{dbChan: make(chan Report, 100), tally: tally{histogram: newHistogram(0)}, rotate: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go c.reporter(ctx, dbPath, runMeta{}, done)
+	const reports = 100
+	for i := 0; i < reports; i++ {
+		c.dbChan <- Report{SequenceNumber: i, MeasuredRTT: int64(time.Millisecond)}
+		time.Sleep(25 * time.Millisecond) // over two rotations, as databases are named to the second
+	}
+	cancel()
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("%s is still there after the last rotation: %v", dbPath, err)
+	}
+	segments, err := filepath.Glob(filepath.Join(filepath.Dir(dbPath), "rtt-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("got %d databases, want the reports spread over several", len(segments))
+	}
+	rows, received := 0, 0
+	for _, path := range segments {
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		err = db.QueryRow("select count(*) from rtt").Scan(&n)
+		db.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		rows += n
+		b, err := os.ReadFile(path + ".summary.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sf summaryFile
+		err = json.Unmarshal(b, &sf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sf.Received != n || sf.SegmentStart == 0 || sf.SegmentEnd < sf.SegmentStart {
+			t.Errorf("%s has %d rows, but its summary says %d received from %d to %d", path, n, sf.Received,
+				sf.SegmentStart, sf.SegmentEnd)
+		}
+		received += sf.Received
+	}
+	if rows != reports || received != reports {
+		t.Errorf("%d rows and %d received across the databases, want %d", rows, received, reports)
+	}
+}
+
+// TestRotateUnderLoadDropsNothing queues reports at 4000 a second over two rotations and checks that every one is
+// written to one of the databases
+func TestRotateUnderLoadDropsNothing(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	c := &StampClient{dbChan: make(chan Report, 100), tally: tally{histogram: newHistogram(0)}, rotate: time.Second,
+		quiet: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go c.reporter(ctx, dbPath, runMeta{}, done)
+	reports := 0
+	start := time.Now()
+	for next := start; time.Since(start) < 2200*time.Millisecond; next = next.Add(250 * time.Microsecond) {
+		for time.Now().Before(next) {
+			runtime.Gosched()
+		}
+		c.queue(ctx, Report{SequenceNumber: reports, MeasuredRTT: int64(time.Millisecond)})
+		reports++
+	}
+	cancel() // the reporter writes what is still queued before it returns
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := filepath.Glob(filepath.Join(filepath.Dir(dbPath), "rtt-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("got %d databases, want at least two rotations", len(segments))
+	}
+	rows := 0
+	for _, path := range segments {
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		err = db.QueryRow("select count(*) from rtt").Scan(&n)
+		db.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		rows += n
+	}
+	if c.reportDrops != 0 || rows != reports {
+		t.Errorf("%d reports dropped and %d written of %d queued, want none dropped", c.reportDrops, rows, reports)
+	}
+}
+
+func TestQueueWaitsWhileSwapping(t *testing.T) {
+	c := &StampClient{dbChan: make(chan Report, 1), quiet: true}
+	ctx := context.Background()
+	c.queue(ctx, Report{SequenceNumber: 0})
+	c.swapping.Store(true)
+	queued := make(chan bool)
+	go func() {
+		queued <- c.queue(ctx, Report{SequenceNumber: 1})
+	}()
+	select {
+	case <-queued:
+		t.Fatal("report queued to a full queue while swapping, want it to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if r := <-c.dbChan; r.SequenceNumber != 0 {
+		t.Errorf("got report %d first, want 0", r.SequenceNumber)
+	}
+	<-queued
+	if r := <-c.dbChan; r.SequenceNumber != 1 || c.reportDrops != 0 {
+		t.Errorf("got report %d and %d dropped, want 1 and none", r.SequenceNumber, c.reportDrops)
+	}
+	c.swapping.Store(false)
+	c.queue(ctx, Report{SequenceNumber: 2})
+	c.queue(ctx, Report{SequenceNumber: 3})
+	if c.reportDrops != 1 {
+		t.Errorf("%d dropped to a full queue, want 1 once the swap is over", c.reportDrops)
+	}
+}
+
+func TestNoDBStillCounts(t *testing.T) {
+	c := &StampClient{dbChan: make(chan Report, 100), tally: tally{histogram: newHistogram(0)}}
+	c.dbChan <- Report{SequenceNumber: 0, MeasuredRTT: int64(time.Millisecond)}
+	c.dbChan <- Report{SequenceNumber: 1, Dropped: true}
+	c.dbChan <- Report{SequenceNumber: 2, MeasuredRTT: int64(time.Millisecond)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // the queued reports are still drained
+	err := c.report(ctx, "", runMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.summary.Received != 2 || c.summary.Dropped != 1 {
+		t.Errorf("got %d received and %d dropped, want 2 and 1", c.summary.Received, c.summary.Dropped)
+	}
+}
+
+// failingOutput fails every write while failing is set
+type failingOutput struct {
+	failing bool
+	written int
+}
+
+func (o *failingOutput) write(r Report) error {
+	if o.failing {
+		return errors.New("disk full")
+	}
+	o.written++
+	return nil
+}
+
+func (o *failingOutput) close() {}
+
+func TestWriteErrorsAreCounted(t *testing.T) {
+	c := &StampClient{tally: tally{histogram: newHistogram(0)}, writeLimit: 3}
+	out := &failingOutput{failing: true}
+	for i := 0; i < 2; i++ {
+		if err := c.record(out, Report{}); err != nil {
+			t.Fatalf("write error %d stopped the reporter: %v", i+1, err)
+		}
+	}
+	out.failing = false
+	if err := c.record(out, Report{}); err != nil {
+		t.Fatalf("successful write returned %v", err)
+	}
+	out.failing = true
+	for i := 0; i < 2; i++ {
+		if err := c.record(out, Report{}); err != nil {
+			t.Fatalf("write error %d after a success stopped the reporter: %v", i+1, err)
+		}
+	}
+	if err := c.record(out, Report{}); !errors.Is(err, errWriteErrors) {
+		t.Errorf("third write error in a row returned %v, want errWriteErrors", err)
+	}
+	if c.summary.WriteErrors != 5 || c.summary.Received != 6 || out.written != 1 {
+		t.Errorf("%d write errors, %d received and %d written, want 5, 6 and 1", c.summary.WriteErrors,
+			c.summary.Received, out.written)
+	}
+}
+
+func TestDBCommitsInBatches(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	out, err := openDB(dbPath, runMeta{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.close()
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	committed := func() int {
+		var n int
+		err := db.QueryRow("select count(*) from rtt").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for seq := 0; seq <= dbBatchLen; seq++ {
+		err = out.write(Report{SequenceNumber: seq})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := committed(); n != dbBatchLen {
+		t.Errorf("%d reports committed, want the first batch of %d", n, dbBatchLen)
+	}
+	_, err = out.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := committed(); n != dbBatchLen+1 {
+		t.Errorf("%d reports committed, want %d", n, dbBatchLen+1)
+	}
+}
+
+// failCommit makes the next commit of out fail, with a deferred foreign key its open transaction breaks
+func failCommit(t *testing.T, out *dbOutput) {
+	t.Helper()
+	_, err := out.tx.Exec("create table parent (id integer primary key); " +
+		"create table child (parent integer references parent(id) deferrable initially deferred); " +
+		"insert into child values (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedCommitCountsEveryReport(t *testing.T) {
+	out, err := openDB(filepath.Join(t.TempDir(), "rtt.db"), runMeta{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.close()
+	out.db.SetMaxOpenConns(1) // the transaction gets the connection with foreign keys on
+	_, err = out.db.Exec("pragma foreign_keys = on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &StampClient{tally: tally{histogram: newHistogram(0)}, writeLimit: dbBatchLen}
+	for seq := 0; seq < 5; seq++ {
+		if err := c.record(out, Report{SequenceNumber: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failCommit(t, out)
+	lost, err := out.commit()
+	if err == nil || lost != 5 {
+		t.Fatalf("commit lost %d reports and returned %v, want 5 and an error", lost, err)
+	}
+	if err := c.writeFailed(lost, err); err != nil {
+		t.Fatalf("%d lost reports stopped the reporter: %v", lost, err)
+	}
+	// the driver leaves the transaction open after a failed constraint, where sqlite rolls it back after the I/O
+	// errors that fail commits for real
+	_, err = out.db.Exec("rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 5; seq < 5+dbBatchLen-1; seq++ {
+		if err := c.record(out, Report{SequenceNumber: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failCommit(t, out)
+	err = c.record(out, Report{SequenceNumber: 5 + dbBatchLen})
+	if !errors.Is(err, errWriteErrors) {
+		t.Errorf("losing a full batch returned %v, want errWriteErrors", err)
+	}
+	if c.summary.WriteErrors != 5+dbBatchLen {
+		t.Errorf("%d write errors, want %d", c.summary.WriteErrors, 5+dbBatchLen)
+	}
+}
+
+func TestWALDatabaseCanBeReadDuringTheRun(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	out, err := openDB(dbPath, runMeta{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.close()
+	err = out.write(Report{SequenceNumber: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = out.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = out.write(Report{SequenceNumber: 2}) // leaves a transaction open
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode string
+	var n int
+	err = db.QueryRow("pragma journal_mode").Scan(&mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow("select count(*) from rtt").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" || n != 1 {
+		t.Errorf("journal mode %q with %d reports readable, want wal with the 1 committed", mode, n)
+	}
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/net_tstamp.h and linux/sockios.h
+const (
+	siocshwtstamp       = 0x89b0
+	hwtstampTxOn        = 1
+	hwtstampFilterAll   = 1
+	timestampingRxHW    = 1 << 2 // SOF_TIMESTAMPING_RX_HARDWARE
+	timestampingRxSW    = 1 << 3 // SOF_TIMESTAMPING_RX_SOFTWARE
+	timestampingSW      = 1 << 4 // SOF_TIMESTAMPING_SOFTWARE
+	timestampingRawHW   = 1 << 6 // SOF_TIMESTAMPING_RAW_HARDWARE
+	timestampingRxFlags = timestampingRxHW | timestampingRxSW | timestampingSW | timestampingRawHW
+)
+
+// hwtstampConfig is struct hwtstamp_config
+type hwtstampConfig struct {
+	flags    int32
+	txType   int32
+	rxFilter int32
+}
+
+// ifreqHwtstamp is struct ifreq with ifr_data pointing at a hwtstampConfig
+type ifreqHwtstamp struct {
+	name [syscall.IFNAMSIZ]byte
+	data *hwtstampConfig
+	_    [16]byte // the rest of the union
+}
+
+// enableRxTimestamps asks the kernel to timestamp the packets the socket receives, so that the time a reflection
+// arrived doesn't include the wait for the receiving goroutine to be scheduled. With TimestampHardware, iface is
+// set to timestamp every packet it sends and receives with its PTP clock, and the socket asks for those timestamps,
+// with the kernel's as well for any packet the NIC doesn't stamp.
+func enableRxTimestamps(rc syscall.RawConn, source TimestampSource, iface string) error {
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		switch source {
+		case TimestampSoftware:
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+		case TimestampHardware:
+			serr = enableHWTimestamps(int(fd), iface)
+			if serr == nil {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, timestampingRxFlags)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("error enabling %s receive timestamps: %w", source, serr)
+	}
+	return nil
+}
+
+// enableHWTimestamps turns on hardware timestamping of all packets on iface with SIOCSHWTSTAMP, through the socket
+// fd
+func enableHWTimestamps(fd int, iface string) error {
+	if iface == "" {
+		return errors.New("hardware timestamps need an interface")
+	}
+	if len(iface) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("interface name %q is too long", iface)
+	}
+	cfg := hwtstampConfig{txType: hwtstampTxOn, rxFilter: hwtstampFilterAll}
+	ifr := ifreqHwtstamp{data: &cfg}
+	copy(ifr.name[:], iface)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocshwtstamp, uintptr(unsafe.Pointer(&ifr)))
+	switch {
+	case errno == 0:
+		return nil
+	case errno == syscall.EPERM:
+		return fmt.Errorf("setting up hardware timestamping on %s needs CAP_NET_ADMIN: %w", iface, errno)
+	default:
+		return fmt.Errorf("interface %s doesn't support hardware timestamping: %w", iface, errno)
+	}
+}
+
+// rxTimestamp returns the receive time in nanoseconds since the epoch from the control messages read with a packet:
+// the NIC's if it stamped the packet, and otherwise the kernel's. It returns false if there isn't one.
+func rxTimestamp(oob []byte) (int64, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET {
+			continue
+		}
+		switch m.Header.Type {
+		case syscall.SCM_TIMESTAMPNS:
+			return timespec(m.Data)
+		case syscall.SCM_TIMESTAMPING:
+			// three timespecs: software, deprecated, and raw hardware
+			size := len(m.Data) / 3
+			if t, ok := timespec(m.Data[2*size:]); ok && t != 0 {
+				return t, true
+			}
+			if t, ok := timespec(m.Data[:size]); ok && t != 0 {
+				return t, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// timespec decodes the struct timespec, of two longs, at the start of b into nanoseconds
+func timespec(b []byte) (int64, bool) {
+	switch {
+	case len(b) >= 16 && unsafe.Sizeof(uintptr(0)) == 8:
+		sec, nsec := binary.NativeEndian.Uint64(b), binary.NativeEndian.Uint64(b[8:])
+		return int64(sec)*1e9 + int64(nsec), true
+	case len(b) >= 8 && unsafe.Sizeof(uintptr(0)) == 4:
+		sec, nsec := binary.NativeEndian.Uint32(b), binary.NativeEndian.Uint32(b[4:])
+		return int64(int32(sec))*1e9 + int64(int32(nsec)), true
+	}
+	return 0, false
+}
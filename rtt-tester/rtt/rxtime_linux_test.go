@@ -0,0 +1,82 @@
+//go:build linux
+
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"stamp/wire"
+)
+
+func TestKernelRxTimestamp(t *testing.T) {
+	conn, source, _, err := listen(context.Background(), "127.0.0.1:0", SenderTTL, false, TimestampSoftware, "", wire.Buffers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if source != TimestampSoftware {
+		t.Fatalf("timestamps from %s, want software", source)
+	}
+	sender, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	time.Sleep(20 * time.Millisecond) // the kernel turns timestamping on in the background
+	before := time.Now().UnixNano()
+	if _, err := sender.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // received well before it is read
+	msgs := []ipv4.Message{{Buffers: [][]byte{make([]byte, 16)}, OOB: make([]byte, 128)}}
+	if _, err := conn.ReadBatch(msgs, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := rxTimestamp(msgs[0].OOB[:msgs[0].NN])
+	if !ok {
+		t.Fatal("no kernel receive timestamp")
+	}
+	if got < before || got > before+int64(25*time.Millisecond) {
+		t.Errorf("received %s after the write, want the time the kernel had it rather than the read", time.Duration(got-before))
+	}
+}
+
+func TestHardwareTimestampsUnsupported(t *testing.T) {
+	// the loopback interface has no PTP clock
+	conn, _, _, err := listen(context.Background(), "127.0.0.1:0", SenderTTL, false, TimestampHardware, "lo", wire.Buffers{})
+	if err == nil {
+		conn.Close()
+		t.Fatal("hardware timestamps enabled on lo")
+	}
+	if !strings.Contains(err.Error(), "lo") {
+		t.Errorf("error %q doesn't name the interface", err)
+	}
+}
@@ -0,0 +1,2055 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"stamp/wire"
+)
+
+const (
+	MaxPacketLen = 10000 // default for Config.MaxPacketLen
+	SenderTTL    = 123
+	HeaderLen    = 16 // sequence number, timestamp and window size
+
+	MaxSrcPorts = 1024 // most source ports to rotate through, each is a socket
+
+	ReflectorPacketLen = 48
+	FlagPrevSeqValid   = 1 << 0 // reflector flags: the previous sender sequence number is valid
+	FlagPayloadCRC     = 1 << 1 // reflector flags: the packet ends with the CRC of the sender packet's payload
+	// ReflectorFormat is the version of the reflector packet layout parsed, which the reflector sends after the
+	// flags. Older reflectors send 0, and are parsed by the length of the packet.
+	ReflectorFormat    = 1
+	reflectorFormatIdx = 42
+)
+
+// Config holds everything needed for one sender run
+type Config struct {
+	ReflectorAddr string        // address:port of the reflector
+	ListenAddr    string        // local address:port to send from and receive on
+	Interface     string        // name of the interface to send out of e.g. eth1, empty to let the OS choose
+	WindowSize    VarParam      // packets per window
+	PacketLen     VarParam      // bytes per packet
+	SizeDist      SizeDist      // packet lengths to draw each packet's from instead of PacketLen, if set
+	Duration      time.Duration // time to ramp over, 0 to run until ctx is done
+	Count         int           // number of packets to send and ramp over instead of a duration, 0 for none
+	Interval      time.Duration // sleep between windows, 0 for back-to-back
+	Schedule      Schedule      // whether Interval is fixed or the mean of random intervals
+	Transport     Transport     // UDP, or TCP for paths that block UDP
+	PPS           int           // packets per second within a window, 0 to send each window as a burst
+	Burst         int           // packets sent back-to-back in each burst within a window, 0 for one burst
+	BurstGap      time.Duration // idle time between the bursts of a window
+	Ramp          RampMode
+	RampSteps     int // number of increments when Ramp is RampStep
+	RampShape     RampShape
+	Fill          FillPattern
+	Seed          int64 // seed for FillRandom, SchedulePoisson, SizeDist and DropRate, each its own stream; 0 for the clock
+	// DBPath is the path of the results database, or a unix:// socket, influx:// line protocol file or InfluxDB
+	// http(s):// write URL to send the results to instead
+	DBPath string
+	Secret []byte // shared secret to authenticate packets to the reflector with, nil for none
+	// TTLThreshold is how far a packet's delta TTL can move from the first packet's before it is taken as a route
+	// change
+	TTLThreshold int
+	// SrcPorts, if set, is a range of ports to rotate through from packet to packet, one socket each, on the
+	// ListenAddr host, so that probes hash to different ECMP paths. The zero value sends from ListenAddr.
+	SrcPorts PortRange
+	// Warmup is how long to send at the start values before the ramp begins. Packets sent during it are recorded,
+	// marked as warmup, but left out of the summary.
+	Warmup time.Duration
+	// Mode is the packet format to send and expect back
+	Mode wire.Mode
+	// TimestampFormat is how timestamps are written in ModeLegacy packets, and must match the reflector's.
+	// ModeSTAMP always uses NTP.
+	TimestampFormat wire.TimestampFormat
+	// MaxPacketLen is the longest packet length allowed, which sizes the send and receive buffers. 0 means
+	// MaxPacketLen, and it can be raised as far as wire.MaxUDPPayload for jumbo frames.
+	MaxPacketLen int
+	// TTL is the TTL of the packets sent, which delta TTL is measured from. A low TTL makes them expire at that hop.
+	// 0 means SenderTTL.
+	TTL int
+	// DSCP is the differentiated services code point the packets are marked with, 0-63, such as 46 (EF) for the
+	// class a video call's media is sent in. 0 leaves them unmarked.
+	DSCP int
+	// DF sets the don't-fragment bit on outgoing packets, so that packets too long for the path are dropped
+	// rather than fragmented. It is only supported on Linux.
+	DF bool
+	// EstimateOffset estimates the offset of the reflector's clock from the sender's from the four timestamps of
+	// each reflection, as NTP does, assuming that the one with the lowest network RTT so far took as long each way,
+	// and corrects the one-way delays of each report by it, see Report.ClockOffset. The estimate only settles once a
+	// reflection has got through the queues on the path, and drifts with the clocks over a long run.
+	EstimateOffset bool
+	// VerifyPayload compares the CRC-32 of what each packet carried after its header with the one the reflector,
+	// run with reflector.Config.PayloadCRC, computed of what it received, flagging those that differ as
+	// Report.Corrupted. ModeLegacy only.
+	VerifyPayload bool
+	// RxTimestamps is where the receive time of each reflection is taken from. TimestampHardware needs Interface,
+	// and a NIC that supports it, on Linux.
+	RxTimestamps TimestampSource
+	// Clock is what send times, the times received packets fall back on and the ramp are taken from, nil for the
+	// system clock. Pacing and intervals are always timed by the system clock.
+	Clock wire.Clock
+	// Replay is the path of a results database whose windows are sent again, with the same number of packets and
+	// packet length in the same order, instead of the ramp. Empty for none.
+	Replay string
+	// ReplayPcap is the path of a pcap capture whose UDP packets are sent again instead of the ramp, each with the
+	// length of its payload at the time it was captured from the start of the capture, cut off at Duration if that is
+	// set. Packets captured within pcapBurstGap of each other are sent back-to-back as a window. Empty for none.
+	ReplayPcap string
+	// SendRetries is how many times to retry a packet that fails to send because the socket or interface is
+	// momentarily out of buffers, see wire.WriteTo. A packet that still fails counts as a send error.
+	SendRetries int
+	// SummaryPath is the path to write the summary of the run to as JSON when it ends, even if it is interrupted,
+	// empty for none
+	SummaryPath string
+	// HistogramBin is the width of the bins the RTTs are counted in for Summary.RTTHistogram, 0 for logarithmic
+	// bins, ten to a decade
+	HistogramBin time.Duration
+	// JitterBuffer is the depth of the jitter buffer the run is played out through for Summary.Playout, see Playout,
+	// 0 for none
+	JitterBuffer time.Duration
+	// Rotate is how often to close the results database and start a new one, 0 to write just the one. Each closed
+	// database is renamed with the time it was opened, see segmentPath, and the summary of the results in it
+	// written beside it. It can only be used with a database DBPath.
+	Rotate time.Duration
+	// Quiet leaves out the log messages about single packets, such as each one dropped or a reflection of the wrong
+	// length, which can flood the log of a lossy test. Other warnings and the summary are still logged, and every
+	// packet is still recorded.
+	Quiet bool
+	// WAL writes a database DBPath in SQLite's write-ahead log mode with synchronous=NORMAL, so that it can be
+	// queried during the run without blocking the writer. A crash of the sender loses nothing more, but a power
+	// failure can lose the last commits.
+	WAL bool
+	// Encoding is how reports are encoded for a unix:// DBPath
+	Encoding Encoding
+	// NoDB writes the reports nowhere, for a quick check that only needs the summary. DBPath is ignored.
+	NoDB bool
+	// SummarizeDrops records each run of packets dropped in a row as one row of the drops table, with the first and
+	// last sequence numbers and how many there were, instead of a row each in the rtt table, to keep the database
+	// small through heavy loss. The summary still counts every packet. Only for a database or NoDB.
+	SummarizeDrops bool
+	// AnySource accepts reflections from any address, rather than only from ReflectorAddr, for a reflector behind
+	// NAT or a load balancer that replies from another address. Packets from elsewhere are otherwise counted in
+	// Summary.Rejected and ignored.
+	AnySource bool
+	// Failover probes one of the reflector's addresses at a time, when its name resolves to more than one, and moves
+	// on to the next when the one being probed has reflected nothing for this long. 0 probes the first address
+	// only. ReflectorAddr may also name an SRV record, such as _stamp._udp.example.com, whose targets are resolved
+	// in turn. UDP unicast only.
+	Failover time.Duration
+	// Resolve is how often to resolve the reflector's name again, so that a long run picks up DNS changes, 0 to
+	// resolve it only at the start. An address that is no longer returned stops being probed.
+	Resolve time.Duration
+	// RecvPort is the port on the ListenAddr host to receive the reflections on, for a reflector run with
+	// reflector.Config.ReplyPort set to it, as a firewall may only let replies in to a fixed port, or to keep the
+	// reflections of a high-rate test off the sockets packets are sent from. Packets are still sent from ListenAddr
+	// or SrcPorts, which are then only sent from, and never read. 0 receives each reflection on the port its packet
+	// was sent from. UDP only.
+	RecvPort int
+	// SocketBuffers sets the receive and send buffers of each UDP socket, so that a high-rate test isn't short of
+	// reflections the kernel dropped for want of room, which look like loss on the network. The OS can grant less,
+	// which is logged, see wire.SetBuffers. The zero Buffers leaves the OS defaults.
+	SocketBuffers wire.Buffers
+	// Proxy is the host:port of a SOCKS5 proxy to relay the packets to the reflector and back through, with a UDP
+	// association each source port, empty for none. The RTT then includes the time through the proxy both ways, and
+	// the TTL the reflector sees is the proxy's. UDP unicast only, and the proxy must not need authentication.
+	Proxy string
+	// AbortLoss stops the run with ErrLossAbort once more than this percentage of the packets sent over the last
+	// AbortWindow, after the warmup, have been lost, so that a run to a reflector that is down doesn't go on for its
+	// whole duration. 0 for no limit. Unicast only.
+	AbortLoss float64
+	// AbortWindow is how long the loss must be over AbortLoss for, 0 for DefaultAbortWindow
+	AbortWindow time.Duration
+	// MaxWriteErrors is how many reports in a row may fail to be written to the output before the run is stopped
+	// with an error, 0 to carry on regardless. Reports that can't be written are counted in Summary.WriteErrors.
+	MaxWriteErrors int
+	// ReportQueueLen is how many reports can wait for the output, 0 for DefaultReportQueueLen. A report that finds
+	// the queue full is dropped and counted in Summary.ReportsDropped rather than waited for, as while the receiver
+	// waits the reflections pile up in the socket buffer, and once that is full the kernel drops them, which would
+	// look like loss on the network.
+	ReportQueueLen int
+	// InfluxToken is the API token to write to an InfluxDB DBPath with, empty for none
+	InfluxToken string
+	// Progress, if set, is called by the reporter about once a second, and once more when the run ends, with a
+	// snapshot of the results so far, for a live display. It must not hold up the reporter.
+	Progress func(Progress)
+	// Labels tag the run, and are recorded in run_meta and on every report streamed to a socket or InfluxDB, where
+	// there is no run_meta, see Report.Labels
+	Labels Labels
+	// Drain is the longest to wait, once the last window has been sent, for the reflections still in flight, 0 for
+	// DefaultDrain. The run ends as soon as every packet sent has been reflected, except to a multicast group, where
+	// any number of reflectors may answer, which is waited on for all of it.
+	Drain time.Duration
+	// DropRate is the fraction of the packets after the warmup, from 0 to 1, that aren't sent at all though their
+	// sequence numbers are used up, so that loss can be put on a perfect path to check that it is detected. The
+	// packets are drawn at random, repeatably with Seed, and reported as lost like any other. For testing only.
+	DropRate float64
+	// Version and GitRev describe the program running the test, and are recorded with the results
+	Version string
+	GitRev  string
+}
+
+// maxPacketLen returns the packet length limit in effect for cfg
+func (cfg Config) maxPacketLen() int {
+	if cfg.MaxPacketLen == 0 {
+		return MaxPacketLen
+	}
+	return cfg.MaxPacketLen
+}
+
+// ttl returns the TTL packets are sent with for cfg
+func (cfg Config) ttl() int {
+	if cfg.TTL == 0 {
+		return SenderTTL
+	}
+	return cfg.TTL
+}
+
+// interval returns the interval between windows in effect for cfg: Interval, unless the run ramps over a duration
+// no longer than it, which would send a window at the start values and then one at the end values and none between.
+// The duration is then split into minRampWindows windows instead, so that a short run still goes through the ramp.
+func (cfg Config) interval() time.Duration {
+	ramps := cfg.WindowSize.start != cfg.WindowSize.end || cfg.PacketLen.start != cfg.PacketLen.end
+	if cfg.Duration == 0 || cfg.Duration > cfg.Interval || !ramps || cfg.Replay != "" || cfg.ReplayPcap != "" {
+		return cfg.Interval
+	}
+	return cfg.Duration / minRampWindows
+}
+
+// validateSizeDist checks that every length in the size distribution fits the packet format and limit, and that
+// there is nothing else setting the packet length
+func (cfg Config) validateSizeDist() error {
+	shortest := HeaderLen
+	if cfg.Secret != nil {
+		shortest += wire.MACLen
+	}
+	if cfg.Mode == wire.ModeSTAMP {
+		shortest = wire.STAMPPacketLen
+	}
+	if cfg.SizeDist.Min() < shortest {
+		return fmt.Errorf("size distribution %s has a packet length smaller than the %d byte minimum", cfg.SizeDist, shortest)
+	}
+	if limit := cfg.maxPacketLen(); cfg.SizeDist.Max() > limit {
+		return fmt.Errorf("size distribution %s has a packet length larger than the maximum permitted size of %d", cfg.SizeDist, limit)
+	}
+	if cfg.PacketLen.start != cfg.PacketLen.end {
+		return fmt.Errorf("a size distribution can't be ramped, give a single packet length or none")
+	}
+	if cfg.Replay != "" || cfg.ReplayPcap != "" {
+		return fmt.Errorf("a replay sends the packet lengths it recorded, so can't be given a size distribution")
+	}
+	return nil
+}
+
+// validate checks the parts of the config that can't be caught while parsing flags
+func (cfg Config) validate() error {
+	if cfg.WindowSize.start < 0 || cfg.WindowSize.end < 0 {
+		return fmt.Errorf("window size must not be negative: %s", cfg.WindowSize)
+	}
+	if cfg.PacketLen.start < HeaderLen || cfg.PacketLen.end < HeaderLen {
+		return fmt.Errorf("packet length %s is smaller than the %d byte header", cfg.PacketLen, HeaderLen)
+	}
+	if cfg.Secret != nil && (cfg.PacketLen.start < HeaderLen+wire.MACLen || cfg.PacketLen.end < HeaderLen+wire.MACLen) {
+		return fmt.Errorf("packet length %s is smaller than the %d byte header and MAC", cfg.PacketLen, HeaderLen+wire.MACLen)
+	}
+	if cfg.SizeDist.Len() > 0 {
+		err := cfg.validateSizeDist()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Mode == wire.ModeTWAMPLight {
+		return fmt.Errorf("%s is a reflector mode only, use stamp to send to a TWAMP-Light reflector", cfg.Mode)
+	}
+	if cfg.Mode == wire.ModeSTAMP {
+		if cfg.Secret != nil {
+			return fmt.Errorf("a secret can't be used in %s mode", cfg.Mode)
+		}
+		if cfg.PacketLen.start < wire.STAMPPacketLen || cfg.PacketLen.end < wire.STAMPPacketLen {
+			return fmt.Errorf("packet length %s is smaller than the %d byte STAMP packet", cfg.PacketLen, wire.STAMPPacketLen)
+		}
+		if cfg.VerifyPayload {
+			return fmt.Errorf("payloads can't be verified in %s mode", cfg.Mode)
+		}
+	}
+	if cfg.Transport == TransportTCP {
+		err := cfg.validateTCP()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.RxTimestamps == TimestampHardware && cfg.Interface == "" {
+		return fmt.Errorf("hardware timestamps need an interface")
+	}
+	if cfg.MaxPacketLen < 0 || cfg.MaxPacketLen > wire.MaxUDPPayload {
+		return fmt.Errorf("maximum packet length %d is not between 0 and the UDP limit of %d", cfg.MaxPacketLen, wire.MaxUDPPayload)
+	}
+	if cfg.TTL < 0 || cfg.TTL > 255 {
+		return fmt.Errorf("TTL %d is not between 1 and 255", cfg.TTL)
+	}
+	if cfg.DSCP < 0 || cfg.DSCP > 63 {
+		return fmt.Errorf("DSCP %d is not between 0 and 63", cfg.DSCP)
+	}
+	if limit := cfg.maxPacketLen(); cfg.PacketLen.start > limit || cfg.PacketLen.end > limit {
+		return fmt.Errorf("requested packet length is larger than the maximum permitted size of %d", limit)
+	}
+	if cfg.Duration < 0 {
+		return fmt.Errorf("duration must not be negative: %s", cfg.Duration)
+	}
+	if cfg.Count < 0 {
+		return fmt.Errorf("count must not be negative: %d", cfg.Count)
+	}
+	if cfg.Count != 0 && cfg.Duration != 0 {
+		return fmt.Errorf("count and duration can't both be set")
+	}
+	if cfg.Warmup < 0 {
+		return fmt.Errorf("warmup must not be negative: %s", cfg.Warmup)
+	}
+	if cfg.Interval < 0 {
+		return fmt.Errorf("interval must not be negative: %s", cfg.Interval)
+	}
+	if cfg.Schedule == SchedulePoisson && cfg.Interval <= 0 {
+		return fmt.Errorf("a poisson schedule needs a mean interval greater than 0")
+	}
+	if cfg.PPS < 0 {
+		return fmt.Errorf("packets per second must not be negative: %d", cfg.PPS)
+	}
+	if cfg.Burst < 0 {
+		return fmt.Errorf("burst size must not be negative: %d", cfg.Burst)
+	}
+	if cfg.BurstGap < 0 {
+		return fmt.Errorf("burst gap must not be negative: %s", cfg.BurstGap)
+	}
+	if cfg.Burst > 0 && cfg.PPS > 0 {
+		return fmt.Errorf("bursts are sent back-to-back, so can't be paced with packets per second too")
+	}
+	if cfg.BurstGap > 0 && cfg.Burst == 0 {
+		return fmt.Errorf("a burst gap needs a burst size")
+	}
+	if cfg.Ramp == RampStep && cfg.RampSteps < 1 {
+		return fmt.Errorf("number of ramp steps must be at least 1: %d", cfg.RampSteps)
+	}
+	if cfg.Rotate < 0 || (cfg.Rotate > 0 && cfg.Rotate < time.Second) {
+		return fmt.Errorf("rotation interval %s must be at least 1s", cfg.Rotate)
+	}
+	if cfg.SummarizeDrops && !cfg.NoDB && !isDBPath(cfg.DBPath) {
+		return fmt.Errorf("only drops written to a database can be summarized, not to %s", cfg.DBPath)
+	}
+	if cfg.SummarizeDrops && cfg.JitterBuffer > 0 {
+		return fmt.Errorf("the jitter buffer plays out each packet, so drops can't be summarized with it")
+	}
+	if cfg.Rotate > 0 && cfg.NoDB {
+		return fmt.Errorf("there is no database to rotate with no-db")
+	}
+	if cfg.Rotate > 0 && !isDBPath(cfg.DBPath) {
+		return fmt.Errorf("only a database output can be rotated, not %s", cfg.DBPath)
+	}
+	if cfg.Encoding != EncodingJSON && !strings.HasPrefix(cfg.DBPath, "unix://") {
+		return fmt.Errorf("only a unix:// output can be encoded as %s, not %s", cfg.Encoding, cfg.DBPath)
+	}
+	if cfg.MaxWriteErrors < 0 {
+		return fmt.Errorf("maximum write errors must not be negative: %d", cfg.MaxWriteErrors)
+	}
+	if cfg.ReportQueueLen < 0 {
+		return fmt.Errorf("report queue length must not be negative: %d", cfg.ReportQueueLen)
+	}
+	if cfg.HistogramBin < 0 {
+		return fmt.Errorf("histogram bin width must not be negative: %s", cfg.HistogramBin)
+	}
+	if cfg.SocketBuffers.Recv < 0 || cfg.SocketBuffers.Send < 0 {
+		return fmt.Errorf("socket buffer sizes must not be negative: %d and %d", cfg.SocketBuffers.Recv, cfg.SocketBuffers.Send)
+	}
+	if cfg.RecvPort < 0 || cfg.RecvPort > 65535 {
+		return fmt.Errorf("receive port %d is not between 0 and 65535", cfg.RecvPort)
+	}
+	if cfg.RecvPort != 0 && cfg.SrcPorts.Len() > 0 && cfg.RecvPort >= cfg.SrcPorts.First && cfg.RecvPort <= cfg.SrcPorts.Last {
+		return fmt.Errorf("receive port %d is one of the source ports %s", cfg.RecvPort, cfg.SrcPorts)
+	}
+	if cfg.RecvPort != 0 && cfg.Proxy != "" {
+		return fmt.Errorf("reflections relayed by a proxy come back to the port they were sent from, not a receive port")
+	}
+	if cfg.Failover < 0 || cfg.Resolve < 0 {
+		return fmt.Errorf("failover and resolve intervals must not be negative: %s, %s", cfg.Failover, cfg.Resolve)
+	}
+	if cfg.AbortLoss < 0 || cfg.AbortLoss >= 100 {
+		return fmt.Errorf("loss to abort on must be at least 0 and under 100 percent: %g", cfg.AbortLoss)
+	}
+	if cfg.Drain < 0 {
+		return fmt.Errorf("drain must not be negative: %s", cfg.Drain)
+	}
+	if !(cfg.DropRate >= 0 && cfg.DropRate <= 1) {
+		return fmt.Errorf("drop rate must be from 0 to 1: %g", cfg.DropRate)
+	}
+	if cfg.AbortWindow < 0 {
+		return fmt.Errorf("abort window must not be negative: %s", cfg.AbortWindow)
+	}
+	if cfg.JitterBuffer < 0 {
+		return fmt.Errorf("jitter buffer depth must not be negative: %s", cfg.JitterBuffer)
+	}
+	if cfg.SendRetries < 0 {
+		return fmt.Errorf("send retries must not be negative: %d", cfg.SendRetries)
+	}
+	if cfg.TTLThreshold < 0 {
+		return fmt.Errorf("TTL threshold must not be negative: %d", cfg.TTLThreshold)
+	}
+	if cfg.SrcPorts.Len() > MaxSrcPorts {
+		return fmt.Errorf("source port range %s is more than %d ports", cfg.SrcPorts, MaxSrcPorts)
+	}
+	if cfg.DBPath == "" && !cfg.NoDB {
+		return fmt.Errorf("no database path given")
+	}
+	if cfg.Replay != "" {
+		if cfg.Count != 0 || cfg.Duration != 0 || cfg.Warmup != 0 {
+			return fmt.Errorf("a replay can't be given a count, duration or warmup, it sends the windows it recorded")
+		}
+		if !cfg.NoDB && filepath.Clean(cfg.Replay) == filepath.Clean(cfg.DBPath) {
+			return fmt.Errorf("the replay database %s would be overwritten by the results", cfg.Replay)
+		}
+	}
+	if cfg.ReplayPcap != "" {
+		if cfg.Replay != "" {
+			return fmt.Errorf("a capture and a results database can't both be replayed")
+		}
+		if cfg.Count != 0 || cfg.Warmup != 0 {
+			return fmt.Errorf("a capture replay can't be given a count or warmup, it sends the packets captured")
+		}
+		if cfg.PPS != 0 || cfg.Burst != 0 || cfg.Schedule != SchedulePeriodic {
+			return fmt.Errorf("a capture is replayed with its own timing, so can't be given a pps, bursts or a poisson schedule")
+		}
+	}
+	return nil
+}
+
+// ErrFatal is returned by Run, wrapped, when it stopped early because the receiver or the reporter hit an error it
+// couldn't carry on from, such as the socket failing or Config.MaxWriteErrors reports in a row not being written
+var ErrFatal = errors.New("run failed")
+
+const (
+	// DefaultDrain is the default Config.Drain
+	DefaultDrain = 2 * time.Second
+	// drainPoll is how often the reflections still in flight are counted while draining
+	drainPoll = 10 * time.Millisecond
+	// recvPortWait is how long the receiver gives the first window at least to come back on Config.RecvPort before
+	// warning that nothing has
+	recvPortWait = time.Second
+)
+
+// minRampWindows is how many windows a ramp over a duration no longer than Config.Interval is sent in, see
+// Config.interval
+const minRampWindows = 10
+
+// Run sends windows of packets to the reflector as described by cfg and records the reflected packets in the
+// database, returning once the duration has elapsed, count packets have been sent or the replay is over (and the
+// reflections still in flight are in, see Config.Drain), or ctx is done. A run stopped by Config.AbortLoss returns
+// its summary along with an error wrapping ErrLossAbort, and one stopped by a goroutine's fatal error its summary
+// along with an error wrapping ErrFatal.
+func Run(ctx context.Context, cfg Config) (Summary, error) {
+	err := cfg.validate()
+	if err != nil {
+		return Summary{}, err
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	replay, err := cfg.loadReplay()
+	if err != nil {
+		return Summary{}, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client, err := newClient(ctx, cfg)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer client.close()
+	client.replay = replay
+
+	done := make(chan error)
+	durationElapsed := make(chan bool, 1)
+	slog.Info("sending", "reflector", cfg.ReflectorAddr, "window", cfg.WindowSize, "packet_length", cfg.PacketLen,
+		"duration", cfg.Duration, "count", cfg.Count, "interval", cfg.Interval, "pps", cfg.PPS, "ramp", cfg.Ramp, "ramp_shape", cfg.RampShape, "fill", cfg.Fill,
+		"warmup", cfg.Warmup, "mode", cfg.Mode, "transport", cfg.Transport, "timestamp_format", cfg.TimestampFormat, "output", cfg.DBPath)
+	if cfg.SrcPorts.Len() > 0 {
+		slog.Info("rotating source ports", "ports", cfg.SrcPorts)
+	}
+	if cfg.Burst > 0 {
+		slog.Info("sending windows in bursts", "burst", cfg.Burst, "gap", cfg.BurstGap)
+	}
+	if cfg.Fill == FillRandom {
+		slog.Info("random fill", "seed", cfg.Seed)
+	}
+	if cfg.SizeDist.Len() > 0 {
+		slog.Info("drawing packet lengths", "size_dist", cfg.SizeDist, "mean", cfg.SizeDist.Mean(), "seed", cfg.Seed)
+	}
+	if cfg.Schedule == SchedulePoisson {
+		slog.Info("poisson schedule", "mean_interval", cfg.interval(), "seed", cfg.Seed)
+	}
+	if interval := cfg.interval(); interval != cfg.Interval {
+		slog.Warn("the duration is no longer than the interval, so the ramp would skip from its start values to its end values: sending windows more often instead",
+			"duration", cfg.Duration, "interval", cfg.Interval, "windows_every", interval)
+	}
+	if cfg.DropRate > 0 {
+		slog.Warn("dropping packets on purpose instead of sending them: the loss reported is artificial",
+			"drop_rate", cfg.DropRate, "seed", cfg.Seed)
+	}
+	if replay != nil {
+		slog.Info("replaying", "path", cfg.Replay+cfg.ReplayPcap, "windows", len(replay))
+	}
+	if longest := cfg.longestPacket(replay); client.mtu > 0 && longest+IPUDPHeaderLen > client.mtu {
+		if cfg.DF {
+			slog.Warn("packets longer than the interface MTU allows will fail to send, as the don't-fragment bit is set",
+				"interface", client.egress, "mtu", client.mtu, "max_packet_length", client.mtu-IPUDPHeaderLen, "longest", longest)
+		} else {
+			slog.Warn("packets longer than the interface MTU allows will be sent in fragments, and lost if any fragment is",
+				"interface", client.egress, "mtu", client.mtu, "max_packet_length", client.mtu-IPUDPHeaderLen, "longest", longest)
+		}
+	}
+	sent := make(chan bool)
+	meta := newRunMeta(cfg, time.Now())
+	meta.RxTimestamps = client.rxTimestamps.String()
+	dbPath := cfg.DBPath
+	if cfg.NoDB {
+		dbPath = "" // discarded, see openOutput
+	}
+	go client.reporter(ctx, dbPath, meta, done)
+	drained, received := make(chan bool), make(chan bool)
+	go func() {
+		client.receiver(ctx, drained)
+		close(received)
+	}()
+	if client.targets != nil && cfg.Resolve > 0 {
+		go client.targets.refresh(ctx, client.clock, cfg.Resolve)
+	}
+	go func() {
+		client.send(ctx, durationElapsed)
+		close(sent)
+	}()
+	var aborted <-chan error
+	if client.lossWatch != nil {
+		aborted = client.lossWatch.aborted
+	}
+	var abortErr, fatalErr error
+	reported := false
+	interrupted := false
+	select {
+	case <-durationElapsed:
+		// keep receiving the final windows until they are all in, or for as long as the drain allows
+		client.drain(ctx)
+		// the receiver reports what is still unanswered as lost, and stops, while the reporter is still running
+		close(drained)
+		<-received
+	case <-ctx.Done():
+		slog.Info("interrupted")
+		interrupted = true
+	case abortErr = <-aborted:
+		interrupted = true
+	case fatalErr = <-client.errChan:
+		slog.Error("stopping the run", "err", fatalErr)
+		interrupted = true
+	case err = <-done:
+		// the reporter only finishes early if it could not set up or rotate the database, gave up writing to it, or
+		// ctx is done
+		if err != nil && !errors.Is(err, errWriteErrors) {
+			return Summary{}, err
+		}
+		reported = true
+		interrupted = true
+	}
+	cancel() // stop sending and receiving
+	<-sent
+	if !reported {
+		err = <-done // wait for reporter goroutine to write queued reports
+	}
+	client.summary.Sent = int(client.nextSendSeqNo - client.warmupSent)
+	if client.offeredTime > 0 {
+		client.summary.MeanOfferedBitrate = int64(client.offeredBits / client.offeredTime.Seconds())
+	}
+	client.summary.PeakOfferedBitrate = client.peakBitrate
+	client.summary.SendErrors = client.sendErrors
+	client.summary.Injected = int(client.injected)
+	client.summary.Rejected = client.rejected
+	client.summary.ReportsDropped = client.reportDrops
+	client.summary.RTT = client.rtts.stats()
+	client.summary.RTTHistogram = client.histogram.bins()
+	client.summary.Reflectors = client.reflectorSummaries()
+	client.summary.ReplySources = client.replySrcs
+	client.summary.SourceChanges = client.srcChanges
+	client.summary.Failovers = client.failovers
+	client.summary.ClockOffset = client.offsetEstimate()
+	if offset := client.summary.ClockOffset; offset != nil {
+		slog.Info("clock offset", "offset", offset.Offset, "network_rtt", offset.NetworkRTT, "assumes", offset.Assumes)
+	}
+	if client.playout != nil {
+		playout := client.playout.Stats()
+		client.summary.Playout = &playout
+		slog.Info("playout", "jitter_buffer", playout.Depth, "late", playout.Late, "lost", playout.Lost,
+			"freezes", playout.Freezes, "frozen", playout.FrozenTime)
+	}
+	slog.Info("summary", "sent", client.summary.Sent, "received", client.summary.Received, "send_errors", client.summary.SendErrors,
+		"write_errors", client.summary.WriteErrors, "rejected", client.summary.Rejected, "reports_dropped", client.summary.ReportsDropped,
+		"dropped", client.summary.Dropped, "forward_loss", client.summary.ForwardLoss,
+		"reverse_loss", client.summary.ReverseLoss, "forward_reordered", client.summary.ForwardReordered,
+		"reverse_reordered", client.summary.ReverseReordered, "duplicates", client.summary.Duplicates, "mean_offered_bps", client.summary.MeanOfferedBitrate,
+		"peak_offered_bps", client.summary.PeakOfferedBitrate, "rtt_p50", client.summary.RTT.P50,
+		"rtt_p99", client.summary.RTT.P99, "jitter", client.summary.RTT.Jitter)
+	if client.summary.Injected > 0 {
+		slog.Warn("packets were dropped on purpose, and are counted in the loss as if the network had lost them",
+			"injected", client.summary.Injected, "dropped", client.summary.Dropped)
+	}
+	if client.summary.ReportsDropped > 0 {
+		slog.Warn("results were dropped because the output fell behind, so the totals are short of what was sent",
+			"reports_dropped", client.summary.ReportsDropped)
+	}
+	client.logReflectors()
+	if cfg.RecvPort != 0 && client.summary.Received == 0 && client.summary.Sent > 0 {
+		slog.Warn("nothing was received on the receive port: the reflector must be run with -reply-port of the same port to send its replies there",
+			"recv_port", cfg.RecvPort)
+	}
+	if cfg.SummaryPath != "" {
+		serr := writeSummary(cfg.SummaryPath, summaryFile{Summary: client.summary, Interrupted: interrupted, Run: meta})
+		if serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if err == nil {
+		err = abortErr
+	}
+	if err == nil {
+		err = fatalErr
+	}
+	return client.summary, err
+}
+
+type StampClient struct {
+	streams       []*stream // one per source port, packet seq is sent from streams[seq%len(streams)]
+	reflectorAddr *net.UDPAddr
+	sendCM        *ipv4.ControlMessage
+	nextSendSeqNo uint32
+	packet        []byte
+	windowSize    VarParam
+	packetLen     VarParam
+	sizeDist      SizeDist
+	sizeRng       *rand.Rand // draws packet lengths from sizeDist
+	dbChan        chan Report
+	tally                   // of the whole run
+	segment       *tally    // of the database being written, nil unless it is rotated
+	segmentStart  time.Time // when the database being written was opened
+	rotate        time.Duration
+	duration      int64
+	count         uint32
+	interval      time.Duration
+	drainMax      time.Duration // Config.Drain
+	schedule      Schedule
+	scheduleRng   *rand.Rand // draws the intervals of a poisson schedule
+	pps           int
+	burst         int
+	burstGap      time.Duration
+	burstAt       burstPosition // of the packet being sent
+	ramp          RampMode
+	rampSteps     int
+	rampShape     RampShape
+	descending    bool // the window being sent is on the way back down a RampTriangle
+	fill          FillPattern
+	rng           *rand.Rand
+	received      bool
+	secret        []byte
+	payloadStart  int // offset of the fill pattern, after the header and MAC if there is one
+	ttl           int
+	ttlThreshold  int64
+	warmupUntil   int64  // packets sent before this time, in nanoseconds since the epoch, are warmup
+	warmupSent    uint32 // packets sent during the warmup
+	mode          wire.Mode
+	tsFormat      wire.TimestampFormat
+	history       *sentHistory
+	bitrate       int64          // offered bitrate of the window being sent
+	offeredBits   float64        // bits offered by the windows sent after the warmup
+	offeredTime   time.Duration  // time the windows sent after the warmup were offered over
+	peakBitrate   int64          // highest offered bitrate of a window sent after the warmup
+	replay        []replayWindow // windows to send instead of the ramp, nil for none
+	replayNext    int            // index in replay of the next window to send
+	lengths       []int          // of the packets of the window being sent, when replaying a capture
+	sendRetries   int
+	sendErrors    int // packets that failed to send after the warmup
+	rejected      int // packets received from somewhere other than the reflector
+	reportDrops   int // reports dropped because dbChan was full
+	anySource     bool
+	multicast     bool               // the reflector address is a multicast group, which any number may answer
+	rxTimestamps  TimestampSource    // where receive times are taken from, after any fallback
+	replySrc      string             // address the last reflection came from, in unicast
+	replySrcs     []string           // every address reflections have come from, in the order first seen
+	srcChanges    int                // times the address reflections come from has changed
+	verifyPayload bool               // compare the payload CRC of each reflection with that of the packet sent
+	noCRC         bool               // a reflection without a payload CRC has been logged
+	remotes       map[string]*remote // the reflectors that have answered, by remoteKey
+	badFormat     bool               // a reflector packet of an unknown format has been logged
+	influxToken   string
+	clock         wire.Clock
+	histogramBin  time.Duration
+	quiet         bool // leave out the log messages about single packets
+	wal           bool // write the database in WAL mode
+	encoding      Encoding
+	labels        Labels
+	playout       *Playout // nil unless Config.JitterBuffer
+	dropRanges    bool     // Config.SummarizeDrops
+	targets       *targets // the reflector's addresses, nil unless they are followed
+	sendTo        *target  // the one of targets the window being sent goes to
+	failover      time.Duration
+	failovers     int
+	lossWatch     *lossWatch // nil unless Config.AbortLoss
+	errChan       chan error // the first fatal error of the receiving goroutines, see fail
+	recvStream    *stream    // reads Config.RecvPort for every stream, nil unless it is set
+	estOffset     bool       // Config.EstimateOffset
+	// writeLimit is how many reports in a row may fail to be written before the reporter gives up, 0 for no
+	// limit, and failedWrites how many have in a row so far
+	writeLimit   int
+	failedWrites int
+	// onProgress is Config.Progress, fed from rolling, the stats of the last packets with a result, and latest, the
+	// report of the last packet received. rolling is nil unless onProgress is set.
+	onProgress func(Progress)
+	rolling    *RollingStats
+	latest     Report
+	// mtu is the MTU of egress, the interface packets are sent out of, 0 if it isn't known, and df is Config.DF, see
+	// fragmented
+	mtu    int
+	egress string
+	df     bool
+	// dropRate is Config.DropRate, drawn against with dropRng, and injected the packets it kept from being sent
+	dropRate float64
+	dropRng  *rand.Rand
+	injected uint32
+	// swapping is set by the reporter while it rotates the database, during which queue waits for room in dbChan
+	// rather than dropping reports
+	swapping atomic.Bool
+}
+
+// stream is what the client knows about the packets sent from one of its sockets. The reflections to a socket are
+// read in order by a goroutine of its own, so gaps in the sequence are looked for within a stream rather than
+// across streams, which are read concurrently.
+type stream struct {
+	conn  *ipv4.PacketConn // nil over TCP
+	tcp   *net.TCPConn     // nil over UDP
+	proxy *socksAssoc      // nil unless sent through Config.Proxy
+	port  int
+	first uint32           // sequence number of the first packet sent from the socket
+	peers map[string]*peer // by remote key
+	// reopen opens the socket again on the same address, for read to replace conn with once its reads keep
+	// failing. mu guards conn while it is replaced, so sends use the socket from before or after. nil over TCP.
+	reopen func(ctx context.Context) (*ipv4.PacketConn, error)
+	mu     sync.RWMutex
+}
+
+// socket returns the stream's UDP socket, which read may have replaced
+func (s *stream) socket() *ipv4.PacketConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+// peer is what has been received on a stream from one reflector
+type peer struct {
+	lastRecvSeqNo uint32 // the stream's first sequence number until a packet is received
+	// send timestamp of lastRecvSeqNo, 0 until a packet is received
+	lastRecvSendTime uint64
+	// maxReflectorSeq and maxSeq are the highest reflector and sender sequence numbers received, once reflected is
+	// set, see reordered
+	reflected       bool
+	maxReflectorSeq uint32
+	maxSeq          uint32
+}
+
+// peer returns what has been received on s from the reflector with the remote key
+func (s *stream) peer(key string) *peer {
+	p, ok := s.peers[key]
+	if !ok {
+		if s.peers == nil {
+			s.peers = make(map[string]*peer)
+		}
+		p = &peer{lastRecvSeqNo: s.first}
+		s.peers[key] = p
+	}
+	return p
+}
+
+func newClient(ctx context.Context, cfg Config) (*StampClient, error) {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = wire.SystemClock{}
+	}
+	var reflectorAddr *net.UDPAddr
+	var targets *targets // nil unless the reflector's addresses are followed
+	var err error
+	if cfg.Failover > 0 || cfg.Resolve > 0 || isSRV(cfg.ReflectorAddr) {
+		targets, err = newTargets(ctx, cfg.ReflectorAddr, clock.Now().UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		reflectorAddr = targets.get().addr
+	} else {
+		reflectorAddr, err = net.ResolveUDPAddr("udp4", cfg.ReflectorAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving reflector address: %w", err)
+		}
+	}
+	var ifi *net.Interface
+	var sendCM *ipv4.ControlMessage // nil unless packets are sent out of a chosen interface
+	if cfg.Interface != "" {
+		ifi, err = wire.InterfaceByName(cfg.Interface)
+		if err != nil {
+			return nil, err
+		}
+		sendCM = &ipv4.ControlMessage{IfIndex: ifi.Index}
+		slog.Info("sending out of", "interface", ifi.Name)
+	}
+	multicast := reflectorAddr.IP.IsMulticast()
+	if multicast && targets != nil {
+		return nil, fmt.Errorf("a multicast group can't be failed over or resolved again")
+	}
+	if multicast && cfg.Proxy != "" {
+		return nil, fmt.Errorf("a multicast group can't be probed through a proxy")
+	}
+	if multicast && cfg.AbortLoss > 0 {
+		return nil, fmt.Errorf("the loss to a multicast group can't be watched to abort on, as any number may answer")
+	}
+	var streams []*stream
+	rxTimestamps := cfg.RxTimestamps
+	addrs := []string{cfg.ListenAddr}
+	if cfg.Transport == TransportTCP {
+		if multicast {
+			return nil, fmt.Errorf("a multicast group can't be probed over TCP")
+		}
+		conn, err := dialTCP(ctx, reflectorAddr, cfg.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		streams = []*stream{{tcp: conn, port: conn.LocalAddr().(*net.TCPAddr).Port}}
+		rxTimestamps = TimestampUserspace
+		addrs = nil
+	}
+	if cfg.SrcPorts.Len() > 0 {
+		host, _, err := net.SplitHostPort(cfg.ListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing listen address: %w", err)
+		}
+		addrs = addrs[:0]
+		for port := cfg.SrcPorts.First; port <= cfg.SrcPorts.Last; port++ {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	// open opens a socket to send from on addr, and is kept to open it again should it break, see read
+	open := func(ctx context.Context, addr string) (*ipv4.PacketConn, TimestampSource, wire.Buffers, error) {
+		conn, source, granted, err := listen(ctx, addr, cfg.ttl(), cfg.DF, cfg.RxTimestamps, cfg.Interface, cfg.SocketBuffers)
+		if err == nil && multicast {
+			err = setMulticast(conn, ifi, cfg.ttl())
+		}
+		if err == nil && cfg.DSCP != 0 {
+			err = conn.SetTOS(cfg.DSCP << 2)
+			if err != nil {
+				err = fmt.Errorf("error in SetTOS: %w", err)
+			}
+		}
+		if err != nil && conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		return conn, source, granted, err
+	}
+	for i, addr := range addrs {
+		conn, source, granted, err := open(ctx, addr)
+		rxTimestamps = source
+		if err == nil && i == 0 && cfg.SocketBuffers != (wire.Buffers{}) {
+			wire.LogBuffers(cfg.SocketBuffers, granted, "sockets", len(addrs))
+		}
+		var proxy *socksAssoc
+		if err == nil && cfg.Proxy != "" {
+			proxy, err = socksAssociate(ctx, cfg.Proxy)
+		}
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			for _, s := range streams {
+				s.conn.Close()
+				if s.proxy != nil {
+					s.proxy.close()
+				}
+			}
+			return nil, err
+		}
+		local := conn.LocalAddr().String() // with the port it was given, so that a reopened socket keeps it
+		streams = append(streams, &stream{
+			conn:  conn,
+			proxy: proxy,
+			port:  conn.LocalAddr().(*net.UDPAddr).Port,
+			first: uint32(i),
+			reopen: func(ctx context.Context) (*ipv4.PacketConn, error) {
+				conn, _, _, err := open(ctx, local)
+				return conn, err
+			},
+		})
+	}
+	var recvStream *stream
+	if cfg.RecvPort != 0 {
+		host, _, err := net.SplitHostPort(cfg.ListenAddr)
+		if err == nil {
+			addr := net.JoinHostPort(host, strconv.Itoa(cfg.RecvPort))
+			listenRecv := func(ctx context.Context) (*ipv4.PacketConn, error) {
+				conn, _, _, err := listen(ctx, addr, cfg.ttl(), false, cfg.RxTimestamps, cfg.Interface, cfg.SocketBuffers)
+				return conn, err
+			}
+			var conn *ipv4.PacketConn
+			conn, err = listenRecv(ctx)
+			if err == nil {
+				recvStream = &stream{conn: conn, port: cfg.RecvPort, reopen: listenRecv}
+			}
+		}
+		if err != nil {
+			for _, s := range streams {
+				s.conn.Close()
+				if s.proxy != nil {
+					s.proxy.close()
+				}
+			}
+			return nil, fmt.Errorf("error listening on the receive port: %w", err)
+		}
+		slog.Info("receiving reflections on", "port", cfg.RecvPort)
+	}
+	var playout *Playout
+	if cfg.JitterBuffer > 0 {
+		playout = NewPlayout(cfg.JitterBuffer)
+	}
+	var watch *lossWatch
+	if cfg.AbortLoss > 0 {
+		window := cfg.AbortWindow
+		if window == 0 {
+			window = DefaultAbortWindow
+		}
+		watch = newLossWatch(cfg.AbortLoss, window)
+	}
+	warmupUntil := int64(0)
+	if cfg.Warmup > 0 {
+		warmupUntil = clock.Now().Add(cfg.Warmup).UnixNano()
+	}
+	payloadStart := HeaderLen
+	if cfg.Secret != nil {
+		payloadStart += wire.MACLen
+	}
+	if cfg.Mode == wire.ModeSTAMP {
+		payloadStart = wire.STAMPPacketLen
+	}
+	queueLen := cfg.ReportQueueLen
+	if queueLen == 0 {
+		queueLen = DefaultReportQueueLen
+	}
+	var egress string
+	var mtu int // fragmentation is only for UDP, and through a proxy happens on its way out
+	if cfg.Transport != TransportTCP && cfg.Proxy == "" {
+		egress, mtu = egressMTU(ifi, reflectorAddr)
+	}
+	drainMax := cfg.Drain
+	if drainMax == 0 {
+		drainMax = DefaultDrain
+	}
+	return &StampClient{
+		streams:       streams,
+		reflectorAddr: reflectorAddr,
+		sendCM:        sendCM,
+		nextSendSeqNo: uint32(0),
+		dbChan:        make(chan Report, queueLen),
+		errChan:       make(chan error, 1),
+		packet:        make([]byte, cfg.maxPacketLen()),
+		windowSize:    cfg.WindowSize,
+		packetLen:     cfg.PacketLen,
+		sizeDist:      cfg.SizeDist,
+		sizeRng:       rand.New(rand.NewSource(cfg.Seed + 1)), // each random stream is seeded apart, to draw independently
+		duration:      cfg.Duration.Nanoseconds(),
+		count:         uint32(cfg.Count),
+		interval:      cfg.interval(),
+		drainMax:      drainMax,
+		schedule:      cfg.Schedule,
+		scheduleRng:   rand.New(rand.NewSource(cfg.Seed + 2)),
+		pps:           cfg.PPS,
+		burst:         cfg.Burst,
+		burstGap:      cfg.BurstGap,
+		ramp:          cfg.Ramp,
+		rampSteps:     cfg.RampSteps,
+		rampShape:     cfg.RampShape,
+		fill:          cfg.Fill,
+		rng:           rand.New(rand.NewSource(cfg.Seed)),
+		received:      false,
+		secret:        cfg.Secret,
+		payloadStart:  payloadStart,
+		ttl:           cfg.ttl(),
+		verifyPayload: cfg.VerifyPayload,
+		ttlThreshold:  int64(cfg.TTLThreshold),
+		warmupUntil:   warmupUntil,
+		mode:          cfg.Mode,
+		tsFormat:      cfg.TimestampFormat,
+		history:       new(sentHistory),
+		sendRetries:   cfg.SendRetries,
+		influxToken:   cfg.InfluxToken,
+		tally:         tally{histogram: newHistogram(cfg.HistogramBin)},
+		histogramBin:  cfg.HistogramBin,
+		rotate:        cfg.Rotate,
+		quiet:         cfg.Quiet,
+		wal:           cfg.WAL,
+		encoding:      cfg.Encoding,
+		labels:        cfg.Labels,
+		onProgress:    cfg.Progress,
+		anySource:     cfg.AnySource,
+		multicast:     multicast,
+		rxTimestamps:  rxTimestamps,
+		clock:         clock,
+		writeLimit:    cfg.MaxWriteErrors,
+		playout:       playout,
+		targets:       targets,
+		failover:      cfg.Failover,
+		lossWatch:     watch,
+		recvStream:    recvStream,
+		estOffset:     cfg.EstimateOffset,
+		dropRanges:    cfg.SummarizeDrops,
+		mtu:           mtu,
+		egress:        egress,
+		df:            cfg.DF,
+		dropRate:      cfg.DropRate,
+		dropRng:       rand.New(rand.NewSource(cfg.Seed + 3)),
+	}, nil
+}
+
+// listen opens a socket on addr to send probes from with ttl and receive their reflections on, with the
+// don't-fragment bit set if df is true, and receive timestamps from source. It returns the source the timestamps will come from: when
+// the kernel can't give software timestamps, the time each packet is read, but hardware timestamps that can't be
+// had on iface are an error.
+func listen(ctx context.Context, addr string, ttl int, df bool, source TimestampSource, iface string, bufs wire.Buffers) (*ipv4.PacketConn, TimestampSource, wire.Buffers, error) {
+	lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
+		if err := enableRxTimestamps(rc, source, iface); err != nil {
+			if source == TimestampHardware {
+				return err
+			}
+			slog.Debug("timestamping received packets in userspace", "err", err)
+			source = TimestampUserspace
+		}
+		if df {
+			return setDontFragment(rc)
+		}
+		return nil
+	}}
+	uconn, err := lc.ListenPacket(ctx, "udp4", addr)
+	if err != nil {
+		return nil, source, wire.Buffers{}, fmt.Errorf("error in listenpacket: %w", err)
+	}
+	granted, err := wire.SetBuffers(uconn.(*net.UDPConn), bufs)
+	if err != nil {
+		uconn.Close()
+		return nil, source, wire.Buffers{}, err
+	}
+	conn := ipv4.NewPacketConn(uconn)
+	err = conn.SetTTL(ttl)
+	if err != nil {
+		conn.Close()
+		return nil, source, wire.Buffers{}, fmt.Errorf("error in SetTTL: %w", err)
+	}
+	return conn, source, granted, nil
+}
+
+// close closes all of the client's sockets
+func (c *StampClient) close() {
+	for _, s := range c.streams {
+		if s.tcp != nil {
+			s.tcp.Close()
+			continue
+		}
+		s.socket().Close()
+		if s.proxy != nil {
+			s.proxy.close()
+		}
+	}
+	if c.recvStream != nil {
+		c.recvStream.socket().Close()
+	}
+}
+
+// stream returns the stream packet seq is sent from
+func (c *StampClient) stream(seq uint32) *stream {
+	return c.streams[seq%uint32(len(c.streams))]
+}
+
+/*  7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                        sequence number                        | <- idx = 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                           timestamp                           | <- idx = 4
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                          window size                          | <- idx = 12
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                      MAC (only with a secret)                 | <- idx = 16
+* |                                                               |
+* |                                                               |
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*
+* The MAC is a truncated HMAC-SHA256 of the sequence number and timestamp (see wire.MAC), so the reflector can
+* drop packets from senders that don't share the secret.
+*
+* In STAMP mode the RFC 8762 packets laid out in package wire are used instead.
+ */
+
+// send runs a loop that sends current window size of packets and then sleeps for the configured interval before
+// sending again. An interval of 0 sends windows back-to-back. The ramp is driven by elapsed wall-clock time, so it
+// tracks the duration regardless of the interval. In count mode the ramp is driven by the number of packets sent
+// instead, and the last window is cut short so that exactly count packets are sent. send returns when ctx is done,
+// or when the loss has stayed over Config.AbortLoss, see checkLoss.
+// A warmup is sent at the start values before all of this, and neither the duration nor the count include it.
+func (c *StampClient) send(ctx context.Context, durationElapsed chan bool) {
+	start := c.clock.Now().UnixNano()
+	if c.warmupUntil != 0 {
+		start = c.warmupUntil
+	}
+	lastSendTime := time.Duration(0)
+	for {
+		now := c.clock.Now().UnixNano()
+		numPackets, done := c.nextWindow(start, now)
+		if done {
+			durationElapsed <- true
+			return
+		}
+		windowStart := time.Now()
+		interval := c.nextInterval()
+		packetLen := c.packetLen.current
+		if c.sizeDist.Len() > 0 {
+			packetLen = int(math.Round(c.sizeDist.Mean()))
+		}
+		c.offer(numPackets, packetLen, interval, lastSendTime, now < c.warmupUntil)
+		c.pickTarget(now)
+		if c.checkLoss(now) {
+			return
+		}
+		c.sendPacketWindow(ctx, numPackets, c.packetLen.current)
+		lastSendTime = time.Since(windowStart)
+		wait := interval
+		if c.pps > 0 || c.lengths != nil {
+			// a paced or captured window counts against the interval, and a window that overruns it is followed
+			// immediately
+			wait -= time.Since(windowStart)
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// nextInterval returns the interval to wait after the window about to be sent: c.interval, or with
+// SchedulePoisson a time drawn from an exponential distribution with a mean of c.interval, so that windows are
+// sent as a Poisson process that can't fall into step with anything periodic on the path (RFC 2330 section 11.1)
+func (c *StampClient) nextInterval() time.Duration {
+	if c.lengths != nil {
+		// a capture's windows are sent when they were captured
+		if c.replayNext == len(c.replay) {
+			return 0
+		}
+		return c.replay[c.replayNext].at - c.replay[c.replayNext-1].at
+	}
+	if c.schedule == SchedulePoisson {
+		return time.Duration(c.scheduleRng.ExpFloat64() * float64(c.interval))
+	}
+	return c.interval
+}
+
+// offer works out the offered bitrate of a window of numPackets of packetLen, as the bits they carry, counting
+// their IPv4 and UDP headers, over the time until the next window starts. That is interval, or the time pacing
+// takes if longer, or for an unpaced window interval plus lastSendTime, the time the previous window took to send
+// as an estimate of how long this one will. The bitrate is logged, set on each packet the window sends, and, unless
+// the window is part of the warmup, counted towards the summary.
+func (c *StampClient) offer(numPackets, packetLen int, interval, lastSendTime time.Duration, warmup bool) {
+	period := interval + lastSendTime
+	if c.pps > 0 {
+		period = max(interval, time.Duration(numPackets)*time.Second/time.Duration(c.pps))
+	}
+	bits := float64(numPackets) * float64(packetLen+IPUDPHeaderLen) * 8
+	c.bitrate = 0
+	if period > 0 {
+		c.bitrate = int64(bits / period.Seconds())
+	}
+	slog.Debug("window", "packets", numPackets, "packet_length", packetLen, "offered_bps", c.bitrate)
+	if warmup || period == 0 {
+		return
+	}
+	c.offeredBits += bits
+	c.offeredTime += period
+	c.peakBitrate = max(c.peakBitrate, c.bitrate)
+}
+
+// nextWindow moves the ramp, which began at start, on to now and returns the number of packets to send in the next
+// window, or done once the duration has elapsed or count packets have been sent. Times are in nanoseconds since the
+// epoch. In a replay the ramp is ignored, and the recorded windows are returned in turn until there are none left.
+func (c *StampClient) nextWindow(start, now int64) (numPackets int, done bool) {
+	if c.replay != nil {
+		if c.replayNext == len(c.replay) {
+			return 0, true
+		}
+		w := c.replay[c.replayNext]
+		c.replayNext++
+		c.windowSize.current, c.packetLen.current = w.packets, w.packetLen
+		c.lengths = w.lengths
+		return w.packets, false
+	}
+	numPackets = c.windowSize.current
+	if now < c.warmupUntil {
+		// hold the start values until the warmup is over
+	} else if c.count != 0 {
+		sent := c.nextSendSeqNo - c.warmupSent
+		if sent >= c.count {
+			return 0, true
+		}
+		c.rampTo(float64(sent), float64(c.count))
+		numPackets = c.windowSize.current
+		if remaining := int(c.count - sent); numPackets > remaining {
+			numPackets = remaining
+		}
+	} else if c.duration != 0 {
+		percent := float64(now-start) / float64(c.duration)
+		if percent >= 1 {
+			// finish when the duration has elapsed, once a window has been sent at the final values
+			windowSize, packetLen := c.windowSize.end, c.packetLen.end
+			if c.rampShape == RampTriangle {
+				windowSize, packetLen = c.windowSize.start, c.packetLen.start
+				c.descending = true
+			}
+			if c.windowSize.current == windowSize && c.packetLen.current == packetLen {
+				return 0, true
+			} else {
+				c.windowSize.current = windowSize
+				c.packetLen.current = packetLen
+			}
+		} else {
+			c.rampTo(float64(now-start), float64(c.duration))
+		}
+		numPackets = c.windowSize.current
+	}
+	return numPackets, false
+}
+
+// rampTo moves the window size and packet length on to done of the total run, each through the ramp of its own
+// phase. A RampTriangle is folded in half, so that the second half of the run retraces the first backwards.
+func (c *StampClient) rampTo(done, total float64) {
+	c.descending = c.rampShape == RampTriangle && 2*done >= total
+	if c.descending {
+		done = total - done
+	}
+	percent := done / total
+	if c.rampShape == RampTriangle {
+		percent = 2 * done / total
+	}
+	c.windowSize.current = c.interpolate(c.windowSize, c.windowSize.progress(percent))
+	c.packetLen.current = c.interpolate(c.packetLen, c.packetLen.progress(percent))
+}
+
+// interpolate returns the value of vp at percent (0 to 1) of the way through the ramp.
+// exponential ramps geometrically from start to end, falling back to linear when either end is not positive.
+// step holds each value for 1/rampSteps of the duration, the last step being reached when the duration elapses.
+func (c *StampClient) interpolate(vp VarParam, percent float64) int {
+	switch c.ramp {
+	case RampExponential:
+		if vp.start > 0 && vp.end > 0 {
+			return int(float64(vp.start) * math.Pow(float64(vp.end)/float64(vp.start), percent))
+		}
+	case RampStep:
+		percent = math.Floor(percent*float64(c.rampSteps)) / float64(c.rampSteps)
+	}
+	return vp.start + int(float64(vp.end-vp.start)*percent)
+}
+
+// fillPayload writes the configured fill pattern into the packet after the header and MAC, up to packetLen.
+// The zero pattern relies on the payload never being written to.
+func (c *StampClient) fillPayload(packetLen int) {
+	if packetLen <= c.payloadStart {
+		return
+	}
+	payload := c.packet[c.payloadStart:packetLen]
+	switch c.fill {
+	case FillRandom:
+		c.rng.Read(payload)
+	case FillIncrementing:
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+	}
+}
+
+// sendPacketWindow sends n packets of size m (n = numPackets, m = packetLen) to the reflector, spread evenly at
+// the configured packets per second if there is one, or back-to-back if not. With a size distribution, each
+// packet's size is drawn from it instead.
+// Each packet has the current time as the timestamp
+// and an incremented sequence number from the previous packet sequence number.
+// A packet that fails to send is counted as a send error and doesn't use up a sequence number, so that it isn't
+// taken for one lost on the way to the reflector.
+func (c *StampClient) sendPacketWindow(ctx context.Context, numPackets int, packetLen int) {
+	start := time.Now()
+	for i := 0; i < numPackets; i++ {
+		if c.burst > 0 {
+			c.burstAt = burstPosition{burst: int32(i/c.burst) + 1, pos: int32(i%c.burst) + 1}
+			if i > 0 && i%c.burst == 0 && c.burstGap > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(c.burstGap):
+				}
+			}
+		}
+		if c.pps > 0 && i > 0 {
+			wait := time.Until(start.Add(time.Duration(i) * time.Second / time.Duration(c.pps)))
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+		n := packetLen
+		if c.sizeDist.Len() > 0 {
+			n = c.sizeDist.draw(c.sizeRng)
+		}
+		if c.lengths != nil {
+			n = c.lengths[i]
+		}
+		// timestamp
+		timestamp := c.clock.Now().UnixNano()
+		// send packet
+		seq := c.nextSendSeqNo
+		c.putPacket(seq, timestamp, n)
+		if c.dropRate > 0 && timestamp >= c.warmupUntil && c.dropRng.Float64() < c.dropRate {
+			// never sent, but the sequence number is used up so that the reflections show a gap, as for real loss
+			c.logPacket(slog.LevelDebug, "dropped on purpose", "seq", seq, "bytes", n)
+			c.history.inject(seq)
+			c.injected++
+			c.nextSendSeqNo += 1
+			continue
+		}
+		err := c.write(c.stream(seq), c.packet[:n])
+		if err != nil {
+			// the sequence number goes to the next packet, so that the receiver sees no gap to count as loss
+			c.logPacket(slog.LevelWarn, "write error", "seq", seq, "err", err)
+			if timestamp >= c.warmupUntil {
+				c.sendErrors++
+			}
+			continue
+		}
+		c.logPacket(slog.LevelDebug, "sent", "seq", seq, "bytes", n)
+		if timestamp < c.warmupUntil {
+			c.warmupSent++
+		}
+		c.nextSendSeqNo += 1
+	}
+}
+
+// putPacket writes the first packetLen bytes of packet seq, sent at timestamp, into c.packet, and remembers what it
+// was sent with
+func (c *StampClient) putPacket(seq uint32, timestamp int64, packetLen int) {
+	sent := sentPacket{seq: seq, windowSize: uint32(c.windowSize.current), packetLen: uint32(packetLen), bitrate: c.bitrate,
+		burst: c.burstAt, descending: c.descending, target: c.sendTo, fragmented: c.fragmented(packetLen),
+		timestamp: timestamp}
+	if c.mode == wire.ModeSTAMP {
+		c.putSTAMPHeader(seq, timestamp, packetLen)
+	} else {
+		idx := 0
+		binary.BigEndian.PutUint32(c.packet[idx:], seq)
+		idx += 4
+		binary.BigEndian.PutUint64(c.packet[idx:], c.tsFormat.Encode(timestamp))
+		idx += 8
+		binary.BigEndian.PutUint32(c.packet[idx:], uint32(c.windowSize.current))
+		if c.secret != nil {
+			copy(c.packet[HeaderLen:], wire.MAC(c.secret, c.packet))
+		}
+	}
+	c.fillPayload(packetLen)
+	if c.verifyPayload {
+		sent.crc = crc32.ChecksumIEEE(c.packet[HeaderLen:packetLen])
+	}
+	c.history.add(sent)
+}
+
+// reflectedPacket is a packet read from one of the sender's sockets
+type reflectedPacket struct {
+	stream      *stream
+	data        []byte
+	src         net.Addr
+	receiveTime int64
+	ttl         int // IP TTL the reflection arrived with, 0 if not known
+}
+
+// receiver reads reflected packets from every socket, or only from c.recvStream if there is one, and queues a report
+// for each, plus one for each sequence number skipped. It returns when ctx is done, which sets a read deadline in the
+// past to unblock the reads, or once drained is closed at the end of the drain, after queueing drops for the packets
+// still unanswered. With a receive port it warns if nothing has come back there once the first window has had time
+// to, as the reflector's -reply-port has to be set to match.
+func (c *StampClient) receiver(ctx context.Context, drained <-chan bool) {
+	packets := make(chan reflectedPacket, 100)
+	for _, s := range c.streams {
+		if s.tcp != nil {
+			go c.readTCP(ctx, s, packets)
+			continue
+		}
+		if s.proxy != nil {
+			go s.proxy.watch(ctx)
+		}
+		if c.recvStream == nil {
+			go c.read(ctx, s, packets)
+		}
+	}
+	var recvCheck <-chan time.Time // nil unless recvStream is to be checked on once the first window is back
+	if c.recvStream != nil {
+		go c.read(ctx, c.recvStream, packets)
+		recvCheck = time.After(max(c.interval, recvPortWait))
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-recvCheck:
+			recvCheck = nil
+			if !c.received {
+				slog.Warn("nothing has come back on the receive port yet: the reflector must be run with -reply-port of the same port to send its replies there",
+					"recv_port", c.recvStream.port, "waited", max(c.interval, recvPortWait))
+			}
+		case <-drained:
+			c.queueUnanswered(ctx)
+			return
+		case p := <-packets:
+			if !c.handle(ctx, p) {
+				return
+			}
+		}
+	}
+}
+
+// read reads packets from the socket of s onto packets until ctx is done. The reports are all made by handle, in
+// the receiver goroutine. Each packet's receive time is the kernel's timestamp if it gave one, and otherwise the
+// time it was read. Packets relayed by a proxy are taken out of their SOCKS header.
+func (c *StampClient) read(ctx context.Context, s *stream, packets chan<- reflectedPacket) {
+	conn := s.socket()
+	slog.Debug("receiving", "addr", conn.LocalAddr())
+	buf := make([]byte, c.replyBufLen()+socksUDPHeaderLen)
+	oob := make([]byte, 128)
+	msgs := []ipv4.Message{{Buffers: [][]byte{buf}, OOB: oob}}
+	err := conn.SetControlMessage(ipv4.FlagTTL, true)
+	if err != nil {
+		slog.Warn("error setting control message", "err", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = s.socket().SetReadDeadline(time.Now())
+	}()
+	var backoff wire.Backoff
+	failed := 0 // reads in a row that failed
+	for {
+		_, err := conn.ReadBatch(msgs, 0)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failed++
+			if failed < wire.MaxReadErrors && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("read error", "err", err)
+				continue
+			}
+			if backoff.Attempts() == wire.MaxReopens {
+				c.fail(fmt.Errorf("%w: reads kept failing on %s after reopening it %d times, the last: %v", ErrFatal,
+					conn.LocalAddr(), wire.MaxReopens, err))
+				return
+			}
+			reopened, rerr := c.reopenSocket(ctx, s, &backoff, err)
+			if rerr != nil {
+				// the old socket is closed, so the next read fails straight away and it is tried again
+				slog.Warn("error reopening socket", "addr", conn.LocalAddr(), "attempt", backoff.Attempts(), "err", rerr)
+				continue
+			}
+			if reopened == nil {
+				return
+			}
+			conn = reopened
+			failed = 0
+			continue
+		}
+		failed = 0
+		backoff.Reset()
+		m := &msgs[0]
+		receiveTime, ok := rxTimestamp(m.OOB[:m.NN])
+		if !ok {
+			receiveTime = c.clock.Now().UnixNano()
+		}
+		data, src := buf[:m.N], m.Addr
+		var ttl int
+		var cm ipv4.ControlMessage
+		if cm.Parse(m.OOB[:m.NN]) == nil {
+			ttl = cm.TTL
+		}
+		if s.proxy != nil {
+			ttl = 0 // the proxy's reply to us, not the reflector's
+			data, src, err = unwrapSOCKS(data)
+			if err != nil {
+				c.logPacket(slog.LevelWarn, "ignoring a packet from the SOCKS proxy", "from", m.Addr, "err", err)
+				continue
+			}
+		}
+		p := reflectedPacket{
+			stream:      s,
+			data:        append([]byte(nil), data...),
+			src:         src,
+			receiveTime: receiveTime,
+			ttl:         ttl,
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case packets <- p:
+		}
+	}
+}
+
+// reopenSocket replaces the socket of s, whose reads keep failing with cause, with a new one on the same address
+// once backoff has been waited out, so that the run can carry on after the interface it was bound through goes down
+// and comes back. It returns nil if ctx is done first.
+func (c *StampClient) reopenSocket(ctx context.Context, s *stream, backoff *wire.Backoff, cause error) (*ipv4.PacketConn, error) {
+	if !backoff.Wait(ctx) {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+	addr := s.conn.LocalAddr()
+	slog.Warn("reopening socket after its reads kept failing", "addr", addr, "attempt", backoff.Attempts(), "err", cause)
+	s.conn.Close() // frees the port for the new socket
+	conn, err := s.reopen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetControlMessage(ipv4.FlagTTL, true)
+	if err != nil {
+		slog.Warn("error setting control message", "err", err)
+	}
+	s.conn = conn
+	slog.Info("reopened socket", "addr", addr)
+	return conn, nil
+}
+
+// fromReflector reports whether src is the address packets are sent to, so that packets sent by anyone else to the
+// sender's ports aren't taken for reflections. A reflector address with an unspecified IP or a multicast group
+// only has its port checked, and with anySource every address is accepted.
+func (c *StampClient) fromReflector(src net.Addr) bool {
+	if c.anySource {
+		return true
+	}
+	addr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if c.targets != nil {
+		return c.targets.has(addr)
+	}
+	if addr.Port != c.reflectorAddr.Port {
+		return false
+	}
+	return c.reflectorAddr.IP.IsUnspecified() || c.multicast || addr.IP.Equal(c.reflectorAddr.IP)
+}
+
+// reflection is what a reflected packet says about the sender packet it reflects
+type reflection struct {
+	reflectorSeq uint32 // the reflector's own number for the reply, counting the packets it has had from the stream
+	txTimestamp  uint64 // reflector send time
+	rxTimestamp  uint64 // reflector receive time
+	seq          uint32
+	sendTime     uint64
+	windowSize   uint32
+	packetLen    uint32
+	ttl          uint8 // TTL of the sender packet when it reached the reflector
+	replyTTL     uint8 // TTL the reflector sent the reply with, 0 if it didn't say
+	hasPrevSeq   bool  // the reflector sends the previous sequence number it reflected
+	prevSeq      uint32
+	prevSeqValid bool
+	hasCRC       bool // the reflector sends the CRC of the payload it received
+	payloadCRC   uint32
+}
+
+// turnaround returns how long the reflector held the packet, from its receive timestamp to its transmit timestamp,
+// and true, or false if that isn't known. A reflector that doesn't stamp the two separately sends the same time in
+// both, which would pass for one that answers instantly, so a turnaround of zero or less isn't known; nor is one
+// longer than rtt, the round trip it is part of.
+func (r reflection) turnaround(rtt uint64) (int64, bool) {
+	t := int64(r.txTimestamp - r.rxTimestamp)
+	if t <= 0 || uint64(t) >= rtt {
+		return 0, false
+	}
+	return t, true
+}
+
+// parse parses a reflected packet in the format of c.mode. It returns false if the packet is too short.
+func (c *StampClient) parse(packet []byte) (reflection, bool) {
+	if c.mode == wire.ModeSTAMP {
+		return c.parseSTAMP(packet)
+	}
+	return c.parseLegacy(packet)
+}
+
+// replyBufLen is how long a buffer must be to read any reflection whole. STAMP reflectors, and legacy ones run with
+// a reply size, reply with as long a packet as they are sent, and a legacy reply is never shorter than its fields.
+func (c *StampClient) replyBufLen() int {
+	return max(len(c.packet), ReflectorPacketLen+crc32.Size)
+}
+
+// parseLegacy parses a reflected packet in this project's own format. It returns false if the packet is too short.
+func (c *StampClient) parseLegacy(packet []byte) (reflection, bool) {
+	format := c.tsFormat
+	n := len(packet)
+	var reflectorFlags byte
+	if n >= ReflectorPacketLen-4 {
+		version := packet[reflectorFormatIdx]
+		reflectorFlags = packet[reflectorFormatIdx-1]
+		// a reflector run with a reply size pads its replies after the fields, which are all a sender needs
+		want := ReflectorPacketLen
+		if reflectorFlags&FlagPayloadCRC != 0 {
+			want += crc32.Size
+		}
+		if version > ReflectorFormat || (version > 0 && n < want) {
+			if !c.badFormat {
+				slog.Error("reflector format mismatch, skipping its packets: the reflector is likely a newer version",
+					"version", version, "bytes", n, "expected_version", ReflectorFormat, "expected_bytes", ReflectorPacketLen)
+				c.badFormat = true
+			}
+			return reflection{}, false
+		}
+	}
+	if n < ReflectorPacketLen {
+		c.logPacket(slog.LevelWarn, "bad packet length", "bytes", n, "expected", ReflectorPacketLen)
+		if n < ReflectorPacketLen-4 { // too short for the fields every reflector version sends
+			return reflection{}, false
+		}
+	}
+	var r reflection
+	idx := 0
+	r.reflectorSeq = binary.BigEndian.Uint32(packet[idx:])
+	idx += 4
+	r.txTimestamp = uint64(format.Decode(binary.BigEndian.Uint64(packet[idx:])))
+	idx += 8
+	r.rxTimestamp = uint64(format.Decode(binary.BigEndian.Uint64(packet[idx:])))
+	idx += 8
+	r.seq = binary.BigEndian.Uint32(packet[idx:])
+	idx += 4
+	r.sendTime = uint64(format.Decode(binary.BigEndian.Uint64(packet[idx:])))
+	idx += 8
+	r.windowSize = binary.BigEndian.Uint32(packet[idx:])
+	idx += 4
+	r.packetLen = binary.BigEndian.Uint32(packet[idx:])
+	idx += 4
+	r.ttl = packet[idx]
+	r.replyTTL = packet[idx+3]
+	idx += 4
+	if n >= ReflectorPacketLen {
+		r.hasPrevSeq = true
+		r.prevSeqValid = reflectorFlags&FlagPrevSeqValid != 0
+		r.prevSeq = binary.BigEndian.Uint32(packet[idx:])
+	}
+	if reflectorFlags&FlagPayloadCRC != 0 && n >= ReflectorPacketLen+crc32.Size {
+		r.hasCRC = true
+		r.payloadCRC = binary.BigEndian.Uint32(packet[ReflectorPacketLen:])
+	}
+	return r, true
+}
+
+// handle queues the reports for one reflected packet. It returns false if ctx is done before they are queued.
+func (c *StampClient) handle(ctx context.Context, p reflectedPacket) bool {
+	s, packet, src, receiveTime := p.stream, p.data, p.src, p.receiveTime
+	if !c.fromReflector(src) {
+		c.rejected++
+		c.logPacket(slog.LevelWarn, "rejected packet from unexpected source", "from", src, "rejected", c.rejected)
+		return true
+	}
+	r, ok := c.parse(packet)
+	if !ok {
+		return true
+	}
+	if !c.received {
+		c.received = true
+		slog.Info("received first packet", "from", src)
+	}
+	if s == c.recvStream {
+		s = c.stream(r.seq) // the receive port hears the reflections of every stream
+	}
+	key := c.remoteKey(src)
+	rem, pr := c.remote(key), s.peer(key)
+	rtt := uint64(receiveTime) - r.sendTime
+	sent := c.history.get(r.seq)
+	replySrc := ""
+	if src != nil {
+		replySrc = src.String()
+	}
+	if !c.multicast {
+		c.noteSource(replySrc, r.seq)
+	}
+	report := Report{
+		SequenceNumber: int(r.seq),
+		Dropped:        false,
+		WindowSize:     int(r.windowSize),
+		PacketLength:   int(r.packetLen),
+		MeasuredRTT:    int64(rtt),
+		TTL:            int64(r.ttl) - int64(c.ttl),
+		ForwardOWD:     int64(r.rxTimestamp - r.sendTime),
+		ReverseOWD:     int64(uint64(receiveTime) - r.txTimestamp),
+		Timestamp:      int64(r.sendTime),
+		SourcePort:     s.port,
+		Warmup:         int64(r.sendTime) < c.warmupUntil,
+		OfferedBitrate: sent.bitrate,
+		Reflector:      key,
+		Burst:          int(sent.burst.burst),
+		BurstPos:       int(sent.burst.pos),
+		Ascending:      !sent.descending,
+		ReplySource:    replySrc,
+		ReplyLength:    len(packet),
+		Target:         targetOf(sent),
+		Fragmented:     sent.fragmented,
+	}
+	if r.replyTTL != 0 && p.ttl != 0 {
+		report.ReverseTTL = int64(p.ttl) - int64(r.replyTTL)
+		report.reverseTTLKnown = true
+	}
+	if sent.target != nil {
+		sent.target.heard.Store(receiveTime)
+	}
+	if c.verifyPayload {
+		report.Corrupted = c.corrupted(r, sent)
+	}
+	turnaround, ok := r.turnaround(rtt)
+	if ok {
+		report.Turnaround = turnaround
+		report.NetworkRTT = int64(rtt) - turnaround
+	}
+	if c.estOffset {
+		rem.correctOWD(&report)
+	}
+	if s.tcp != nil {
+		report.TTL = 0 // the reflector has no IP header to read a TTL from over TCP
+	}
+	if c.history.receive(r.seq, rem.index) {
+		// the network delivered it twice: the copy is neither a gap in the sequence nor another RTT
+		report.Duplicate = true
+		c.logPacket(slog.LevelDebug, "duplicate", "seq", report.SequenceNumber, "from", src)
+		return c.queue(ctx, report)
+	}
+
+	stride := uint32(len(c.streams))
+	next := pr.lastRecvSeqNo + stride
+	if pr.lastRecvSendTime == 0 {
+		next = pr.lastRecvSeqNo // nothing received yet, so the stream's first packet may be lost too
+	}
+	lost := func(seq uint32, _ sentPacket) (int64, LossDirection) {
+		dir := LossUnknown
+		if r.hasPrevSeq {
+			dir = lossDirection(seq, r.prevSeq, r.prevSeqValid)
+		}
+		return pr.expectedSendTime(seq, r.seq, r.sendTime), dir
+	}
+	if !c.queueDrops(ctx, s, key, next, r.seq, lost) {
+		return false
+	}
+	// received packet
+	report.RouteChanged = c.routeChanged(rem, report)
+	report.ReflectorSeq = int(r.reflectorSeq)
+	report.Reordered = pr.reordered(r.reflectorSeq, r.seq)
+	if report.Reordered != LossUnknown {
+		c.logPacket(slog.LevelDebug, "reordered", "seq", report.SequenceNumber, "reflector_seq", report.ReflectorSeq,
+			"direction", report.Reordered)
+	}
+	c.logPacket(slog.LevelDebug, "received", "seq", report.SequenceNumber, "rtt", time.Duration(report.MeasuredRTT), "from", src)
+	if c.lossWatch != nil && !report.Warmup {
+		c.lossWatch.received.Add(1)
+	}
+	if !c.queue(ctx, report) {
+		return false
+	}
+	pr.lastRecvSeqNo = r.seq
+	pr.lastRecvSendTime = r.sendTime
+	return true
+}
+
+// queueDrops queues the reports of the packets from, from+stride and so on up to to, which were sent on s and lost
+// on the way to or from the reflector with the remote key. lost gives when each was sent and which way it was lost.
+// With c.dropRanges drops in a row are merged into one report. It returns false if ctx is done before they are
+// queued.
+func (c *StampClient) queueDrops(ctx context.Context, s *stream, key string, from, to uint32,
+	lost func(seq uint32, sent sentPacket) (int64, LossDirection)) bool {
+	stride := uint32(len(c.streams))
+	var run Report // of drops in a row, with dropRanges
+	for seq := from; seq < to; seq += stride {
+		sent := c.history.get(seq)
+		dropped := Report{
+			SequenceNumber: int(seq),
+			Dropped:        true,
+			SourcePort:     s.port,
+			OfferedBitrate: sent.bitrate,
+			Reflector:      key,
+			Burst:          int(sent.burst.burst),
+			BurstPos:       int(sent.burst.pos),
+			Ascending:      !sent.descending,
+			Target:         targetOf(sent),
+			Fragmented:     sent.fragmented,
+		}
+		dropped.Timestamp, dropped.Direction = lost(seq, sent)
+		dropped.Warmup = dropped.Timestamp < c.warmupUntil
+		if c.dropRanges {
+			if run.dropCount > 0 && run.Direction == dropped.Direction && run.Warmup == dropped.Warmup {
+				run.dropLast = int(seq)
+				run.dropCount++
+				continue
+			}
+			if run.dropCount > 0 && !c.queue(ctx, run) {
+				return false
+			}
+			run = dropped
+			run.dropLast, run.dropCount = int(seq), 1
+			continue
+		}
+		if !c.queue(ctx, dropped) {
+			return false
+		}
+	}
+	return run.dropCount == 0 || c.queue(ctx, run)
+}
+
+// queueUnanswered queues drop reports for the packets sent on each stream after the last one each reflector
+// returned, once the run has drained, as no later reflection is coming to reveal the gap. Those dropped on purpose
+// were lost on the way out, and which way the others were lost can't be told. A reflector that has returned
+// nothing on a stream is left out, as it is by handle.
+func (c *StampClient) queueUnanswered(ctx context.Context) {
+	stride := uint32(len(c.streams))
+	lost := func(_ uint32, sent sentPacket) (int64, LossDirection) {
+		if sent.injected {
+			return sent.timestamp, LossForward
+		}
+		return sent.timestamp, LossUnknown
+	}
+	for _, s := range c.streams {
+		for key, pr := range s.peers {
+			if pr.lastRecvSendTime != 0 && !c.queueDrops(ctx, s, key, pr.lastRecvSeqNo+stride, c.nextSendSeqNo, lost) {
+				return
+			}
+		}
+	}
+}
+
+// noteSource keeps track of the addresses reflections come from, warning when the reflection of packet seq comes
+// from a different one than the last, which is a sign of a NAT in front of the reflector rebinding or failing over
+func (c *StampClient) noteSource(src string, seq uint32) {
+	if src == c.replySrc {
+		return
+	}
+	if c.replySrc != "" {
+		c.srcChanges++
+		slog.Warn("reflections are coming from a different address, a NAT may have rebound or failed over", "seq", seq,
+			"from", src, "was", c.replySrc)
+	}
+	c.replySrc = src
+	if !slices.Contains(c.replySrcs, src) {
+		c.replySrcs = append(c.replySrcs, src)
+	}
+}
+
+// corrupted reports whether the payload CRC the reflector sent in r differs from that of sent, the packet it
+// reflects. A reflection without one can't be checked, and the first is logged; nor can one of a packet the history
+// has forgotten.
+func (c *StampClient) corrupted(r reflection, sent sentPacket) bool {
+	if !r.hasCRC {
+		if !c.noCRC {
+			slog.Warn("reflector doesn't send payload CRCs, run it with -payload-crc to verify payloads")
+			c.noCRC = true
+		}
+		return false
+	}
+	if sent.packetLen == 0 || r.payloadCRC == sent.crc {
+		return false
+	}
+	c.logPacket(slog.LevelWarn, "payload corrupted", "seq", r.seq, "crc", r.payloadCRC, "sent_crc", sent.crc)
+	return true
+}
+
+// logPacket logs a message about a single packet, unless the client is quiet
+func (c *StampClient) logPacket(level slog.Level, msg string, args ...any) {
+	if !c.quiet {
+		slog.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// routeChanged reports whether the delta TTL of the packet r received from rem has moved more than the threshold
+// from the first packet's from rem, which means the path has changed length. The first packet sets the baseline
+// and is never flagged. A warning is logged each time the delta TTL changes while it is off the baseline.
+func (c *StampClient) routeChanged(rem *remote, r Report) bool {
+	if !rem.received {
+		rem.received = true
+		rem.baselineTTL = r.TTL
+		rem.lastTTL = r.TTL
+		return false
+	}
+	diff := r.TTL - rem.baselineTTL
+	if diff < 0 {
+		diff = -diff
+	}
+	changed := diff > c.ttlThreshold
+	if changed && r.TTL != rem.lastTTL {
+		slog.Warn("delta TTL moved from the first packet's, the route has likely changed", "seq", r.SequenceNumber,
+			"delta_ttl", r.TTL, "baseline", rem.baselineTTL, "reflector", rem.name())
+	}
+	rem.lastTTL = r.TTL
+	return changed
+}
+
+// reordered works out whether a packet received from p's reflector, numbered reflectorSeq by it, was reordered on
+// the way: on the return path if the reflector sent a packet that has already been received after it, or else on
+// the forward path if the reflector received it after a packet the sender sent later. A packet reordered both ways
+// counts as return path. The reflector numbers the packets of each source from 0, so 0 after other packets means
+// it has forgotten the stream, and the comparison starts again.
+func (p *peer) reordered(reflectorSeq, seq uint32) LossDirection {
+	if !p.reflected || reflectorSeq == 0 {
+		p.reflected = true
+		p.maxReflectorSeq, p.maxSeq = reflectorSeq, seq
+		return LossUnknown
+	}
+	dir := LossUnknown
+	if reflectorSeq < p.maxReflectorSeq {
+		dir = LossReverse
+	} else if seq < p.maxSeq {
+		dir = LossForward
+	}
+	p.maxReflectorSeq = max(p.maxReflectorSeq, reflectorSeq)
+	p.maxSeq = max(p.maxSeq, seq)
+	return dir
+}
+
+// expectedSendTime estimates when the dropped packet seq was sent by interpolating between the send times of the
+// last packet received from p's reflector on the stream and the packet recvSeq, sent at recvSendTime, that revealed
+// the gap.
+func (p *peer) expectedSendTime(seq, recvSeq uint32, recvSendTime uint64) int64 {
+	if p.lastRecvSendTime == 0 || recvSeq <= p.lastRecvSeqNo {
+		return int64(recvSendTime)
+	}
+	span := float64(recvSendTime) - float64(p.lastRecvSendTime)
+	frac := float64(seq-p.lastRecvSeqNo) / float64(recvSeq-p.lastRecvSeqNo)
+	return int64(p.lastRecvSendTime) + int64(span*frac)
+}
+
+// lossDirection works out which way seq was lost, given the previous sequence number the reflector saw before the
+// packet that revealed the gap. Packets after prevSeq never reached the reflector and prevSeq itself did but wasn't
+// returned. Anything before prevSeq can't be told apart, as the reflection that would say so was itself lost.
+func lossDirection(seq, prevSeq uint32, prevSeqValid bool) LossDirection {
+	switch {
+	case !prevSeqValid || seq > prevSeq:
+		return LossForward
+	case seq == prevSeq:
+		return LossReverse
+	}
+	return LossUnknown
+}
+
+// queue hands a report to the reporter, returning false if ctx is done. If the reporter has fallen behind and
+// dbChan is full the report is dropped and counted in c.reportDrops, so that reading the socket is never held
+// up by the output. While the reporter is rotating the database it waits for room instead, as the swap only holds
+// the reporter up for a moment.
+func (c *StampClient) queue(ctx context.Context, r Report) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case c.dbChan <- r:
+		return true
+	default:
+	}
+	if c.swapping.Load() {
+		select {
+		case c.dbChan <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	c.reportDrops++
+	if c.reportDrops == 1 {
+		slog.Warn("the output is falling behind, dropping results rather than reflections", "queue_len", cap(c.dbChan))
+	}
+	return true
+}
+
+// fail hands err to Run to stop the run on, from a goroutine that can't carry on. Only the first error is kept, as
+// the others most likely follow from it.
+func (c *StampClient) fail(err error) {
+	select {
+	case c.errChan <- err:
+	default:
+	}
+}
+
+// drain waits, once the last window has been sent, until every packet sent has been reflected, c.drainMax is up
+// or ctx is done, for the receiver to take in the reflections still in flight. Packets lost on the way are waited
+// on for all of c.drainMax, as are the reflections of a multicast group, whose reflectors can't be counted.
+func (c *StampClient) drain(ctx context.Context) {
+	timeout := time.After(c.drainMax)
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for {
+		inFlight := c.nextSendSeqNo - c.injected - c.history.answered()
+		if inFlight == 0 && !c.multicast {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout:
+			slog.Debug("stopped waiting for reflections", "in_flight", inFlight, "drain", c.drainMax)
+			return
+		case <-tick.C:
+		}
+	}
+}
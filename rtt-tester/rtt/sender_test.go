@@ -0,0 +1,711 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"log/slog"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOfferedBitrate(t *testing.T) {
+	c := &StampClient{interval: time.Second}
+	// 100 packets of 1000 bits each, headers included, a second apart
+	c.offer(100, 1000/8-IPUDPHeaderLen, c.interval, 0, false)
+	if c.bitrate != 100000 {
+		t.Errorf("bitrate = %d, want 100000", c.bitrate)
+	}
+	// the window took half a second to send, so the next starts 1.5s after it
+	c.offer(150, 1000/8-IPUDPHeaderLen, c.interval, 500*time.Millisecond, false)
+	if c.bitrate != 100000 {
+		t.Errorf("bitrate after a slow window = %d, want 100000", c.bitrate)
+	}
+	// pacing 400 packets at 100 per second takes longer than the interval
+	c.pps = 100
+	c.offer(400, 1000/8-IPUDPHeaderLen, c.interval, 0, false)
+	if c.bitrate != 100000 {
+		t.Errorf("paced bitrate = %d, want 100000", c.bitrate)
+	}
+	c.offer(1000, 1000/8-IPUDPHeaderLen, c.interval, 0, true)
+	if c.peakBitrate != 100000 {
+		t.Errorf("peak = %d, want 100000 as the warmup doesn't count", c.peakBitrate)
+	}
+	if c.offeredBits != 650*1000 || c.offeredTime != 6500*time.Millisecond {
+		t.Errorf("offered %.0f bits over %s, want 650000 over 6.5s", c.offeredBits, c.offeredTime)
+	}
+}
+
+func TestSendErrorsAreNotLoss(t *testing.T) {
+	ctx := context.Background()
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	c, err := newClient(ctx, Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(2, 2),
+		PacketLen:     NewVarParam(100, 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	c.sendPacketWindow(ctx, 2, 100)
+	// an IPv6 destination can't be sent to from an IPv4 socket, so these fail locally
+	good := c.reflectorAddr
+	c.reflectorAddr = &net.UDPAddr{IP: net.IPv6loopback, Port: good.Port}
+	c.sendPacketWindow(ctx, 3, 100)
+	c.reflectorAddr = good
+	c.sendPacketWindow(ctx, 2, 100)
+	if c.sendErrors != 3 {
+		t.Errorf("send errors = %d, want 3", c.sendErrors)
+	}
+	if c.nextSendSeqNo != 4 {
+		t.Errorf("next sequence number = %d, want 4 as failed packets don't use one up", c.nextSendSeqNo)
+	}
+
+	// reflect what arrived, and check that the receiver finds nothing missing
+	buf := make([]byte, 100)
+	for i := 0; i < 4; i++ {
+		_ = reflector.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := reflector.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, ReflectorPacketLen)
+		copy(reply[20:32], buf[:12]) // sender sequence number and timestamp
+		copy(reply[32:36], buf[12:16])
+		if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, src: good, receiveTime: time.Now().UnixNano()}) {
+			t.Fatal("handle gave up")
+		}
+		r := <-c.dbChan
+		if r.Dropped || r.SequenceNumber != i {
+			t.Errorf("report %d = seq %d dropped %v, want seq %d received", i, r.SequenceNumber, r.Dropped, i)
+		}
+	}
+}
+
+// reports is an output that keeps what is written to it
+type reports []Report
+
+func (o *reports) write(r Report) error {
+	*o = append(*o, r)
+	return nil
+}
+
+func (o *reports) close() {}
+
+func TestDuplicatesAreNotLoss(t *testing.T) {
+	ctx := context.Background()
+	c := &StampClient{streams: []*stream{{port: 9998}}, dbChan: make(chan Report, 100), history: new(sentHistory),
+		tally: tally{histogram: newHistogram(0)}, anySource: true}
+	sendTime := time.Now().Add(-time.Millisecond).UnixNano()
+	for seq := uint32(0); seq < 5; seq++ {
+		c.history.add(sentPacket{seq: seq})
+	}
+	// 1 is duplicated straight away and again after later packets, and 2 is lost
+	for _, seq := range []uint32{0, 1, 1, 3, 1, 4} {
+		reply := make([]byte, ReflectorPacketLen)
+		binary.BigEndian.PutUint32(reply[20:], seq)
+		binary.BigEndian.PutUint64(reply[24:], uint64(sendTime))
+		if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, receiveTime: time.Now().UnixNano()}) {
+			t.Fatal("handle gave up")
+		}
+	}
+	var out reports
+	for len(c.dbChan) > 0 {
+		c.record(&out, <-c.dbChan)
+	}
+	var dups, drops []int
+	for _, r := range out {
+		if r.Duplicate {
+			dups = append(dups, r.SequenceNumber)
+		}
+		if r.Dropped {
+			drops = append(drops, r.SequenceNumber)
+		}
+	}
+	if len(dups) != 2 || dups[0] != 1 || dups[1] != 1 {
+		t.Errorf("duplicates = %v, want [1 1]", dups)
+	}
+	if len(drops) != 1 || drops[0] != 2 {
+		t.Errorf("dropped = %v, want [2]", drops)
+	}
+	if c.summary.Received != 4 || c.summary.Dropped != 1 || c.summary.Duplicates != 2 {
+		t.Errorf("summary received %d dropped %d duplicates %d, want 4, 1 and 2", c.summary.Received, c.summary.Dropped,
+			c.summary.Duplicates)
+	}
+	if len(c.rtts.rtts) != 4 {
+		t.Errorf("%d RTTs recorded, want 4 as duplicates aren't", len(c.rtts.rtts))
+	}
+}
+
+func TestRejectsOtherSources(t *testing.T) {
+	ctx := context.Background()
+	reflector := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 9996}
+	c := &StampClient{streams: []*stream{{port: 9998}}, dbChan: make(chan Report, 100), history: new(sentHistory),
+		reflectorAddr: reflector, quiet: true}
+	c.history.add(sentPacket{seq: 0})
+	reply := make([]byte, ReflectorPacketLen)
+	binary.BigEndian.PutUint64(reply[24:], uint64(time.Now().UnixNano()))
+	for _, src := range []*net.UDPAddr{
+		{IP: net.IPv4(10, 0, 1, 2), Port: 9996},
+		{IP: net.IPv4(10, 0, 1, 1), Port: 9997},
+		reflector,
+	} {
+		if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, src: src, receiveTime: time.Now().UnixNano()}) {
+			t.Fatal("handle gave up")
+		}
+	}
+	if c.rejected != 2 || len(c.dbChan) != 1 {
+		t.Errorf("%d rejected and %d reported, want 2 and the 1 from the reflector", c.rejected, len(c.dbChan))
+	}
+	c.anySource = true
+	if !c.fromReflector(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}) {
+		t.Error("packet from another source rejected with anySource")
+	}
+}
+
+func TestQuietLeavesOutPackets(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	c := &StampClient{quiet: true}
+	c.logPacket(slog.LevelWarn, "bad packet length", "bytes", 12)
+	c.logPacket(slog.LevelDebug, "dropped", "seq", 1)
+	if buf.Len() != 0 {
+		t.Errorf("quiet client logged %q", buf.String())
+	}
+	c.quiet = false
+	c.logPacket(slog.LevelDebug, "dropped", "seq", 1)
+	if !bytes.Contains(buf.Bytes(), []byte("msg=dropped seq=1")) {
+		t.Errorf("client logged %q, want the dropped packet", buf.String())
+	}
+}
+
+func TestPoissonIntervals(t *testing.T) {
+	c := &StampClient{interval: 100 * time.Millisecond, scheduleRng: rand.New(rand.NewSource(1))}
+	if d := c.nextInterval(); d != c.interval {
+		t.Errorf("periodic interval = %s, want %s", d, c.interval)
+	}
+	c.schedule = SchedulePoisson
+	const n = 10000
+	var sum time.Duration
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < n; i++ {
+		d := c.nextInterval()
+		sum += d
+		distinct[d] = true
+	}
+	if mean := sum / n; mean < 95*time.Millisecond || mean > 105*time.Millisecond {
+		t.Errorf("mean poisson interval = %s, want about %s", mean, c.interval)
+	}
+	if len(distinct) < n/2 {
+		t.Errorf("only %d distinct intervals in %d", len(distinct), n)
+	}
+}
+
+func TestReorderedDirection(t *testing.T) {
+	p := &peer{}
+	for i, c := range []struct {
+		reflectorSeq, seq uint32
+		want              LossDirection
+	}{
+		{0, 0, LossUnknown},
+		{1, 2, LossUnknown},  // the reflector got 2 before 1
+		{2, 1, LossForward},  // so 1 was reordered on the way there
+		{4, 4, LossUnknown},  // the reflector sent 3 before 4
+		{3, 3, LossReverse},  // so 3 was reordered on the way back
+		{5, 5, LossUnknown},  // in order
+		{0, 9, LossUnknown},  // the reflector forgot the stream and started counting again
+		{1, 10, LossUnknown}, // which doesn't look like reordering
+	} {
+		if got := p.reordered(c.reflectorSeq, c.seq); got != c.want {
+			t.Errorf("packet %d, seq %d reflector seq %d: reordered %s, want %s", i, c.seq, c.reflectorSeq, got, c.want)
+		}
+	}
+}
+
+func TestReflectorFormatMismatch(t *testing.T) {
+	c := &StampClient{quiet: true}
+	for _, p := range []struct {
+		version byte
+		n       int
+		ok      bool
+	}{
+		{0, ReflectorPacketLen - 4, true}, // from a reflector that predates the version byte
+		{0, ReflectorPacketLen, true},
+		{ReflectorFormat, ReflectorPacketLen, true},
+		{ReflectorFormat, ReflectorPacketLen + 8, true}, // padded by a reflector run with a reply size
+		{ReflectorFormat, ReflectorPacketLen - 4, false},
+		{ReflectorFormat + 1, ReflectorPacketLen + 8, false},
+		{ReflectorFormat + 1, ReflectorPacketLen, false},
+	} {
+		packet := make([]byte, p.n)
+		packet[reflectorFormatIdx] = p.version
+		if _, ok := c.parseLegacy(packet); ok != p.ok {
+			t.Errorf("version %d, %d bytes: parsed %v, want %v", p.version, p.n, ok, p.ok)
+		}
+	}
+	if !c.badFormat {
+		t.Error("mismatch not noted")
+	}
+}
+
+func TestUnknownInterface(t *testing.T) {
+	_, err := newClient(context.Background(), Config{ReflectorAddr: "127.0.0.1:9996", ListenAddr: "127.0.0.1:0",
+		Interface: "nosuchif0"})
+	if err == nil {
+		t.Error("client created with an interface that doesn't exist")
+	}
+}
+
+func TestBursts(t *testing.T) {
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	c, err := newClient(context.Background(), Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(10, 10),
+		PacketLen:     NewVarParam(100, 100),
+		Burst:         4,
+		BurstGap:      20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	start := time.Now()
+	c.sendPacketWindow(context.Background(), 10, 100)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("window of 3 bursts took %s, want at least the 2 gaps of 20ms", elapsed)
+	}
+	for seq := uint32(0); seq < 10; seq++ {
+		got := c.history.get(seq).burst
+		want := burstPosition{burst: int32(seq/4) + 1, pos: int32(seq%4) + 1}
+		if got != want {
+			t.Errorf("packet %d sent at %+v, want %+v", seq, got, want)
+		}
+	}
+}
+
+// TestRandomStreamsDrawApart checks that the random streams seeded from Config.Seed don't draw the same sequence,
+// which would tie packet lengths, gaps, fill and drops together
+func TestRandomStreamsDrawApart(t *testing.T) {
+	c, err := newClient(context.Background(), Config{ReflectorAddr: "127.0.0.1:9996", ListenAddr: "127.0.0.1:0",
+		WindowSize: NewVarParam(1, 1), PacketLen: NewVarParam(100, 100), Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	streams := map[string]*rand.Rand{"fill": c.rng, "size": c.sizeRng, "schedule": c.scheduleRng, "drop": c.dropRng}
+	first := make(map[float64]string)
+	for name, rng := range streams {
+		x := rng.Float64()
+		if other, ok := first[x]; ok {
+			t.Errorf("the %s and %s streams draw the same %g", name, other, x)
+		}
+		first[x] = name
+	}
+}
+
+func TestTriangleLegs(t *testing.T) {
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	c, err := newClient(context.Background(), Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(10, 30),
+		PacketLen:     NewVarParam(100, 100),
+		RampShape:     RampTriangle,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	for i, done := range []float64{2, 8} {
+		c.rampTo(done, 10)
+		if c.windowSize.current != 18 {
+			t.Errorf("window size %d at %v of 10, want 18", c.windowSize.current, done)
+		}
+		c.sendPacketWindow(context.Background(), 1, 100)
+		if got, want := c.history.get(uint32(i)).descending, done > 5; got != want {
+			t.Errorf("packet sent at %v of 10 descending %v, want %v", done, got, want)
+		}
+	}
+}
+
+func TestBurstNeedsNoPacing(t *testing.T) {
+	cfg := Config{ReflectorAddr: "127.0.0.1:9996", ListenAddr: "127.0.0.1:0", WindowSize: NewVarParam(10, 10),
+		PacketLen: NewVarParam(100, 100), Count: 10, DBPath: "rtt.db", Burst: 4, PPS: 100}
+	if cfg.validate() == nil {
+		t.Error("bursts accepted with -pps")
+	}
+	cfg.Burst, cfg.PPS, cfg.BurstGap = 0, 0, time.Millisecond
+	if cfg.validate() == nil {
+		t.Error("burst gap accepted without a burst size")
+	}
+}
+
+func TestTurnaround(t *testing.T) {
+	for _, tc := range []struct {
+		rx, tx, rtt uint64
+		want        int64
+		ok          bool
+	}{
+		{rx: 1000, tx: 1300, rtt: 5000, want: 300, ok: true},
+		{rx: 1000, tx: 1000, rtt: 5000}, // one time in both timestamps
+		{rx: 1000, tx: 900, rtt: 5000},
+		{rx: 1000, tx: 7000, rtt: 5000}, // longer than the round trip
+	} {
+		got, ok := reflection{rxTimestamp: tc.rx, txTimestamp: tc.tx}.turnaround(tc.rtt)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("turnaround from %d to %d in a %d RTT = %d, %v, want %d, %v", tc.rx, tc.tx, tc.rtt, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestFullQueueDropsReports(t *testing.T) {
+	ctx := context.Background()
+	c := &StampClient{dbChan: make(chan Report, 1)}
+	for seq := 0; seq < 3; seq++ {
+		if !c.queue(ctx, Report{SequenceNumber: seq}) {
+			t.Fatalf("report %d not queued", seq)
+		}
+	}
+	if c.reportDrops != 2 || len(c.dbChan) != 1 {
+		t.Errorf("%d reports dropped and %d queued, want 2 and 1", c.reportDrops, len(c.dbChan))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if c.queue(ctx, Report{SequenceNumber: 3}) {
+		t.Error("report queued after ctx was done")
+	}
+}
+
+// steppingClock is a Clock that moves on by step each time it is read
+type steppingClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *steppingClock) Now() time.Time {
+	t := c.now
+	c.now = c.now.Add(c.step)
+	return t
+}
+
+func TestClockTimesRTT(t *testing.T) {
+	ctx := context.Background()
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	c, err := newClient(ctx, Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		Clock:         &steppingClock{now: at},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	c.sendPacketWindow(ctx, 1, 100)
+	buf := make([]byte, 100)
+	_ = reflector.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reflector.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, ReflectorPacketLen)
+	copy(reply[20:36], buf[:16]) // sender sequence number, timestamp and window size
+	receiveTime := at.Add(5 * time.Millisecond).UnixNano()
+	if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, src: c.reflectorAddr, receiveTime: receiveTime}) {
+		t.Fatal("handle gave up")
+	}
+	r := <-c.dbChan
+	if r.Timestamp != at.UnixNano() || r.MeasuredRTT != int64(5*time.Millisecond) {
+		t.Errorf("sent at %d with RTT %d, want %d and 5ms", r.Timestamp, r.MeasuredRTT, at.UnixNano())
+	}
+}
+
+func TestClockDrivesRamp(t *testing.T) {
+	ctx := context.Background()
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	c, err := newClient(ctx, Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 200),
+		Duration:      10 * time.Second,
+		Clock:         &steppingClock{now: time.Unix(0, 0), step: 500 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	// the clock is read at the start, then for each window and for its one packet, so window i is planned
+	// (2i+1)/2 seconds in and the ramp has gone (2i+1)/20 of the way
+	elapsed := make(chan bool)
+	go c.send(ctx, elapsed)
+	select {
+	case <-elapsed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the duration didn't elapse")
+	}
+	if c.nextSendSeqNo != 11 {
+		t.Fatalf("sent %d packets, want 10 over the ramp and one at the end value", c.nextSendSeqNo)
+	}
+	for seq := uint32(0); seq < 11; seq++ {
+		want := 105 + 10*int(seq)
+		if seq == 10 {
+			want = 200
+		}
+		if got := int(c.history.get(seq).packetLen); got != want {
+			t.Errorf("packet %d of %d bytes, want %d", seq, got, want)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	for _, ttl := range []int{-1, 256} {
+		cfg := Config{WindowSize: NewVarParam(1, 1), PacketLen: NewVarParam(100, 100), DBPath: "unused", TTL: ttl}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("TTL %d accepted", ttl)
+		}
+	}
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	c, err := newClient(ctx, Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		TTL:           64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if got, err := c.streams[0].conn.TTL(); err != nil || got != 64 {
+		t.Fatalf("socket TTL %d (%v), want 64", got, err)
+	}
+
+	c.sendPacketWindow(ctx, 1, 100)
+	buf := make([]byte, 100)
+	_ = reflector.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reflector.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, ReflectorPacketLen)
+	copy(reply[20:36], buf[:16])
+	reply[40] = 60 // 4 hops away
+	if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, src: c.reflectorAddr, receiveTime: time.Now().UnixNano()}) {
+		t.Fatal("handle gave up")
+	}
+	if r := <-c.dbChan; r.TTL != -4 {
+		t.Errorf("delta TTL %d, want -4 from the TTL sent with", r.TTL)
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	for _, dscp := range []int{-1, 64} {
+		cfg := Config{WindowSize: NewVarParam(1, 1), PacketLen: NewVarParam(100, 100), DBPath: "unused", DSCP: dscp}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("DSCP %d accepted", dscp)
+		}
+	}
+	c, err := newClient(context.Background(), Config{
+		ReflectorAddr: "127.0.0.1:9996",
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		DSCP:          46,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if got, err := c.streams[0].conn.TOS(); err != nil || got != 46<<2 {
+		t.Errorf("socket TOS %d (%v), want EF, %d", got, err, 46<<2)
+	}
+}
+
+func TestSourceChanges(t *testing.T) {
+	ctx := context.Background()
+	c := &StampClient{streams: []*stream{{port: 9998}}, dbChan: make(chan Report, 100), history: new(sentHistory),
+		tally: tally{histogram: newHistogram(0)}, anySource: true}
+	sendTime := time.Now().Add(-time.Millisecond).UnixNano()
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9996}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	// the NAT rebinds after packet 1, and fails back after packet 3
+	for seq, src := range []*net.UDPAddr{a, a, b, b, a} {
+		c.history.add(sentPacket{seq: uint32(seq)})
+		reply := make([]byte, ReflectorPacketLen)
+		binary.BigEndian.PutUint32(reply[20:], uint32(seq))
+		binary.BigEndian.PutUint64(reply[24:], uint64(sendTime))
+		if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, src: src, receiveTime: time.Now().UnixNano()}) {
+			t.Fatal("handle gave up")
+		}
+		if r := <-c.dbChan; r.ReplySource != src.String() {
+			t.Errorf("packet %d reflected from %q, want %s", seq, r.ReplySource, src)
+		}
+	}
+	if c.srcChanges != 2 {
+		t.Errorf("%d source changes, want 2", c.srcChanges)
+	}
+	if len(c.replySrcs) != 2 || c.replySrcs[0] != a.String() || c.replySrcs[1] != b.String() {
+		t.Errorf("reply sources %v, want %s and %s", c.replySrcs, a, b)
+	}
+}
+
+func TestVerifyPayload(t *testing.T) {
+	ctx := context.Background()
+	c := &StampClient{streams: []*stream{{port: 9998}}, dbChan: make(chan Report, 100), history: new(sentHistory),
+		tally: tally{histogram: newHistogram(0)}, anySource: true, packet: make([]byte, 100), payloadStart: HeaderLen,
+		fill: FillIncrementing, verifyPayload: true}
+	sendTime := time.Now().Add(-time.Millisecond).UnixNano()
+	tests := []struct {
+		crc       bool
+		change    bool // the payload the reflector gets differs from the one sent
+		corrupted bool
+	}{
+		{true, false, false},
+		{true, true, true},
+		{false, true, false}, // an older reflector's reply can't be checked
+	}
+	for seq, tt := range tests {
+		c.putPacket(uint32(seq), sendTime, len(c.packet))
+		received := append([]byte(nil), c.packet...)
+		if tt.change {
+			received[60] ^= 0x10
+		}
+		reply := make([]byte, ReflectorPacketLen, ReflectorPacketLen+4)
+		binary.BigEndian.PutUint32(reply[20:], uint32(seq))
+		binary.BigEndian.PutUint64(reply[24:], uint64(sendTime))
+		reply[42] = ReflectorFormat
+		if tt.crc {
+			reply[41] = FlagPayloadCRC
+			reply = binary.BigEndian.AppendUint32(reply, crc32.ChecksumIEEE(received[HeaderLen:]))
+		}
+		if !c.handle(ctx, reflectedPacket{stream: c.streams[0], data: reply, receiveTime: time.Now().UnixNano()}) {
+			t.Fatal("handle gave up")
+		}
+		r := <-c.dbChan
+		if r.Dropped || r.Corrupted != tt.corrupted {
+			t.Errorf("packet %d: dropped %t corrupted %t, want a reflection corrupted %t", seq, r.Dropped, r.Corrupted, tt.corrupted)
+		}
+	}
+	if !c.noCRC {
+		t.Error("a reflection without a payload CRC wasn't noticed")
+	}
+}
+
+// TestReadReopensSocket breaks a stream's socket under the receiver, and checks that it is reopened on the same port,
+// for both sending and receiving, rather than the run failing
+func TestReadReopensSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reflector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reflector.Close()
+	c, err := newClient(ctx, Config{
+		ReflectorAddr: reflector.LocalAddr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	s := c.streams[0]
+	packets := make(chan reflectedPacket, 1)
+	go c.read(ctx, s, packets)
+
+	broken := s.socket()
+	broken.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.socket() == broken {
+		if time.Now().After(deadline) {
+			t.Fatal("socket wasn't reopened")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c.sendPacketWindow(ctx, 1, 100)
+	buf := make([]byte, 100)
+	_ = reflector.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := reflector.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Port != s.port {
+		t.Errorf("sent from port %d, want the stream's port %d", from.Port, s.port)
+	}
+	_, err = reflector.WriteToUDP([]byte("reflection"), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-packets:
+		if string(p.data) != "reflection" {
+			t.Errorf("read %q, want the reflection", p.data)
+		}
+	case err := <-c.errChan:
+		t.Fatalf("receiver failed: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("nothing read on the reopened socket")
+	}
+}
@@ -0,0 +1,149 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SizeDist is a weighted distribution of packet lengths, such as the mix of large and small packets that the frames
+// of a video stream are sent as. The zero value is no distribution.
+type SizeDist struct {
+	sizes []int
+	// cumulative is the running total of the weights, so that a length is drawn by a search for a random point in
+	// the total
+	cumulative []int
+	spec       string
+}
+
+// ParseSizeDist parses a distribution of packet lengths, either given inline as comma-separated length:weight
+// pairs e.g. 1200:30,200:70, or as the path of a file with a length and a weight on each line, separated by
+// spaces or a comma. Blank lines and lines starting with # in the file are skipped.
+func ParseSizeDist(s string) (SizeDist, error) {
+	if strings.Contains(s, ":") {
+		return parseSizeDist(s, strings.Split(s, ","), ":")
+	}
+	f, err := os.Open(s)
+	if err != nil {
+		return SizeDist{}, fmt.Errorf("error reading size distribution: %w", err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}), " "))
+	}
+	if err := scanner.Err(); err != nil {
+		return SizeDist{}, fmt.Errorf("error reading size distribution: %w", err)
+	}
+	return parseSizeDist(s, lines, " ")
+}
+
+// parseSizeDist makes the distribution named spec from entries of a length and a weight split by sep
+func parseSizeDist(spec string, entries []string, sep string) (SizeDist, error) {
+	d := SizeDist{spec: spec}
+	total := 0
+	for _, entry := range entries {
+		size, weight, ok := strings.Cut(entry, sep)
+		if !ok {
+			return SizeDist{}, fmt.Errorf("bad size distribution entry %q in %s: expected a length and a weight", entry, spec)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || n < 1 {
+			return SizeDist{}, fmt.Errorf("bad packet length %q in size distribution %s", size, spec)
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil || w < 0 {
+			return SizeDist{}, fmt.Errorf("bad weight %q in size distribution %s", weight, spec)
+		}
+		if w == 0 {
+			continue
+		}
+		total += w
+		d.sizes = append(d.sizes, n)
+		d.cumulative = append(d.cumulative, total)
+	}
+	if total == 0 {
+		return SizeDist{}, fmt.Errorf("size distribution %s has no lengths with a weight above 0", spec)
+	}
+	return d, nil
+}
+
+// Len returns the number of packet lengths in the distribution
+func (d SizeDist) Len() int {
+	return len(d.sizes)
+}
+
+// Min returns the shortest packet length in the distribution
+func (d SizeDist) Min() int {
+	shortest := 0
+	for i, size := range d.sizes {
+		if i == 0 || size < shortest {
+			shortest = size
+		}
+	}
+	return shortest
+}
+
+// Max returns the longest packet length in the distribution
+func (d SizeDist) Max() int {
+	longest := 0
+	for _, size := range d.sizes {
+		longest = max(longest, size)
+	}
+	return longest
+}
+
+// Mean returns the mean packet length, weighted
+func (d SizeDist) Mean() float64 {
+	if len(d.sizes) == 0 {
+		return 0
+	}
+	sum, prev := 0.0, 0
+	for i, size := range d.sizes {
+		sum += float64(size) * float64(d.cumulative[i]-prev)
+		prev = d.cumulative[i]
+	}
+	return sum / float64(prev)
+}
+
+// draw returns a packet length picked at random with the distribution's weights
+func (d SizeDist) draw(rng *rand.Rand) int {
+	point := rng.Intn(d.cumulative[len(d.cumulative)-1])
+	return d.sizes[sort.SearchInts(d.cumulative, point+1)]
+}
+
+func (d SizeDist) String() string {
+	return d.spec
+}
@@ -0,0 +1,170 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"stamp/reflector"
+)
+
+func TestParseSizeDist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sizes.txt")
+	err := os.WriteFile(path, []byte("# length weight\n1200 30\n\n200,70\n64\t0\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in      string
+		sizes   []int
+		mean    float64
+		wantErr bool
+	}{
+		{in: "1200:30,200:70", sizes: []int{1200, 200}, mean: 500},
+		{in: "100:1", sizes: []int{100}, mean: 100},
+		{in: "100:0,300:1", sizes: []int{300}, mean: 300},
+		{in: path, sizes: []int{1200, 200}, mean: 500},
+		{in: "100:0", wantErr: true},
+		{in: "100:-1", wantErr: true},
+		{in: "0:1", wantErr: true},
+		{in: "100", wantErr: true}, // taken for a file that doesn't exist
+		{in: "100:1,200", wantErr: true},
+		{in: "abc:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSizeDist(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSizeDist(%q) = %v, want error", tt.in, got.sizes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSizeDist(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.sizes, tt.sizes) || got.Mean() != tt.mean {
+			t.Errorf("ParseSizeDist(%q) = %v with mean %g, want %v with mean %g", tt.in, got.sizes, got.Mean(),
+				tt.sizes, tt.mean)
+		}
+	}
+}
+
+func TestSizeDistDraw(t *testing.T) {
+	d, err := ParseSizeDist("1200:30,200:60,64:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Min() != 64 || d.Max() != 1200 {
+		t.Errorf("range %d-%d, want 64-1200", d.Min(), d.Max())
+	}
+	rng := rand.New(rand.NewSource(1))
+	counts := map[int]int{}
+	const draws = 100000
+	for i := 0; i < draws; i++ {
+		counts[d.draw(rng)]++
+	}
+	for size, weight := range map[int]float64{1200: 0.3, 200: 0.6, 64: 0.1} {
+		if got := float64(counts[size]) / draws; math.Abs(got-weight) > 0.01 {
+			t.Errorf("%d drawn %.3f of the time, want %.2f", size, got, weight)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("drew %v, want only the lengths in the distribution", counts)
+	}
+}
+
+// TestSizeDistRun checks that a run sends packets of the lengths in the distribution, and records each one's
+func TestSizeDistRun(t *testing.T) {
+	d, err := ParseSizeDist("1200:30,200:70")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	_, err = Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(20, 20),
+		PacketLen:     NewVarParam(100, 100),
+		SizeDist:      d,
+		Count:         200,
+		Interval:      10 * time.Millisecond,
+		DBPath:        dbPath,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select packet_length, count(*) from rtt where packet_length is not null group by packet_length")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	counts := map[int]int{}
+	for rows.Next() {
+		var length, n int
+		if err := rows.Scan(&length, &n); err != nil {
+			t.Fatal(err)
+		}
+		counts[length] = n
+	}
+	if len(counts) != 2 || counts[1200] == 0 || counts[200] == 0 {
+		t.Errorf("recorded packet lengths %v, want both 1200 and 200", counts)
+	}
+	var meta string
+	err = db.QueryRow("select size_dist from run_meta").Scan(&meta)
+	if err != nil || meta != "1200:30,200:70" {
+		t.Errorf("run_meta size_dist %q, %v, want the distribution", meta, err)
+	}
+}
+
+func TestSizeDistValidate(t *testing.T) {
+	d, err := ParseSizeDist("1200:30,10:70")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{WindowSize: NewVarParam(10, 10), PacketLen: NewVarParam(100, 100), SizeDist: d, DBPath: "rtt.db"}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("a length shorter than the header validated")
+	}
+	cfg.SizeDist, _ = ParseSizeDist("1200:30,200:70")
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate() = %v", err)
+	}
+	cfg.PacketLen = NewVarParam(100, 200)
+	if err := cfg.validate(); err == nil {
+		t.Errorf("a ramped packet length validated with a size distribution")
+	}
+}
@@ -0,0 +1,151 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	socketBufferLen    = 10000           // reports held while the socket listener is unavailable
+	socketRetry        = time.Second     // wait between attempts to connect to the socket
+	socketCloseTimeout = 5 * time.Second // how long to keep trying to deliver buffered reports at the end of a run
+)
+
+// socketOutput streams reports as JSON lines, or CBOR, to a listener on a UNIX domain socket. Reports are written
+// by a goroutine of its own, so that a listener that is slow or not there never holds up the receiver: while it
+// can't be written to, reports are buffered up to socketBufferLen and then dropped.
+type socketOutput struct {
+	path     string
+	encoding Encoding
+	reports  chan Report
+	dropped  int // reports dropped, by write while running and then by run if it is stopped
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSocketOutput(path string, encoding Encoding) *socketOutput {
+	o := &socketOutput{
+		path:     path,
+		encoding: encoding,
+		reports:  make(chan Report, socketBufferLen),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// write queues r to be sent, dropping it with a warning if the buffer is full
+func (o *socketOutput) write(r Report) error {
+	select {
+	case o.reports <- r:
+	default:
+		o.dropped++
+		if o.dropped == 1 || o.dropped%1000 == 0 {
+			slog.Warn("results socket buffer is full, dropping reports", "path", o.path, "dropped", o.dropped)
+		}
+	}
+	return nil
+}
+
+// close sends the reports still buffered, giving up on them if the listener can't be reached within
+// socketCloseTimeout
+func (o *socketOutput) close() {
+	close(o.reports)
+	select {
+	case <-o.done:
+	case <-time.After(socketCloseTimeout):
+		close(o.stop)
+		<-o.done
+	}
+	if o.dropped > 0 {
+		slog.Warn("reports were dropped because the results socket couldn't keep up", "path", o.path, "dropped", o.dropped)
+	}
+}
+
+// run writes the queued reports to the socket, connecting and reconnecting as needed, until close has been called
+// and they have all been sent or stop is closed
+func (o *socketOutput) run() {
+	defer close(o.done)
+	var conn net.Conn
+	unavailable := false // the listener couldn't be reached, and that has been logged
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var buf []byte
+	for r := range o.reports {
+		line, err := o.encode(buf[:0], r)
+		if err != nil {
+			slog.Warn("error encoding report", "err", err)
+			continue
+		}
+		buf = line
+		for {
+			if conn == nil {
+				conn, err = net.Dial("unix", o.path)
+				if err != nil {
+					if !unavailable {
+						slog.Warn("results socket unavailable, buffering reports", "path", o.path, "err", err)
+						unavailable = true
+					}
+					conn = nil
+				} else {
+					slog.Info("connected to results socket", "path", o.path)
+					unavailable = false
+				}
+			}
+			if conn != nil {
+				_, err = conn.Write(line)
+				if err == nil {
+					break
+				}
+				slog.Warn("error writing to results socket, reconnecting", "path", o.path, "err", err)
+				conn.Close()
+				conn = nil
+			}
+			select {
+			case <-o.stop:
+				o.dropped += 1 + len(o.reports)
+				return
+			case <-time.After(socketRetry):
+			}
+		}
+	}
+}
+
+// encode appends r to b in o's encoding
+func (o *socketOutput) encode(b []byte, r Report) ([]byte, error) {
+	if o.encoding == EncodingCBOR {
+		return appendCBOR(b, r), nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return b, err
+	}
+	return append(append(b, line...), '\n'), nil
+}
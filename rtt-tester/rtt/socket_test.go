@@ -0,0 +1,124 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSocketOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []Report)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(got)
+			return
+		}
+		defer conn.Close()
+		var reports []Report
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			var r Report
+			if json.Unmarshal(sc.Bytes(), &r) == nil {
+				reports = append(reports, r)
+			}
+		}
+		got <- reports
+	}()
+
+	out, err := openOutput("unix://"+path, runMeta{}, outputOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.write(Report{SequenceNumber: 0, WindowSize: 10, MeasuredRTT: 1000})
+	out.write(Report{SequenceNumber: 1, Dropped: true, Direction: LossForward})
+	out.close()
+	reports := <-got
+	if len(reports) != 2 || reports[0].MeasuredRTT != 1000 || !reports[1].Dropped || reports[1].Direction != LossForward {
+		t.Errorf("reports = %+v", reports)
+	}
+}
+
+func TestSocketOutputUnavailable(t *testing.T) {
+	o := newSocketOutput(filepath.Join(t.TempDir(), "nobody.sock"), EncodingJSON)
+	for i := 0; i < socketBufferLen+5; i++ {
+		o.write(Report{SequenceNumber: i}) // must not block
+	}
+	// the writer may have taken one off the buffer to wait with
+	if o.dropped != 4 && o.dropped != 5 {
+		t.Errorf("dropped %d reports, want 4 or 5", o.dropped)
+	}
+	close(o.stop)
+	<-o.done
+}
+
+func TestSocketOutputCBOR(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(got)
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+
+	out, err := openOutput("unix://"+path, runMeta{}, outputOptions{encoding: EncodingCBOR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.write(Report{SequenceNumber: 0, MeasuredRTT: 1000})
+	out.write(Report{SequenceNumber: 1, Dropped: true})
+	out.close()
+	b := <-got
+	var reports []any
+	for len(b) > 0 {
+		var r any
+		r, b, err = decodeCBOR(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r)
+	}
+	if len(reports) != 2 || reports[1].(map[string]any)["dropped"] != true {
+		t.Errorf("reports = %v", reports)
+	}
+}
@@ -0,0 +1,182 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// SOCKS5 protocol values, from RFC 1928
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoMethods    = 0xff
+	socksUDPAssociate = 3
+	socksIPv4         = 1
+	socksIPv6         = 4
+	// socksUDPHeaderLen is the length of the header a datagram relayed to or from an IPv4 address is sent with
+	socksUDPHeaderLen = 10
+)
+
+// socksReplies are the meanings of the reply codes of a SOCKS5 proxy, by code
+var socksReplies = []string{
+	1: "general failure",
+	2: "not allowed by the ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksAssoc is a UDP association with a SOCKS5 proxy (RFC 1928 section 7), through which a stream's packets are
+// relayed to the reflector and back. It lasts as long as the TCP connection it was set up on.
+type socksAssoc struct {
+	ctrl  net.Conn
+	relay *net.UDPAddr // the proxy's address to send the datagrams to be relayed to
+	buf   []byte       // the datagram being sent
+}
+
+// socksAssociate sets up a UDP association with the SOCKS5 proxy at addr, which must take clients without
+// authentication
+func socksAssociate(ctx context.Context, addr string) (*socksAssoc, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the SOCKS proxy: %w", err)
+	}
+	relay, err := socksHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error setting up a UDP association with the SOCKS proxy %s: %w", addr, err)
+	}
+	if relay.IP.IsUnspecified() {
+		// the relay is on the address the proxy was reached at
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	slog.Info("relaying through SOCKS proxy", "proxy", addr, "relay", relay)
+	return &socksAssoc{ctrl: conn, relay: relay}, nil
+}
+
+// socksHandshake asks the proxy on conn for a UDP association, and returns the address it relays from
+func socksHandshake(conn net.Conn) (*net.UDPAddr, error) {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	_, err := conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	if err != nil {
+		return nil, err
+	}
+	var method [2]byte
+	_, err = io.ReadFull(conn, method[:])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case method[0] != socksVersion:
+		return nil, fmt.Errorf("not a SOCKS5 proxy, version %d", method[0])
+	case method[1] == socksNoMethods:
+		return nil, fmt.Errorf("the proxy needs authentication")
+	case method[1] != socksNoAuth:
+		return nil, fmt.Errorf("the proxy chose the unknown method %d", method[1])
+	}
+	// the address packets will be sent from is left as zeros, as it may be translated on the way to the proxy
+	_, err = conn.Write([]byte{socksVersion, socksUDPAssociate, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return nil, err
+	}
+	var head [4]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		reason := "unknown error"
+		if int(head[1]) < len(socksReplies) {
+			reason = socksReplies[head[1]]
+		}
+		return nil, fmt.Errorf("the proxy refused: %s", reason)
+	}
+	if head[3] != socksIPv4 {
+		return nil, fmt.Errorf("the proxy relays from an address of type %d, not IPv4", head[3])
+	}
+	var bound [6]byte
+	_, err = io.ReadFull(conn, bound[:])
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: net.IP(bound[:4]), Port: int(binary.BigEndian.Uint16(bound[4:]))}, nil
+}
+
+// wrap returns packet with the header that has the proxy relay it to dst
+func (a *socksAssoc) wrap(packet []byte, dst *net.UDPAddr) []byte {
+	a.buf = append(a.buf[:0], 0, 0, 0, socksIPv4)
+	a.buf = append(a.buf, dst.IP.To4()...)
+	a.buf = binary.BigEndian.AppendUint16(a.buf, uint16(dst.Port))
+	return append(a.buf, packet...)
+}
+
+// unwrapSOCKS returns the packet relayed in datagram from the proxy and the address it came from
+func unwrapSOCKS(datagram []byte) ([]byte, *net.UDPAddr, error) {
+	if len(datagram) < 4 {
+		return nil, nil, errors.New("too short for a SOCKS header")
+	}
+	if datagram[2] != 0 {
+		return nil, nil, errors.New("fragmented by the proxy")
+	}
+	addrLen := 0
+	switch datagram[3] {
+	case socksIPv4:
+		addrLen = net.IPv4len
+	case socksIPv6:
+		addrLen = net.IPv6len
+	default:
+		return nil, nil, fmt.Errorf("from an address of type %d", datagram[3])
+	}
+	if len(datagram) < 4+addrLen+2 {
+		return nil, nil, errors.New("too short for a SOCKS header")
+	}
+	src := &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), datagram[4:4+addrLen]...)),
+		Port: int(binary.BigEndian.Uint16(datagram[4+addrLen:])),
+	}
+	return datagram[4+addrLen+2:], src, nil
+}
+
+// watch logs if the proxy ends the association before ctx is done, as it then relays nothing more
+func (a *socksAssoc) watch(ctx context.Context) {
+	_, _ = io.Copy(io.Discard, a.ctrl)
+	if ctx.Err() == nil {
+		slog.Error("the SOCKS proxy closed the UDP association, the rest of the run will be lost")
+	}
+}
+
+func (a *socksAssoc) close() {
+	a.ctrl.Close()
+}
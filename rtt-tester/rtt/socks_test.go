@@ -0,0 +1,152 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"stamp/reflector"
+)
+
+// startSOCKSProxy starts a SOCKS5 proxy on loopback that gives each client a UDP association on one relay socket,
+// and returns its address and the count of the datagrams it relays. The first address to send to the relay is
+// taken for the client's. A method other than 0 is chosen if method is given.
+func startSOCKSProxy(t *testing.T, method ...byte) (string, *atomic.Int64) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		relay.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			greeting := make([]byte, 3)
+			request := make([]byte, 10)
+			if _, err := io.ReadFull(conn, greeting); err != nil {
+				continue
+			}
+			if len(method) > 0 {
+				conn.Write([]byte{socksVersion, method[0]})
+				continue
+			}
+			conn.Write([]byte{socksVersion, socksNoAuth})
+			if _, err := io.ReadFull(conn, request); err != nil {
+				continue
+			}
+			// the relay is given as 0.0.0.0, to be reached at the proxy's own address
+			reply := []byte{socksVersion, 0, 0, socksIPv4, 0, 0, 0, 0}
+			conn.Write(binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port)))
+		}
+	}()
+	relayed := new(atomic.Int64)
+	go func() {
+		buf := make([]byte, 65536)
+		var client *net.UDPAddr
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			relayed.Add(1)
+			if client == nil {
+				client = from // the first to send is the client, and the rest of the world replies
+			}
+			if from.String() == client.String() {
+				if data, dst, err := unwrapSOCKS(buf[:n]); err == nil {
+					relay.WriteToUDP(data, dst)
+				}
+			} else {
+				header := append([]byte{0, 0, 0, socksIPv4}, from.IP.To4()...)
+				header = binary.BigEndian.AppendUint16(header, uint16(from.Port))
+				relay.WriteToUDP(append(header, buf[:n]...), client)
+			}
+		}
+	}()
+	return ln.Addr().String(), relayed
+}
+
+func TestProxy(t *testing.T) {
+	proxy, relayed := startSOCKSProxy(t)
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(10, 10),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         100,
+		Interval:      10 * time.Millisecond,
+		Proxy:         proxy,
+		DBPath:        dbPath,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 100 || summary.Received != 100 {
+		t.Errorf("%d of %d received, want all of 100", summary.Received, summary.Sent)
+	}
+	if n := relayed.Load(); n != 200 {
+		t.Errorf("the proxy relayed %d datagrams, want 100 each way", n)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var recorded string
+	err = db.QueryRow("select proxy from run_meta").Scan(&recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != proxy {
+		t.Errorf("run_meta has proxy %q, want %q", recorded, proxy)
+	}
+}
+
+func TestProxyNeedsAuthentication(t *testing.T) {
+	proxy, _ := startSOCKSProxy(t, socksNoMethods)
+	_, err := socksAssociate(context.Background(), proxy)
+	if err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Errorf("got %v, want the proxy needing authentication", err)
+	}
+}
@@ -0,0 +1,150 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+
+	"stamp/wire"
+)
+
+// stampSSID is the RFC 8972 session sender identifier sent in STAMP mode
+const stampSSID = 1
+
+// sentHistoryLen is how many packets back sentHistory remembers, enough for any window in flight
+const sentHistoryLen = 1 << 16
+
+// sentHistory remembers the window size and length recent packets were sent with, for STAMP reflectors, which
+// don't echo them, the offered bitrate of their windows, which no reflector knows, and whether they have been
+// received, to tell duplicates
+type sentHistory struct {
+	mu       sync.Mutex
+	packets  [sentHistoryLen]sentPacket
+	returned uint32 // packets that have been returned by at least one reflector
+}
+
+type sentPacket struct {
+	seq        uint32
+	windowSize uint32
+	packetLen  uint32
+	bitrate    int64  // offered bitrate of the packet's window
+	received   uint64 // bit i is set once the reflector with index i has returned it, see remote
+	burst      burstPosition
+	descending bool    // sent on the way back down a RampTriangle
+	crc        uint32  // of the payload, with Config.VerifyPayload
+	target     *target // the reflector address it was sent to, nil unless they are followed
+	fragmented bool    // see StampClient.fragmented
+	timestamp  int64   // when it was sent
+	injected   bool    // dropped on purpose rather than sent, see Config.DropRate
+}
+
+// burstPosition is where a packet was in the bursts of its window, counting from 1. The zero burstPosition is for a
+// packet that wasn't sent in bursts.
+type burstPosition struct {
+	burst int32 // the burst's number in the window
+	pos   int32 // the packet's number in the burst
+}
+
+func (h *sentHistory) add(p sentPacket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.packets[p.seq%sentHistoryLen] = p
+}
+
+// get returns what seq was sent with, or zeros if it has been forgotten
+func (h *sentHistory) get(seq uint32) sentPacket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := h.packets[seq%sentHistoryLen]
+	if p.seq != seq {
+		return sentPacket{}
+	}
+	return p
+}
+
+// receive marks seq as received from the reflector with index reflector, and returns true if it already was, so
+// this is a duplicate. A packet that has been forgotten, or from a reflector with an index of 64 or more, is never
+// taken for a duplicate.
+func (h *sentHistory) receive(seq uint32, reflector int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := &h.packets[seq%sentHistoryLen]
+	if p.seq != seq || reflector >= 64 {
+		return false
+	}
+	bit := uint64(1) << reflector
+	dup := p.received&bit != 0
+	if p.received == 0 {
+		h.returned++
+	}
+	p.received |= bit
+	return dup
+}
+
+// inject marks seq as dropped on purpose rather than sent
+func (h *sentHistory) inject(seq uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := &h.packets[seq%sentHistoryLen]
+	if p.seq == seq {
+		p.injected = true
+	}
+}
+
+// answered returns how many packets have been returned by at least one reflector. Packets forgotten before they
+// were returned are never counted.
+func (h *sentHistory) answered() uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.returned
+}
+
+// putSTAMPHeader writes the RFC 8762 Session-Sender header for packet seq, sent at timestamp, into c.packet
+func (c *StampClient) putSTAMPHeader(seq uint32, timestamp int64, packetLen int) {
+	binary.BigEndian.PutUint32(c.packet[wire.STAMPSeqIdx:], seq)
+	wire.PutNTP(c.packet[wire.STAMPTimestampIdx:], timestamp)
+	binary.BigEndian.PutUint16(c.packet[wire.STAMPErrorEstimateIdx:], wire.ErrorEstimate)
+	binary.BigEndian.PutUint16(c.packet[wire.STAMPSSIDIdx:], stampSSID)
+	// the MBZ bytes up to wire.STAMPPacketLen are never written to
+}
+
+// parseSTAMP parses an RFC 8762 Session-Reflector packet, or an unpadded TWAMP-Light one, which is the same but
+// for being 3 bytes shorter. It returns false if the packet is too short.
+func (c *StampClient) parseSTAMP(packet []byte) (reflection, bool) {
+	if len(packet) < wire.TWAMPReflectorLen {
+		c.logPacket(slog.LevelWarn, "bad packet length", "bytes", len(packet), "min", wire.TWAMPReflectorLen)
+		return reflection{}, false
+	}
+	r := reflection{
+		reflectorSeq: binary.BigEndian.Uint32(packet[wire.STAMPSeqIdx:]),
+		txTimestamp:  uint64(wire.NTP(packet[wire.STAMPTimestampIdx:])),
+		rxTimestamp:  uint64(wire.NTP(packet[wire.STAMPReceiveTimestampIdx:])),
+		seq:          binary.BigEndian.Uint32(packet[wire.STAMPSenderSeqIdx:]),
+		sendTime:     uint64(wire.NTP(packet[wire.STAMPSenderTimestampIdx:])),
+		ttl:          packet[wire.STAMPSenderTTLIdx],
+	}
+	p := c.history.get(r.seq)
+	r.windowSize, r.packetLen = p.windowSize, p.packetLen
+	return r, true
+}
@@ -0,0 +1,129 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// RTTStats summarizes the round-trip times of the received packets of a run
+type RTTStats struct {
+	Min    time.Duration `json:"min_ns"`
+	Mean   time.Duration `json:"mean_ns"`
+	P50    time.Duration `json:"p50_ns"`
+	P90    time.Duration `json:"p90_ns"`
+	P95    time.Duration `json:"p95_ns"`
+	P99    time.Duration `json:"p99_ns"`
+	Max    time.Duration `json:"max_ns"`
+	Jitter time.Duration `json:"jitter_ns"` // mean difference between the RTTs of packets received one after another
+}
+
+// rttSamples gathers the round-trip times of received packets, in the order they are received
+type rttSamples struct {
+	rtts      []int64
+	jitterSum int64
+}
+
+func (s *rttSamples) add(rtt int64) {
+	if n := len(s.rtts); n > 0 {
+		d := rtt - s.rtts[n-1]
+		if d < 0 {
+			d = -d
+		}
+		s.jitterSum += d
+	}
+	s.rtts = append(s.rtts, rtt)
+}
+
+// stats returns the summary of the samples, all zero if there are none
+func (s *rttSamples) stats() RTTStats {
+	n := len(s.rtts)
+	if n == 0 {
+		return RTTStats{}
+	}
+	sorted := slices.Clone(s.rtts)
+	slices.Sort(sorted)
+	sum := int64(0)
+	for _, rtt := range sorted {
+		sum += rtt
+	}
+	// nearest rank
+	percentile := func(p int) time.Duration {
+		return time.Duration(sorted[(p*n+99)/100-1])
+	}
+	st := RTTStats{
+		Min:  time.Duration(sorted[0]),
+		Mean: time.Duration(sum / int64(n)),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P95:  percentile(95),
+		P99:  percentile(99),
+		Max:  time.Duration(sorted[n-1]),
+	}
+	if n > 1 {
+		st.Jitter = time.Duration(s.jitterSum / int64(n-1))
+	}
+	return st
+}
+
+// summaryFile is the JSON written to Config.SummaryPath at the end of a run, and beside each database when they are
+// rotated
+type summaryFile struct {
+	Summary
+	LossPercent float64 `json:"loss_percent"` // dropped packets as a percentage of those sent
+	Interrupted bool    `json:"interrupted"`  // the run was stopped before it finished, so the summary is partial
+	Run         runMeta `json:"run"`
+	// SegmentStart and SegmentEnd are when the rotated database the summary is of was opened and closed, in
+	// nanoseconds since the epoch, and 0 in the summary of the run
+	SegmentStart int64 `json:"segment_start,omitempty"`
+	SegmentEnd   int64 `json:"segment_end,omitempty"`
+}
+
+// LossPercent returns the dropped packets as a percentage of those sent. Losses are only seen in the gaps between
+// received packets, so packets sent with none received at all count as all lost.
+func (s Summary) LossPercent() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	if s.Received == 0 {
+		return 100
+	}
+	return 100 * float64(s.Dropped) / float64(s.Sent)
+}
+
+// writeSummary writes sf as JSON to path, filling in its loss percentage
+func writeSummary(path string, sf summaryFile) error {
+	sf.LossPercent = sf.Summary.LossPercent()
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, append(b, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing summary: %w", err)
+	}
+	return nil
+}
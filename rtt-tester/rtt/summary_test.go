@@ -0,0 +1,64 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	var s rttSamples
+	if got := s.stats(); got != (RTTStats{}) {
+		t.Errorf("stats of no samples = %+v, want zeros", got)
+	}
+	// 1 to 100, received in reverse
+	for rtt := int64(100); rtt >= 1; rtt-- {
+		s.add(rtt)
+	}
+	want := RTTStats{Min: 1, Mean: 50, P50: 50, P90: 90, P95: 95, P99: 99, Max: 100, Jitter: 1}
+	if got := s.stats(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+	s = rttSamples{}
+	s.add(int64(10 * time.Millisecond))
+	s.add(int64(20 * time.Millisecond))
+	s.add(int64(10 * time.Millisecond))
+	if got := s.stats().Jitter; got != 10*time.Millisecond {
+		t.Errorf("jitter = %s, want 10ms", got)
+	}
+}
+
+func TestLossPercent(t *testing.T) {
+	for _, c := range []struct {
+		s    Summary
+		want float64
+	}{
+		{Summary{}, 0},
+		{Summary{Sent: 200, Received: 199, Dropped: 1}, 0.5},
+		{Summary{Sent: 200}, 100}, // nothing came back to reveal the losses
+	} {
+		if got := c.s.LossPercent(); got != c.want {
+			t.Errorf("%+v: loss %v%%, want %v%%", c.s, got, c.want)
+		}
+	}
+}
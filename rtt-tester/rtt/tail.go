@@ -0,0 +1,227 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// tailColumns are the columns of the rtt table read back into reports by Tail
+var tailColumns = []string{"id", "sequence_number", "window_size", "packet_length", "rtt", "delta_ttl", "owd_forward",
+	"owd_reverse", "loss_direction", "timestamp", "route_changed", "src_port", "warmup", "offered_bps", "duplicate"}
+
+// Tail follows the results database at path while it is written, calling fn with each row added to its rtt table in
+// the order they were inserted, checking for more every poll until ctx is done. It waits for the database to be
+// created, and when it is replaced, as it is each time the sender rotates it, it finishes reading the old one and
+// then follows the new one from its start. In WAL mode, see Config.WAL, reading doesn't hold up the writer.
+func Tail(ctx context.Context, path string, poll time.Duration, fn func(Report)) error {
+	t := &tailer{path: path}
+	defer t.close()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		if t.db == nil {
+			err := t.open()
+			if err != nil {
+				return err
+			}
+		}
+		if t.db != nil {
+			// the sender closes a database before moving it out of the way, so once it has been replaced, reading
+			// it again gets the last of its rows
+			replaced := t.replaced()
+			err := t.read(fn)
+			if err != nil {
+				return err
+			}
+			if replaced {
+				slog.Info("results database replaced, following the new one", "path", path)
+				t.close()
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// tailer is the database being followed by Tail
+type tailer struct {
+	path   string
+	db     *sql.DB // nil until the database has been created
+	file   os.FileInfo
+	lastID int64 // of the last row read
+}
+
+// open opens the database at path if it has been created and has its rtt table, leaving t.db nil if not yet
+func (t *tailer) open() error {
+	file, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening results database: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+t.path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("error opening results database: %w", err)
+	}
+	err = checkColumns(db, tailColumns...)
+	if errors.Is(err, errNoRTTTable) {
+		db.Close() // still being set up
+		return nil
+	}
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("%s can't be followed: %w", t.path, err)
+	}
+	t.db, t.file, t.lastID = db, file, 0
+	return nil
+}
+
+// replaced reports whether path no longer names the database being read
+func (t *tailer) replaced() bool {
+	file, err := os.Stat(t.path)
+	return err != nil || !os.SameFile(file, t.file)
+}
+
+// read calls fn with each row of the rtt table added since the last read
+func (t *tailer) read(fn func(Report)) error {
+	rows, err := t.db.Query(`select id, sequence_number, window_size, packet_length, rtt, delta_ttl, owd_forward, owd_reverse,
+		loss_direction, timestamp, route_changed, src_port, warmup, offered_bps, duplicate from rtt where id > ? order by id`, t.lastID)
+	if err != nil {
+		return fmt.Errorf("error reading results database: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Report
+		var windowLen, packetLen, rtt, ttl, owdForward, owdReverse, offered sql.NullInt64
+		var direction sql.NullString
+		var routeChanged, duplicate sql.NullBool
+		err = rows.Scan(&t.lastID, &r.SequenceNumber, &windowLen, &packetLen, &rtt, &ttl, &owdForward, &owdReverse,
+			&direction, &r.Timestamp, &routeChanged, &r.SourcePort, &r.Warmup, &offered, &duplicate)
+		if err != nil {
+			return fmt.Errorf("error reading results database: %w", err)
+		}
+		r.Dropped = !rtt.Valid
+		r.WindowSize, r.PacketLength = int(windowLen.Int64), int(packetLen.Int64)
+		r.MeasuredRTT, r.TTL, r.ForwardOWD, r.ReverseOWD = rtt.Int64, ttl.Int64, owdForward.Int64, owdReverse.Int64
+		switch direction.String {
+		case LossForward.String():
+			r.Direction = LossForward
+		case LossReverse.String():
+			r.Direction = LossReverse
+		}
+		r.RouteChanged, r.Duplicate, r.OfferedBitrate = routeChanged.Bool, duplicate.Bool, offered.Int64
+		fn(r)
+	}
+	return rows.Err()
+}
+
+func (t *tailer) close() {
+	if t.db != nil {
+		t.db.Close()
+		t.db = nil
+	}
+}
+
+// RollingStats are the loss and mean RTT of the last packets reported, leaving out duplicates and the warmup as the
+// summary does
+type RollingStats struct {
+	rtts    []int64 // of the last packets in a ring, -1 for a dropped packet
+	next    int     // index in rtts of the next packet
+	n       int     // packets in rtts
+	dropped int     // dropped packets in rtts
+	sum     int64   // of the RTTs in rtts
+}
+
+// NewRollingStats returns the stats of the last n packets
+func NewRollingStats(n int) *RollingStats {
+	return &RollingStats{rtts: make([]int64, max(n, 1))}
+}
+
+// Add counts r in place of the oldest packet, once there are n
+func (s *RollingStats) Add(r Report) {
+	if r.Duplicate || r.Warmup {
+		return
+	}
+	if s.n == len(s.rtts) {
+		s.remove(s.rtts[s.next])
+	} else {
+		s.n++
+	}
+	rtt := int64(-1)
+	if !r.Dropped {
+		rtt = r.MeasuredRTT
+		s.sum += rtt
+	} else {
+		s.dropped++
+	}
+	s.rtts[s.next] = rtt
+	s.next = (s.next + 1) % len(s.rtts)
+}
+
+func (s *RollingStats) remove(rtt int64) {
+	if rtt < 0 {
+		s.dropped--
+	} else {
+		s.sum -= rtt
+	}
+}
+
+// LossPercent is the percentage of the last packets that were dropped
+func (s *RollingStats) LossPercent() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return 100 * float64(s.dropped) / float64(s.n)
+}
+
+// RTT is the statistics of the RTTs of the last packets that were received, the zero RTTStats if none were
+func (s *RollingStats) RTT() RTTStats {
+	var samples rttSamples
+	for i := 0; i < s.n; i++ {
+		// oldest first, for the jitter
+		if rtt := s.rtts[(s.next-s.n+i+len(s.rtts))%len(s.rtts)]; rtt >= 0 {
+			samples.add(rtt)
+		}
+	}
+	return samples.stats()
+}
+
+// MeanRTT is the mean RTT of the last packets that were received, 0 if none were
+func (s *RollingStats) MeanRTT() time.Duration {
+	received := s.n - s.dropped
+	if received == 0 {
+		return 0
+	}
+	return time.Duration(s.sum / int64(received))
+}
@@ -0,0 +1,103 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTailFollowsRotation(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reports := make(chan Report, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- Tail(ctx, dbPath, 10*time.Millisecond, func(r Report) { reports <- r })
+	}()
+	next := func() Report {
+		select {
+		case r := <-reports:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a report")
+		}
+		return Report{}
+	}
+	for _, wal := range []bool{true, false} {
+		out, err := openDB(dbPath, runMeta{}, wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for seq := 1; seq <= 2; seq++ {
+			err = out.write(Report{SequenceNumber: seq, MeasuredRTT: int64(seq), WindowSize: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = out.write(Report{SequenceNumber: 3, Dropped: true, Direction: LossForward})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.close()
+		if r := next(); r.SequenceNumber != 1 || r.MeasuredRTT != 1 || r.WindowSize != 2 || r.Dropped {
+			t.Errorf("first report of wal=%v database is %+v", wal, r)
+		}
+		next()
+		if r := next(); r.SequenceNumber != 3 || !r.Dropped || r.Direction != LossForward {
+			t.Errorf("dropped report of wal=%v database is %+v", wal, r)
+		}
+		err = os.Rename(dbPath, segmentPath(dbPath, time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	err := <-done
+	if err != nil {
+		t.Errorf("Tail returned %v", err)
+	}
+}
+
+func TestRollingStats(t *testing.T) {
+	s := NewRollingStats(4)
+	for _, r := range []Report{
+		{MeasuredRTT: 100},
+		{Dropped: true},
+		{MeasuredRTT: 200},
+		{MeasuredRTT: 900, Duplicate: true},
+		{MeasuredRTT: 300},
+		{MeasuredRTT: 400},
+	} {
+		s.Add(r)
+	}
+	if s.LossPercent() != 25 || s.MeanRTT() != 300 {
+		t.Errorf("loss %v%% and mean RTT %v, want 25%% and 300ns", s.LossPercent(), s.MeanRTT())
+	}
+	if st := s.RTT(); st.Min != 200 || st.P50 != 300 || st.Max != 400 || st.Jitter != 100 {
+		t.Errorf("RTT stats %+v, want 200ns to 400ns with a median of 300ns and 100ns jitter", st)
+	}
+}
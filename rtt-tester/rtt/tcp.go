@@ -0,0 +1,144 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"stamp/wire"
+)
+
+// Transport selects how probes are carried to the reflector
+type Transport int
+
+const (
+	TransportUDP Transport = iota // one datagram per packet
+	TransportTCP                  // length-prefixed frames on one connection, for paths that block UDP
+)
+
+func (t Transport) String() string {
+	if t == TransportTCP {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// ParseTransport returns the Transport named by s
+func ParseTransport(s string) (Transport, error) {
+	switch s {
+	case "udp":
+		return TransportUDP, nil
+	case "tcp":
+		return TransportTCP, nil
+	}
+	return TransportUDP, fmt.Errorf("unknown transport %q: expected udp or tcp", s)
+}
+
+// validateTCP checks that the settings that only make sense for UDP aren't asked for with cfg.Transport TCP
+func (cfg Config) validateTCP() error {
+	switch {
+	case cfg.Mode != wire.ModeLegacy:
+		return fmt.Errorf("%s mode can't be sent over TCP", cfg.Mode)
+	case cfg.SrcPorts.Len() > 0:
+		return fmt.Errorf("source ports can't be rotated over TCP")
+	case cfg.DF:
+		return fmt.Errorf("the don't-fragment bit can't be set over TCP")
+	case cfg.TTL != 0:
+		return fmt.Errorf("the TTL can't be set over TCP")
+	case cfg.DSCP != 0:
+		return fmt.Errorf("the DSCP can't be set over TCP")
+	case cfg.Interface != "":
+		return fmt.Errorf("an interface can't be chosen over TCP")
+	case cfg.Failover != 0 || cfg.Resolve != 0:
+		return fmt.Errorf("the reflector can't be failed over or resolved again over TCP")
+	case cfg.RecvPort != 0:
+		return fmt.Errorf("reflections come back down the TCP connection, not to a receive port")
+	case cfg.Proxy != "":
+		return fmt.Errorf("TCP can't be sent through a SOCKS proxy's UDP association")
+	}
+	return nil
+}
+
+// dialTCP connects to the reflector at addr from the host of listenAddr, on a port the OS picks, since a fixed
+// port can't be reused while the last run's connection is in TIME_WAIT
+func dialTCP(ctx context.Context, addr *net.UDPAddr, listenAddr string) (*net.TCPConn, error) {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing listen address: %w", err)
+	}
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(host)}, Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp4", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the reflector: %w", err)
+	}
+	slog.Info("connected", "reflector", addr, "from", conn.LocalAddr())
+	return conn.(*net.TCPConn), nil
+}
+
+// readTCP reads the frames of reflections from the TCP connection of s onto packets until ctx is done or the
+// connection is lost, which fails the run, as read does for UDP
+func (c *StampClient) readTCP(ctx context.Context, s *stream, packets chan<- reflectedPacket) {
+	r := bufio.NewReader(s.tcp)
+	buf := make([]byte, wire.MaxFrameLen)
+	go func() {
+		<-ctx.Done()
+		_ = s.tcp.SetReadDeadline(time.Now())
+	}()
+	for {
+		packet, err := wire.ReadFrame(r, buf)
+		receiveTime := c.clock.Now().UnixNano()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.fail(fmt.Errorf("%w: lost the connection to the reflector: %v", ErrFatal, err))
+			return
+		}
+		p := reflectedPacket{
+			stream:      s,
+			data:        append([]byte(nil), packet...),
+			src:         c.reflectorAddr, // the connection is only to the reflector
+			receiveTime: receiveTime,
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case packets <- p:
+		}
+	}
+}
+
+// write sends packet to the reflector from s
+func (c *StampClient) write(s *stream, packet []byte) error {
+	if s.tcp != nil {
+		return wire.WriteFrame(s.tcp, packet)
+	}
+	if s.proxy != nil {
+		return wire.WriteTo(s.socket(), s.proxy.wrap(packet, c.dest()), c.sendCM, s.proxy.relay, c.sendRetries)
+	}
+	return wire.WriteTo(s.socket(), packet, c.sendCM, c.dest(), c.sendRetries)
+}
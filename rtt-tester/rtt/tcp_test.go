@@ -0,0 +1,153 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stamp/reflector"
+	"stamp/wire"
+)
+
+func TestParseTransport(t *testing.T) {
+	for _, want := range []Transport{TransportUDP, TransportTCP} {
+		got, err := ParseTransport(want.String())
+		if err != nil || got != want {
+			t.Errorf("ParseTransport(%q) = %s, %v", want, got, err)
+		}
+	}
+	_, err := ParseTransport("sctp")
+	if err == nil {
+		t.Error("sctp accepted")
+	}
+}
+
+func TestTCPRejectsUDPOnlySettings(t *testing.T) {
+	base := Config{
+		ReflectorAddr: "127.0.0.1:9996",
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         1,
+		Transport:     TransportTCP,
+		DBPath:        "rtt.db",
+	}
+	err := base.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(*Config){
+		"stamp mode": func(c *Config) {
+			c.Mode = wire.ModeSTAMP
+			c.PacketLen = NewVarParam(wire.STAMPPacketLen, wire.STAMPPacketLen)
+		},
+		"source ports": func(c *Config) { c.SrcPorts = PortRange{First: 40000, Last: 40001} },
+		"df":           func(c *Config) { c.DF = true },
+		"interface":    func(c *Config) { c.Interface = "lo" },
+	} {
+		cfg := base
+		change(&cfg)
+		if cfg.validate() == nil {
+			t.Errorf("%s accepted over TCP", name)
+		}
+	}
+}
+
+// TestLoopbackTCP sends over a TCP connection to a reflector in the same process, as the sender's -loopback does
+// with -transport tcp
+func TestLoopbackTCP(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rtt.db")
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{TCP: true}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(20, 20),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         200,
+		Interval:      10 * time.Millisecond,
+		Transport:     TransportTCP,
+		DBPath:        dbPath,
+		Quiet:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 200 || summary.Received != 200 {
+		t.Errorf("%d of %d received, want all of 200", summary.Received, summary.Sent)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var transport string
+	var ttls int
+	err = db.QueryRow("select transport, (select count(*) from rtt where delta_ttl != 0) from run_meta").Scan(&transport, &ttls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport != "tcp" || ttls != 0 {
+		t.Errorf("transport %q with %d nonzero delta TTLs, want tcp with none", transport, ttls)
+	}
+}
+
+// TestLostConnectionStopsRun checks that a run whose reflector hangs up stops straight away with ErrFatal and the
+// summary so far, rather than carrying on with every packet a send error
+func TestLostConnectionStopsRun(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	start := time.Now()
+	summary, err := Run(context.Background(), Config{
+		ReflectorAddr: l.Addr().String(),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		Count:         1000,
+		Interval:      10 * time.Millisecond,
+		Transport:     TransportTCP,
+		NoDB:          true,
+		Quiet:         true,
+	})
+	if !errors.Is(err, ErrFatal) {
+		t.Fatalf("got %v, want ErrFatal", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the run took %s to stop", elapsed)
+	}
+	if summary.Sent == 1000 {
+		t.Error("every packet was sent")
+	}
+}
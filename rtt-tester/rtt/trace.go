@@ -0,0 +1,268 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"stamp/wire"
+)
+
+const (
+	traceMaxHops = 30          // highest TTL probed before giving up on reaching the reflector
+	traceProbes  = 3           // probes sent at each TTL
+	traceTimeout = time.Second // how long to wait for each probe to be answered
+)
+
+// Hop is what answered the probes sent with one TTL
+type Hop struct {
+	TTL  int
+	Addr net.IP // the router, or reflector, that answered, nil if nothing did
+	// RTTs are of each probe, 0 for one that wasn't answered
+	RTTs []time.Duration
+	// Reached is set when the reflector reflected the probes, or the probes were rejected as unreachable, which
+	// ends the trace
+	Reached bool
+	// DSCP is that of the probes as they arrived at the router, read from the IP header quoted by its ICMP error,
+	// or -1 if there was no error to read it from, as when the reflector answered or nothing did
+	DSCP int
+}
+
+// traceAnswer is an answer to a trace probe: an ICMP error quoting one, or a reflection
+type traceAnswer struct {
+	from      net.IP
+	reflected bool
+	seq       uint32 // of a reflection, an ICMP error doesn't quote enough of the probe to tell
+	reached   bool
+	received  int64
+	dscp      int // quoted by an ICMP error, -1 for a reflection
+}
+
+// Trace maps the path to the reflector, traceroute style: it sends traceProbes probes with each TTL from 1 up,
+// listening on a raw ICMP socket for the time exceeded errors of the routers they expire at, until the reflector
+// reflects them or traceMaxHops is reached. Probes are sent one at a time, as an ICMP error only quotes the UDP
+// header of the probe. Reading ICMP needs root or CAP_NET_RAW. Nothing is written to the database.
+// The probes are marked with Config.DSCP, and each hop records the DSCP they reached it with, so that the first
+// hop to see another, the one after a router that bleached or re-marked them, is logged.
+func Trace(ctx context.Context, cfg Config) ([]Hop, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Transport == TransportTCP {
+		return nil, fmt.Errorf("the path can't be traced over TCP")
+	}
+	if cfg.Proxy != "" || cfg.RecvPort != 0 {
+		return nil, fmt.Errorf("the path can't be traced through a proxy or with a receive port")
+	}
+	cfg.SrcPorts = PortRange{}
+	c, err := newClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	if c.multicast {
+		return nil, fmt.Errorf("the path to a multicast group can't be traced")
+	}
+	icmpConn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("tracing needs a raw ICMP socket, which needs root or CAP_NET_RAW: %w", err)
+	}
+	defer icmpConn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := c.streams[0]
+	answers := make(chan traceAnswer)
+	go c.readICMP(ctx, icmpConn, s.port, answers)
+	go c.readReflections(ctx, s.conn, answers)
+	go func() {
+		<-ctx.Done()
+		_ = icmpConn.SetReadDeadline(time.Now())
+		_ = s.conn.SetReadDeadline(time.Now())
+	}()
+
+	packetLen := cfg.PacketLen.start
+	slog.Info("tracing", "reflector", cfg.ReflectorAddr, "max_hops", traceMaxHops)
+	var hops []Hop
+	remarked := false
+	for ttl := 1; ttl <= traceMaxHops; ttl++ {
+		err = s.conn.SetTTL(ttl)
+		if err != nil {
+			return hops, fmt.Errorf("error in SetTTL: %w", err)
+		}
+		hop := Hop{TTL: ttl, DSCP: -1}
+		for i := 0; i < traceProbes; i++ {
+			seq := c.nextSendSeqNo
+			c.nextSendSeqNo++
+			sent := c.clock.Now().UnixNano()
+			c.putPacket(seq, sent, packetLen)
+			err := wire.WriteTo(s.conn, c.packet[:packetLen], c.sendCM, c.reflectorAddr, c.sendRetries)
+			if err != nil {
+				return hops, fmt.Errorf("error sending probe: %w", err)
+			}
+			a, ok, err := awaitAnswer(ctx, answers, seq)
+			if err != nil {
+				return hops, err
+			}
+			if !ok {
+				hop.RTTs = append(hop.RTTs, 0)
+				continue
+			}
+			if hop.Addr == nil {
+				hop.Addr = a.from
+			}
+			if hop.DSCP < 0 {
+				hop.DSCP = a.dscp
+			}
+			hop.RTTs = append(hop.RTTs, time.Duration(a.received-sent))
+			hop.Reached = hop.Reached || a.reached
+		}
+		slog.Info("hop", "ttl", ttl, "addr", hop.Addr, "rtts", hop.RTTs, "dscp", hop.DSCP)
+		if hop.DSCP >= 0 && hop.DSCP != cfg.DSCP && !remarked {
+			slog.Warn("the probes' DSCP was changed before this hop", "ttl", ttl, "addr", hop.Addr, "sent", cfg.DSCP,
+				"seen", hop.DSCP)
+			remarked = true
+		}
+		hops = append(hops, hop)
+		if hop.Reached {
+			return hops, nil
+		}
+	}
+	slog.Warn("the reflector wasn't reached", "max_hops", traceMaxHops)
+	return hops, nil
+}
+
+// awaitAnswer waits for an answer to probe seq on answers, returning false if there isn't one within traceTimeout.
+// Late reflections of earlier probes are skipped.
+func awaitAnswer(ctx context.Context, answers <-chan traceAnswer, seq uint32) (traceAnswer, bool, error) {
+	timer := time.NewTimer(traceTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return traceAnswer{}, false, ctx.Err()
+		case <-timer.C:
+			return traceAnswer{}, false, nil
+		case a := <-answers:
+			if !a.reflected || a.seq == seq {
+				return a, true, nil
+			}
+		}
+	}
+}
+
+// readICMP sends each ICMP error read from conn that quotes a probe sent from port onto answers, until ctx is done
+func (c *StampClient) readICMP(ctx context.Context, conn *icmp.PacketConn, port int, answers chan<- traceAnswer) {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		received := c.clock.Now().UnixNano()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("ICMP read error", "err", err)
+			continue
+		}
+		reached, dscp, ok := c.quotesProbe(buf[:n], port)
+		if !ok {
+			continue
+		}
+		a := traceAnswer{reached: reached, received: received, dscp: dscp}
+		if addr, ok := peer.(*net.IPAddr); ok {
+			a.from = addr.IP
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case answers <- a:
+		}
+	}
+}
+
+// quotesProbe reports whether the ICMP message b is a time exceeded or destination unreachable error for a probe
+// sent from port to the reflector, whether it is the latter, which ends the trace, and the DSCP of the quoted
+// probe
+func (c *StampClient) quotesProbe(b []byte, port int) (reached bool, dscp int, ok bool) {
+	m, err := icmp.ParseMessage(1, b) // 1 is the protocol number of ICMP
+	if err != nil {
+		return false, 0, false
+	}
+	var quoted []byte
+	switch body := m.Body.(type) {
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.DstUnreach:
+		quoted, reached = body.Data, true
+	default:
+		return false, 0, false
+	}
+	h, err := ipv4.ParseHeader(quoted)
+	if err != nil || h.Protocol != 17 || len(quoted) < h.Len+4 { // 17 is UDP
+		return false, 0, false
+	}
+	udp := quoted[h.Len:]
+	if int(binary.BigEndian.Uint16(udp)) != port || int(binary.BigEndian.Uint16(udp[2:])) != c.reflectorAddr.Port {
+		return false, 0, false
+	}
+	if !c.reflectorAddr.IP.IsUnspecified() && !h.Dst.Equal(c.reflectorAddr.IP) {
+		return false, 0, false
+	}
+	return reached, h.TOS >> 2, true
+}
+
+// readReflections sends each reflection read from conn onto answers, until ctx is done
+func (c *StampClient) readReflections(ctx context.Context, conn *ipv4.PacketConn, answers chan<- traceAnswer) {
+	buf := make([]byte, c.replyBufLen())
+	for {
+		n, _, src, err := conn.ReadFrom(buf)
+		received := c.clock.Now().UnixNano()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("read error", "err", err)
+			continue
+		}
+		r, ok := c.parse(buf[:n])
+		if !ok || !c.fromReflector(src) {
+			continue
+		}
+		a := traceAnswer{reflected: true, seq: r.seq, reached: true, received: received, dscp: -1}
+		if addr, ok := src.(*net.UDPAddr); ok {
+			a.from = addr.IP
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case answers <- a:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package rtt
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"stamp/reflector"
+)
+
+// icmpError returns an ICMP error of type typ quoting a UDP packet sent from port to dst with tos
+func icmpError(t *testing.T, typ icmp.Type, port int, dst *net.UDPAddr, tos int) []byte {
+	h := ipv4.Header{Version: 4, Len: ipv4.HeaderLen, TOS: tos, TotalLen: ipv4.HeaderLen + 8, TTL: 1, Protocol: 17,
+		Src: net.IPv4(10, 0, 0, 1), Dst: dst.IP}
+	quoted, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp, uint16(port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	quoted = append(quoted, udp...)
+	var body icmp.MessageBody = &icmp.TimeExceeded{Data: quoted}
+	if typ == ipv4.ICMPTypeDestinationUnreachable {
+		body = &icmp.DstUnreach{Data: quoted}
+	}
+	b, err := (&icmp.Message{Type: typ, Body: body}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestQuotesProbe(t *testing.T) {
+	reflectorAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9996}
+	c := &StampClient{reflectorAddr: reflectorAddr}
+	tests := []struct {
+		name        string
+		b           []byte
+		ok, reached bool
+		dscp        int
+	}{
+		{"time exceeded", icmpError(t, ipv4.ICMPTypeTimeExceeded, 9998, reflectorAddr, 0), true, false, 0},
+		{"unreachable", icmpError(t, ipv4.ICMPTypeDestinationUnreachable, 9998, reflectorAddr, 0), true, true, 0},
+		{"marked EF", icmpError(t, ipv4.ICMPTypeTimeExceeded, 9998, reflectorAddr, 46<<2), true, false, 46},
+		{"marked EF with ECN", icmpError(t, ipv4.ICMPTypeTimeExceeded, 9998, reflectorAddr, 46<<2|1), true, false, 46},
+		{"other source port", icmpError(t, ipv4.ICMPTypeTimeExceeded, 9999, reflectorAddr, 0), false, false, 0},
+		{"other destination", icmpError(t, ipv4.ICMPTypeTimeExceeded, 9998, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 9996}, 0), false, false, 0},
+		{"not an error", func() []byte {
+			b, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{}}).Marshal(nil)
+			return b
+		}(), false, false, 0},
+	}
+	for _, tt := range tests {
+		reached, dscp, ok := c.quotesProbe(tt.b, 9998)
+		if ok != tt.ok || reached != tt.reached || dscp != tt.dscp {
+			t.Errorf("%s: quotes a probe %v, reached %v, DSCP %d, want %v, %v and %d", tt.name, ok, reached, dscp,
+				tt.ok, tt.reached, tt.dscp)
+		}
+	}
+}
+
+func TestTraceLoopback(t *testing.T) {
+	hops, err := Trace(context.Background(), Config{
+		ReflectorAddr: startReflector(t, reflector.Config{}),
+		ListenAddr:    "127.0.0.1:0",
+		WindowSize:    NewVarParam(1, 1),
+		PacketLen:     NewVarParam(100, 100),
+		DBPath:        "unused",
+	})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("no raw ICMP socket:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reflector is on this host, so the first hop reaches it
+	if len(hops) != 1 || !hops[0].Reached || !hops[0].Addr.Equal(net.IPv4(127, 0, 0, 1)) || len(hops[0].RTTs) != traceProbes {
+		t.Fatalf("hops %+v, want the reflector at TTL 1", hops)
+	}
+	if hops[0].DSCP != -1 {
+		t.Errorf("DSCP %d at the reflector, want -1 as no ICMP error quoted it", hops[0].DSCP)
+	}
+	for i, rtt := range hops[0].RTTs {
+		if rtt <= 0 {
+			t.Errorf("probe %d unanswered", i)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// MACLen is the length of the MAC carried after the sender header when a shared secret is used
+const MACLen = 16
+
+// AuthenticatedLen is how many leading bytes of a sender packet the MAC covers: the sequence number and timestamp
+const AuthenticatedLen = 12
+
+// MAC returns the HMAC-SHA256, truncated to MACLen bytes, of the sequence number and timestamp at the start of
+// the sender packet pkt. pkt must be at least AuthenticatedLen bytes.
+func MAC(secret, pkt []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(pkt[:AuthenticatedLen])
+	return m.Sum(nil)[:MACLen]
+}
+
+// Verify reports whether mac is the MAC of pkt under secret
+func Verify(secret, pkt, mac []byte) bool {
+	return hmac.Equal(MAC(secret, pkt), mac)
+}
@@ -0,0 +1,69 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// Buffers are the sizes in bytes of a socket's receive and send buffers, 0 for the OS default
+type Buffers struct {
+	Recv int
+	Send int
+}
+
+// SetBuffers sets the receive and send buffers of conn to the sizes in b that aren't 0, and returns the sizes the OS
+// granted, which can be less: Linux clamps them to net.core.rmem_max and net.core.wmem_max. The sizes granted are 0
+// where the OS can't tell them.
+func SetBuffers(conn *net.UDPConn, b Buffers) (Buffers, error) {
+	if b.Recv > 0 {
+		err := conn.SetReadBuffer(b.Recv)
+		if err != nil {
+			return Buffers{}, fmt.Errorf("error setting the receive buffer: %w", err)
+		}
+	}
+	if b.Send > 0 {
+		err := conn.SetWriteBuffer(b.Send)
+		if err != nil {
+			return Buffers{}, fmt.Errorf("error setting the send buffer: %w", err)
+		}
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return Buffers{}, err
+	}
+	return socketBuffers(rc)
+}
+
+// LogBuffers logs the buffer sizes got, as returned by SetBuffers for want, along with args, warning if the OS
+// granted less than was asked for
+func LogBuffers(want, got Buffers, args ...any) {
+	args = append(args, "rcvbuf", got.Recv, "sndbuf", got.Send)
+	if got.Recv > 0 && got.Recv < want.Recv || got.Send > 0 && got.Send < want.Send {
+		slog.Warn("the OS granted smaller socket buffers than asked for, raise its maximum: net.core.rmem_max and net.core.wmem_max on Linux",
+			append(args, "want_rcvbuf", want.Recv, "want_sndbuf", want.Send)...)
+		return
+	}
+	slog.Info("socket buffers", args...)
+}
@@ -0,0 +1,47 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+	"syscall"
+)
+
+// socketBuffers returns the sizes of the socket's buffers. Linux doubles the size asked for, to leave room for its
+// own bookkeeping, and reports the doubled size, so they are halved to compare with what was asked for.
+func socketBuffers(rc syscall.RawConn) (Buffers, error) {
+	var b Buffers
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		b.Recv, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if serr == nil {
+			b.Send, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return Buffers{}, fmt.Errorf("error reading the socket buffer sizes: %w", err)
+	}
+	return Buffers{Recv: b.Recv / 2, Send: b.Send / 2}, nil
+}
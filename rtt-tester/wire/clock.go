@@ -0,0 +1,53 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import "time"
+
+// Clock tells the time that packets are stamped and timed with. Senders and reflectors take it from a Clock so that
+// tests can set it.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the system's wall time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// MonotonicClock tells the time as the time of another Clock when it was made plus the time since by the system's
+// monotonic clock, so that it keeps steady through the wall clock being stepped or slewed, but drifts from it.
+type MonotonicClock struct {
+	anchor time.Time // the other Clock's time when it was made
+	start  time.Time // the system's time when it was made, for its monotonic reading
+}
+
+// NewMonotonicClock returns a MonotonicClock anchored to the time of c now
+func NewMonotonicClock(c Clock) *MonotonicClock {
+	return &MonotonicClock{anchor: c.Now(), start: time.Now()}
+}
+
+func (c *MonotonicClock) Now() time.Time {
+	return c.anchor.Add(time.Since(c.start))
+}
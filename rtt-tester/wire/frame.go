@@ -0,0 +1,68 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// FrameHeaderLen is the length of the header before each packet sent over TCP, which holds the packet's length
+const FrameHeaderLen = 2
+
+// MaxFrameLen is the longest packet a frame can carry
+const MaxFrameLen = 1<<16 - 1
+
+// WriteFrame writes the packet b to conn as a frame: its length as a 16-bit big-endian integer followed by the
+// packet, so that packets keep their boundaries over a TCP stream. The two are written in one call, so that with
+// Nagle's algorithm off, as it is by default in Go, each packet goes in one segment if it fits.
+func WriteFrame(conn net.Conn, b []byte) error {
+	if len(b) > MaxFrameLen {
+		return fmt.Errorf("a %d byte packet is too long for a frame", len(b))
+	}
+	var header [FrameHeaderLen]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+	bufs := net.Buffers{header[:], b}
+	_, err := bufs.WriteTo(conn)
+	return err
+}
+
+// ReadFrame reads the next frame written by WriteFrame from r into buf, which must be MaxFrameLen long, and returns
+// its packet
+func ReadFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var header [FrameHeaderLen]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
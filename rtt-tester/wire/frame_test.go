@@ -0,0 +1,59 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	a, b := net.Pipe()
+	packets := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xaa}, MaxFrameLen)}
+	go func() {
+		for _, p := range packets {
+			if err := WriteFrame(a, p); err != nil {
+				t.Error(err)
+			}
+		}
+		a.Close()
+	}()
+	buf := make([]byte, MaxFrameLen)
+	for i, want := range packets {
+		got, err := ReadFrame(b, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d is %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := ReadFrame(b, buf); !errors.Is(err, io.EOF) {
+		t.Errorf("read after the last frame returned %v, want EOF", err)
+	}
+	if err := WriteFrame(a, make([]byte, MaxFrameLen+1)); err == nil {
+		t.Error("wrote a packet too long for a frame")
+	}
+}
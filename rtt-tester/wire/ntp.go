@@ -0,0 +1,107 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// TimestampFormat selects how timestamps are written into legacy mode packets
+type TimestampFormat int
+
+const (
+	TimestampUnixNano TimestampFormat = iota // nanoseconds since the Unix epoch
+	TimestampNTP                             // 64-bit NTP, as used by TWAMP and STAMP
+)
+
+func (f TimestampFormat) String() string {
+	if f == TimestampNTP {
+		return "ntp"
+	}
+	return "unix"
+}
+
+// ParseTimestampFormat returns the TimestampFormat named by s
+func ParseTimestampFormat(s string) (TimestampFormat, error) {
+	switch s {
+	case "unix":
+		return TimestampUnixNano, nil
+	case "ntp":
+		return TimestampNTP, nil
+	}
+	return TimestampUnixNano, fmt.Errorf("unknown timestamp format %q: expected unix or ntp", s)
+}
+
+// Encode returns ns nanoseconds since the Unix epoch as a timestamp in format f
+func (f TimestampFormat) Encode(ns int64) uint64 {
+	if f == TimestampNTP {
+		return ToNTP(ns)
+	}
+	return uint64(ns)
+}
+
+// Decode returns the timestamp t, in format f, as nanoseconds since the Unix epoch
+func (f TimestampFormat) Decode(t uint64) int64 {
+	if f == TimestampNTP {
+		return FromNTP(t)
+	}
+	return int64(t)
+}
+
+// ntpEpochOffset is the seconds from the NTP epoch (1900) to the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// ToNTP converts ns nanoseconds since the Unix epoch to a 64-bit NTP timestamp
+func ToNTP(ns int64) uint64 {
+	secs := uint64(ns/1e9) + ntpEpochOffset
+	frac := (uint64(ns%1e9) << 32) / 1e9
+	return secs<<32 | frac
+}
+
+// FromNTP converts a 64-bit NTP timestamp to nanoseconds since the Unix epoch
+func FromNTP(t uint64) int64 {
+	secs := int64(t>>32) - ntpEpochOffset
+	frac := int64(((t&0xffffffff)*1e9 + 1<<31) >> 32) // rounded, so that FromNTP(ToNTP(ns)) == ns
+	return secs*1e9 + frac
+}
+
+// PutNTP writes ns nanoseconds since the Unix epoch into b as an NTP timestamp
+func PutNTP(b []byte, ns int64) {
+	binary.BigEndian.PutUint64(b, ToNTP(ns))
+}
+
+// NTP reads an NTP timestamp from b as nanoseconds since the Unix epoch
+func NTP(b []byte) int64 {
+	return FromNTP(binary.BigEndian.Uint64(b))
+}
+
+// TimeToNTP converts t to a 64-bit NTP timestamp
+func TimeToNTP(t time.Time) uint64 {
+	return ToNTP(t.UnixNano())
+}
+
+// NTPToTime converts a 64-bit NTP timestamp to a time.Time
+func NTPToTime(ntp uint64) time.Time {
+	return time.Unix(0, FromNTP(ntp))
+}
@@ -0,0 +1,64 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"testing"
+	"time"
+)
+
+func TestNTPRoundTrip(t *testing.T) {
+	for _, ns := range []int64{
+		0,
+		1,
+		999999999,
+		time.Date(2022, 10, 25, 14, 3, 22, 500000001, time.UTC).UnixNano(),
+		time.Date(2035, 1, 1, 0, 0, 0, 123456789, time.UTC).UnixNano(),
+	} {
+		if got := FromNTP(ToNTP(ns)); got != ns {
+			t.Errorf("FromNTP(ToNTP(%d)) = %d", ns, got)
+		}
+	}
+}
+
+func TestToNTP(t *testing.T) {
+	if got, want := ToNTP(0), uint64(2208988800)<<32; got != want {
+		t.Errorf("ToNTP(0) = %#x, want %#x", got, want)
+	}
+	if got, want := ToNTP(5e8), uint64(2208988800)<<32|1<<31; got != want {
+		t.Errorf("ToNTP(0.5s) = %#x, want %#x", got, want)
+	}
+}
+
+func TestTimeToNTP(t *testing.T) {
+	tm := time.Date(2022, 10, 25, 14, 3, 22, 250000000, time.UTC)
+	ntp := TimeToNTP(tm)
+	if got, want := ntp>>32, uint64(tm.Unix()+2208988800); got != want {
+		t.Errorf("TimeToNTP(%s) seconds = %d, want %d", tm, got, want)
+	}
+	if got, want := ntp&0xffffffff, uint64(1<<30); got != want {
+		t.Errorf("TimeToNTP(%s) fraction = %#x, want %#x", tm, got, want)
+	}
+	if got := NTPToTime(ntp); !got.Equal(tm) {
+		t.Errorf("NTPToTime(TimeToNTP(%s)) = %s", tm, got)
+	}
+}
@@ -0,0 +1,74 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"time"
+)
+
+const (
+	// ReopenBackoff is how long to wait before reopening a socket whose reads keep failing, doubling for each
+	// reopen after without a good read in between, up to MaxReopenBackoff
+	ReopenBackoff    = 10 * time.Millisecond
+	MaxReopenBackoff = 5 * time.Second
+	// MaxReadErrors is how many reads in a row may fail before the socket is taken to be broken, as it can be
+	// after the interface it is bound through goes down and comes back, and reopened
+	MaxReadErrors = 100
+	// MaxReopens is how many times in a row a socket whose reads keep failing is reopened before giving up on it,
+	// which with Backoff is about ten seconds of trying
+	MaxReopens = 10
+)
+
+// Backoff paces the attempts to reopen a broken socket, from ReopenBackoff doubling up to MaxReopenBackoff. The
+// zero Backoff is ready to use.
+type Backoff struct {
+	next     time.Duration
+	attempts int
+}
+
+// Wait waits before the next attempt, returning false without waiting it out if ctx is done first
+func (b *Backoff) Wait(ctx context.Context) bool {
+	if b.next == 0 {
+		b.next = ReopenBackoff
+	}
+	t := time.NewTimer(b.next)
+	defer t.Stop()
+	b.next = min(2*b.next, MaxReopenBackoff)
+	b.attempts++
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Attempts returns how many times Wait has been called since the last Reset
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset starts the backoff again from ReopenBackoff, once the socket is working
+func (b *Backoff) Reset() {
+	*b = Backoff{}
+}
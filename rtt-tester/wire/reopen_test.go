@@ -0,0 +1,62 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	var b Backoff
+	want := ReopenBackoff
+	for i := 1; i <= 3; i++ {
+		start := time.Now()
+		if !b.Wait(context.Background()) {
+			t.Fatal("Wait returned false with ctx not done")
+		}
+		if waited := time.Since(start); waited < want {
+			t.Errorf("attempt %d waited %s, want at least %s", i, waited, want)
+		}
+		if b.Attempts() != i {
+			t.Errorf("attempts = %d, want %d", b.Attempts(), i)
+		}
+		want *= 2
+	}
+	b.Reset()
+	if b.Attempts() != 0 || b.next != 0 {
+		t.Errorf("after Reset, attempts = %d and next %s, want 0", b.Attempts(), b.next)
+	}
+}
+
+func TestBackoffMax(t *testing.T) {
+	b := Backoff{next: MaxReopenBackoff}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if b.Wait(ctx) {
+		t.Error("Wait returned true with ctx done")
+	}
+	if b.next != MaxReopenBackoff {
+		t.Errorf("next wait %s, want it held at %s", b.next, MaxReopenBackoff)
+	}
+}
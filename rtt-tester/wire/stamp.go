@@ -0,0 +1,130 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"fmt"
+)
+
+// Mode selects the packet format spoken between sender and reflector
+type Mode int
+
+const (
+	ModeLegacy     Mode = iota // this project's own format, see the layouts in rtt and reflector
+	ModeSTAMP                  // RFC 8762 unauthenticated STAMP
+	ModeTWAMPLight             // RFC 5357 unauthenticated TWAMP-Light, reflector only
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeSTAMP:
+		return "stamp"
+	case ModeTWAMPLight:
+		return "twamp-light"
+	}
+	return "legacy"
+}
+
+// ParseMode returns the Mode named by s
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "legacy":
+		return ModeLegacy, nil
+	case "stamp":
+		return ModeSTAMP, nil
+	case "twamp-light":
+		return ModeTWAMPLight, nil
+	}
+	return ModeLegacy, fmt.Errorf("unknown mode %q: expected legacy, stamp or twamp-light", s)
+}
+
+/* RFC 8762 unauthenticated Session-Sender test packet, with the SSID of RFC 8972
+*
+*  7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0 7 6 5 4 3 2 1 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                        sequence number                        | <- idx = 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                       timestamp (NTP)                         | <- idx = 4
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |        error estimate         |             SSID              | <- idx = 12
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                         MBZ (28 bytes)                        | <- idx = 16
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*
+* Session-Reflector test packet
+*
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                        sequence number                        | <- idx = 0
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                       timestamp (NTP)                         | <- idx = 4
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |        error estimate         |             SSID              | <- idx = 12
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                   receive timestamp (NTP)                     | <- idx = 16
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                 session-sender sequence number                | <- idx = 24
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |                   session-sender timestamp                    | <- idx = 28
+* |                                                               |
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* | session-sender error estimate |              MBZ              | <- idx = 36
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+* |  sender TTL   |                      MBZ                      | <- idx = 40
+* +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*
+* The unauthenticated TWAMP-Light packets of RFC 5357 have the same layout, except that the SSID field is MBZ in the
+* reflector packet and padding in the sender packet, which need only be 14 bytes long. The reflector packet ends
+* after the sender TTL, at 41 bytes, unless it is padded.
+ */
+
+// MaxUDPPayload is the largest payload a UDP datagram over IPv4 can carry
+const MaxUDPPayload = 65507
+
+// STAMPPacketLen is the length of both the sender and reflector packets in STAMP mode, before any padding
+const STAMPPacketLen = 44
+
+// TWAMPSenderMinLen and TWAMPReflectorLen are the shortest TWAMP-Light sender and reflector packets
+const (
+	TWAMPSenderMinLen = 14
+	TWAMPReflectorLen = 41
+)
+
+// Offsets into the STAMP sender and reflector packets, which are also those of TWAMP-Light
+const (
+	STAMPSeqIdx           = 0
+	STAMPTimestampIdx     = 4
+	STAMPErrorEstimateIdx = 12
+	STAMPSSIDIdx          = 14
+
+	STAMPReceiveTimestampIdx = 16
+	STAMPSenderSeqIdx        = 24
+	STAMPSenderTimestampIdx  = 28
+	STAMPSenderErrorIdx      = 36
+	STAMPSenderTTLIdx        = 40
+)
+
+// ErrorEstimate is the RFC 4656 error estimate sent with every STAMP timestamp: S (synchronized) clear, a scale of
+// 22 and a multiplier of 1, which is 2^22 * 2^-32 seconds, about a millisecond.
+const ErrorEstimate = 22<<8 | 1
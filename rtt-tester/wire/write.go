@@ -0,0 +1,72 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// RetryBackoff is how long WriteTo waits before its first retry, doubling for each retry after
+const RetryBackoff = 100 * time.Microsecond
+
+// Temporary reports whether err is from a write that can succeed if tried again, as when the socket's send buffer
+// or the interface queue is momentarily full
+func Temporary(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN)
+}
+
+// WriteTo writes the packet b to dst on conn, retrying up to retries times while it fails with a Temporary error,
+// backing off from RetryBackoff. It returns an error if the packet was not sent whole.
+func WriteTo(conn *ipv4.PacketConn, b []byte, cm *ipv4.ControlMessage, dst net.Addr, retries int) error {
+	backoff := RetryBackoff
+	for i := 0; ; i++ {
+		n, err := conn.WriteTo(b, cm, dst)
+		if err == nil && n != len(b) {
+			return fmt.Errorf("short write of %d of %d bytes", n, len(b))
+		}
+		if err == nil || !Temporary(err) || i == retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// InterfaceByName returns the interface called name, which must be up, to send out of by giving its index as the
+// IfIndex of the ControlMessage passed to WriteTo. Unlike a source address, the name stays the same when the
+// interface's addresses are reassigned.
+func InterfaceByName(name string) (*net.Interface, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("no interface %q: %w", name, err)
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", name)
+	}
+	return ifi, nil
+}
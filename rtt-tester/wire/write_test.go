@@ -0,0 +1,91 @@
+package wire
+
+/*
+Copyright (c) 2022 Port 9 Labs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestTemporary(t *testing.T) {
+	wrap := func(err error) error {
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", err)}
+	}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{wrap(syscall.ENOBUFS), true},
+		{wrap(syscall.EAGAIN), true},
+		{wrap(syscall.EMSGSIZE), false},
+		{wrap(syscall.ECONNREFUSED), false},
+		{errors.New("closed"), false},
+	} {
+		if got := Temporary(tc.err); got != tc.want {
+			t.Errorf("Temporary(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestInterfaceByName(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 && ifaces[i].Flags&net.FlagUp != 0 {
+			lo = &ifaces[i]
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface")
+	}
+	ifi, err := InterfaceByName(lo.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := ipv4.NewPacketConn(c)
+	defer conn.Close()
+	err = WriteTo(conn, []byte("hello"), &ipv4.ControlMessage{IfIndex: ifi.Index}, rx.LocalAddr(), 0)
+	if err != nil {
+		t.Errorf("error sending out of %s: %s", ifi.Name, err)
+	}
+	_, err = InterfaceByName("nosuchif0")
+	if err == nil {
+		t.Error("found an interface that doesn't exist")
+	}
+}